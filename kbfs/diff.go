@@ -0,0 +1,104 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func parseRevision(s string) (libkbfs.MetadataRevision, error) {
+	rev, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return libkbfs.MetadataRevisionUninitialized,
+			fmt.Errorf("invalid revision %s", s)
+	}
+	return libkbfs.MetadataRevision(rev), nil
+}
+
+func printDiffEntry(e libkbfs.DiffEntry) {
+	switch e.Change {
+	case libkbfs.DiffRenamed:
+		fmt.Printf("%-8s %s -> %s\n", e.Change, e.OldPath, e.Path)
+	case libkbfs.DiffModified:
+		var changes []string
+		for _, w := range e.Writes {
+			if w.Len == 0 {
+				changes = append(changes,
+					fmt.Sprintf("truncated at %d", w.Off))
+			} else {
+				changes = append(changes, fmt.Sprintf("wrote %s at %d",
+					byteCountStr(int(w.Len)), w.Off))
+			}
+		}
+		for _, attr := range e.Attrs {
+			changes = append(changes, "set "+attr)
+		}
+		fmt.Printf("%-8s %s (%s)\n", e.Change, e.Path,
+			strings.Join(changes, ", "))
+	default:
+		fmt.Printf("%-8s %s\n", e.Change, e.Path)
+	}
+}
+
+func diffHelper(ctx context.Context, config libkbfs.Config, args []string) error {
+	flags := flag.NewFlagSet("kbfs diff", flag.ContinueOnError)
+	jsonOutput := flags.Bool("json", false, "Print the changes as JSON.")
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		return errDiffArgs
+	}
+
+	p, err := makeKbfsPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if p.pathType != tlfPath || len(p.tlfComponents) != 0 {
+		return fmt.Errorf("%s is not a top-level folder", p)
+	}
+	from, err := parseRevision(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	to, err := parseRevision(flags.Arg(2))
+	if err != nil {
+		return err
+	}
+
+	rootNode, err := p.getDirNode(ctx, config)
+	if err != nil {
+		return err
+	}
+	diff, err := config.KBFSOps().GetRevisionDiff(
+		ctx, rootNode.GetFolderBranch(), from, to)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(diff)
+	}
+	for _, e := range diff.Entries {
+		printDiffEntry(e)
+	}
+	return nil
+}
+
+func diff(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	err := diffHelper(ctx, config, args)
+	if err != nil {
+		printError("diff", err)
+		exitStatus = 1
+	}
+	return
+}
@@ -12,6 +12,7 @@ import (
 var errExactlyOnePath = errors.New("exactly one path must be specified")
 var errAtLeastOnePath = errors.New("at least one path must be specified")
 var errCannotSplit = errors.New("cannot split path")
+var errDiffArgs = errors.New("a top-level folder and two revisions must be specified")
 
 type invalidKbfsPathErr struct {
 	pathStr string
@@ -241,9 +241,21 @@ outer:
 		}
 	}
 
-	n, ei, err =
-		config.KBFSOps().GetOrCreateRootNode(
-			ctx, h, libkbfs.MasterBranch)
+	if atTime.IsZero() {
+		n, ei, err =
+			config.KBFSOps().GetOrCreateRootNode(
+				ctx, h, libkbfs.MasterBranch)
+	} else {
+		var rev libkbfs.MetadataRevision
+		rev, err = config.KBFSOps().GetRevisionAtTime(ctx, h, atTime)
+		if err != nil {
+			return nil, libkbfs.EntryInfo{}, err
+		}
+		n, ei, err = config.KBFSOps().GetRootNodeAtRevision(ctx, h, rev)
+	}
+	if err != nil {
+		return nil, libkbfs.EntryInfo{}, err
+	}
 
 	for _, component := range p.tlfComponents {
 		cn, cei, err := config.KBFSOps().Lookup(ctx, n, component)
@@ -8,26 +8,34 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 )
 
 var version = flag.Bool("version", false, "Print version")
+var at = flag.String("at", "", "View folders as of the given time, "+
+	"like 2016-10-01T12:00Z (read-only)")
+
+// atTime is the parsed value of the -at flag, or the zero time if
+// folders should be viewed at their latest revisions.
+var atTime time.Time
 
 const usageFormatStr = `Usage:
   kbfs -version
 
 To run against remote KBFS servers:
   kbfs [-debug] [-cpuprofile=path/to/dir] [-bserver=%s] [-mdserver=%s]
-    <command> [<args>]
+    [-at=<time>] <command> [<args>]
 
 To run in a local testing environment:
   kbfs [-debug] [-cpuprofile=path/to/dir]
     [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
-    <command> [<args>]
+    [-at=<time>] <command> [<args>]
 
 The possible commands are:
   stat		Display file status
@@ -35,6 +43,7 @@ The possible commands are:
   mkdir		Make directories
   read		Dump file to stdout
   write		Write stdin to file
+  diff		Show what changed in a folder between two revisions
 
 `
 
@@ -66,6 +75,15 @@ func realMain() (exitStatus int) {
 		return 1
 	}
 
+	if *at != "" {
+		var err error
+		atTime, err = libfs.ParseRevisionTime(*at)
+		if err != nil {
+			printError("kbfs", err)
+			return 1
+		}
+	}
+
 	log := logger.NewWithCallDepth("", 1)
 
 	config, err := libkbfs.Init(*kbfsParams, nil, log)
@@ -96,6 +114,8 @@ func realMain() (exitStatus int) {
 		return read(ctx, config, args)
 	case "write":
 		return write(ctx, config, args)
+	case "diff":
+		return diff(ctx, config, args)
 	default:
 		printError("kbfs", fmt.Errorf("unknown command '%s'", cmd))
 		return 1
@@ -0,0 +1,34 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"fmt"
+	"time"
+)
+
+// revisionTimeFormats are the layouts accepted by ParseRevisionTime,
+// from most to least precise.
+var revisionTimeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// ParseRevisionTime parses a wall-clock time given by a user to pick
+// the revision of a folder as of that time, like
+// "2016-10-01T12:00Z".  Times without a time zone are taken to be
+// in UTC.
+func ParseRevisionTime(s string) (time.Time, error) {
+	for _, layout := range revisionTimeFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Couldn't parse %q as a time; "+
+		"try something like 2016-10-01T12:00Z", s)
+}
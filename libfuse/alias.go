@@ -12,7 +12,9 @@ import (
 	"golang.org/x/net/context"
 )
 
-// Alias is a top-level folder accessed through its non-canonical name.
+// Alias is a symlink from a non-canonical name to a canonical one,
+// like for a top-level folder accessed through its non-canonical
+// name.
 type Alias struct {
 	// canonical name for this folder
 	canon string
@@ -0,0 +1,87 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"strconv"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ArchivedRevisionsDirName is the name of the directory that holds
+// read-only views of the older revisions of a top-level folder -- it
+// can be reached in the root of a top-level folder.
+const ArchivedRevisionsDirName = ".kbfs_archived"
+
+// ArchivedRevisionsDir is a virtual directory whose children, named
+// by revision number, are the root directories of a top-level folder
+// as of those revisions.  Looking up a time instead, like
+// "2016-10-01T12:00Z", gives a symlink to the revision as of that
+// time.
+type ArchivedRevisionsDir struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*ArchivedRevisionsDir)(nil)
+
+// Attr implements the fs.Node interface for ArchivedRevisionsDir.
+func (d *ArchivedRevisionsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0500
+	if d.folder.list.public {
+		a.Mode |= 0055
+	}
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*ArchivedRevisionsDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// ArchivedRevisionsDir.
+func (d *ArchivedRevisionsDir) Lookup(ctx context.Context,
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (
+	node fs.Node, err error) {
+	d.folder.fs.log.CDebugf(ctx, "ArchivedRevisionsDir Lookup %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	rev, err := strconv.ParseInt(req.Name, 10, 64)
+	if err == nil {
+		return d.folder.lookupArchived(ctx, libkbfs.MetadataRevision(rev))
+	}
+
+	// Names that are times link to the revision as of that time.
+	serverTime, err := libfs.ParseRevisionTime(req.Name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	d.folder.handleMu.RLock()
+	h := d.folder.h
+	d.folder.handleMu.RUnlock()
+	timeRev, err := d.folder.fs.config.KBFSOps().GetRevisionAtTime(
+		ctx, h, serverTime)
+	if err != nil {
+		return nil, err
+	}
+	// The revision at a time can change as new revisions are made,
+	// so don't let the kernel cache the link.
+	resp.EntryValid = 0
+	return &Alias{canon: strconv.FormatInt(int64(timeRev), 10)}, nil
+}
+
+var _ fs.Handle = (*ArchivedRevisionsDir)(nil)
+
+var _ fs.HandleReadDirAller = (*ArchivedRevisionsDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// ArchivedRevisionsDir.  There may be a great many revisions, so
+// none are listed; they can only be looked up by number.
+func (d *ArchivedRevisionsDir) ReadDirAll(ctx context.Context) (
+	[]fuse.Dirent, error) {
+	return nil, nil
+}
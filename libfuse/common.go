@@ -41,4 +41,7 @@ func fillAttr(ei *libkbfs.EntryInfo, a *fuse.Attr) {
 	a.Size = ei.Size
 	a.Mtime = time.Unix(0, ei.Mtime)
 	a.Ctime = time.Unix(0, ei.Ctime)
+	if ei.Nlink > 1 {
+		a.Nlink = ei.Nlink
+	}
 }
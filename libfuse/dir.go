@@ -50,18 +50,118 @@ type Folder struct {
 	// file system.  Sending a struct{}{} on this channel will unpause
 	// the updates.
 	updateChan chan<- struct{}
+
+	// Protects archived.
+	archivedMu sync.Mutex
+	// archived maps revisions to the read-only folders viewing them,
+	// while the kernel holds a reference to any of their nodes.
+	// Each of them holds one reference to its revision, released
+	// when it's forgotten.
+	archived map[libkbfs.MetadataRevision]*Folder
+
+	// live is the folder that this one is a read-only view of, or
+	// nil if this folder isn't viewing an older revision.
+	live *Folder
 }
 
 func newFolder(fl *FolderList, h *libkbfs.TlfHandle) *Folder {
 	f := &Folder{
-		fs:    fl.fs,
-		list:  fl,
-		h:     h,
-		nodes: map[libkbfs.NodeID]fs.Node{},
+		fs:       fl.fs,
+		list:     fl,
+		h:        h,
+		nodes:    map[libkbfs.NodeID]fs.Node{},
+		archived: map[libkbfs.MetadataRevision]*Folder{},
 	}
 	return f
 }
 
+func (f *Folder) isArchived() bool {
+	return f.live != nil
+}
+
+// lookupArchived returns the root directory of this folder as of the
+// given revision.
+func (f *Folder) lookupArchived(ctx context.Context,
+	rev libkbfs.MetadataRevision) (fs.Node, error) {
+	f.handleMu.RLock()
+	h := f.h
+	f.handleMu.RUnlock()
+	kbfsOps := f.fs.config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetRootNodeAtRevision(ctx, h, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	f.archivedMu.Lock()
+	defer f.archivedMu.Unlock()
+	archived, ok := f.archived[rev]
+	if ok {
+		// The existing read-only folder already holds a reference
+		// to the revision, which it releases when it's forgotten.
+		err := kbfsOps.ReleaseRevision(ctx, rootNode.GetFolderBranch())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		archived = &Folder{
+			fs:    f.fs,
+			list:  f.list,
+			h:     h,
+			nodes: map[libkbfs.NodeID]fs.Node{},
+			live:  f,
+		}
+		err := archived.setFolderBranch(rootNode.GetFolderBranch())
+		if err != nil {
+			if releaseErr := kbfsOps.ReleaseRevision(
+				ctx, rootNode.GetFolderBranch()); releaseErr != nil {
+				f.fs.log.CDebugf(ctx, "Couldn't release revision %d: %v",
+					rev, releaseErr)
+			}
+			return nil, err
+		}
+		f.archived[rev] = archived
+	}
+
+	archived.nodesMu.Lock()
+	defer archived.nodesMu.Unlock()
+	if n, ok := archived.nodes[rootNode.GetID()]; ok {
+		return n, nil
+	}
+	child := newDir(archived, rootNode)
+	archived.nodes[rootNode.GetID()] = child
+	return child, nil
+}
+
+// forgetArchivedNode forgets a formerly active node of the given
+// read-only folder.  Once the folder has no active nodes left, it
+// forgets the folder too, and releases its revision.
+func (f *Folder) forgetArchivedNode(archived *Folder, node libkbfs.Node) {
+	// Take archivedMu first, so that lookupArchived can't hand out
+	// the folder while it's being forgotten.
+	f.archivedMu.Lock()
+	defer f.archivedMu.Unlock()
+	archived.nodesMu.Lock()
+	defer archived.nodesMu.Unlock()
+
+	delete(archived.nodes, node.GetID())
+	if len(archived.nodes) > 0 {
+		return
+	}
+
+	ctx := context.Background()
+	folderBranch := archived.getFolderBranch()
+	archived.unsetFolderBranch(ctx)
+	for rev, a := range f.archived {
+		if a == archived {
+			delete(f.archived, rev)
+		}
+	}
+	err := f.fs.config.KBFSOps().ReleaseRevision(ctx, folderBranch)
+	if err != nil {
+		f.fs.log.CDebugf(ctx, "Couldn't release %s: %v", folderBranch, err)
+	}
+}
+
 func (f *Folder) name() libkbfs.CanonicalTlfName {
 	f.handleMu.RLock()
 	defer f.handleMu.RUnlock()
@@ -122,6 +222,11 @@ func (f *Folder) getFolderBranch() libkbfs.FolderBranch {
 
 // forgetNode forgets a formerly active child with basename name.
 func (f *Folder) forgetNode(node libkbfs.Node) {
+	if f.isArchived() {
+		f.live.forgetArchivedNode(f, node)
+		return
+	}
+
 	f.nodesMu.Lock()
 	defer f.nodesMu.Unlock()
 
@@ -196,6 +301,23 @@ func (f *Folder) localChangeInvalidate(ctx context.Context, node libkbfs.Node,
 	}
 }
 
+// invalidateEntry drops the given name in the given directory from
+// the kernel's dentry cache, if the kernel knows about the directory.
+func (f *Folder) invalidateEntry(ctx context.Context, dir libkbfs.Node,
+	name string) {
+	f.nodesMu.Lock()
+	n, ok := f.nodes[dir.GetID()]
+	f.nodesMu.Unlock()
+	if !ok {
+		return
+	}
+
+	if err := f.fs.fuse.InvalidateEntry(n, name); err != nil && err != fuse.ErrNotCached {
+		// TODO we have no mechanism to do anything about this
+		f.fs.log.CErrorf(ctx, "FUSE invalidate error: %v", err)
+	}
+}
+
 // BatchChanges is called for changes originating anywhere, including
 // other hosts.
 func (f *Folder) BatchChanges(ctx context.Context, changes []libkbfs.NodeChange) {
@@ -293,12 +415,17 @@ type DirInterface interface {
 	fs.NodeCreater
 	fs.NodeMkdirer
 	fs.NodeSymlinker
+	fs.NodeLinker
 	fs.NodeRenamer
 	fs.NodeRemover
 	fs.Handle
 	fs.HandleReadDirAller
 	fs.NodeForgetter
 	fs.NodeSetattrer
+	fs.NodeGetxattrer
+	fs.NodeListxattrer
+	fs.NodeSetxattrer
+	fs.NodeRemovexattrer
 }
 
 // Dir represents a subdirectory of a KBFS top-level folder (including
@@ -340,6 +467,9 @@ func (d *Dir) attr(ctx context.Context, a *fuse.Attr) (err error) {
 	if d.folder.list.public {
 		a.Mode |= 0055
 	}
+	if d.folder.isArchived() {
+		a.Mode &^= 0222
+	}
 	return nil
 }
 
@@ -353,6 +483,16 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		return specialNode, nil
 	}
 
+	if d.folder.isArchived() {
+		switch req.Name {
+		case libfs.UnstageFileName, libfs.DisableUpdatesFileName,
+			libfs.EnableUpdatesFileName, libfs.RekeyFileName,
+			libfs.ReclaimQuotaFileName, libfs.SyncFromServerFileName:
+			// These only make sense for the live folder.
+			return nil, fuse.ENOENT
+		}
+	}
+
 	switch req.Name {
 	case libfs.StatusFileName:
 		folderBranch := d.folder.getFolderBranch()
@@ -361,6 +501,9 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 	case UpdateHistoryFileName:
 		return NewUpdateHistoryFile(d.folder, resp), nil
 
+	case FileInfoDirName:
+		return &FileInfoDir{dir: d}, nil
+
 	case libfs.UnstageFileName:
 		resp.EntryValid = 0
 		child := &UnstageFile{
@@ -434,6 +577,7 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		child := &File{
 			folder: d.folder,
 			node:   newNode,
+			parent: d,
 		}
 		d.folder.nodes[newNode.GetID()] = child
 		return child, nil
@@ -469,6 +613,7 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 	child := &File{
 		folder: d.folder,
 		node:   newNode,
+		parent: d,
 	}
 	d.folder.nodesMu.Lock()
 	d.folder.nodes[newNode.GetID()] = child
@@ -514,6 +659,31 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (
 	return child, nil
 }
 
+// Link implements the fs.NodeLinker interface for Dir.
+func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest,
+	old fs.Node) (node fs.Node, err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Link %s", req.NewName)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	file, ok := old.(*File)
+	if !ok {
+		// Only regular files can have more than one name.
+		return nil, fuse.Errno(syscall.EPERM)
+	}
+
+	if d.folder != file.folder {
+		return nil, fuse.Errno(syscall.EXDEV)
+	}
+
+	if _, err := d.folder.fs.config.KBFSOps().CreateHardLink(
+		ctx, d.node, req.NewName, file.node); err != nil {
+		return nil, err
+	}
+
+	// All names of the file share its node.
+	return file, nil
+}
+
 // Rename implements the fs.NodeRenamer interface for Dir.
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 	newDir fs.Node) (err error) {
@@ -537,17 +707,19 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 		// later). The kernel won't let a rename newDir point
 		// to a non-directory.
 		//
-		// We have no cheap atomic rename across folders, so
-		// we can't serve this. EXDEV makes `mv` do a
+		// We can't serve this. EXDEV makes `mv` do a
 		// copy+delete, and the Lookup on the destination path
 		// will decide whether it's legal.
 		return fuse.Errno(syscall.EXDEV)
 	}
 
-	if d.folder != realNewDir.folder {
-		// Check this explicitly, not just trusting KBFSOps.Rename to
-		// return an error, because we rely on it for locking
-		// correctness.
+	// KBFSOps.Rename moves entries between folders itself, and
+	// returns an EXDEV error for the moves it can't do, so that `mv`
+	// falls back to a copy+delete.  A move between folders leaves a
+	// stale entry in the kernel's cache, so it's only done if the
+	// cache can be invalidated.
+	crossFolder := realNewDir.folder != d.folder
+	if crossFolder && !d.folder.fs.conn.Protocol().HasInvalidate() {
 		return fuse.Errno(syscall.EXDEV)
 	}
 
@@ -559,6 +731,20 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 		return err
 	}
 
+	if crossFolder {
+		// The kernel moves its cached entry to the new name, but
+		// that entry still points to the old folder's node, which
+		// was just unlinked, so writes through it would be lost.
+		// Drop both names from the cache once the rename is done,
+		// so they're looked up again.  Our own changes don't come
+		// back through BatchChanges, so this has to happen here.
+		oldName, newName := req.OldName, req.NewName
+		d.folder.fs.queueNotification(func() {
+			d.folder.invalidateEntry(ctx, d.node, oldName)
+			realNewDir.folder.invalidateEntry(ctx, realNewDir.node, newName)
+		})
+	}
+
 	return nil
 }
 
@@ -672,6 +858,38 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 	return nil
 }
 
+// Getxattr implements the fs.NodeGetxattrer interface for Dir.
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Getxattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return getXattr(ctx, d.folder, d.node, req, resp)
+}
+
+// Listxattr implements the fs.NodeListxattrer interface for Dir.
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Listxattr")
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return listXattr(ctx, d.folder, d.node, resp)
+}
+
+// Setxattr implements the fs.NodeSetxattrer interface for Dir.
+func (d *Dir) Setxattr(ctx context.Context,
+	req *fuse.SetxattrRequest) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Setxattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return setXattr(ctx, d.folder, d.node, req)
+}
+
+// Removexattr implements the fs.NodeRemovexattrer interface for Dir.
+func (d *Dir) Removexattr(ctx context.Context,
+	req *fuse.RemovexattrRequest) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Removexattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return removeXattr(ctx, d.folder, d.node, req)
+}
+
 // TLF represents the root directory of a TLF. It wraps a lazy-loaded
 // Dir.
 type TLF struct {
@@ -800,6 +1018,12 @@ func (tlf *TLF) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.
 	if exitEarly {
 		return nil, fuse.ENOENT
 	}
+	if req.Name == ArchivedRevisionsDirName {
+		return &ArchivedRevisionsDir{folder: tlf.folder}, nil
+	}
+	if req.Name == TrashDirName {
+		return &TrashDir{folder: tlf.folder}, nil
+	}
 	return dir.Lookup(ctx, req, resp)
 }
 
@@ -832,6 +1056,16 @@ func (tlf *TLF) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (
 	return dir.Symlink(ctx, req)
 }
 
+// Link implements the fs.NodeLinker interface for TLF.
+func (tlf *TLF) Link(ctx context.Context, req *fuse.LinkRequest,
+	old fs.Node) (fs.Node, error) {
+	dir, err := tlf.loadDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dir.Link(ctx, req, old)
+}
+
 // Rename implements the fs.NodeRenamer interface for TLF.
 func (tlf *TLF) Rename(ctx context.Context, req *fuse.RenameRequest,
 	newDir fs.Node) error {
@@ -880,6 +1114,38 @@ func (tlf *TLF) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fus
 	return dir.Setattr(ctx, req, resp)
 }
 
+// Getxattr implements the fs.NodeGetxattrer interface for TLF.
+func (tlf *TLF) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) error {
+	dir, err := tlf.loadDir(ctx)
+	if err != nil {
+		return err
+	}
+	return dir.Getxattr(ctx, req, resp)
+}
+
+// Listxattr implements the fs.NodeListxattrer interface for TLF.
+func (tlf *TLF) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) error {
+	dir, err := tlf.loadDir(ctx)
+	if err != nil {
+		return err
+	}
+	return dir.Listxattr(ctx, req, resp)
+}
+
+// Setxattr implements the fs.NodeSetxattrer interface for TLF.
+func (tlf *TLF) Setxattr(ctx context.Context,
+	req *fuse.SetxattrRequest) error {
+	return errRootXattr
+}
+
+// Removexattr implements the fs.NodeRemovexattrer interface for TLF.
+func (tlf *TLF) Removexattr(ctx context.Context,
+	req *fuse.RemovexattrRequest) error {
+	return errRootXattr
+}
+
 var _ fs.Handle = (*TLF)(nil)
 
 var _ fs.NodeOpener = (*TLF)(nil)
@@ -5,6 +5,8 @@
 package libfuse
 
 import (
+	"syscall"
+
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/keybase/kbfs/libkbfs"
@@ -15,6 +17,10 @@ import (
 type File struct {
 	folder *Folder
 	node   libkbfs.Node
+	// parent is the directory this file was looked up or created
+	// in.  It may be out of date after a rename, so it's only used
+	// as a hint, and checked before use.
+	parent *Dir
 }
 
 var _ fs.Node = (*File)(nil)
@@ -41,6 +47,9 @@ func (f *File) attr(ctx context.Context, a *fuse.Attr) (err error) {
 	if de.Type == libkbfs.Exec {
 		a.Mode |= 0111
 	}
+	if f.folder.isArchived() {
+		a.Mode &^= 0222
+	}
 	return nil
 }
 
@@ -89,14 +98,71 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest,
 	f.folder.fs.log.CDebugf(ctx, "File Write sz=%d ", len(req.Data))
 	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
 
-	if err := f.folder.fs.config.KBFSOps().Write(
-		ctx, f.node, req.Data, req.Offset); err != nil {
+	// Appends are recorded as such, so that concurrent appends from
+	// other devices can be merged instead of conflicting.
+	if req.FileFlags&fuse.OpenAppend != 0 {
+		err = f.folder.fs.config.KBFSOps().Append(ctx, f.node, req.Data)
+	} else {
+		err = f.folder.fs.config.KBFSOps().Write(
+			ctx, f.node, req.Data, req.Offset)
+	}
+	if err != nil {
 		return err
 	}
 	resp.Size = len(req.Data)
 	return nil
 }
 
+// errNoCopyByReference makes the kernel fall back to copying data
+// through reads and writes.
+var errNoCopyByReference = fuse.Errno(syscall.EOPNOTSUPP)
+
+var _ fs.HandleCopyFileRanger = (*File)(nil)
+
+// CopyFileRange implements the fs.HandleCopyFileRanger interface for
+// File.  A copy of the whole file into an empty file in the same
+// folder, like the ones cp makes, just adds new references to the
+// file's blocks; any other copy is done by the kernel.
+func (f *File) CopyFileRange(ctx context.Context,
+	req *fuse.CopyFileRangeRequest, out fs.Handle,
+	resp *fuse.CopyFileRangeResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File CopyFileRange sz=%d", req.Len)
+	dst, ok := out.(*File)
+	if !ok || dst.folder != f.folder || dst.parent == nil ||
+		req.Offset != 0 || req.OffsetOut != 0 {
+		return errNoCopyByReference
+	}
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	ei, err := f.folder.fs.config.KBFSOps().Stat(ctx, f.node)
+	if err != nil {
+		return err
+	}
+	if req.Len < ei.Size {
+		return errNoCopyByReference
+	}
+
+	// Make sure the destination still has the name it had in its
+	// parent directory.
+	name := dst.node.GetBasename()
+	n, _, err := f.folder.fs.config.KBFSOps().Lookup(
+		ctx, dst.parent.node, name)
+	if err != nil || n == nil || n.GetID() != dst.node.GetID() {
+		return errNoCopyByReference
+	}
+
+	_, _, err = f.folder.fs.config.KBFSOps().CopyFile(
+		ctx, f.node, dst.parent.node, name)
+	if _, ok := err.(libkbfs.NameExistsError); ok {
+		// The destination isn't empty.
+		return errNoCopyByReference
+	} else if err != nil {
+		return err
+	}
+	resp.Size = int(ei.Size)
+	return nil
+}
+
 var _ fs.HandleFlusher = (*File)(nil)
 
 // Flush implements the fs.HandleFlusher interface for File.
@@ -186,6 +252,46 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	return nil
 }
 
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for File.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Getxattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return getXattr(ctx, f.folder, f.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for File.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Listxattr")
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return listXattr(ctx, f.folder, f.node, resp)
+}
+
+var _ fs.NodeSetxattrer = (*File)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for File.
+func (f *File) Setxattr(ctx context.Context,
+	req *fuse.SetxattrRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Setxattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return setXattr(ctx, f.folder, f.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*File)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for File.
+func (f *File) Removexattr(ctx context.Context,
+	req *fuse.RemovexattrRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Removexattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return removeXattr(ctx, f.folder, f.node, req)
+}
+
 var _ fs.NodeForgetter = (*File)(nil)
 
 // Forget kernel reference to this node.
@@ -0,0 +1,113 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// FileInfoDirName is the name of the directory that holds the
+// version histories of the files in a directory -- it can be reached
+// in any directory within a top-level folder.
+const FileInfoDirName = ".kbfs_fileinfo"
+
+// FileInfoDir is a virtual directory with a special file for each
+// file in a directory, of the same name, holding a JSON
+// representation of that file's version history.
+type FileInfoDir struct {
+	dir *Dir
+}
+
+var _ fs.Node = (*FileInfoDir)(nil)
+
+// Attr implements the fs.Node interface for FileInfoDir.
+func (d *FileInfoDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0500
+	if d.dir.folder.list.public {
+		a.Mode |= 0055
+	}
+	return nil
+}
+
+func getEncodedFileHistory(ctx context.Context, folder *Folder,
+	node libkbfs.Node) (data []byte, t time.Time, err error) {
+	versions, err := folder.fs.config.KBFSOps().GetFileHistory(ctx, node)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err = json.Marshal(versions)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data = append(data, '\n')
+	return data, time.Time{}, err
+}
+
+var _ fs.NodeRequestLookuper = (*FileInfoDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// FileInfoDir.
+func (d *FileInfoDir) Lookup(ctx context.Context,
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (
+	node fs.Node, err error) {
+	d.dir.folder.fs.log.CDebugf(ctx, "FileInfoDir Lookup %s", req.Name)
+	defer func() { d.dir.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	fileNode, ei, err := d.dir.folder.fs.config.KBFSOps().Lookup(
+		ctx, d.dir.node, req.Name)
+	if err != nil {
+		if _, ok := err.(libkbfs.NoSuchNameError); ok {
+			return nil, fuse.ENOENT
+		}
+		return nil, err
+	}
+	if ei.Type != libkbfs.File && ei.Type != libkbfs.Exec {
+		return nil, fuse.ENOENT
+	}
+
+	resp.EntryValid = 0
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return getEncodedFileHistory(ctx, d.dir.folder, fileNode)
+		},
+	}, nil
+}
+
+var _ fs.Handle = (*FileInfoDir)(nil)
+
+var _ fs.HandleReadDirAller = (*FileInfoDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// FileInfoDir.
+func (d *FileInfoDir) ReadDirAll(ctx context.Context) (
+	res []fuse.Dirent, err error) {
+	d.dir.folder.fs.log.CDebugf(ctx, "FileInfoDir ReadDirAll")
+	defer func() { d.dir.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	children, err := d.dir.folder.fs.config.KBFSOps().GetDirChildren(
+		ctx, d.dir.node)
+	if err != nil {
+		return nil, err
+	}
+	for name, ei := range children {
+		if ei.Type != libkbfs.File && ei.Type != libkbfs.Exec {
+			continue
+		}
+		res = append(res, fuse.Dirent{
+			Type: fuse.DT_File,
+			Name: name,
+		})
+	}
+	return res, nil
+}
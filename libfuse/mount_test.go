@@ -15,6 +15,7 @@ import (
 	"path"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"testing"
@@ -829,44 +830,41 @@ func TestRenameCrossDir(t *testing.T) {
 func TestRenameCrossFolder(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe", "wsmith")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
-	mnt, _, cancelFn := makeFS(t, config)
+	mnt, fs, cancelFn := makeFS(t, config)
 	defer mnt.Close()
 	defer cancelFn()
 
 	p1 := path.Join(mnt.Dir, PrivateName, "jdoe", "old")
 	p2 := path.Join(mnt.Dir, PrivateName, "wsmith,jdoe", "new")
 	const input = "hello, world\n"
-	if err := ioutil.WriteFile(p1, []byte(input), 0644); err != nil {
+	if err := ioutil.WriteFile(p1, []byte(input), 0755); err != nil {
 		t.Fatal(err)
 	}
-
-	err := os.Rename(p1, p2)
-	if err == nil {
-		t.Fatalf("expected an error from rename: %v", err)
-	}
-	lerr, ok := err.(*os.LinkError)
-	if !ok {
-		t.Fatalf("expected a LinkError from rename: %v", err)
-	}
-	if g, e := lerr.Op, "rename"; g != e {
-		t.Errorf("wrong LinkError.Op: %q != %q", g, e)
-	}
-	if g, e := lerr.Old, p1; g != e {
-		t.Errorf("wrong LinkError.Old: %q != %q", g, e)
-	}
-	if g, e := lerr.New, p2; g != e {
-		t.Errorf("wrong LinkError.New: %q != %q", g, e)
+	fi, err := os.Lstat(p1)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if g, e := lerr.Err, syscall.EXDEV; g != e {
-		t.Errorf("expected EXDEV: %T %v", lerr.Err, lerr.Err)
+	mtime := fi.ModTime()
+
+	if err := os.Rename(p1, p2); err != nil {
+		t.Fatalf("cannot rename across folders: %v", err)
 	}
 
-	checkDir(t, path.Join(mnt.Dir, PrivateName, "jdoe"), map[string]fileInfoCheck{
-		"old": nil,
+	checkDir(t, path.Join(mnt.Dir, PrivateName, "jdoe"), map[string]fileInfoCheck{})
+	checkDir(t, path.Join(mnt.Dir, PrivateName, "wsmith,jdoe"), map[string]fileInfoCheck{
+		"new": func(fi os.FileInfo) error {
+			if !fi.ModTime().Equal(mtime) {
+				return fmt.Errorf("mtime changed from %v to %v",
+					mtime, fi.ModTime())
+			}
+			if fi.Mode()&0100 == 0 {
+				return fmt.Errorf("lost exec bit: %v", fi.Mode())
+			}
+			return nil
+		},
 	})
-	checkDir(t, path.Join(mnt.Dir, PrivateName, "wsmith,jdoe"), map[string]fileInfoCheck{})
 
-	buf, err := ioutil.ReadFile(p1)
+	buf, err := ioutil.ReadFile(p2)
 	if err != nil {
 		t.Errorf("read error: %v", err)
 	}
@@ -874,8 +872,36 @@ func TestRenameCrossFolder(t *testing.T) {
 		t.Errorf("bad file contents: %q != %q", g, e)
 	}
 
-	if _, err := ioutil.ReadFile(p2); !os.IsNotExist(err) {
-		t.Errorf("new name exists even on error: %v", err)
+	if _, err := ioutil.ReadFile(p1); !os.IsNotExist(err) {
+		t.Errorf("old name still exists: %v", err)
+	}
+
+	// Writes through the new name must reach the moved file, not
+	// the unlinked one the kernel had cached for the old name.
+	fs.NotificationGroupWait()
+	const input2 = "goodbye, world\n"
+	if err := ioutil.WriteFile(p2, []byte(input2), 0755); err != nil {
+		t.Fatal(err)
+	}
+	buf, err = ioutil.ReadFile(p2)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if g, e := string(buf), input2; g != e {
+		t.Errorf("bad file contents after write: %q != %q", g, e)
+	}
+	config2 := libkbfs.ConfigAsUser(config, "wsmith")
+	defer libkbfs.CheckConfigAndShutdown(t, config2)
+	mnt2, _, cancelFn2 := makeFS(t, config2)
+	defer mnt2.Close()
+	defer cancelFn2()
+	buf, err = ioutil.ReadFile(
+		path.Join(mnt2.Dir, PrivateName, "wsmith,jdoe", "new"))
+	if err != nil {
+		t.Fatalf("read error on the other device: %v", err)
+	}
+	if g, e := string(buf), input2; g != e {
+		t.Errorf("bad file contents on the other device: %q != %q", g, e)
 	}
 }
 
@@ -2562,6 +2588,137 @@ func TestStatusFile(t *testing.T) {
 	}
 }
 
+func TestArchivedRevision(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	const input = "hello, world\n"
+	if err := ioutil.WriteFile(p, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	jdoe := libkbfs.GetRootNodeOrBust(t, config, "jdoe", false)
+	history, err := config.KBFSOps().GetUpdateHistory(
+		ctx, jdoe.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get update history: %v", err)
+	}
+	rev := history.Updates[len(history.Updates)-1].Revision
+
+	if err := ioutil.WriteFile(p, []byte("goodbye\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archivedPath := path.Join(mnt.Dir, PrivateName, "jdoe",
+		ArchivedRevisionsDirName, strconv.FormatInt(int64(rev), 10),
+		"myfile")
+	buf, err := ioutil.ReadFile(archivedPath)
+	if err != nil {
+		t.Fatalf("Couldn't read archived file: %v", err)
+	}
+	if g, e := string(buf), input; g != e {
+		t.Errorf("wrong archived content: %q != %q", g, e)
+	}
+
+	err = ioutil.WriteFile(archivedPath, []byte("oops\n"), 0644)
+	switch err := err.(type) {
+	case *os.PathError:
+		if g, e := err.Err, syscall.EROFS; g != e {
+			t.Fatalf("wrong error: %v != %v", g, e)
+		}
+	default:
+		t.Fatalf("expected a PathError, got %T: %v", err, err)
+	}
+
+	_, err = os.Lstat(path.Join(mnt.Dir, PrivateName, "jdoe",
+		ArchivedRevisionsDirName, "1000"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Future revision exists: %v", err)
+	}
+}
+
+func TestTrashRestore(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	const input = "hello, world\n"
+	if err := ioutil.WriteFile(p, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+
+	trashPath := path.Join(mnt.Dir, PrivateName, "jdoe", TrashDirName)
+	fis, err := ioutil.ReadDir(trashPath)
+	if err != nil {
+		t.Fatalf("Couldn't read trash: %v", err)
+	}
+	if len(fis) != 1 {
+		t.Fatalf("Expected 1 trash entry, got %d", len(fis))
+	}
+	trashed := path.Join(trashPath, fis[0].Name())
+	buf, err := ioutil.ReadFile(trashed)
+	if err != nil {
+		t.Fatalf("Couldn't read removed file: %v", err)
+	}
+	if g, e := string(buf), input; g != e {
+		t.Errorf("wrong removed content: %q != %q", g, e)
+	}
+
+	if err := os.Rename(trashed, p); err != nil {
+		t.Fatalf("Couldn't restore file: %v", err)
+	}
+	buf, err = ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("Couldn't read restored file: %v", err)
+	}
+	if g, e := string(buf), input; g != e {
+		t.Errorf("wrong restored content: %q != %q", g, e)
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	if err := ioutil.WriteFile(p, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte("goodbye\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(path.Join(mnt.Dir, PrivateName, "jdoe",
+		FileInfoDirName, "myfile"))
+	if err != nil {
+		t.Fatalf("Couldn't read file info: %v", err)
+	}
+	var versions []libkbfs.FileVersion
+	if err := json.Unmarshal(buf, &versions); err != nil {
+		t.Fatalf("Couldn't decode file info: %v", err)
+	}
+	if len(versions) < 2 {
+		t.Fatalf("Expected at least 2 versions, got %d", len(versions))
+	}
+	if g, e := versions[0].Size, uint64(len("goodbye\n")); g != e {
+		t.Errorf("wrong latest size: %d != %d", g, e)
+	}
+}
+
 // TODO: remove once we have automatic conflict resolution tests
 func TestUnstageFile(t *testing.T) {
 	config1 := libkbfs.MakeTestConfigOrBust(t, "user1",
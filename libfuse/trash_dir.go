@@ -0,0 +1,147 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// TrashDirName is the name of the directory that lists the recently
+// removed entries of a top-level folder -- it can be reached in the
+// root of a top-level folder.
+const TrashDirName = ".kbfs_trash"
+
+// TrashDir is a virtual directory of the recently removed entries of
+// a top-level folder.  Each child is named "<name>~<revision>", for
+// the revision that removed it, and is a symlink to the entry in the
+// archived revision that still has it.  Renaming a child into the
+// folder restores the entry there.
+type TrashDir struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*TrashDir)(nil)
+
+// Attr implements the fs.Node interface for TrashDir.
+func (d *TrashDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0700
+	if d.folder.list.public {
+		a.Mode |= 0055
+	}
+	return nil
+}
+
+func trashEntryName(e libkbfs.DeletedEntry) string {
+	return fmt.Sprintf("%s~%d", e.Name, e.Revision)
+}
+
+// findEntry returns the removed entry with the given trash name.
+func (d *TrashDir) findEntry(ctx context.Context, name string) (
+	libkbfs.DeletedEntry, error) {
+	entries, err := d.folder.fs.config.KBFSOps().GetDeletedEntries(
+		ctx, d.folder.getFolderBranch())
+	if err != nil {
+		return libkbfs.DeletedEntry{}, err
+	}
+	for _, e := range entries {
+		if trashEntryName(e) == name {
+			return e, nil
+		}
+	}
+	return libkbfs.DeletedEntry{}, fuse.ENOENT
+}
+
+var _ fs.NodeRequestLookuper = (*TrashDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// TrashDir.
+func (d *TrashDir) Lookup(ctx context.Context,
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (
+	node fs.Node, err error) {
+	d.folder.fs.log.CDebugf(ctx, "TrashDir Lookup %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	e, err := d.findEntry(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	// Entries leave the trash when they are restored or reclaimed.
+	resp.EntryValid = 0
+	elems := append([]string{"..", ArchivedRevisionsDirName,
+		strconv.FormatInt(int64(e.SnapshotRevision), 10)}, e.Dir...)
+	return &Alias{canon: path.Join(append(elems, e.Name)...)}, nil
+}
+
+var _ fs.Handle = (*TrashDir)(nil)
+
+var _ fs.HandleReadDirAller = (*TrashDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// TrashDir.
+func (d *TrashDir) ReadDirAll(ctx context.Context) (
+	res []fuse.Dirent, err error) {
+	d.folder.fs.log.CDebugf(ctx, "TrashDir ReadDirAll")
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	entries, err := d.folder.fs.config.KBFSOps().GetDeletedEntries(
+		ctx, d.folder.getFolderBranch())
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		res = append(res, fuse.Dirent{
+			Type: fuse.DT_Link,
+			Name: trashEntryName(e),
+		})
+	}
+	return res, nil
+}
+
+var _ fs.NodeRenamer = (*TrashDir)(nil)
+
+// Rename implements the fs.NodeRenamer interface for TrashDir, by
+// restoring the removed entry under its new name.
+func (d *TrashDir) Rename(ctx context.Context, req *fuse.RenameRequest,
+	newDir fs.Node) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "TrashDir Rename %s -> %s",
+		req.OldName, req.NewName)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	var realNewDir *Dir
+	switch newDir := newDir.(type) {
+	case *Dir:
+		realNewDir = newDir
+	case *TLF:
+		var err error
+		realNewDir, err = newDir.loadDir(ctx)
+		if err != nil {
+			return err
+		}
+	default:
+		return fuse.Errno(syscall.EXDEV)
+	}
+	if d.folder != realNewDir.folder {
+		// Entries can only be restored into the folder they were
+		// removed from, and not into an archived revision of it.
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	e, err := d.findEntry(ctx, req.OldName)
+	if err != nil {
+		return err
+	}
+	_, _, err = d.folder.fs.config.KBFSOps().RestoreDeletedEntry(
+		ctx, e, realNewDir.node, req.NewName)
+	return err
+}
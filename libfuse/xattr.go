@@ -0,0 +1,77 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"sort"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// The setxattr(2) flags; these have the same values on Linux and OS
+// X.
+const (
+	xattrCreate  = 1
+	xattrReplace = 2
+)
+
+func getXattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	xattrs, err := folder.fs.config.KBFSOps().GetXattrs(ctx, node)
+	if err != nil {
+		return err
+	}
+	value, ok := xattrs[req.Name]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = value
+	return nil
+}
+
+func listXattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	resp *fuse.ListxattrResponse) error {
+	xattrs, err := folder.fs.config.KBFSOps().GetXattrs(ctx, node)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resp.Append(names...)
+	return nil
+}
+
+func setXattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.SetxattrRequest) error {
+	if req.Flags&(xattrCreate|xattrReplace) != 0 {
+		xattrs, err := folder.fs.config.KBFSOps().GetXattrs(ctx, node)
+		if err != nil {
+			return err
+		}
+		_, ok := xattrs[req.Name]
+		if ok && req.Flags&xattrCreate != 0 {
+			return fuse.EEXIST
+		} else if !ok && req.Flags&xattrReplace != 0 {
+			return fuse.ErrNoXattr
+		}
+	}
+	return folder.fs.config.KBFSOps().SetXattr(
+		ctx, node, req.Name, req.Xattr)
+}
+
+func removeXattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.RemovexattrRequest) error {
+	return folder.fs.config.KBFSOps().RemoveXattr(ctx, node, req.Name)
+}
+
+// The root directory of a TLF has no parent entry to hold its
+// extended attributes, so they can't be changed.
+var errRootXattr = fuse.Errno(syscall.EPERM)
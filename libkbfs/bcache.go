@@ -31,6 +31,7 @@ type idCacheKey struct {
 // references simultaneously.
 type BlockCacheStandard struct {
 	config             Config
+	transientCapacity  int
 	cleanBytesCapacity uint64
 
 	ids *lru.Cache
@@ -58,6 +59,7 @@ func NewBlockCacheStandard(config Config, transientCapacity int,
 	cleanBytesCapacity uint64) *BlockCacheStandard {
 	b := &BlockCacheStandard{
 		config:             config,
+		transientCapacity:  transientCapacity,
 		cleanBytesCapacity: cleanBytesCapacity,
 		cleanPermanent:     make(map[BlockID]Block),
 		dirty:              make(map[dirtyBlockID]Block),
@@ -363,3 +365,12 @@ func (b *BlockCacheStandard) DirtyBytesEstimate() uint64 {
 	}
 	return b.dirtyBytesEstimate
 }
+
+// TransientCapacity implements the BlockCache interface for
+// BlockCacheStandard.
+func (b *BlockCacheStandard) TransientCapacity() int {
+	if b.cleanTransient == nil {
+		return 0
+	}
+	return b.transientCapacity
+}
@@ -18,25 +18,88 @@ type BlockOpsStandard struct {
 
 var _ BlockOps = (*BlockOpsStandard)(nil)
 
-// Get implements the BlockOps interface for BlockOpsStandard.
-func (b *BlockOpsStandard) Get(ctx context.Context, md *RootMetadata,
-	blockPtr BlockPointer, block Block) error {
-	bserv := b.config.BlockServer()
-	buf, blockServerHalf, err := bserv.Get(ctx, blockPtr.ID, md.ID, blockPtr)
+// getFromDiskCache returns the encrypted block for the given pointer
+// from the disk block cache, if there is one and the block is in it.
+// Blocks that fail verification are dropped from the cache.
+func (b *BlockOpsStandard) getFromDiskCache(ctx context.Context,
+	dbcache DiskBlockCache, blockPtr BlockPointer) (
+	buf []byte, serverHalf BlockCryptKeyServerHalf, ok bool) {
+	buf, serverHalf, err := dbcache.Get(ctx, blockPtr.ID)
+	if _, isMiss := err.(NoSuchBlockError); isMiss {
+		return nil, BlockCryptKeyServerHalf{}, false
+	}
+	log := b.config.MakeLogger("")
 	if err != nil {
-		// Temporary code to track down bad block
-		// requests. Remove when not needed anymore.
-		if _, ok := err.(BServerErrorBadRequest); ok {
-			panic(fmt.Sprintf("Bad BServer request detected: err=%s, blockPtr=%s",
-				err, blockPtr))
+		log.CDebugf(ctx, "Disk block cache get of %v failed: %v",
+			blockPtr, err)
+		return nil, BlockCryptKeyServerHalf{}, false
+	}
+	err = b.config.Crypto().VerifyBlockID(buf, blockPtr.ID)
+	if err != nil {
+		log.CWarningf(ctx, "Disk block cache has a bad copy of %v: %v",
+			blockPtr, err)
+		if err := dbcache.Delete(ctx, []BlockID{blockPtr.ID}); err != nil {
+			log.CDebugf(ctx, "Couldn't delete %v from the disk "+
+				"block cache: %v", blockPtr, err)
 		}
+		return nil, BlockCryptKeyServerHalf{}, false
+	}
+	return buf, serverHalf, true
+}
 
-		return err
+// putInDiskCache stores the given encrypted block in the disk block
+// cache.  Failures are only logged, since the block is safe on the
+// server either way.
+func (b *BlockOpsStandard) putInDiskCache(ctx context.Context,
+	dbcache DiskBlockCache, id BlockID, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) {
+	if err := dbcache.Put(ctx, id, buf, serverHalf); err != nil {
+		b.config.MakeLogger("").CDebugf(ctx, "Couldn't put block %s "+
+			"in the disk block cache: %v", id, err)
 	}
+}
 
+// Get implements the BlockOps interface for BlockOpsStandard.
+func (b *BlockOpsStandard) Get(ctx context.Context, md *RootMetadata,
+	blockPtr BlockPointer, block Block) error {
 	crypto := b.config.Crypto()
-	if err := crypto.VerifyBlockID(buf, blockPtr.ID); err != nil {
-		return err
+	dbcache := b.config.DiskBlockCache()
+	var buf []byte
+	var blockServerHalf BlockCryptKeyServerHalf
+	cached := false
+	if dbcache != nil {
+		buf, blockServerHalf, cached = b.getFromDiskCache(
+			ctx, dbcache, blockPtr)
+	}
+
+	if !cached {
+		bserv := b.config.BlockServer()
+		var err error
+		buf, blockServerHalf, err = bserv.Get(
+			ctx, blockPtr.ID, md.ID, blockPtr)
+		if err != nil {
+			// Temporary code to track down bad block
+			// requests. Remove when not needed anymore.
+			if _, ok := err.(BServerErrorBadRequest); ok {
+				panic(fmt.Sprintf("Bad BServer request detected: err=%s, blockPtr=%s",
+					err, blockPtr))
+			}
+
+			return err
+		}
+
+		if err := crypto.VerifyBlockID(buf, blockPtr.ID); err != nil {
+			return err
+		}
+
+		if dbcache != nil {
+			b.putInDiskCache(ctx, dbcache, blockPtr.ID, buf, blockServerHalf)
+		}
+
+		err = b.config.TransferScheduler().RecordGet(ctx, len(buf))
+		if err != nil {
+			return err
+		}
 	}
 
 	tlfCryptKey, err := b.config.KeyManager().
@@ -59,7 +122,8 @@ func (b *BlockOpsStandard) Get(ctx context.Context, md *RootMetadata,
 	}
 
 	// decrypt the block
-	err = crypto.DecryptBlock(encryptedBlock, blockCryptKey, block)
+	err = crypto.DecryptBlock(encryptedBlock, blockCryptKey,
+		int(b.config.BlockSplitter().MaxSize()), block)
 	if err != nil {
 		return err
 	}
@@ -99,7 +163,8 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, md *RootMetadata,
 		return
 	}
 
-	plainSize, encryptedBlock, err := crypto.EncryptBlock(block, blockKey)
+	plainSize, encryptedBlock, err := crypto.EncryptBlock(block, blockKey,
+		int(b.config.BlockSplitter().MaxSize()))
 	if err != nil {
 		return
 	}
@@ -112,10 +177,11 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, md *RootMetadata,
 	readyBlockData = ReadyBlockData{
 		buf:        buf,
 		serverHalf: serverHalf,
+		compressed: encryptedBlock.Version == EncryptionSecretboxFlate,
 	}
 
 	encodedSize := readyBlockData.GetEncodedSize()
-	if encodedSize < plainSize {
+	if !readyBlockData.compressed && encodedSize < plainSize {
 		err = TooLowByteCountError{
 			ExpectedMinByteCount: plainSize,
 			ByteCount:            encodedSize,
@@ -139,8 +205,16 @@ func (b *BlockOpsStandard) Put(ctx context.Context, md *RootMetadata,
 	blockPtr BlockPointer, readyBlockData ReadyBlockData) error {
 	bserv := b.config.BlockServer()
 	if blockPtr.RefNonce == zeroBlockRefNonce {
-		return bserv.Put(ctx, blockPtr.ID, md.ID, blockPtr, readyBlockData.buf,
+		err := bserv.Put(ctx, blockPtr.ID, md.ID, blockPtr, readyBlockData.buf,
 			readyBlockData.serverHalf)
+		if err != nil {
+			return err
+		}
+		if dbcache := b.config.DiskBlockCache(); dbcache != nil {
+			b.putInDiskCache(ctx, dbcache, blockPtr.ID, readyBlockData.buf,
+				readyBlockData.serverHalf)
+		}
+		return nil
 	}
 	// non-zero block refnonce means this is a new reference to an
 	// existing block.
@@ -154,7 +228,27 @@ func (b *BlockOpsStandard) Delete(ctx context.Context, md *RootMetadata,
 	for _, ptr := range ptrs {
 		contexts[ptr.ID] = append(contexts[ptr.ID], ptr)
 	}
-	return b.config.BlockServer().RemoveBlockReference(ctx, md.ID, contexts)
+	liveCounts, err = b.config.BlockServer().RemoveBlockReference(
+		ctx, md.ID, contexts)
+	if err != nil {
+		return liveCounts, err
+	}
+
+	if dbcache := b.config.DiskBlockCache(); dbcache != nil {
+		var deadIDs []BlockID
+		for id, count := range liveCounts {
+			if count == 0 {
+				deadIDs = append(deadIDs, id)
+			}
+		}
+		if len(deadIDs) > 0 {
+			if err := dbcache.Delete(ctx, deadIDs); err != nil {
+				b.config.MakeLogger("").CDebugf(ctx, "Couldn't delete "+
+					"blocks from the disk block cache: %v", err)
+			}
+		}
+	}
+	return liveCounts, nil
 }
 
 // Archive implements the BlockOps interface for BlockOpsStandard.
@@ -90,8 +90,9 @@ func expectBlockEncrypt(config *ConfigMock, rmd *RootMetadata, decData Block, pl
 	encryptedBlock := EncryptedBlock{
 		EncryptedData: encData,
 	}
-	config.mockCrypto.EXPECT().EncryptBlock(decData, BlockCryptKey{}).
-		Return(plainSize, encryptedBlock, err)
+	config.mockBsplit.EXPECT().MaxSize().Return(int64(64 * 1024))
+	config.mockCrypto.EXPECT().EncryptBlock(decData, BlockCryptKey{},
+		64*1024).Return(plainSize, encryptedBlock, err)
 	if err == nil {
 		config.mockCodec.EXPECT().Encode(encryptedBlock).Return(encData, nil)
 	}
@@ -103,8 +104,9 @@ func expectBlockDecrypt(config *ConfigMock, rmd *RootMetadata, blockPtr BlockPoi
 	config.mockCrypto.EXPECT().UnmaskBlockCryptKey(gomock.Any(), gomock.Any()).
 		Return(BlockCryptKey{}, nil)
 	config.mockCodec.EXPECT().Decode(encData, gomock.Any()).Return(nil)
-	config.mockCrypto.EXPECT().DecryptBlock(gomock.Any(), BlockCryptKey{}, gomock.Any()).
-		Do(func(encryptedBlock EncryptedBlock, key BlockCryptKey, b Block) {
+	config.mockBsplit.EXPECT().MaxSize().Return(int64(64 * 1024))
+	config.mockCrypto.EXPECT().DecryptBlock(gomock.Any(), BlockCryptKey{}, 64*1024, gomock.Any()).
+		Do(func(encryptedBlock EncryptedBlock, key BlockCryptKey, maxSize int, b Block) {
 			if b != nil {
 				tb := b.(*TestBlock)
 				*tb = block
@@ -200,6 +202,108 @@ func TestBlockOpsGetFailDecryptBlockData(t *testing.T) {
 	}
 }
 
+func TestBlockOpsGetDiskCacheHit(t *testing.T) {
+	mockCtrl, config, ctx := blockOpsInit(t)
+	defer blockOpsShutdown(mockCtrl, config)
+	dbcache := NewMockDiskBlockCache(mockCtrl)
+	config.SetDiskBlockCache(dbcache)
+
+	rmd := makeRMD()
+
+	// expect the block to come from the disk cache, without any
+	// call to the block server
+	id := fakeBlockID(1)
+	encData := []byte{1, 2, 3, 4}
+	blockPtr := BlockPointer{ID: id}
+	dbcache.EXPECT().Get(ctx, id).Return(
+		encData, BlockCryptKeyServerHalf{}, nil)
+	decData := TestBlock{42}
+
+	expectBlockDecrypt(config, rmd, blockPtr, encData, decData, nil)
+
+	var gotBlock TestBlock
+	err := config.BlockOps().Get(ctx, rmd, blockPtr, &gotBlock)
+	if err != nil {
+		t.Fatalf("Got error on get: %v", err)
+	}
+
+	if gotBlock != decData {
+		t.Errorf("Got back wrong block data on get: %v", gotBlock)
+	}
+}
+
+func TestBlockOpsGetDiskCacheMiss(t *testing.T) {
+	mockCtrl, config, ctx := blockOpsInit(t)
+	defer blockOpsShutdown(mockCtrl, config)
+	dbcache := NewMockDiskBlockCache(mockCtrl)
+	config.SetDiskBlockCache(dbcache)
+
+	rmd := makeRMD()
+
+	// expect the block to be fetched from the server and then
+	// put in the disk cache
+	id := fakeBlockID(1)
+	encData := []byte{1, 2, 3, 4}
+	blockPtr := BlockPointer{ID: id}
+	dbcache.EXPECT().Get(ctx, id).Return(
+		nil, BlockCryptKeyServerHalf{}, NoSuchBlockError{id})
+	config.mockBserv.EXPECT().Get(ctx, id, rmd.ID, blockPtr).Return(
+		encData, BlockCryptKeyServerHalf{}, nil)
+	dbcache.EXPECT().Put(ctx, id, encData, BlockCryptKeyServerHalf{}).
+		Return(nil)
+	decData := TestBlock{42}
+
+	expectBlockDecrypt(config, rmd, blockPtr, encData, decData, nil)
+
+	var gotBlock TestBlock
+	err := config.BlockOps().Get(ctx, rmd, blockPtr, &gotBlock)
+	if err != nil {
+		t.Fatalf("Got error on get: %v", err)
+	}
+
+	if gotBlock != decData {
+		t.Errorf("Got back wrong block data on get: %v", gotBlock)
+	}
+}
+
+func TestBlockOpsGetDiskCacheFailVerify(t *testing.T) {
+	mockCtrl, config, ctx := blockOpsInit(t)
+	defer blockOpsShutdown(mockCtrl, config)
+	dbcache := NewMockDiskBlockCache(mockCtrl)
+	config.SetDiskBlockCache(dbcache)
+
+	rmd := makeRMD()
+
+	// expect the bad cached copy to be dropped, and the block to
+	// be fetched from the server instead
+	id := fakeBlockID(1)
+	badData := []byte{1, 2, 3}
+	encData := []byte{1, 2, 3, 4}
+	blockPtr := BlockPointer{ID: id}
+	dbcache.EXPECT().Get(ctx, id).Return(
+		badData, BlockCryptKeyServerHalf{}, nil)
+	config.mockCrypto.EXPECT().VerifyBlockID(badData, id).Return(
+		errors.New("Fake verification fail"))
+	dbcache.EXPECT().Delete(ctx, []BlockID{id}).Return(nil)
+	config.mockBserv.EXPECT().Get(ctx, id, rmd.ID, blockPtr).Return(
+		encData, BlockCryptKeyServerHalf{}, nil)
+	dbcache.EXPECT().Put(ctx, id, encData, BlockCryptKeyServerHalf{}).
+		Return(nil)
+	decData := TestBlock{42}
+
+	expectBlockDecrypt(config, rmd, blockPtr, encData, decData, nil)
+
+	var gotBlock TestBlock
+	err := config.BlockOps().Get(ctx, rmd, blockPtr, &gotBlock)
+	if err != nil {
+		t.Fatalf("Got error on get: %v", err)
+	}
+
+	if gotBlock != decData {
+		t.Errorf("Got back wrong block data on get: %v", gotBlock)
+	}
+}
+
 func TestBlockOpsReadySuccess(t *testing.T) {
 	mockCtrl, config, ctx := blockOpsInit(t)
 	defer blockOpsShutdown(mockCtrl, config)
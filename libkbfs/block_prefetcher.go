@@ -0,0 +1,183 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	// How many prefetches may be fetching blocks at the same time.
+	numPrefetchWorkers = 4
+	// How many files to remember the last read of, to detect
+	// sequential reads.
+	numPrefetchReadsTracked = 100
+	// Prefetching stops once the queued blocks would take up more
+	// than 1/prefetchCacheFraction of the block cache's transient
+	// entries, so that prefetched blocks don't push the blocks being
+	// read (or each other) out of the cache before they're used.
+	prefetchCacheFraction = 4
+)
+
+// blockPrefetcher fetches blocks into the block cache in the
+// background, ahead of sequential file reads and directory
+// listings.  Prefetches are best-effort: they're dropped when too
+// many are queued, and their errors are only logged.
+type blockPrefetcher struct {
+	config Config
+	log    logger.Logger
+	id     TlfID
+
+	// ctx is canceled on shutdown, to stop the outstanding
+	// fetches.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// workers limits the number of concurrent fetches.
+	workers chan struct{}
+	// group tracks the outstanding prefetches.
+	group sync.WaitGroup
+
+	lock sync.Mutex
+	// queued holds the IDs of the blocks waiting to be, or being,
+	// fetched.
+	queued map[BlockID]bool
+	// reads maps the ref of a file being read to the offset just
+	// past its last read.
+	reads *lru.Cache
+	// isShutdown is true once shutdown has started.
+	isShutdown bool
+}
+
+func newBlockPrefetcher(config Config, fb FolderBranch,
+	log logger.Logger) *blockPrefetcher {
+	// The cache only fails with a non-positive size.
+	reads, _ := lru.New(numPrefetchReadsTracked)
+	ctx, cancel := context.WithCancel(context.Background())
+	return &blockPrefetcher{
+		config:  config,
+		log:     log,
+		id:      fb.Tlf,
+		ctx:     ctx,
+		cancel:  cancel,
+		workers: make(chan struct{}, numPrefetchWorkers),
+		queued:  make(map[BlockID]bool),
+		reads:   reads,
+	}
+}
+
+// CtxPrefetchTagKey is the type used for unique context tags within
+// blockPrefetcher.
+type CtxPrefetchTagKey int
+
+const (
+	// CtxPrefetchIDKey is the type of the tag for unique operation
+	// IDs within blockPrefetcher.
+	CtxPrefetchIDKey CtxPrefetchTagKey = iota
+)
+
+// CtxPrefetchOpID is the display name for the unique operation
+// blockPrefetcher ID tag.
+const CtxPrefetchOpID = "PFID"
+
+// noteRead records a read of n bytes at off in the given file, and
+// returns whether it continues right where the previous read of the
+// file left off.
+func (p *blockPrefetcher) noteRead(file blockRef, off, n int64) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	prevEnd, ok := p.reads.Get(file)
+	p.reads.Add(file, off+n)
+	return ok && prevEnd.(int64) == off
+}
+
+// maxQueuedLocked returns how many blocks may be queued for
+// prefetching at once.
+func (p *blockPrefetcher) maxQueuedLocked() int {
+	return p.config.BlockCache().TransientCapacity() / prefetchCacheFraction
+}
+
+// prefetch starts fetching the given blocks into the block cache,
+// skipping the ones that are cached already.  md must be the MD the
+// pointers came from, for the keys of the blocks.
+func (p *blockPrefetcher) prefetch(md *RootMetadata, ptrs []BlockPointer,
+	branch BranchName, newBlock makeNewBlock) {
+	bcache := p.config.BlockCache()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.isShutdown {
+		return
+	}
+	maxQueued := p.maxQueuedLocked()
+	for _, ptr := range ptrs {
+		if len(p.queued) >= maxQueued {
+			return
+		}
+		if !ptr.IsValid() || p.queued[ptr.ID] {
+			continue
+		}
+		// This also skips dirty blocks, which may not even be on
+		// the server yet.
+		if _, err := bcache.Get(ptr, branch); err == nil {
+			continue
+		}
+		p.queued[ptr.ID] = true
+		p.group.Add(1)
+		go p.fetch(md, ptr, branch, newBlock)
+	}
+}
+
+func (p *blockPrefetcher) fetch(md *RootMetadata, ptr BlockPointer,
+	branch BranchName, newBlock makeNewBlock) {
+	defer p.group.Done()
+	defer func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		delete(p.queued, ptr.ID)
+	}()
+
+	select {
+	case p.workers <- struct{}{}:
+		defer func() { <-p.workers }()
+	case <-p.ctx.Done():
+		return
+	}
+
+	ctx := ctxWithRandomID(p.ctx, CtxPrefetchIDKey, CtxPrefetchOpID, p.log)
+	bcache := p.config.BlockCache()
+	if _, err := bcache.Get(ptr, branch); err == nil {
+		// A read got to it first.
+		return
+	}
+	block := newBlock()
+	err := p.config.BlockOps().Get(ctx, md, ptr, block)
+	if err == nil {
+		err = bcache.Put(ptr, p.id, block, TransientEntry)
+	}
+	if err != nil && ctx.Err() == nil {
+		p.log.CDebugf(ctx, "Couldn't prefetch block %v: %v", ptr, err)
+	}
+}
+
+// waitForPrefetches waits until all the prefetches started so far
+// are done.
+func (p *blockPrefetcher) waitForPrefetches() {
+	p.group.Wait()
+}
+
+// shutdown cancels the outstanding prefetches, and waits for them to
+// stop.
+func (p *blockPrefetcher) shutdown() {
+	func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.isShutdown = true
+	}()
+	p.cancel()
+	p.group.Wait()
+}
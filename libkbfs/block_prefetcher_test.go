@@ -0,0 +1,146 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+)
+
+func TestBlockPrefetcherReadAhead(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	bsplitter, err := NewBlockSplitterSimple(4096, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't create block splitter: %v", err)
+	}
+	config.SetBlockSplitter(bsplitter)
+	config.(*ConfigLocal).SetReadAheadBlocks(3)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := make([]byte, 40*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	md, err := ops.getMDLocked(ctx, lState, mdReadNoIdentify)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %v", err)
+	}
+	p := ops.nodeCache.PathFromNode(fileNode)
+	fblock, err := ops.blocks.GetFileBlockForReading(
+		ctx, lState, md, p.tailPointer(), p.Branch, p)
+	if err != nil {
+		t.Fatalf("Couldn't get file block: %v", err)
+	}
+	if !fblock.IsInd || len(fblock.IPtrs) < 6 {
+		t.Fatalf("Expected at least 6 child blocks, got %d",
+			len(fblock.IPtrs))
+	}
+	iptrs := fblock.IPtrs
+
+	// Only keep the top block cached, so everything else has to
+	// come from the server.
+	bcache := config.BlockCache()
+	for _, iptr := range iptrs {
+		if err := bcache.DeleteTransient(iptr.BlockPointer, md.ID); err != nil {
+			t.Fatalf("Couldn't delete block: %v", err)
+		}
+	}
+	checkCached := func(i int, expected bool) {
+		_, err := bcache.Get(iptrs[i].BlockPointer, p.Branch)
+		if cached := err == nil; cached != expected {
+			t.Errorf("Block %d cached: %t, expected %t", i, cached, expected)
+		}
+	}
+
+	// The first read of a file isn't read ahead.
+	buf := make([]byte, iptrs[1].Off)
+	if _, err := kbfsOps.Read(ctx, fileNode, buf, 0); err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	ops.blocks.prefetcher.waitForPrefetches()
+	checkCached(1, false)
+
+	// The next one continues it, so the three blocks after the
+	// last one read get prefetched.
+	buf = make([]byte, iptrs[2].Off-iptrs[1].Off)
+	if _, err := kbfsOps.Read(ctx, fileNode, buf, iptrs[1].Off); err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	ops.blocks.prefetcher.waitForPrefetches()
+	for i := 2; i < 5; i++ {
+		checkCached(i, true)
+	}
+	checkCached(5, false)
+}
+
+func TestBlockPrefetcherDirPrefetch(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	var dirNodes []Node
+	for _, name := range []string{"a", "b"} {
+		dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, name)
+		if err != nil {
+			t.Fatalf("Couldn't create dir: %v", err)
+		}
+		dirNodes = append(dirNodes, dirNode)
+	}
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "c", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	bcache := config.BlockCache()
+	var ptrs []BlockPointer
+	for _, dirNode := range dirNodes {
+		p := ops.nodeCache.PathFromNode(dirNode)
+		ptr := p.tailPointer()
+		if err := bcache.DeleteTransient(ptr, p.Tlf); err != nil {
+			t.Fatalf("Couldn't delete block: %v", err)
+		}
+		ptrs = append(ptrs, ptr)
+	}
+	checkCached := func(expected bool) {
+		for _, ptr := range ptrs {
+			_, err := bcache.Get(ptr, MasterBranch)
+			if cached := err == nil; cached != expected {
+				t.Errorf("Block %v cached: %t, expected %t",
+					ptr, cached, expected)
+			}
+		}
+	}
+
+	// Directory prefetching is off by default.
+	if _, err := kbfsOps.GetDirChildren(ctx, rootNode); err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	ops.blocks.prefetcher.waitForPrefetches()
+	checkCached(false)
+
+	config.(*ConfigLocal).SetDoDirPrefetch(true)
+	if _, err := kbfsOps.GetDirChildren(ctx, rootNode); err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	ops.blocks.prefetcher.waitForPrefetches()
+	checkCached(true)
+}
@@ -4,7 +4,11 @@
 
 package libkbfs
 
-import "github.com/keybase/go-codec/codec"
+import (
+	"sort"
+
+	"github.com/keybase/go-codec/codec"
+)
 
 // IndirectDirPtr pairs an indirect dir block with the start of that
 // block's range of directory entries (inclusive)
@@ -13,6 +17,10 @@ type IndirectDirPtr struct {
 	// field is non-zero.
 	BlockInfo
 	Off string `codec:"o"`
+	// Size is the plaintext size of the child block, so that the
+	// size of the whole directory can be computed without fetching
+	// every child block.
+	Size uint64 `codec:"s,omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -24,6 +32,10 @@ type IndirectFilePtr struct {
 	// be dirty.
 	BlockInfo
 	Off int64 `codec:"o"`
+	// Holes is set when the range of this pointer contains a hole,
+	// which reads as zeroes.  A leaf block has a hole when its
+	// contents end before the offset of the next leaf block.
+	Holes bool `codec:"h,omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -63,6 +75,12 @@ type DirBlock struct {
 	Children map[string]DirEntry `codec:"c,omitempty"`
 	// if indirect, contains the indirect pointers to the next level of blocks
 	IPtrs []IndirectDirPtr `codec:"i,omitempty"`
+
+	// loadedLeaves is only set on local copies of indirect blocks.
+	// It maps the offset of each child block whose entries have
+	// been merged into Children to the original, unmodified child
+	// block.  Not serialized.
+	loadedLeaves map[string]*DirBlock
 }
 
 // NewDirBlock creates a new, empty DirBlock.
@@ -82,9 +100,38 @@ func (db DirBlock) DeepCopy(codec Codec) (*DirBlock, error) {
 	if dirBlockCopy.Children == nil {
 		dirBlockCopy.Children = make(map[string]DirEntry)
 	}
+	if db.loadedLeaves != nil {
+		// The original child blocks are never modified, so there's
+		// no need to copy them.
+		dirBlockCopy.loadedLeaves = make(map[string]*DirBlock)
+		for off, leaf := range db.loadedLeaves {
+			dirBlockCopy.loadedLeaves[off] = leaf
+		}
+	}
 	return &dirBlockCopy, nil
 }
 
+// leafIndex returns the index of the indirect pointer whose range of
+// entries would contain the given name.  Must only be called on
+// indirect blocks.
+func (db DirBlock) leafIndex(name string) int {
+	// The first pointer always starts at the empty string, so this
+	// can never be less than 0.
+	return sort.Search(len(db.IPtrs), func(i int) bool {
+		return db.IPtrs[i].Off > name
+	}) - 1
+}
+
+// leafEnd returns the (exclusive) end of the range of entries
+// covered by the child block at the given index, and false if the
+// range is unbounded.  Must only be called on indirect blocks.
+func (db DirBlock) leafEnd(i int) (string, bool) {
+	if i+1 < len(db.IPtrs) {
+		return db.IPtrs[i+1].Off, true
+	}
+	return "", false
+}
+
 // FileBlock is the contents of a file
 type FileBlock struct {
 	CommonBlock
@@ -110,3 +157,52 @@ func (fb FileBlock) DeepCopy(codec Codec) (*FileBlock, error) {
 	}
 	return &fileBlockCopy, nil
 }
+
+// hasHoles returns whether any of the indirect pointers of this
+// block have a hole in their range.
+func (fb *FileBlock) hasHoles() bool {
+	for _, iptr := range fb.IPtrs {
+		if iptr.Holes {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHardLinks returns whether this block, or any of the blocks under
+// it, has an entry that is a hard link.
+func (db *DirBlock) hasHardLinks() bool {
+	for _, de := range db.Children {
+		if de.Type == HardLink {
+			return true
+		}
+	}
+	for _, iptr := range db.IPtrs {
+		if iptr.DataVer >= HardLinksDataVer {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIndirectChildren returns whether any of the blocks under this
+// block are indirect blocks themselves.
+func (fb *FileBlock) hasIndirectChildren() bool {
+	for _, iptr := range fb.IPtrs {
+		if iptr.DataVer >= MultiLevelFilesDataVer {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCompressedChildren returns whether any of the blocks under this
+// block were compressed before they were encrypted.
+func (fb *FileBlock) hasCompressedChildren() bool {
+	for _, iptr := range fb.IPtrs {
+		if iptr.DataVer >= CompressedBlocksDataVer {
+			return true
+		}
+	}
+	return false
+}
@@ -51,6 +51,7 @@ func makeFakeIndirectDirPtrFuture(t *testing.T) indirectDirPtrFuture {
 		indirectDirPtrCurrent{
 			makeFakeBlockInfo(t),
 			"offset",
+			100,
 			codec.UnknownFieldSetHandler{},
 		},
 		makeExtraOrBust("IndirectDirPtr", t),
@@ -81,6 +82,7 @@ func makeFakeIndirectFilePtrFuture(t *testing.T) indirectFilePtrFuture {
 		indirectFilePtrCurrent{
 			makeFakeBlockInfo(t),
 			25,
+			true,
 			codec.UnknownFieldSetHandler{},
 		},
 		makeExtraOrBust("IndirectFilePtr", t),
@@ -129,6 +131,7 @@ func makeFakeDirBlockFuture(t *testing.T) dirBlockFuture {
 			},
 			nil,
 			nil,
+			nil,
 		},
 		map[string]dirEntryFuture{
 			"child1": makeFakeDirEntryFuture(t),
@@ -0,0 +1,149 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+// gearTable maps each byte value to a pseudo-random 64-bit number
+// for the gear rolling hash.  It must be the same on every client,
+// so that the same contents always get split at the same places and
+// can be deduplicated, so it is generated from a fixed seed.
+var gearTable = func() (table [256]uint64) {
+	// splitmix64
+	x := uint64(0x6b626673)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// BlockSplitterCDC implements the BlockSplitter interface by
+// splitting file blocks at content-defined boundaries, found with a
+// gear rolling hash, within a minimum and maximum block size.  Since
+// each boundary only depends on the bytes right before it, inserting
+// or removing data only changes the blocks around the edit, and the
+// rest of the file keeps the same block contents (and so the same
+// block IDs) as before.  Directory blocks, indirect pointers and
+// block changes are handled the same way as in BlockSplitterSimple.
+type BlockSplitterCDC struct {
+	*BlockSplitterSimple
+	minSize int64
+	// mask selects the hash bits that must all be zero at a
+	// boundary.  It uses the high bits of the hash, which depend on
+	// the most preceding bytes.
+	mask uint64
+}
+
+// NewBlockSplitterCDC creates a new BlockSplitterCDC with the same
+// max size as a BlockSplitterSimple for the given desired block
+// size.  Blocks are at least a quarter of the max size, and about
+// half of it on average.
+func NewBlockSplitterCDC(desiredBlockSize int64,
+	blockChangeEmbedMaxSize uint64, codec Codec) (*BlockSplitterCDC, error) {
+	bsplit, err := NewBlockSplitterSimple(
+		desiredBlockSize, blockChangeEmbedMaxSize, codec)
+	if err != nil {
+		return nil, err
+	}
+	return newBlockSplitterCDC(bsplit), nil
+}
+
+// newBlockSplitterCDC makes a BlockSplitterCDC that uses the given
+// BlockSplitterSimple's max size and its non-file-block decisions.
+func newBlockSplitterCDC(bsplit *BlockSplitterSimple) *BlockSplitterCDC {
+	minSize := bsplit.maxSize / 4
+	if minSize < 1 {
+		minSize = 1
+	}
+	// Pick the number of mask bits so that a boundary is expected
+	// about minSize bytes past the minimum.
+	bits := uint(0)
+	for int64(2)<<bits <= minSize && bits < 63 {
+		bits++
+	}
+	return &BlockSplitterCDC{
+		BlockSplitterSimple: bsplit,
+		minSize:             minSize,
+		mask:                ((uint64(1) << bits) - 1) << (64 - bits),
+	}
+}
+
+// findBoundary returns the length of the first chunk of data that is
+// at least minLen bytes long, or -1 if data isn't yet long enough to
+// contain a boundary.  Since every bit of the gear hash has shifted
+// out after 64 bytes, the hash only needs to start 64 bytes before
+// the first possible boundary.
+func (b *BlockSplitterCDC) findBoundary(data []byte, minLen int64) int64 {
+	if minLen < b.minSize {
+		minLen = b.minSize
+	}
+	end := int64(len(data))
+	if end > b.maxSize {
+		end = b.maxSize
+	}
+	i := minLen - 64
+	if i < 0 {
+		i = 0
+	}
+	var h uint64
+	for ; i < end; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if i+1 >= minLen && h&b.mask == 0 {
+			return i + 1
+		}
+	}
+	if int64(len(data)) >= b.maxSize {
+		return b.maxSize
+	}
+	return -1
+}
+
+// CopyUntilSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) CopyUntilSplit(
+	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	currLen := int64(len(block.Contents))
+	if off < currLen || len(data) == 0 {
+		// Overwriting the middle of the block just copies what
+		// fits; CheckSplit will find the new boundaries later.
+		return b.BlockSplitterSimple.CopyUntilSplit(
+			block, lastBlock, data, off)
+	}
+
+	// When appending to a block that already ends at a boundary,
+	// the new data belongs in the next block.
+	if off == currLen && b.findBoundary(block.Contents, currLen) == currLen {
+		return 0
+	}
+
+	n := b.BlockSplitterSimple.CopyUntilSplit(block, lastBlock, data, off)
+	if n == 0 {
+		return 0
+	}
+	// Stop at the first boundary within the new data.
+	if cut := b.findBoundary(block.Contents, off+1); cut > 0 && cut < off+n {
+		block.Contents = block.Contents[:cut]
+		return cut - off
+	}
+	return n
+}
+
+// CheckSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) CheckSplit(block *FileBlock) int64 {
+	cut := b.findBoundary(block.Contents, 0)
+	switch {
+	case cut < 0:
+		// Keep pulling in bytes from the next block until there's
+		// a boundary.
+		return -1
+	case cut == int64(len(block.Contents)):
+		return 0
+	default:
+		return cut
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func makeTestCDCData(n int) []byte {
+	data := make([]byte, n)
+	r := rand.New(rand.NewSource(1))
+	for i := range data {
+		data[i] = byte(r.Intn(256))
+	}
+	return data
+}
+
+// chunkWithCDC splits data into blocks the way a sync would, by
+// repeatedly checking where the current block should end.
+func chunkWithCDC(t *testing.T, bsplit *BlockSplitterCDC,
+	data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		block := NewFileBlock().(*FileBlock)
+		block.Contents = data
+		n := bsplit.CheckSplit(block)
+		if n <= 0 {
+			// The last block doesn't need to end at a boundary.
+			n = int64(len(data))
+		}
+		if n > bsplit.maxSize {
+			t.Fatalf("Block of size %d is bigger than the max %d",
+				n, bsplit.maxSize)
+		}
+		if n < bsplit.minSize && n != int64(len(data)) {
+			t.Fatalf("Block of size %d is smaller than the min %d",
+				n, bsplit.minSize)
+		}
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+func TestBsplitterCDCInsertKeepsBlocks(t *testing.T) {
+	bsplit := newBlockSplitterCDC(&BlockSplitterSimple{4096, 10, 0, 0, 4096})
+	data := makeTestCDCData(256 * 1024)
+	oldChunks := chunkWithCDC(t, bsplit, data)
+	if len(oldChunks) < 32 {
+		t.Fatalf("Only got %d chunks", len(oldChunks))
+	}
+	known := make(map[string]bool)
+	for _, c := range oldChunks {
+		known[string(c)] = true
+	}
+
+	newData := append([]byte{0xff}, data...)
+	newChunks := chunkWithCDC(t, bsplit, newData)
+	changed := 0
+	for _, c := range newChunks {
+		if !known[string(c)] {
+			changed++
+		}
+	}
+	if changed > 1 {
+		t.Fatalf("%d of %d chunks changed after a one-byte insert",
+			changed, len(newChunks))
+	}
+}
+
+func TestBsplitterCDCCopyStopsAtBoundary(t *testing.T) {
+	bsplit := newBlockSplitterCDC(&BlockSplitterSimple{4096, 10, 0, 0, 4096})
+	data := makeTestCDCData(64 * 1024)
+	chunks := chunkWithCDC(t, bsplit, data)
+
+	// Appending the whole file to an empty last block only takes
+	// the first chunk.
+	block := NewFileBlock().(*FileBlock)
+	n := bsplit.CopyUntilSplit(block, true, data, 0)
+	if n != int64(len(chunks[0])) {
+		t.Fatalf("Copied %d bytes, expected %d", n, len(chunks[0]))
+	}
+	if !bytes.Equal(block.Contents, chunks[0]) {
+		t.Fatalf("Wrong block contents after copy")
+	}
+
+	// Appending more to a full chunk copies nothing.
+	if n := bsplit.CopyUntilSplit(
+		block, true, data[n:], int64(len(block.Contents))); n != 0 {
+		t.Fatalf("Copied %d bytes into a full chunk", n)
+	}
+
+	// Appending in small pieces ends up at the same boundary.
+	block = NewFileBlock().(*FileBlock)
+	var copied int64
+	for copied < int64(len(data)) {
+		end := copied + 100
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		copied += bsplit.CopyUntilSplit(
+			block, true, data[copied:end], copied)
+		if copied < end {
+			break
+		}
+	}
+	if !bytes.Equal(block.Contents, chunks[0]) {
+		t.Fatalf("Wrong block contents after small copies: %d bytes",
+			len(block.Contents))
+	}
+}
+
+func TestBsplitterCDCOverwriteCopiesAll(t *testing.T) {
+	bsplit := newBlockSplitterCDC(&BlockSplitterSimple{4096, 10, 0, 0, 4096})
+	data := makeTestCDCData(1024)
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = make([]byte, 2048)
+
+	// Overwrites in the middle of a block ignore boundaries until
+	// the next CheckSplit.
+	if n := bsplit.CopyUntilSplit(block, true, data, 512); n != 1024 {
+		t.Fatalf("Copied %d bytes, expected 1024", n)
+	}
+	if !bytes.Equal(block.Contents[512:1536], data) {
+		t.Fatalf("Wrong block contents after overwrite")
+	}
+}
+
+func TestBsplitterCDCCheckSplit(t *testing.T) {
+	bsplit := newBlockSplitterCDC(&BlockSplitterSimple{4096, 10, 0, 0, 4096})
+	data := makeTestCDCData(64 * 1024)
+	chunks := chunkWithCDC(t, bsplit, data)
+	first := int64(len(chunks[0]))
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = data[:first]
+	if n := bsplit.CheckSplit(block); n != 0 {
+		t.Fatalf("Block ending at a boundary needs split at %d", n)
+	}
+	block.Contents = data[:first+10]
+	if n := bsplit.CheckSplit(block); n != first {
+		t.Fatalf("Got split at %d, expected %d", n, first)
+	}
+	block.Contents = data[:bsplit.minSize]
+	if n := bsplit.CheckSplit(block); n != -1 {
+		t.Fatalf("Block without a boundary got split at %d", n)
+	}
+	block.Contents = make([]byte, 2*bsplit.maxSize)
+	if n := bsplit.CheckSplit(block); n != bsplit.maxSize {
+		t.Fatalf("Block without a boundary split at %d, not at the max %d",
+			n, bsplit.maxSize)
+	}
+}
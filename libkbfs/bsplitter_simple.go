@@ -4,13 +4,51 @@
 
 package libkbfs
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
 
 // BlockSplitterSimple implements the BlockSplitter interface by using
 // a simple max-size algorithm to determine when to split blocks.
 type BlockSplitterSimple struct {
 	maxSize                 int64
 	blockChangeEmbedMaxSize uint64
+	// maxDirEntriesPerBlock is the most entries a single directory
+	// block may hold before it gets split.  0 means directory blocks
+	// are never split.
+	maxDirEntriesPerBlock int
+	// maxPtrsPerBlock is the most indirect pointers a single file
+	// block may hold.  0 means there is no limit.
+	maxPtrsPerBlock int
+	// blockSize is the largest encoded size of the file blocks it
+	// makes, i.e. the encoded size of a file block holding maxSize
+	// bytes of data.
+	blockSize int64
+}
+
+// makeWorstCaseBlockInfo returns a BlockInfo that encodes to at
+// least as many bytes as any real one.
+func makeWorstCaseBlockInfo() (BlockInfo, error) {
+	h, err := DefaultHash([]byte{1})
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	uid := keybase1.UID(strings.Repeat("f", 32))
+	return BlockInfo{
+		BlockPointer: BlockPointer{
+			ID:       BlockID{h},
+			KeyGen:   1,
+			DataVer:  FirstValidDataVer,
+			Creator:  uid,
+			Writer:   uid,
+			RefNonce: BlockRefNonce{1, 1, 1, 1, 1, 1, 1, 1},
+		},
+		EncodedSize: 1 << 31,
+	}, nil
 }
 
 // NewBlockSplitterSimple creates a new BlockSplittleSimple and
@@ -68,12 +106,80 @@ func NewBlockSplitterSimple(desiredBlockSize int64,
 			"desired size of %d", desiredBlockSize)
 	}
 
+	// Now see how many indirect pointers fit into an indirect block
+	// of the desired size.
+	info, err := makeWorstCaseBlockInfo()
+	if err != nil {
+		return nil, err
+	}
+	indBlock := &FileBlock{CommonBlock: CommonBlock{IsInd: true}}
+	emptyBuf, err := codec.Encode(indBlock)
+	if err != nil {
+		return nil, err
+	}
+	indBlock.IPtrs = []IndirectFilePtr{{BlockInfo: info, Off: 1 << 62}}
+	fullBuf, err := codec.Encode(indBlock)
+	if err != nil {
+		return nil, err
+	}
+	maxPtrs := (desiredBlockSize - int64(len(emptyBuf))) /
+		int64(len(fullBuf)-len(emptyBuf))
+	// Any fewer, and the tree of indirect blocks could never end.
+	if maxPtrs < 2 {
+		maxPtrs = 2
+	}
+
 	return &BlockSplitterSimple{
 		maxSize:                 maxSize,
 		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
+		maxPtrsPerBlock:         int(maxPtrs),
+		blockSize:               desiredBlockSize,
 	}, nil
 }
 
+// SetMaxDirEntriesByBlockSize sets the maximum number of entries
+// per directory block, so that a block filled with worst-case entries
+// (those with names of length maxNameBytes) still fits within the
+// max block size.  Should not be called while this splitter is in
+// use.
+func (b *BlockSplitterSimple) SetMaxDirEntriesByBlockSize(
+	codec Codec, maxNameBytes uint32) error {
+	info, err := makeWorstCaseBlockInfo()
+	if err != nil {
+		return err
+	}
+	de := DirEntry{
+		BlockInfo: info,
+		EntryInfo: EntryInfo{
+			Type:  Exec,
+			Size:  1 << 63,
+			Mtime: 1 << 62,
+			Ctime: 1 << 62,
+		},
+	}
+	name := strings.Repeat("a", int(maxNameBytes))
+
+	block := NewDirBlock().(*DirBlock)
+	emptyBuf, err := codec.Encode(block)
+	if err != nil {
+		return err
+	}
+	block.Children[name] = de
+	fullBuf, err := codec.Encode(block)
+	if err != nil {
+		return err
+	}
+
+	entrySize := int64(len(fullBuf) - len(emptyBuf))
+	maxEntries := (b.maxSize - int64(len(emptyBuf))) / entrySize
+	if maxEntries < 2 {
+		return fmt.Errorf("Max block size %d is too small to hold more "+
+			"than one directory entry of size %d", b.maxSize, entrySize)
+	}
+	b.maxDirEntriesPerBlock = int(maxEntries)
+	return nil
+}
+
 // CopyUntilSplit implements the BlockSplitter interface for
 // BlockSplitterSimple.
 func (b *BlockSplitterSimple) CopyUntilSplit(
@@ -119,6 +225,55 @@ func (b *BlockSplitterSimple) CheckSplit(block *FileBlock) int64 {
 	return 0
 }
 
+// MaxPtrsPerBlock implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) MaxPtrsPerBlock() int {
+	return b.maxPtrsPerBlock
+}
+
+// SplitDirIfNeeded implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) SplitDirIfNeeded(block *DirBlock) []string {
+	n := len(block.Children)
+	if b.maxDirEntriesPerBlock == 0 || n <= b.maxDirEntriesPerBlock {
+		return nil
+	}
+
+	names := make([]string, 0, n)
+	for name := range block.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Leave each new block about half full, so that it can absorb a
+	// few new entries before it needs to be split again.
+	numBlocks := 2 * n / b.maxDirEntriesPerBlock
+	var splits []string
+	for i := 1; i < numBlocks; i++ {
+		splits = append(splits, names[i*n/numBlocks])
+	}
+	return splits
+}
+
+// ShouldMergeDirBlocks implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) ShouldMergeDirBlocks(
+	left, right *DirBlock) bool {
+	if b.maxDirEntriesPerBlock == 0 {
+		return true
+	}
+	// Only merge when the result would be at most half full, to
+	// avoid flip-flopping between splitting and merging.
+	return len(left.Children)+len(right.Children) <=
+		b.maxDirEntriesPerBlock/2
+}
+
+// MaxSize implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) MaxSize() int64 {
+	return b.blockSize
+}
+
 // ShouldEmbedBlockChanges implements the BlockSplitter interface for
 // BlockSplitterSimple.
 func (b *BlockSplitterSimple) ShouldEmbedBlockChanges(
@@ -6,11 +6,12 @@ package libkbfs
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 )
 
 func TestBsplitterEmptyCopyAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{10, 10, 0, 0, 10}
 	fblock := NewFileBlock().(*FileBlock)
 	data := []byte{1, 2, 3, 4, 5}
 
@@ -22,7 +23,7 @@ func TestBsplitterEmptyCopyAll(t *testing.T) {
 }
 
 func TestBsplitterNonemptyCopyAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{10, 10, 0, 0, 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9}
 	data := []byte{1, 2, 3, 4, 5}
@@ -35,7 +36,7 @@ func TestBsplitterNonemptyCopyAll(t *testing.T) {
 }
 
 func TestBsplitterAppendAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{10, 10, 0, 0, 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9}
 	data := []byte{1, 2, 3, 4, 5}
@@ -48,7 +49,7 @@ func TestBsplitterAppendAll(t *testing.T) {
 }
 
 func TestBsplitterAppendExact(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{10, 10, 0, 0, 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5}
@@ -62,7 +63,7 @@ func TestBsplitterAppendExact(t *testing.T) {
 }
 
 func TestBsplitterSplitOne(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{10, 10, 0, 0, 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -76,7 +77,7 @@ func TestBsplitterSplitOne(t *testing.T) {
 }
 
 func TestBsplitterOverwriteMaxSizeBlock(t *testing.T) {
-	bsplit := &BlockSplitterSimple{5, 10}
+	bsplit := &BlockSplitterSimple{5, 10, 0, 0, 5}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
@@ -89,7 +90,7 @@ func TestBsplitterOverwriteMaxSizeBlock(t *testing.T) {
 }
 
 func TestBsplitterBlockTooBig(t *testing.T) {
-	bsplit := &BlockSplitterSimple{3, 10}
+	bsplit := &BlockSplitterSimple{3, 10, 0, 0, 3}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -102,7 +103,7 @@ func TestBsplitterBlockTooBig(t *testing.T) {
 }
 
 func TestBsplitterOffTooBig(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{10, 10, 0, 0, 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -116,7 +117,7 @@ func TestBsplitterOffTooBig(t *testing.T) {
 }
 
 func TestBsplitterShouldEmbed(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{10, 10, 0, 0, 10}
 	bc := &BlockChanges{}
 	bc.sizeEstimate = 1
 	if !bsplit.ShouldEmbedBlockChanges(bc) {
@@ -129,7 +130,7 @@ func TestBsplitterShouldEmbed(t *testing.T) {
 }
 
 func TestBsplitterShouldNotEmbed(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{10, 10, 0, 0, 10}
 	bc := &BlockChanges{}
 	bc.sizeEstimate = 11
 	if bsplit.ShouldEmbedBlockChanges(bc) {
@@ -166,3 +167,73 @@ func TestBsplitterOverhead(t *testing.T) {
 			g, e)
 	}
 }
+
+func TestBsplitterMaxPtrsPerBlock(t *testing.T) {
+	codec := NewCodecMsgpack()
+	desiredBlockSize := int64(64 * 1024)
+	bsplit, err := NewBlockSplitterSimple(desiredBlockSize, 8*1024, codec)
+	if err != nil {
+		t.Fatalf("Got error making block splitter: %v", err)
+	}
+
+	info, err := makeWorstCaseBlockInfo()
+	if err != nil {
+		t.Fatalf("Couldn't make block info: %v", err)
+	}
+	block := &FileBlock{CommonBlock: CommonBlock{IsInd: true}}
+	for i := 0; i < bsplit.MaxPtrsPerBlock(); i++ {
+		block.IPtrs = append(block.IPtrs,
+			IndirectFilePtr{BlockInfo: info, Off: 1 << 62})
+	}
+	encodedBlock, err := codec.Encode(block)
+	if err != nil {
+		t.Fatalf("Encoding block failed: %v", err)
+	}
+	if g, e := int64(len(encodedBlock)), desiredBlockSize; g > e {
+		t.Fatalf("Full indirect block size %d is bigger than the desired "+
+			"block size %d", g, e)
+	}
+
+	// A small block size still allows for a tree of blocks.
+	bsplit, err = NewBlockSplitterSimple(20, 8*1024, codec)
+	if err != nil {
+		t.Fatalf("Got error making block splitter: %v", err)
+	}
+	if g, e := bsplit.MaxPtrsPerBlock(), 2; g != e {
+		t.Fatalf("Got max ptrs %d, expected %d", g, e)
+	}
+}
+
+func TestBsplitterSplitDir(t *testing.T) {
+	bsplit := &BlockSplitterSimple{10, 10, 4, 0, 10}
+	block := NewDirBlock().(*DirBlock)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		block.Children[name] = DirEntry{}
+	}
+	if splits := bsplit.SplitDirIfNeeded(block); splits != nil {
+		t.Errorf("Unexpected splits for a full block: %v", splits)
+	}
+
+	for _, name := range []string{"e", "f", "g", "h"} {
+		block.Children[name] = DirEntry{}
+	}
+	splits := bsplit.SplitDirIfNeeded(block)
+	if !reflect.DeepEqual(splits, []string{"c", "e", "g"}) {
+		t.Errorf("Unexpected splits: %v", splits)
+	}
+}
+
+func TestBsplitterMergeDirBlocks(t *testing.T) {
+	bsplit := &BlockSplitterSimple{10, 10, 4, 0, 10}
+	left := NewDirBlock().(*DirBlock)
+	right := NewDirBlock().(*DirBlock)
+	left.Children["a"] = DirEntry{}
+	right.Children["b"] = DirEntry{}
+	if !bsplit.ShouldMergeDirBlocks(left, right) {
+		t.Errorf("Not merging two small blocks")
+	}
+	right.Children["c"] = DirEntry{}
+	if bsplit.ShouldMergeDirBlocks(left, right) {
+		t.Errorf("Merging blocks that are too big")
+	}
+}
@@ -16,9 +16,8 @@ import (
 )
 
 const (
-	// Max supported plaintext size of a file in KBFS.  TODO: increase
-	// this once we support multiple levels of indirection.
-	maxFileBytesDefault = 2 * 1024 * 1024 * 1024
+	// Max supported plaintext size of a file in KBFS.
+	maxFileBytesDefault = 1024 * 1024 * 1024 * 1024
 	// Max supported size of a directory entry name.
 	maxNameBytesDefault = 255
 	// Maximum supported plaintext size of a directory in KBFS. TODO:
@@ -34,6 +33,18 @@ const (
 	qrUnrefAgeDefault = 1 * time.Minute
 	// tlfValidDurationDefault is the default for tlf validity before redoing identify.
 	tlfValidDurationDefault = 6 * time.Hour
+	// How many blocks to prefetch ahead of sequential file reads.
+	readAheadBlocksDefault = 8
+	// Bounds on the dirty-data budget.  The minimum is what can be
+	// uploaded by one round of parallel block puts.
+	dirtyBudgetMinBytesDefault = maxParallelBlockPuts * (512 << 10)
+	dirtyBudgetMaxBytesDefault = 10 * dirtyBudgetMinBytesDefault
+	// How long syncing the dirty-data budget should take, at the
+	// measured upload throughput.
+	dirtyBudgetSyncTimeDefault = 5 * time.Second
+	// The biggest file whose conflicting versions get merged, in
+	// the folders where merging is enabled.
+	mergeMaxBytesDefault = 1 << 20
 )
 
 // ConfigLocal implements the Config interface using purely local
@@ -45,6 +56,8 @@ type ConfigLocal struct {
 	rep         Reporter
 	kcache      KeyCache
 	bcache      BlockCache
+	dbcache     DiskBlockCache
+	dmcache     DiskMDCache
 	codec       Codec
 	mdops       MDOps
 	kops        KeyOps
@@ -60,17 +73,25 @@ type ConfigLocal struct {
 	clock       Clock
 	kbpki       KBPKI
 	renamer     ConflictRenamer
+	merger      ContentMerger
 	registry    metrics.Registry
 	loggerFn    func(prefix string) logger.Logger
 	noBGFlush   bool // logic opposite so the default value is the common setting
 	rwpWaitTime time.Duration
 
+	readAheadBlocks int
+	dirPrefetch     bool
+	mdBatchWindow   time.Duration
+	mdBatchBytes    uint64
+
 	sharingBeforeSignupEnabled bool
 
 	maxFileBytes uint64
 	maxNameBytes uint32
 	maxDirBytes  uint64
 	rekeyQueue   RekeyQueue
+	tscheduler   TransferScheduler
+	dirtyBudget  DirtyBudget
 
 	qrPeriod   time.Duration
 	qrUnrefAge time.Duration
@@ -191,6 +212,7 @@ func NewConfigLocal() *ConfigLocal {
 	config.SetClock(wallClock{})
 	config.SetReporter(NewReporterSimple(config.Clock(), 10))
 	config.SetConflictRenamer(WriterDeviceDateConflictRenamer{config})
+	config.SetContentMerger(NewContentMergerStandard())
 	config.ResetCaches()
 	config.SetCodec(NewCodecMsgpack())
 	config.SetBlockOps(&BlockOpsStandard{config})
@@ -201,6 +223,7 @@ func NewConfigLocal() *ConfigLocal {
 	config.maxNameBytes = maxNameBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
+	config.readAheadBlocks = readAheadBlocksDefault
 
 	config.qrPeriod = qrPeriodDefault
 	config.qrUnrefAge = qrUnrefAgeDefault
@@ -213,6 +236,13 @@ func NewConfigLocal() *ConfigLocal {
 
 	config.tlfValidDuration = tlfValidDurationDefault
 
+	// This needs the metrics registry, so it has to come after it.
+	config.SetTransferScheduler(
+		NewTransferSchedulerStandard(config, maxParallelBlockPuts, 0, 0))
+	config.SetDirtyBudget(NewDirtyBudgetStandard(config,
+		dirtyBudgetMinBytesDefault, dirtyBudgetMaxBytesDefault,
+		dirtyBudgetSyncTimeDefault))
+
 	return config
 }
 
@@ -300,6 +330,34 @@ func (c *ConfigLocal) SetBlockCache(b BlockCache) {
 	c.bcache = b
 }
 
+// DiskBlockCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DiskBlockCache() DiskBlockCache {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.dbcache
+}
+
+// SetDiskBlockCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDiskBlockCache(d DiskBlockCache) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dbcache = d
+}
+
+// DiskMDCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DiskMDCache() DiskMDCache {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.dmcache
+}
+
+// SetDiskMDCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDiskMDCache(d DiskMDCache) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dmcache = d
+}
+
 // Crypto implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) Crypto() Crypto {
 	c.lock.RLock()
@@ -497,6 +555,20 @@ func (c *ConfigLocal) SetConflictRenamer(cr ConflictRenamer) {
 	c.renamer = cr
 }
 
+// ContentMerger implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ContentMerger() ContentMerger {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.merger
+}
+
+// SetContentMerger implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetContentMerger(cm ContentMerger) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.merger = cm
+}
+
 // MetadataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) MetadataVersion() MetadataVer {
 	return InitialExtraMetadataVer
@@ -504,7 +576,7 @@ func (c *ConfigLocal) MetadataVersion() MetadataVer {
 
 // DataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DataVersion() DataVer {
-	return 1
+	return IndirectDirsDataVer
 }
 
 // DoBackgroundFlushes implements the Config interface for ConfigLocal.
@@ -512,6 +584,60 @@ func (c *ConfigLocal) DoBackgroundFlushes() bool {
 	return !c.noBGFlush
 }
 
+// ReadAheadBlocks implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ReadAheadBlocks() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.readAheadBlocks
+}
+
+// SetReadAheadBlocks sets how many of the following blocks of a file
+// to prefetch once the file is being read sequentially.
+func (c *ConfigLocal) SetReadAheadBlocks(readAheadBlocks int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readAheadBlocks = readAheadBlocks
+}
+
+// DoDirPrefetch implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DoDirPrefetch() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.dirPrefetch
+}
+
+// SetDoDirPrefetch sets whether to prefetch the blocks of the
+// subdirectories of a directory when it is listed.
+func (c *ConfigLocal) SetDoDirPrefetch(dirPrefetch bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dirPrefetch = dirPrefetch
+}
+
+// MDBatchWindow implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MDBatchWindow() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.mdBatchWindow
+}
+
+// MDBatchBytes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MDBatchBytes() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.mdBatchBytes
+}
+
+// SetMDBatching sets how long local changes may be gathered into a
+// single MD revision, and how many bytes of new blocks the revision
+// may reference, before it is put to the MD server.
+func (c *ConfigLocal) SetMDBatching(window time.Duration, maxBytes uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.mdBatchWindow = window
+	c.mdBatchBytes = maxBytes
+}
+
 // RekeyWithPromptWaitTime implements the Config interface for
 // ConfigLocal.
 func (c *ConfigLocal) RekeyWithPromptWaitTime() time.Duration {
@@ -624,6 +750,34 @@ func (c *ConfigLocal) RekeyQueue() RekeyQueue {
 	return c.rekeyQueue
 }
 
+// TransferScheduler implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) TransferScheduler() TransferScheduler {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tscheduler
+}
+
+// SetTransferScheduler implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetTransferScheduler(s TransferScheduler) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tscheduler = s
+}
+
+// DirtyBudget implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DirtyBudget() DirtyBudget {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.dirtyBudget
+}
+
+// SetDirtyBudget implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDirtyBudget(b DirtyBudget) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dirtyBudget = b
+}
+
 // SetMetricsRegistry implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) SetMetricsRegistry(r metrics.Registry) {
 	c.registry = r
@@ -665,6 +819,12 @@ func (c *ConfigLocal) Shutdown() error {
 	c.KeyServer().Shutdown()
 	c.KeybaseDaemon().Shutdown()
 	c.BlockServer().Shutdown()
+	if dbcache := c.DiskBlockCache(); dbcache != nil {
+		dbcache.Shutdown()
+	}
+	if dmcache := c.DiskMDCache(); dmcache != nil {
+		dmcache.Shutdown()
+	}
 	c.Crypto().Shutdown()
 	c.Reporter().Shutdown()
 	return err
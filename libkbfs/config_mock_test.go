@@ -109,6 +109,14 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.SetClock(config.mockClock)
 	config.mockRekeyQueue = NewMockRekeyQueue(c)
 	config.SetRekeyQueue(config.mockRekeyQueue)
+	// No folders have content merging enabled.
+	config.SetContentMerger(NewContentMergerStandard())
+	// Block puts go straight through, without any limits to mock.
+	config.SetTransferScheduler(
+		NewTransferSchedulerStandard(config, maxParallelBlockPuts, 0, 0))
+	config.SetDirtyBudget(NewDirtyBudgetStandard(config,
+		dirtyBudgetMinBytesDefault, dirtyBudgetMaxBytesDefault,
+		dirtyBudgetSyncTimeDefault))
 	config.observer = &FakeObserver{}
 	config.ctr = ctr
 	config.SetLoggerMaker(func(m string) logger.Logger {
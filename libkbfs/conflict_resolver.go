@@ -423,7 +423,7 @@ func (cr *ConflictResolver) checkPathForMerge(ctx context.Context,
 	mergedCreates := make(map[string]*createOp)
 	for _, op := range mergedChain.ops {
 		cop, ok := op.(*createOp)
-		if !ok || len(cop.Refs()) == 0 || cop.renamed {
+		if !ok || len(cop.Refs()) == 0 || cop.renamed || cop.copied {
 			continue
 		}
 		mergedCreates[cop.NewName] = cop
@@ -437,7 +437,9 @@ func (cr *ConflictResolver) checkPathForMerge(ctx context.Context,
 	toDrop := make(map[int]bool)
 	for i, op := range unmergedChain.ops {
 		cop, ok := op.(*createOp)
-		if !ok || len(cop.Refs()) == 0 || cop.renamed {
+		// A copied file's contents can't be merged with another
+		// file's, since they didn't come from syncs.
+		if !ok || len(cop.Refs()) == 0 || cop.renamed || cop.copied {
 			continue
 		}
 
@@ -577,8 +579,18 @@ func (cr *ConflictResolver) addChildBlocksIfIndirectFile(ctx context.Context,
 	if fblock.IsInd {
 		cr.log.CDebugf(ctx, "Adding child pointers for recreated "+
 			"file %s", currPath)
-		for _, ptr := range fblock.IPtrs {
-			op.AddRefBlock(ptr.BlockPointer)
+		file := path{
+			FolderBranch: currPath.FolderBranch,
+			path: []pathNode{{
+				BlockPointer: mostRecent, Name: currPath.tailName()}},
+		}
+		infos, err := cr.fbo.blocks.GetIndirectFileBlockInfos(ctx, lState,
+			unmergedChains.mostRecentMD, file)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			op.AddRefBlock(info.BlockPointer)
 		}
 	}
 	return nil
@@ -1621,6 +1633,36 @@ func (cr *ConflictResolver) addMergedRecreates(ctx context.Context,
 	return nil
 }
 
+// canMergeContents returns whether the folder's ContentMerger should
+// try to merge the conflicting writes to the file with the given
+// chains.  That's only the case if the folder has merging enabled,
+// and the file existed before the branches split and was only
+// written to in both of them.
+func (cr *ConflictResolver) canMergeContents(unmergedChains *crChains,
+	mergedChains *crChains, unmergedChain *crChain,
+	mergedChain *crChain) bool {
+	if mergedChain == nil ||
+		cr.config.ContentMerger().MaxMergeBytes(
+			mergedChains.mostRecentMD.GetTlfHandle()) == 0 {
+		return false
+	}
+	if unmergedChains.isCreated(unmergedChain.original) ||
+		mergedChains.isCreated(mergedChain.original) {
+		return false
+	}
+	for _, chain := range []*crChain{unmergedChain, mergedChain} {
+		if len(chain.ops) == 0 {
+			return false
+		}
+		for _, op := range chain.ops {
+			if _, ok := op.(*syncOp); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // getActionsToMerge returns the set of actions needed to merge each
 // unmerged chain of operations, in a map keyed by the tail pointer of
 // the corresponding merged path.
@@ -1651,6 +1693,24 @@ func (cr *ConflictResolver) getActionsToMerge(unmergedChains *crChains,
 			return nil, err
 		}
 
+		// Try merging the contents of files written in both
+		// branches before renaming them.
+		if cr.canMergeContents(unmergedChains, mergedChains,
+			unmergedChain, mergedChain) {
+			for i, action := range actions {
+				rua, ok := action.(*renameUnmergedAction)
+				if !ok {
+					continue
+				}
+				actions[i] = &mergeUnmergedAction{
+					fromName: rua.fromName,
+					toName:   mergedPath.tailName(),
+					base:     original,
+					rename:   rua,
+				}
+			}
+		}
+
 		if len(actions) > 0 {
 			actionMap[mergedPath.tailPointer()] = actions
 		}
@@ -1754,6 +1814,11 @@ func (cr *ConflictResolver) fetchDirBlockCopy(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
+	// Resolution may touch any entry, so load them all.
+	err = cr.fbo.blocks.LoadAllDirEntries(ctx, lState, md, dir, dblock)
+	if err != nil {
+		return nil, err
+	}
 	lbc[ptr] = dblock
 	return dblock, nil
 }
@@ -1820,29 +1885,431 @@ func (cr *ConflictResolver) makeFileBlockDeepCopy(ctx context.Context,
 		blocks[mergedMostRecent] = make(map[string]*FileBlock)
 	}
 
-	// Dup all of the leaf blocks.
-	// TODO: deal with multiple levels of indirection.
+	// Dup all of the child blocks.
 	if fblock.IsInd {
-		for i, iptr := range fblock.IPtrs {
-			if newlyCreated {
-				chains.toUnrefPointers[iptr.BlockPointer] = true
-			}
+		err := cr.deepCopyFileChildren(ctx, lState, chains,
+			parentPath.ChildPath(name, ptr), fblock, newlyCreated, uid)
+		if err != nil {
+			return BlockPointer{}, err
+		}
+	}
+
+	blocks[mergedMostRecent][name] = fblock
+	return newPtr, nil
+}
+
+// deepCopyFileChildren makes new references for all the children of
+// the given copy of an indirect file block.  Leaf blocks just get new
+// nonces, while indirect blocks are copied as well, and cached as
+// dirty under temporary IDs until syncTree readies them.
+func (cr *ConflictResolver) deepCopyFileChildren(ctx context.Context,
+	lState *lockState, chains *crChains, file path, fblock *FileBlock,
+	newlyCreated bool, uid keybase1.UID) error {
+	md := chains.mostRecentMD
+	// All leaf blocks are at the same depth, so the first child
+	// tells us whether the children are leaves.
+	child, err := cr.fbo.blocks.GetFileBlockForReading(ctx, lState, md,
+		fblock.IPtrs[0].BlockPointer, file.Branch, file)
+	if err != nil {
+		return err
+	}
+	childrenAreLeaves := !child.IsInd
+
+	for i, iptr := range fblock.IPtrs {
+		if newlyCreated {
+			chains.toUnrefPointers[iptr.BlockPointer] = true
+		}
 
+		if childrenAreLeaves {
 			// Generate a new nonce for each one.
 			iptr.RefNonce, err = cr.config.Crypto().MakeBlockRefNonce()
 			if err != nil {
-				return BlockPointer{}, err
+				return err
 			}
 			iptr.SetWriter(uid)
 			fblock.IPtrs[i] = iptr
 			chains.createdOriginals[iptr.BlockPointer] = true
+			continue
+		}
+
+		child, err := cr.fbo.blocks.GetFileBlockForReading(ctx, lState, md,
+			iptr.BlockPointer, file.Branch, file)
+		if err != nil {
+			return err
+		}
+		child, err = child.DeepCopy(cr.config.Codec())
+		if err != nil {
+			return err
+		}
+		err = cr.deepCopyFileChildren(
+			ctx, lState, chains, file, child, newlyCreated, uid)
+		if err != nil {
+			return err
 		}
+		newID, err := cr.config.Crypto().MakeTemporaryBlockID()
+		if err != nil {
+			return err
+		}
+		newPtr := BlockPointer{
+			ID:       newID,
+			KeyGen:   md.LatestKeyGeneration(),
+			DataVer:  cr.config.DataVersion(),
+			Creator:  uid,
+			RefNonce: zeroBlockRefNonce,
+		}
+		err = cr.config.BlockCache().PutDirty(newPtr, file.Branch, child)
+		if err != nil {
+			return err
+		}
+		fblock.IPtrs[i].BlockInfo = BlockInfo{BlockPointer: newPtr}
 	}
+	return nil
+}
 
-	blocks[mergedMostRecent][name] = fblock
+// readyFileChildren readies the indirect children of the given
+// indirect file block copy that were cached as dirty by
+// deepCopyFileChildren, and makes sure a new reference is made for
+// every child block.  All the new blocks are added to bps.
+func (cr *ConflictResolver) readyFileChildren(ctx context.Context,
+	md *RootMetadata, uid keybase1.UID, branch BranchName,
+	fblock *FileBlock, bps *blockPutState) error {
+	bcache := cr.config.BlockCache()
+	for i, iptr := range fblock.IPtrs {
+		if !bcache.IsDirty(iptr.BlockPointer, branch) {
+			bps.addNewBlock(iptr.BlockPointer, nil, ReadyBlockData{})
+			// TODO: add block updates to the op chain for these guys
+			// (need encoded size!)
+			md.AddRefBlock(iptr.BlockInfo)
+			continue
+		}
+
+		block, err := bcache.Get(iptr.BlockPointer, branch)
+		if err != nil {
+			return err
+		}
+		child, ok := block.(*FileBlock)
+		if !ok {
+			return NotFileBlockError{iptr.BlockPointer, branch, path{}}
+		}
+		err = cr.readyFileChildren(ctx, md, uid, branch, child, bps)
+		if err != nil {
+			return err
+		}
+		newInfo, _, readyBlockData, err :=
+			cr.fbo.blocks.ReadyFileChildBlock(ctx, md, child, uid)
+		if err != nil {
+			return err
+		}
+		if err := bcache.DeleteDirty(iptr.BlockPointer, branch); err != nil {
+			return err
+		}
+		fblock.IPtrs[i].BlockInfo = newInfo
+		md.AddRefBlock(newInfo)
+		bps.addNewBlock(newInfo.BlockPointer, child, readyBlockData)
+	}
+	return nil
+}
+
+// putDirtyFileBlock caches the given new file block as dirty, under
+// a new temporary ID, until syncTree readies it.
+func (cr *ConflictResolver) putDirtyFileBlock(md *RootMetadata,
+	uid keybase1.UID, branch BranchName, block *FileBlock) (
+	BlockPointer, error) {
+	newID, err := cr.config.Crypto().MakeTemporaryBlockID()
+	if err != nil {
+		return BlockPointer{}, err
+	}
+	newPtr := BlockPointer{
+		ID:       newID,
+		KeyGen:   md.LatestKeyGeneration(),
+		DataVer:  cr.config.DataVersion(),
+		Creator:  uid,
+		RefNonce: zeroBlockRefNonce,
+	}
+	err = cr.config.BlockCache().PutDirty(newPtr, branch, block)
+	if err != nil {
+		return BlockPointer{}, err
+	}
 	return newPtr, nil
 }
 
+// makeAppendedFileCopy makes a deep copy of the given merged file,
+// and adds to its end the data of the given unmerged file from off
+// on.  The new blocks are cached as dirty under temporary IDs until
+// syncTree readies them, like the ones made by deepCopyFileChildren.
+// It returns the pointers of the merged file's child blocks, which
+// the copy doesn't use anymore.
+func (cr *ConflictResolver) makeAppendedFileCopy(ctx context.Context,
+	lState *lockState, unmergedChains *crChains, mergedChains *crChains,
+	unmergedPath path, mergedPath path, fromName string,
+	unmergedEntry DirEntry, off uint64, toName string,
+	mergedEntry DirEntry, blocks fileBlockMap) ([]BlockPointer, error) {
+	data := make([]byte, unmergedEntry.Size-off)
+	n, err := cr.fbo.blocks.Read(ctx, lState, unmergedChains.mostRecentMD,
+		unmergedPath.ChildPath(fromName, unmergedEntry.BlockPointer),
+		data, int64(off))
+	if err != nil {
+		return nil, err
+	}
+	if n != int64(len(data)) {
+		return nil, fmt.Errorf("Read only %d of the %d bytes appended to %s",
+			n, len(data), fromName)
+	}
+
+	md := mergedChains.mostRecentMD
+	mergedFile := mergedPath.ChildPath(toName, mergedEntry.BlockPointer)
+	infos, err := cr.fbo.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, md, mergedFile)
+	if err != nil {
+		return nil, err
+	}
+	unrefs := make([]BlockPointer, len(infos))
+	for i, info := range infos {
+		unrefs[i] = info.BlockPointer
+	}
+
+	_, err = cr.makeFileBlockDeepCopy(ctx, lState, mergedChains,
+		mergedPath.tailPointer(), mergedPath, toName,
+		mergedEntry.BlockPointer, blocks)
+	if err != nil {
+		return nil, err
+	}
+	fblock := blocks[mergedPath.tailPointer()][toName]
+
+	_, uid, err := cr.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bcache := cr.config.BlockCache()
+	bsplit := cr.config.BlockSplitter()
+	branch := mergedPath.Branch
+	putNewBlock := func(block *FileBlock) (BlockPointer, error) {
+		return cr.putDirtyFileBlock(md, uid, branch, block)
+	}
+
+	if !fblock.IsInd {
+		nCopied := bsplit.CopyUntilSplit(
+			fblock, true, data, int64(len(fblock.Contents)))
+		data = data[nCopied:]
+		if len(data) == 0 {
+			return unrefs, nil
+		}
+
+		// The data doesn't fit in one block, so the old contents
+		// become the first child of a new top block.
+		ptr, err := putNewBlock(fblock)
+		if err != nil {
+			return nil, err
+		}
+		top := NewFileBlock().(*FileBlock)
+		top.IsInd = true
+		top.IPtrs = []IndirectFilePtr{{
+			BlockInfo: BlockInfo{BlockPointer: ptr},
+			Off:       0,
+		}}
+		fblock = top
+		blocks[mergedPath.tailPointer()][toName] = fblock
+	}
+
+	// New leaves go into the right-most indirect block at the
+	// lowest level; the copied indirect blocks on the way there are
+	// already dirty.
+	parent := fblock
+	for {
+		iptr := parent.IPtrs[len(parent.IPtrs)-1]
+		if !bcache.IsDirty(iptr.BlockPointer, branch) {
+			break
+		}
+		block, err := bcache.Get(iptr.BlockPointer, branch)
+		if err != nil {
+			return nil, err
+		}
+		child, ok := block.(*FileBlock)
+		if !ok {
+			return nil, NotFileBlockError{iptr.BlockPointer, branch, mergedFile}
+		}
+		if !child.IsInd {
+			break
+		}
+		parent = child
+	}
+
+	size := int64(mergedEntry.Size)
+	for len(data) > 0 {
+		leaf := NewFileBlock().(*FileBlock)
+		nCopied := bsplit.CopyUntilSplit(leaf, true, data, 0)
+		ptr, err := putNewBlock(leaf)
+		if err != nil {
+			return nil, err
+		}
+		parent.IPtrs = append(parent.IPtrs, IndirectFilePtr{
+			BlockInfo: BlockInfo{BlockPointer: ptr},
+			Off:       size,
+		})
+		size += nCopied
+		data = data[nCopied:]
+	}
+	return unrefs, nil
+}
+
+// readFileForMerge reads the whole file at the given path, unless
+// it's bigger than maxBytes, in which case it returns false.
+func (cr *ConflictResolver) readFileForMerge(ctx context.Context,
+	lState *lockState, md *RootMetadata, file path, maxBytes uint64) (
+	[]byte, bool, error) {
+	const chunkSize = 64 << 10
+	var data []byte
+	for {
+		chunk := make([]byte, chunkSize)
+		n, err := cr.fbo.blocks.Read(
+			ctx, lState, md, file, chunk, int64(len(data)))
+		if err != nil {
+			return nil, false, err
+		}
+		data = append(data, chunk[:n]...)
+		if uint64(len(data)) > maxBytes {
+			return nil, false, nil
+		}
+		if n < chunkSize {
+			return data, true, nil
+		}
+	}
+}
+
+// makeFileBlocks makes a new file with the given contents, and
+// returns its top block.  Any other blocks are cached as dirty under
+// temporary IDs until syncTree readies them.
+func (cr *ConflictResolver) makeFileBlocks(md *RootMetadata,
+	uid keybase1.UID, branch BranchName, data []byte) (*FileBlock, error) {
+	bsplit := cr.config.BlockSplitter()
+	top := NewFileBlock().(*FileBlock)
+	if bsplit.CopyUntilSplit(top, true, data, 0) == int64(len(data)) {
+		return top, nil
+	}
+
+	var iptrs []IndirectFilePtr
+	for off := int64(0); off < int64(len(data)); {
+		leaf := NewFileBlock().(*FileBlock)
+		nCopied := bsplit.CopyUntilSplit(leaf, true, data[off:], 0)
+		ptr, err := cr.putDirtyFileBlock(md, uid, branch, leaf)
+		if err != nil {
+			return nil, err
+		}
+		iptrs = append(iptrs, IndirectFilePtr{
+			BlockInfo: BlockInfo{BlockPointer: ptr},
+			Off:       off,
+		})
+		off += nCopied
+	}
+
+	// Add levels of indirect blocks until the pointers fit in the
+	// top block.
+	maxPtrs := bsplit.MaxPtrsPerBlock()
+	for maxPtrs > 0 && len(iptrs) > maxPtrs {
+		var parentPtrs []IndirectFilePtr
+		for i := 0; i < len(iptrs); i += maxPtrs {
+			end := i + maxPtrs
+			if end > len(iptrs) {
+				end = len(iptrs)
+			}
+			parent := NewFileBlock().(*FileBlock)
+			parent.IsInd = true
+			parent.IPtrs = append([]IndirectFilePtr(nil), iptrs[i:end]...)
+			ptr, err := cr.putDirtyFileBlock(md, uid, branch, parent)
+			if err != nil {
+				return nil, err
+			}
+			parentPtrs = append(parentPtrs, IndirectFilePtr{
+				BlockInfo: BlockInfo{BlockPointer: ptr},
+				Off:       iptrs[i].Off,
+			})
+		}
+		iptrs = parentPtrs
+	}
+
+	top = NewFileBlock().(*FileBlock)
+	top.IsInd = true
+	top.IPtrs = iptrs
+	return top, nil
+}
+
+// makeMergedFileCopy tries to merge the contents of the given
+// unmerged and merged files, using the contents of the file at the
+// given base pointer (their common ancestor) and the folder's
+// ContentMerger.  If they merge cleanly, it makes a new copy of the
+// merged file with the merged contents, and returns the pointers of
+// the merged file's child blocks, which the copy doesn't use
+// anymore, along with the size of the copy.  Otherwise, it returns
+// false.
+func (cr *ConflictResolver) makeMergedFileCopy(ctx context.Context,
+	lState *lockState, unmergedChains *crChains, mergedChains *crChains,
+	unmergedPath path, mergedPath path, fromName string,
+	unmergedEntry DirEntry, base BlockPointer, toName string,
+	mergedEntry DirEntry, blocks fileBlockMap) (
+	[]BlockPointer, uint64, bool, error) {
+	md := mergedChains.mostRecentMD
+	merger := cr.config.ContentMerger()
+	maxBytes := merger.MaxMergeBytes(md.GetTlfHandle())
+	if unmergedEntry.Size > maxBytes || mergedEntry.Size > maxBytes {
+		cr.log.CDebugf(ctx, "Not merging %s: too big", fromName)
+		return nil, 0, false, nil
+	}
+
+	mergedFile := mergedPath.ChildPath(toName, mergedEntry.BlockPointer)
+	files := []struct {
+		md   *RootMetadata
+		file path
+	}{
+		{md, mergedPath.ChildPath(toName, base)},
+		{md, mergedFile},
+		{unmergedChains.mostRecentMD,
+			unmergedPath.ChildPath(fromName, unmergedEntry.BlockPointer)},
+	}
+	contents := make([][]byte, len(files))
+	for i, f := range files {
+		data, ok, err := cr.readFileForMerge(ctx, lState, f.md, f.file,
+			maxBytes)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if !ok {
+			cr.log.CDebugf(ctx, "Not merging %s: too big", fromName)
+			return nil, 0, false, nil
+		}
+		contents[i] = data
+	}
+	data, ok := merger.Merge(contents[0], contents[1], contents[2])
+	if !ok {
+		cr.log.CDebugf(ctx, "Couldn't merge %s", fromName)
+		return nil, 0, false, nil
+	}
+
+	infos, err := cr.fbo.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, md, mergedFile)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	unrefs := make([]BlockPointer, len(infos))
+	for i, info := range infos {
+		unrefs[i] = info.BlockPointer
+	}
+
+	_, uid, err := cr.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	fblock, err := cr.makeFileBlocks(md, uid, mergedPath.Branch, data)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	mergedMostRecent := mergedPath.tailPointer()
+	if _, ok := blocks[mergedMostRecent]; !ok {
+		blocks[mergedMostRecent] = make(map[string]*FileBlock)
+	}
+	blocks[mergedMostRecent][toName] = fblock
+	return unrefs, uint64(len(data)), true, nil
+}
+
 func (cr *ConflictResolver) doActions(ctx context.Context,
 	lState *lockState, unmergedChains *crChains, mergedChains *crChains,
 	unmergedPaths []path, mergedPaths map[BlockPointer]path,
@@ -1930,6 +2397,20 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 					mergedPath.tailPointer(), mergedPath, name,
 					ptr, newFileBlocks)
 			}
+			appender := func(ctx context.Context, fromName string,
+				unmergedEntry DirEntry, off uint64, toName string,
+				mergedEntry DirEntry) ([]BlockPointer, error) {
+				return cr.makeAppendedFileCopy(ctx, lState, unmergedChains,
+					mergedChains, unmergedPath, mergedPath, fromName,
+					unmergedEntry, off, toName, mergedEntry, newFileBlocks)
+			}
+			merger := func(ctx context.Context, fromName string,
+				unmergedEntry DirEntry, base BlockPointer, toName string,
+				mergedEntry DirEntry) ([]BlockPointer, uint64, bool, error) {
+				return cr.makeMergedFileCopy(ctx, lState, unmergedChains,
+					mergedChains, unmergedPath, mergedPath, fromName,
+					unmergedEntry, base, toName, mergedEntry, newFileBlocks)
+			}
 
 			// Execute each action and save the modified ops back into
 			// each chain.
@@ -1949,19 +2430,31 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 					} else {
 						// Fetch the specified one. Don't need to make
 						// a copy since this will just be a source
-						// block.
+						// block, unless its entries need to be
+						// loaded from its child blocks.
 						dBlock, err := cr.fbo.blocks.GetDirBlockForReading(ctx, lState,
 							mergedChains.mostRecentMD, newPtr,
 							mergedPath.Branch, path{})
 						if err != nil {
 							return err
 						}
+						if dBlock.IsInd {
+							dBlock, err = dBlock.DeepCopy(cr.config.Codec())
+							if err != nil {
+								return err
+							}
+							err = cr.fbo.blocks.LoadAllDirEntries(ctx, lState,
+								mergedChains.mostRecentMD, path{}, dBlock)
+							if err != nil {
+								return err
+							}
+						}
 						uBlock = dBlock
 					}
 				}
 
-				err = action.do(ctx, unmergedFetcher, mergedFetcher, uBlock,
-					mergedBlock)
+				err = action.do(ctx, unmergedFetcher, mergedFetcher, appender,
+					merger, uBlock, mergedBlock)
 				if err != nil {
 					return err
 				}
@@ -2036,13 +2529,15 @@ func (cr *ConflictResolver) makeRevertedOps(ctx context.Context,
 				renameOriginal, ok := renames[crRenameHelperKey{
 					chain.original, cop.NewName}]
 				if !ok {
-					if cop.crSymPath != "" || cop.Type == Sym {
+					if cop.crSymPath != "" || cop.Type == Sym ||
+						cop.Type == HardLink {
 						// For symlinks created by the CR process, we
 						// expect the rmOp to have been removed.  For
-						// existing symlinks that were simply moved,
-						// there is no benefit in combining their
-						// create and rm ops back together since there
-						// is no corresponding node.
+						// existing symlinks and hard links that were
+						// simply moved, there is no benefit in
+						// combining their create and rm ops back
+						// together since there is no corresponding
+						// node.
 						continue
 					}
 					return nil, fmt.Errorf("Couldn't find corresponding "+
@@ -2163,11 +2658,16 @@ func (cr *ConflictResolver) createResolvedMD(ctx context.Context,
 					return nil, err
 				}
 				if fblock.IsInd {
+					infos, err := cr.fbo.blocks.GetIndirectFileBlockInfos(
+						ctx, lState, unmergedChains.mostRecentMD, file)
+					if err != nil {
+						return nil, err
+					}
 					newCreateOp.RefBlocks = make([]BlockPointer,
-						len(fblock.IPtrs)+1)
+						len(infos)+1)
 					newCreateOp.RefBlocks[0] = cop.Refs()[0]
-					for j, iptr := range fblock.IPtrs {
-						newCreateOp.RefBlocks[j+1] = iptr.BlockPointer
+					for j, info := range infos {
+						newCreateOp.RefBlocks[j+1] = info.BlockPointer
 					}
 				}
 			}
@@ -2263,6 +2763,16 @@ func crFixOpPointers(oldOps []op, updates map[BlockPointer]BlockPointer,
 			ptrsToFix = append(ptrsToFix, &realOp.File)
 			// The leading resolutionOp will take care of the updates.
 			realOp.Updates = nil
+		case *linkOp:
+			updatesToFix = append(updatesToFix, &realOp.Dir, &realOp.Links,
+				&realOp.OldDir)
+			ptrsToFix = append(ptrsToFix, &realOp.Linked)
+			// The leading resolutionOp will take care of the updates.
+			realOp.Updates = nil
+		case *unlinkOp:
+			updatesToFix = append(updatesToFix, &realOp.Dir, &realOp.Links)
+			// The leading resolutionOp will take care of the updates.
+			realOp.Updates = nil
 		}
 
 		for _, update := range updatesToFix {
@@ -2470,6 +2980,20 @@ func (cr *ConflictResolver) syncTree(ctx context.Context, lState *lockState,
 			entryType = File // TODO: FIXME for Ex and Sym
 		}
 
+		// For an indirect file block, make sure a new reference
+		// is made for every child block, and that the copied
+		// indirect children are ready before the file block
+		// itself.
+		var childBps *blockPutState
+		if entryType != Dir && fblock.IsInd {
+			childBps = newBlockPutState(len(fblock.IPtrs))
+			err := cr.readyFileChildren(ctx, newMD, uid,
+				node.mergedPath.Branch, fblock, childBps)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// TODO: fix mtime and ctime?
 		_, _, bps, err := cr.fbo.syncBlockForConflictResolution(
 			ctx, lState, uid, newMD, block,
@@ -2479,17 +3003,8 @@ func (cr *ConflictResolver) syncTree(ctx context.Context, lState *lockState,
 			return nil, err
 		}
 
-		if entryType != Dir {
-			if fblock.IsInd {
-				// For an indirect file block, make sure a new
-				// reference is made for every child block.
-				for _, iptr := range fblock.IPtrs {
-					bps.addNewBlock(iptr.BlockPointer, nil, ReadyBlockData{})
-					// TODO: add block updates to the op chain for these guys
-					// (need encoded size!)
-					newMD.AddRefBlock(iptr.BlockInfo)
-				}
-			}
+		if childBps != nil {
+			bps.mergeOtherBps(childBps)
 		}
 
 		return bps, nil
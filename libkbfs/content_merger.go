@@ -0,0 +1,232 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxLineMergeEdits is the largest number of inserted and removed
+// lines that ContentMergerStandard looks for between two versions of
+// a file, which bounds the time and memory a merge can take.
+const maxLineMergeEdits = 1000
+
+// ContentMergerStandard implements the ContentMerger interface with
+// a line-by-line three-way merge of text files, like the one done by
+// diff3.  Files aren't merged in any folder until that folder is
+// enabled.  Folders are given by their canonical paths, like
+// /keybase/private/alice,bob.
+type ContentMergerStandard struct {
+	lock     sync.RWMutex
+	maxBytes map[string]uint64
+}
+
+var _ ContentMerger = (*ContentMergerStandard)(nil)
+
+// NewContentMergerStandard returns a new ContentMergerStandard,
+// without any folders enabled.
+func NewContentMergerStandard() *ContentMergerStandard {
+	return &ContentMergerStandard{
+		maxBytes: make(map[string]uint64),
+	}
+}
+
+// EnableForTlf makes conflicting changes to text files in the
+// top-level folder with the given canonical path get merged, as long
+// as none of the versions of the file is bigger than maxBytes.
+func (cm *ContentMergerStandard) EnableForTlf(
+	tlfPath string, maxBytes uint64) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.maxBytes[tlfPath] = maxBytes
+}
+
+// DisableForTlf goes back to renaming conflicting files in the
+// top-level folder with the given canonical path.
+func (cm *ContentMergerStandard) DisableForTlf(tlfPath string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	delete(cm.maxBytes, tlfPath)
+}
+
+// MaxMergeBytes implements the ContentMerger interface for
+// ContentMergerStandard.
+func (cm *ContentMergerStandard) MaxMergeBytes(h *TlfHandle) uint64 {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	return cm.maxBytes[h.GetCanonicalPath()]
+}
+
+// Merge implements the ContentMerger interface for
+// ContentMergerStandard.  Only UTF-8 text without NUL bytes is
+// merged, and only if the two sets of changes don't touch the same
+// or adjacent lines.
+func (cm *ContentMergerStandard) Merge(base, merged, unmerged []byte) (
+	[]byte, bool) {
+	for _, data := range [][]byte{base, merged, unmerged} {
+		if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+			return nil, false
+		}
+	}
+	lines, ok := mergeLines(
+		splitLines(base), splitLines(merged), splitLines(unmerged))
+	if !ok {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+	return buf.Bytes(), true
+}
+
+// splitLines splits the given text into lines, each of which keeps
+// its newline (except maybe the last one).
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, string(data[:i]))
+		data = data[i:]
+	}
+	return lines
+}
+
+// matchLines finds a longest common subsequence of the lines in a
+// and b, using Myers' algorithm.  It returns, for each line in a, the
+// index of the line in b it's matched with, or -1 if it isn't part
+// of the subsequence.  It returns false if a and b are too different
+// to be worth matching.
+func matchLines(a, b []string) ([]int, bool) {
+	n, m := len(a), len(b)
+	maxD := n + m
+	if maxD > maxLineMergeEdits {
+		maxD = maxLineMergeEdits
+	}
+
+	// v[off+k] is the furthest x reached on diagonal k = x - y;
+	// trace[d] keeps the values for diagonals -d..d after d edits.
+	off := maxD + 1
+	v := make([]int, 2*maxD+3)
+	var trace [][]int
+	found := false
+	for d := 0; d <= maxD && !found; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+	}
+	if !found {
+		return nil, false
+	}
+
+	matches := make([]int, n)
+	for i := range matches {
+		matches[i] = -1
+	}
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			matches[x] = y
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		matches[x] = y
+	}
+	return matches, true
+}
+
+func linesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeLines does a three-way merge of the changes from base to a
+// and from base to b.  The lines of base that are kept by both a and
+// b split the files into chunks, and each chunk is taken from
+// whichever side changed it; it returns false if both sides changed
+// the same chunk in different ways.
+func mergeLines(base, a, b []string) ([]string, bool) {
+	matchesA, ok := matchLines(base, a)
+	if !ok {
+		return nil, false
+	}
+	matchesB, ok := matchLines(base, b)
+	if !ok {
+		return nil, false
+	}
+
+	var lines []string
+	i, iA, iB := 0, 0, 0
+	for {
+		// Find the next line that's the same in all three.
+		j := i
+		for j < len(base) && (matchesA[j] < 0 || matchesB[j] < 0) {
+			j++
+		}
+		endA, endB := len(a), len(b)
+		if j < len(base) {
+			endA, endB = matchesA[j], matchesB[j]
+		}
+
+		chunkBase, chunkA, chunkB := base[i:j], a[iA:endA], b[iB:endB]
+		switch {
+		case linesEqual(chunkA, chunkBase):
+			lines = append(lines, chunkB...)
+		case linesEqual(chunkB, chunkBase), linesEqual(chunkA, chunkB):
+			lines = append(lines, chunkA...)
+		default:
+			return nil, false
+		}
+
+		if j == len(base) {
+			return lines, true
+		}
+		lines = append(lines, base[j])
+		i, iA, iB = j+1, endA+1, endB+1
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContentMergerStandardMerge(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+	tests := []struct {
+		name     string
+		merged   string
+		unmerged string
+		expected string
+		ok       bool
+	}{
+		{"separate changes", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n",
+			"A\nb\nc\nd\nE\n", true},
+		{"insert and delete", "a\nb\nx\nc\nd\ne\n", "a\nb\nc\nd\n",
+			"a\nb\nx\nc\nd\n", true},
+		{"same change", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n",
+			"a\nB\nc\nd\ne\n", true},
+		{"only one side", base, "a\nb\nc\nd\ne\nf", "a\nb\nc\nd\ne\nf",
+			true},
+		{"same line", "a\nB\nc\nd\ne\n", "a\nb2\nc\nd\ne\n", "", false},
+		{"adjacent lines", "a\nB\nc\nd\ne\n", "a\nb\nC\nd\ne\n", "",
+			false},
+		{"binary", "a\nb\x00\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "", false},
+	}
+
+	cm := NewContentMergerStandard()
+	for _, test := range tests {
+		data, ok := cm.Merge(
+			[]byte(base), []byte(test.merged), []byte(test.unmerged))
+		if ok != test.ok {
+			t.Errorf("%s: merge returned %t, expected %t",
+				test.name, ok, test.ok)
+		} else if ok && string(data) != test.expected {
+			t.Errorf("%s: merged %q, expected %q",
+				test.name, data, test.expected)
+		}
+	}
+}
+
+func TestContentMergerStandardTooManyEdits(t *testing.T) {
+	var base, merged []string
+	for i := 0; i < maxLineMergeEdits; i++ {
+		base = append(base, "a\n")
+		merged = append(merged, "b\n")
+	}
+	cm := NewContentMergerStandard()
+	_, ok := cm.Merge([]byte(strings.Join(base, "")),
+		[]byte(strings.Join(merged, "")), []byte(strings.Join(base, "")))
+	if ok {
+		t.Errorf("Merged files with too many differences")
+	}
+}
+
+func TestContentMergerStandardEnable(t *testing.T) {
+	cm := NewContentMergerStandard()
+	h := &TlfHandle{name: "alice,bob"}
+	if max := cm.MaxMergeBytes(h); max != 0 {
+		t.Errorf("Merging enabled by default, up to %d bytes", max)
+	}
+	cm.EnableForTlf("/keybase/private/alice,bob", 100)
+	if max := cm.MaxMergeBytes(h); max != 100 {
+		t.Errorf("Merging enabled up to %d bytes, expected 100", max)
+	}
+	if max := cm.MaxMergeBytes(&TlfHandle{name: "alice"}); max != 0 {
+		t.Errorf("Merging enabled for another folder, up to %d bytes", max)
+	}
+	cm.DisableForTlf("/keybase/private/alice,bob")
+	if max := cm.MaxMergeBytes(h); max != 0 {
+		t.Errorf("Merging still enabled, up to %d bytes", max)
+	}
+}
@@ -27,6 +27,7 @@ type copyUnmergedEntryAction struct {
 	unique        bool
 	unmergedEntry DirEntry
 	attr          []attrChange
+	xattrs        []string
 }
 
 func fixupNamesInOps(fromName string, toName string, ops []op,
@@ -35,7 +36,7 @@ func fixupNamesInOps(fromName string, toName string, ops []op,
 	for _, uop := range ops {
 		done := false
 		switch realOp := uop.(type) {
-		// The only names that matter are in createOps or
+		// The only names that matter are in createOps, linkOps or
 		// setAttrOps.  rms on the unmerged side wouldn't be
 		// part of the unmerged entry
 		case *createOp:
@@ -64,6 +65,13 @@ func fixupNamesInOps(fromName string, toName string, ops []op,
 				retOps = append(retOps, &realOpCopy)
 				done = true
 			}
+		case *linkOp:
+			if realOp.NewName == fromName {
+				realOpCopy := *realOp
+				realOpCopy.NewName = toName
+				retOps = append(retOps, &realOpCopy)
+				done = true
+			}
 		}
 		if !done {
 			retOps = append(retOps, uop)
@@ -101,6 +109,9 @@ func (cuea *copyUnmergedEntryAction) swapUnmergedBlock(
 			// attributes so we can re-apply them during do().
 			if sao, ok := op.(*setAttrOp); ok {
 				cuea.attr = append(cuea.attr, sao.Attr)
+				if sao.Attr == xattrAttr {
+					cuea.xattrs = append(cuea.xattrs, sao.XattrName)
+				}
 			} else {
 				return false, zeroPtr, nil
 			}
@@ -152,6 +163,7 @@ func uniquifyName(block *DirBlock, name string) (string, error) {
 
 func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	appender fileBlockAppender, merger fileContentMerger,
 	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
 	// Find the unmerged entry
 	unmergedEntry, ok := unmergedBlock.Children[cuea.fromName]
@@ -189,6 +201,10 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 				unmergedEntry.Type = cuea.unmergedEntry.Type
 			case mtimeAttr:
 				unmergedEntry.Mtime = cuea.unmergedEntry.Mtime
+			case xattrAttr:
+				unmergedEntry.Xattrs = copyXattrs(
+					cuea.unmergedEntry.Xattrs, unmergedEntry.Xattrs,
+					cuea.xattrs)
 			}
 		}
 	}
@@ -283,6 +299,29 @@ type copyUnmergedAttrAction struct {
 	fromName string
 	toName   string
 	attr     []attrChange
+	xattrs   []string
+}
+
+// copyXattrs returns a copy of the to map, with the given extended
+// attributes replaced by their values in from, or removed if from
+// doesn't have them.
+func copyXattrs(from map[string][]byte, to map[string][]byte,
+	names []string) map[string][]byte {
+	xattrs := make(map[string][]byte, len(to))
+	for k, v := range to {
+		xattrs[k] = v
+	}
+	for _, name := range names {
+		if v, ok := from[name]; ok {
+			xattrs[name] = v
+		} else {
+			delete(xattrs, name)
+		}
+	}
+	if len(xattrs) == 0 {
+		return nil
+	}
+	return xattrs
 }
 
 func (cuaa *copyUnmergedAttrAction) swapUnmergedBlock(
@@ -293,6 +332,7 @@ func (cuaa *copyUnmergedAttrAction) swapUnmergedBlock(
 
 func (cuaa *copyUnmergedAttrAction) do(ctx context.Context,
 	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	appender fileBlockAppender, merger fileContentMerger,
 	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
 	// Find the unmerged entry
 	unmergedEntry, ok := unmergedBlock.Children[cuaa.fromName]
@@ -314,6 +354,9 @@ func (cuaa *copyUnmergedAttrAction) do(ctx context.Context,
 			mergedEntry.Size = unmergedEntry.Size
 			mergedEntry.EncodedSize = unmergedEntry.EncodedSize
 			mergedEntry.BlockPointer = unmergedEntry.BlockPointer
+		case xattrAttr:
+			mergedEntry.Xattrs = copyXattrs(
+				unmergedEntry.Xattrs, mergedEntry.Xattrs, cuaa.xattrs)
 		}
 	}
 	mergedBlock.Children[cuaa.toName] = mergedEntry
@@ -362,6 +405,7 @@ func (rmea *rmMergedEntryAction) swapUnmergedBlock(
 
 func (rmea *rmMergedEntryAction) do(ctx context.Context,
 	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	appender fileBlockAppender, merger fileContentMerger,
 	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
 	if _, ok := mergedBlock.Children[rmea.name]; !ok {
 		return NoSuchNameError{rmea.name}
@@ -381,6 +425,102 @@ func (rmea *rmMergedEntryAction) String() string {
 	return fmt.Sprintf("rmMergedEntry: %s", rmea.name)
 }
 
+// adjustLinkCountAction says that the link count of the merged entry
+// for the given name, a file in the hidden links directory, should
+// change by delta.  If the merged entry is gone and restore is set,
+// the unmerged file is first copied back in, since the unmerged
+// branch gave it a new name.  If drop is set, that unmerged op is
+// dropped, since it would have removed a file that the merged branch
+// still links to.
+type adjustLinkCountAction struct {
+	name    string
+	delta   int
+	restore bool
+	drop    op
+
+	// Set by do() if the file had to be restored.
+	restored bool
+}
+
+func (alca *adjustLinkCountAction) swapUnmergedBlock(
+	unmergedChains *crChains, mergedChains *crChains,
+	unmergedBlock *DirBlock) (bool, BlockPointer, error) {
+	return false, zeroPtr, nil
+}
+
+func (alca *adjustLinkCountAction) do(ctx context.Context,
+	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	appender fileBlockAppender, merger fileContentMerger,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	nlink := alca.delta
+	mergedEntry, ok := mergedBlock.Children[alca.name]
+	if ok {
+		if mergedEntry.Nlink == 0 {
+			nlink++
+		} else {
+			nlink += int(mergedEntry.Nlink)
+		}
+	} else if alca.restore {
+		// The merged branch unref'd the file's blocks, so make new
+		// references to them.
+		_, _, err := crActionCopyFile(ctx, unmergedCopier, alca.name,
+			alca.name, "", unmergedBlock, mergedBlock)
+		if err != nil {
+			return err
+		}
+		mergedEntry = mergedBlock.Children[alca.name]
+		alca.restored = true
+	} else {
+		// Nothing left to adjust.
+		return nil
+	}
+
+	if nlink < 1 {
+		nlink = 1
+	}
+	mergedEntry.Nlink = uint32(nlink)
+	mergedBlock.Children[alca.name] = mergedEntry
+	return nil
+}
+
+func (alca *adjustLinkCountAction) updateOps(unmergedMostRecent BlockPointer,
+	mergedMostRecent BlockPointer, unmergedBlock *DirBlock,
+	mergedBlock *DirBlock, unmergedChains *crChains,
+	mergedChains *crChains) error {
+	if alca.drop != nil {
+		dua := &dropUnmergedAction{op: alca.drop}
+		err := dua.updateOps(unmergedMostRecent, mergedMostRecent,
+			unmergedBlock, mergedBlock, unmergedChains, mergedChains)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !alca.restored {
+		return nil
+	}
+
+	restoredEntry, ok := mergedBlock.Children[alca.name]
+	if !ok {
+		return NoSuchNameError{alca.name}
+	}
+
+	// Re-create the file locally, and reference its copied blocks
+	// in the resolution.
+	err := prependOpsToChain(mergedMostRecent, mergedChains,
+		newCreateOp(alca.name, mergedMostRecent, restoredEntry.Type))
+	if err != nil {
+		return err
+	}
+	co := newCreateOp(alca.name, unmergedMostRecent, restoredEntry.Type)
+	co.AddRefBlock(restoredEntry.BlockPointer)
+	return prependOpsToChain(unmergedMostRecent, unmergedChains, co)
+}
+
+func (alca *adjustLinkCountAction) String() string {
+	return fmt.Sprintf("adjustLinkCount: %s %+d", alca.name, alca.delta)
+}
+
 // renameUnmergedAction says that the unmerged copy of a file needs to
 // be renamed, and the file blocks should be copied.
 type renameUnmergedAction struct {
@@ -449,6 +589,7 @@ func (rua *renameUnmergedAction) swapUnmergedBlock(
 
 func (rua *renameUnmergedAction) do(ctx context.Context,
 	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	appender fileBlockAppender, merger fileContentMerger,
 	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
 	_, name, err := crActionCopyFile(ctx, unmergedCopier, rua.fromName,
 		rua.toName, rua.symPath, unmergedBlock, mergedBlock)
@@ -593,6 +734,244 @@ func (rua *renameUnmergedAction) String() string {
 		rua.symPath)
 }
 
+// appendUnmergedAction says that the data appended to the unmerged
+// copy of a file, starting at off, should be appended to the merged
+// copy as well, instead of renaming the unmerged copy.  This makes a
+// copy of the merged file, and the unmerged syncs are then applied to
+// that copy.
+type appendUnmergedAction struct {
+	fromName string
+	toName   string
+	off      uint64
+
+	// Set by do: the merged blocks that the copy replaces, and the
+	// size of the copy.
+	unrefs  []BlockPointer
+	newSize uint64
+}
+
+func (aua *appendUnmergedAction) swapUnmergedBlock(
+	unmergedChains *crChains, mergedChains *crChains,
+	unmergedBlock *DirBlock) (bool, BlockPointer, error) {
+	return false, zeroPtr, nil
+}
+
+func (aua *appendUnmergedAction) do(ctx context.Context,
+	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	appender fileBlockAppender, merger fileContentMerger,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	unmergedEntry, ok := unmergedBlock.Children[aua.fromName]
+	if !ok {
+		return NoSuchNameError{aua.fromName}
+	}
+	mergedEntry, ok := mergedBlock.Children[aua.toName]
+	if !ok {
+		return NoSuchNameError{aua.toName}
+	}
+	if unmergedEntry.Size < aua.off {
+		return fmt.Errorf("Appends to %s start at %d, past its end at %d",
+			aua.fromName, aua.off, unmergedEntry.Size)
+	}
+
+	unrefs, err := appender(
+		ctx, aua.fromName, unmergedEntry, aua.off, aua.toName, mergedEntry)
+	if err != nil {
+		return err
+	}
+	aua.unrefs = unrefs
+
+	// The merged entry keeps its pointer and encoded size, so that
+	// syncing the copy turns into an update of the merged file.
+	mergedEntry.Size += unmergedEntry.Size - aua.off
+	if unmergedEntry.Mtime > mergedEntry.Mtime {
+		mergedEntry.Mtime = unmergedEntry.Mtime
+	}
+	if unmergedEntry.Ctime > mergedEntry.Ctime {
+		mergedEntry.Ctime = unmergedEntry.Ctime
+	}
+	mergedBlock.Children[aua.toName] = mergedEntry
+	aua.newSize = mergedEntry.Size
+	return nil
+}
+
+func (aua *appendUnmergedAction) updateOps(unmergedMostRecent BlockPointer,
+	mergedMostRecent BlockPointer, unmergedBlock *DirBlock,
+	mergedBlock *DirBlock, unmergedChains *crChains,
+	mergedChains *crChains) error {
+	// The unmerged data moved to after the merged data.
+	writes := []WriteRange{{Off: aua.off, Len: aua.newSize - aua.off}}
+	return crActionReplaceMergedFile(aua.fromName, aua.toName, aua.unrefs,
+		writes, unmergedMostRecent, mergedMostRecent, unmergedBlock,
+		mergedBlock, unmergedChains, mergedChains)
+}
+
+// crActionReplaceMergedFile updates the ops of an unmerged file whose
+// changes were put into a new copy of the merged file, with the
+// given write ranges.  The unmerged syncs then apply to the copy,
+// and the blocks they made are dropped.
+func crActionReplaceMergedFile(fromName string, toName string,
+	unrefs []BlockPointer, writes []WriteRange,
+	unmergedMostRecent BlockPointer, mergedMostRecent BlockPointer,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock,
+	unmergedChains *crChains, mergedChains *crChains) error {
+	unmergedChain, ok := unmergedChains.byMostRecent[unmergedMostRecent]
+	if !ok {
+		return fmt.Errorf("Couldn't find unmerged chain for %v",
+			unmergedMostRecent)
+	}
+
+	// Only the chain of the file itself needs updating.
+	unmergedEntry, ok := unmergedBlock.Children[fromName]
+	if !ok {
+		return NoSuchNameError{fromName}
+	}
+	if unmergedEntry.BlockPointer != unmergedMostRecent {
+		return nil
+	}
+
+	if fromName != toName {
+		unmergedChain.ops =
+			fixupNamesInOps(fromName, toName, unmergedChain.ops,
+				unmergedChains)
+	}
+
+	mergedEntry, ok := mergedBlock.Children[toName]
+	if !ok {
+		return NoSuchNameError{toName}
+	}
+
+	// The first sync unreferences the merged blocks that the copy
+	// replaced, and tells other devices which parts of the file
+	// changed.
+	first := true
+	for _, op := range unmergedChain.ops {
+		switch realOp := op.(type) {
+		case *syncOp:
+			realOp.File.Unref = mergedEntry.BlockPointer
+			realOp.File.Ref = mergedEntry.BlockPointer
+			for _, ptr := range realOp.RefBlocks {
+				unmergedChains.toUnrefPointers[ptr] = true
+			}
+			realOp.RefBlocks = nil
+			realOp.Writes = nil
+			if first {
+				for _, ptr := range unrefs {
+					realOp.AddUnrefBlock(ptr)
+				}
+				realOp.Writes = append(realOp.Writes, writes...)
+				first = false
+			}
+		case *setAttrOp:
+			realOp.File = mergedEntry.BlockPointer
+		}
+	}
+
+	// Locally, the merged file changed in the same way.
+	so := newSyncOp(mergedMostRecent)
+	so.File.Ref = mergedMostRecent
+	so.Writes = append(so.Writes, writes...)
+	return prependOpsToChain(mergedMostRecent, mergedChains, so)
+}
+
+func (aua *appendUnmergedAction) String() string {
+	return fmt.Sprintf("appendUnmerged: %s -> %s (from %d)",
+		aua.fromName, aua.toName, aua.off)
+}
+
+// mergeUnmergedAction says that the contents of an unmerged file,
+// which was also changed in the merged branch, should be merged into
+// the merged file, using the base file as their common ancestor.  If
+// the contents can't be merged, the unmerged file is renamed by the
+// given renameUnmergedAction instead.
+type mergeUnmergedAction struct {
+	fromName string
+	toName   string
+	base     BlockPointer
+	rename   *renameUnmergedAction
+
+	// Set by do: whether the contents were merged, the merged blocks
+	// that the copy replaces, and the sizes of the merged file before
+	// and after.
+	merged  bool
+	unrefs  []BlockPointer
+	oldSize uint64
+	newSize uint64
+}
+
+func (mua *mergeUnmergedAction) swapUnmergedBlock(
+	unmergedChains *crChains, mergedChains *crChains,
+	unmergedBlock *DirBlock) (bool, BlockPointer, error) {
+	return mua.rename.swapUnmergedBlock(
+		unmergedChains, mergedChains, unmergedBlock)
+}
+
+func (mua *mergeUnmergedAction) do(ctx context.Context,
+	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	appender fileBlockAppender, merger fileContentMerger,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	unmergedEntry, ok := unmergedBlock.Children[mua.fromName]
+	if !ok {
+		return NoSuchNameError{mua.fromName}
+	}
+	mergedEntry, ok := mergedBlock.Children[mua.toName]
+	if !ok {
+		return NoSuchNameError{mua.toName}
+	}
+
+	unrefs, newSize, merged, err := merger(ctx, mua.fromName,
+		unmergedEntry, mua.base, mua.toName, mergedEntry)
+	if err != nil {
+		return err
+	}
+	if !merged {
+		return mua.rename.do(ctx, unmergedCopier, mergedCopier, appender,
+			merger, unmergedBlock, mergedBlock)
+	}
+	mua.merged = true
+	mua.unrefs = unrefs
+	mua.oldSize = mergedEntry.Size
+	mua.newSize = newSize
+
+	// As with appends, the merged entry keeps its pointer and
+	// encoded size until the copy is synced.
+	mergedEntry.Size = newSize
+	if unmergedEntry.Mtime > mergedEntry.Mtime {
+		mergedEntry.Mtime = unmergedEntry.Mtime
+	}
+	if unmergedEntry.Ctime > mergedEntry.Ctime {
+		mergedEntry.Ctime = unmergedEntry.Ctime
+	}
+	mergedBlock.Children[mua.toName] = mergedEntry
+	return nil
+}
+
+func (mua *mergeUnmergedAction) updateOps(unmergedMostRecent BlockPointer,
+	mergedMostRecent BlockPointer, unmergedBlock *DirBlock,
+	mergedBlock *DirBlock, unmergedChains *crChains,
+	mergedChains *crChains) error {
+	if !mua.merged {
+		return mua.rename.updateOps(unmergedMostRecent, mergedMostRecent,
+			unmergedBlock, mergedBlock, unmergedChains, mergedChains)
+	}
+
+	// The whole file may have changed.
+	var writes []WriteRange
+	if mua.newSize < mua.oldSize {
+		writes = append(writes, WriteRange{Off: mua.newSize})
+	}
+	if mua.newSize > 0 {
+		writes = append(writes, WriteRange{Off: 0, Len: mua.newSize})
+	}
+	return crActionReplaceMergedFile(mua.fromName, mua.toName, mua.unrefs,
+		writes, unmergedMostRecent, mergedMostRecent, unmergedBlock,
+		mergedBlock, unmergedChains, mergedChains)
+}
+
+func (mua *mergeUnmergedAction) String() string {
+	return fmt.Sprintf("mergeUnmerged: %s -> %s (or %s)",
+		mua.fromName, mua.toName, mua.rename)
+}
+
 // renameMergedAction says that the merged copy of a file needs to be
 // renamed, and the unmerged entry should be added to the merged block
 // under the old from name.  Merged file blocks do not have to be
@@ -616,6 +995,7 @@ func (rma *renameMergedAction) swapUnmergedBlock(
 
 func (rma *renameMergedAction) do(ctx context.Context,
 	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	appender fileBlockAppender, merger fileContentMerger,
 	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
 	// Find the merged entry
 	mergedEntry, ok := mergedBlock.Children[rma.fromName]
@@ -729,6 +1109,7 @@ func (dua *dropUnmergedAction) swapUnmergedBlock(
 
 func (dua *dropUnmergedAction) do(ctx context.Context,
 	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	appender fileBlockAppender, merger fileContentMerger,
 	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
 	return nil
 }
@@ -795,8 +1176,10 @@ func setTopAction(action crAction, fromName string, index int,
 func (cal crActionList) collapse() crActionList {
 	// Order of precedence for a given fromName:
 	// 1) renameUnmergedAction
-	// 2) copyUnmergedEntryAction
-	// 3) copyUnmergedAttrAction
+	// 2) mergeUnmergedAction
+	// 3) appendUnmergedAction
+	// 4) copyUnmergedEntryAction
+	// 5) copyUnmergedAttrAction
 	infoMap := make(map[string]collapseActionInfo) // fromName -> info
 	indicesToRemove := make(map[int]bool)
 	for i, untypedAction := range cal {
@@ -805,10 +1188,36 @@ func (cal crActionList) collapse() crActionList {
 		// Unmerged actions:
 		case *renameUnmergedAction:
 			setTopAction(action, action.fromName, i, infoMap, indicesToRemove)
+		case *mergeUnmergedAction:
+			untypedTopAction := infoMap[action.fromName].topAction
+			switch untypedTopAction.(type) {
+			case *renameUnmergedAction, *mergeUnmergedAction:
+				indicesToRemove[i] = true
+			default:
+				setTopAction(action, action.fromName, i, infoMap,
+					indicesToRemove)
+			}
+		case *appendUnmergedAction:
+			untypedTopAction := infoMap[action.fromName].topAction
+			switch topAction := untypedTopAction.(type) {
+			case *renameUnmergedAction, *mergeUnmergedAction:
+				indicesToRemove[i] = true
+			case *appendUnmergedAction:
+				// Each unmerged sync makes its own append action;
+				// one copy of all the appended data is enough.
+				if action.off < topAction.off {
+					topAction.off = action.off
+				}
+				indicesToRemove[i] = true
+			default:
+				setTopAction(action, action.fromName, i, infoMap,
+					indicesToRemove)
+			}
 		case *copyUnmergedEntryAction:
 			untypedTopAction := infoMap[action.fromName].topAction
 			switch untypedTopAction.(type) {
-			case *renameUnmergedAction:
+			case *renameUnmergedAction, *mergeUnmergedAction,
+				*appendUnmergedAction:
 				indicesToRemove[i] = true
 			default:
 				setTopAction(action, action.fromName, i, infoMap,
@@ -817,7 +1226,8 @@ func (cal crActionList) collapse() crActionList {
 		case *copyUnmergedAttrAction:
 			untypedTopAction := infoMap[action.fromName].topAction
 			switch topAction := untypedTopAction.(type) {
-			case *renameUnmergedAction:
+			case *renameUnmergedAction, *mergeUnmergedAction,
+				*appendUnmergedAction:
 				indicesToRemove[i] = true
 			case *copyUnmergedEntryAction:
 				indicesToRemove[i] = true
@@ -836,6 +1246,7 @@ func (cal crActionList) collapse() crActionList {
 						topAction.attr = append(topAction.attr, a)
 					}
 				}
+				topAction.xattrs = append(topAction.xattrs, action.xattrs...)
 				indicesToRemove[i] = true
 			default:
 				setTopAction(action, action.fromName, i, infoMap,
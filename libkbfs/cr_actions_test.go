@@ -12,12 +12,12 @@ import (
 func TestCRActionsCollapseNoChange(t *testing.T) {
 	al := crActionList{
 		&copyUnmergedEntryAction{"old1", "new1", "", false, false,
-			DirEntry{}, nil},
+			DirEntry{}, nil, nil},
 		&copyUnmergedEntryAction{"old2", "new2", "", false, false,
-			DirEntry{}, nil},
+			DirEntry{}, nil, nil},
 		&renameUnmergedAction{"old3", "new3", "", zeroPtr, zeroPtr},
 		&renameMergedAction{"old4", "new4", ""},
-		&copyUnmergedAttrAction{"old5", "new5", []attrChange{mtimeAttr}},
+		&copyUnmergedAttrAction{"old5", "new5", []attrChange{mtimeAttr}, nil},
 	}
 
 	newList := al.collapse()
@@ -28,9 +28,9 @@ func TestCRActionsCollapseNoChange(t *testing.T) {
 
 func TestCRActionsCollapseEntry(t *testing.T) {
 	al := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, nil},
 		&copyUnmergedEntryAction{"old", "new", "", false, false,
-			DirEntry{}, nil},
+			DirEntry{}, nil, nil},
 		&renameUnmergedAction{"old", "new", "", zeroPtr, zeroPtr},
 	}
 
@@ -65,13 +65,13 @@ func TestCRActionsCollapseEntry(t *testing.T) {
 }
 func TestCRActionsCollapseAttr(t *testing.T) {
 	al := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}},
-		&copyUnmergedAttrAction{"old", "new", []attrChange{exAttr}},
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, nil},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{exAttr}, nil},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, nil},
 	}
 
 	expected := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr, exAttr}},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr, exAttr}, nil},
 	}
 
 	newList := al.collapse()
@@ -80,3 +80,64 @@ func TestCRActionsCollapseAttr(t *testing.T) {
 			expected, newList)
 	}
 }
+
+func TestCRActionsCollapseAppend(t *testing.T) {
+	al := crActionList{
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, nil},
+		&appendUnmergedAction{"old", "new", 10, nil, 0},
+		&appendUnmergedAction{"old", "new", 5, nil, 0},
+	}
+
+	expected := crActionList{
+		&appendUnmergedAction{"old", "new", 5, nil, 0},
+	}
+
+	newList := al.collapse()
+	if !reflect.DeepEqual(expected, newList) {
+		t.Errorf("Collapse returned unexpected list: %v vs %v",
+			expected, newList)
+	}
+
+	// A rename beats an append.
+	al = crActionList{
+		&appendUnmergedAction{"old", "new", 5, nil, 0},
+		&renameUnmergedAction{"old", "new", "", zeroPtr, zeroPtr},
+	}
+	expected = crActionList{al[1]}
+
+	newList = al.collapse()
+	if !reflect.DeepEqual(expected, newList) {
+		t.Errorf("Collapse returned unexpected list: %v vs %v",
+			expected, newList)
+	}
+}
+
+func TestCRActionsCollapseMerge(t *testing.T) {
+	rename := &renameUnmergedAction{"old", "new", "", zeroPtr, zeroPtr}
+	al := crActionList{
+		&appendUnmergedAction{"old", "old", 5, nil, 0},
+		&mergeUnmergedAction{fromName: "old", toName: "old",
+			rename: rename},
+		&copyUnmergedAttrAction{"old", "old", []attrChange{mtimeAttr}, nil},
+		&mergeUnmergedAction{fromName: "old", toName: "old",
+			rename: rename},
+	}
+
+	expected := crActionList{al[1]}
+
+	newList := al.collapse()
+	if !reflect.DeepEqual(expected, newList) {
+		t.Errorf("Collapse returned unexpected list: %v vs %v",
+			expected, newList)
+	}
+
+	// A rename beats a merge.
+	al = crActionList{al[1], rename}
+	expected = crActionList{rename}
+
+	newList = al.collapse()
+	if !reflect.DeepEqual(expected, newList) {
+		t.Errorf("Collapse returned unexpected list: %v vs %v",
+			expected, newList)
+	}
+}
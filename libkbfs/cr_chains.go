@@ -25,6 +25,9 @@ type crChain struct {
 //  * A create followed by a remove for the same name (delete both ops)
 //  * A create followed by a create (renamed == true) for the same name
 //    (delete the create op)
+//  * A hard link followed by an unlink of the same name (delete both ops)
+//  * A link count change for a file created in this chain (delete the
+//    count change, since the file's entry already has the final count)
 func (cc *crChain) collapse() {
 	createsSeen := make(map[string]int)
 	indicesToRemove := make(map[int]bool)
@@ -45,6 +48,22 @@ func (cc *crChain) collapse() {
 				indicesToRemove[prevCreateIndex] = true
 				indicesToRemove[i] = true
 			}
+		case *linkOp:
+			if realOp.NewName != "" {
+				createsSeen[realOp.NewName] = i
+			} else if _, ok := createsSeen[realOp.LinkID]; ok {
+				indicesToRemove[i] = true
+			}
+		case *unlinkOp:
+			if realOp.Links == (blockUpdate{}) {
+				if prevCreateIndex, ok := createsSeen[realOp.OldName]; ok {
+					delete(createsSeen, realOp.OldName)
+					indicesToRemove[prevCreateIndex] = true
+					indicesToRemove[i] = true
+				}
+			} else if _, ok := createsSeen[realOp.LinkID]; ok {
+				indicesToRemove[i] = true
+			}
 		case *setAttrOp:
 			// TODO: Collapse opposite setex pairs
 		default:
@@ -262,88 +281,115 @@ func (ccs *crChains) makeChainForOp(op op) error {
 		if err != nil {
 			return err
 		}
-	case *rmOp:
-		err := ccs.addOp(realOp.Dir.Ref, op)
+	case *copyOp:
+		// The copy's blocks are already referenced, so as far as
+		// conflict resolution is concerned it's just a new file.
+		err := ccs.addOp(realOp.Dir.Ref, realOp.toCreateOp())
 		if err != nil {
 			return err
 		}
-	case *renameOp:
-		// split rename op into two separate operations, one for
-		// remove and one for create
-		ro := newRmOp(realOp.OldName, realOp.OldDir.Unref)
-		ro.setWriterInfo(realOp.getWriterInfo())
-		ro.Dir.Ref = realOp.OldDir.Ref
-		err := ccs.addOp(realOp.OldDir.Ref, ro)
+	case *rmOp:
+		err := ccs.addOp(realOp.Dir.Ref, op)
 		if err != nil {
 			return err
 		}
-
-		ndu := realOp.NewDir.Unref
-		ndr := realOp.NewDir.Ref
+	case *renameOp:
+		newDir := realOp.NewDir
 		if realOp.NewDir == (blockUpdate{}) {
 			// this is a rename within the same directory
-			ndu = realOp.OldDir.Unref
-			ndr = realOp.OldDir.Ref
+			newDir = realOp.OldDir
 		}
-
-		if len(realOp.Unrefs()) > 0 {
-			// Something was overwritten; make an explicit rm for it
-			// so we can check for conflicts.
-			roOverwrite := newRmOp(realOp.NewName, ndu)
-			roOverwrite.setWriterInfo(realOp.getWriterInfo())
-			roOverwrite.Dir.Ref = ndr
-			err = ccs.addOp(ndr, roOverwrite)
+		err := ccs.makeChainsForRename(realOp, realOp.OldName,
+			realOp.OldDir, realOp.NewName, newDir, realOp.Renamed,
+			realOp.RenamedType, realOp.Unrefs())
+		if err != nil {
+			return err
+		}
+	case *linkOp:
+		// Split the link op into the name(s) it adds and the link
+		// count change, which land in different chains.
+		if realOp.OldName != "" {
+			oldDir := realOp.OldDir
+			if realOp.OldDir == (blockUpdate{}) {
+				oldDir = realOp.Dir
+			}
+			// The file moves into the links directory...
+			err := ccs.makeChainsForRename(realOp, realOp.OldName, oldDir,
+				realOp.LinkID, realOp.Links, realOp.Linked, File, nil)
 			if err != nil {
 				return err
 			}
-			// Transfer any unrefs over.
-			for _, ptr := range realOp.Unrefs() {
-				roOverwrite.AddUnrefBlock(ptr)
+			// ...and its old name becomes a link to it.
+			lo := &linkOp{
+				NewName: realOp.OldName,
+				Dir:     oldDir,
+				LinkID:  realOp.LinkID,
+			}
+			lo.setWriterInfo(realOp.getWriterInfo())
+			err = ccs.addOp(oldDir.Ref, lo)
+			if err != nil {
+				return err
+			}
+		} else if realOp.adjustsCount() {
+			lo := &linkOp{
+				LinkID: realOp.LinkID,
+				Links:  realOp.Links,
+			}
+			lo.setWriterInfo(realOp.getWriterInfo())
+			err := ccs.addOp(realOp.Links.Ref, lo)
+			if err != nil {
+				return err
 			}
 		}
 
-		co := newCreateOp(realOp.NewName, ndu, realOp.RenamedType)
-		co.setWriterInfo(realOp.getWriterInfo())
-		co.renamed = true
-		co.Dir.Ref = ndr
-		err = ccs.addOp(ndr, co)
-		if err != nil {
-			return err
+		if realOp.NewName != "" {
+			lo := &linkOp{
+				NewName: realOp.NewName,
+				Dir:     realOp.Dir,
+				LinkID:  realOp.LinkID,
+			}
+			lo.setWriterInfo(realOp.getWriterInfo())
+			err := ccs.addOp(realOp.Dir.Ref, lo)
+			if err != nil {
+				return err
+			}
 		}
-
-		// also keep track of the new parent for the renamed node
-		if realOp.Renamed.IsInitialized() {
-			newParentChain, ok := ccs.byMostRecent[ndr]
-			if !ok {
-				return fmt.Errorf("While renaming, couldn't find the chain "+
-					"for the new parent %v", ndr)
+	case *unlinkOp:
+		if realOp.Dir != (blockUpdate{}) {
+			uo := &unlinkOp{
+				OldName: realOp.OldName,
+				Dir:     realOp.Dir,
+				LinkID:  realOp.LinkID,
 			}
-			oldParentChain, ok := ccs.byMostRecent[realOp.OldDir.Ref]
-			if !ok {
-				return fmt.Errorf("While renaming, couldn't find the chain "+
-					"for the old parent %v", ndr)
+			uo.setWriterInfo(realOp.getWriterInfo())
+			err := ccs.addOp(realOp.Dir.Ref, uo)
+			if err != nil {
+				return err
 			}
+		}
 
-			renamedOriginal := realOp.Renamed
-			if renamedChain, ok := ccs.byMostRecent[realOp.Renamed]; ok {
-				renamedOriginal = renamedChain.original
+		var err error
+		if realOp.removesFile() {
+			// Removing the last name removes the file too, which
+			// should look like any other file removal.
+			ro := newRmOp(realOp.LinkID, realOp.Links.Unref)
+			ro.setWriterInfo(realOp.getWriterInfo())
+			ro.Dir.Ref = realOp.Links.Ref
+			for _, ptr := range realOp.Unrefs() {
+				ro.AddUnrefBlock(ptr)
 			}
-			// Use the previous old info if there is one already,
-			// in case this node has been renamed multiple times.
-			ri, ok := ccs.renamedOriginals[renamedOriginal]
-			if !ok {
-				// Otherwise make a new one.
-				ri = renameInfo{
-					originalOldParent: oldParentChain.original,
-					oldName:           realOp.OldName,
-				}
+			err = ccs.addOp(realOp.Links.Ref, ro)
+		} else if realOp.adjustsCount() {
+			cuo := &unlinkOp{
+				OldName: realOp.OldName,
+				LinkID:  realOp.LinkID,
+				Links:   realOp.Links,
 			}
-			ri.originalNewParent = newParentChain.original
-			ri.newName = realOp.NewName
-			ccs.renamedOriginals[renamedOriginal] = ri
-			// Remember what you create, in case we need to merge
-			// directories after a rename.
-			co.AddRefBlock(renamedOriginal)
+			cuo.setWriterInfo(realOp.getWriterInfo())
+			err = ccs.addOp(realOp.Links.Ref, cuo)
+		}
+		if err != nil {
+			return err
 		}
 	case *syncOp:
 		err := ccs.addOp(realOp.File.Ref, op)
@@ -377,6 +423,87 @@ func (ccs *crChains) makeChainForOp(op op) error {
 	return nil
 }
 
+// makeChainsForRename splits a rename of the given node into two
+// separate operations, one for remove and one for create, and adds
+// them to the chains of the old and new parent directories.  Any
+// unrefs are for an entry that was overwritten by the rename.
+func (ccs *crChains) makeChainsForRename(op op, oldName string,
+	oldDir blockUpdate, newName string, newDir blockUpdate,
+	renamed BlockPointer, renamedType EntryType,
+	unrefs []BlockPointer) error {
+	ro := newRmOp(oldName, oldDir.Unref)
+	ro.setWriterInfo(op.getWriterInfo())
+	ro.Dir.Ref = oldDir.Ref
+	err := ccs.addOp(oldDir.Ref, ro)
+	if err != nil {
+		return err
+	}
+
+	ndu := newDir.Unref
+	ndr := newDir.Ref
+
+	if len(unrefs) > 0 {
+		// Something was overwritten; make an explicit rm for it
+		// so we can check for conflicts.
+		roOverwrite := newRmOp(newName, ndu)
+		roOverwrite.setWriterInfo(op.getWriterInfo())
+		roOverwrite.Dir.Ref = ndr
+		err = ccs.addOp(ndr, roOverwrite)
+		if err != nil {
+			return err
+		}
+		// Transfer any unrefs over.
+		for _, ptr := range unrefs {
+			roOverwrite.AddUnrefBlock(ptr)
+		}
+	}
+
+	co := newCreateOp(newName, ndu, renamedType)
+	co.setWriterInfo(op.getWriterInfo())
+	co.renamed = true
+	co.Dir.Ref = ndr
+	err = ccs.addOp(ndr, co)
+	if err != nil {
+		return err
+	}
+
+	// also keep track of the new parent for the renamed node
+	if renamed.IsInitialized() {
+		newParentChain, ok := ccs.byMostRecent[ndr]
+		if !ok {
+			return fmt.Errorf("While renaming, couldn't find the chain "+
+				"for the new parent %v", ndr)
+		}
+		oldParentChain, ok := ccs.byMostRecent[oldDir.Ref]
+		if !ok {
+			return fmt.Errorf("While renaming, couldn't find the chain "+
+				"for the old parent %v", ndr)
+		}
+
+		renamedOriginal := renamed
+		if renamedChain, ok := ccs.byMostRecent[renamed]; ok {
+			renamedOriginal = renamedChain.original
+		}
+		// Use the previous old info if there is one already,
+		// in case this node has been renamed multiple times.
+		ri, ok := ccs.renamedOriginals[renamedOriginal]
+		if !ok {
+			// Otherwise make a new one.
+			ri = renameInfo{
+				originalOldParent: oldParentChain.original,
+				oldName:           oldName,
+			}
+		}
+		ri.originalNewParent = newParentChain.original
+		ri.newName = newName
+		ccs.renamedOriginals[renamedOriginal] = ri
+		// Remember what you create, in case we need to merge
+		// directories after a rename.
+		co.AddRefBlock(renamedOriginal)
+	}
+	return nil
+}
+
 func (ccs *crChains) makeChainForNewOpWithUpdate(
 	targetPtr BlockPointer, newOp op, update *blockUpdate) error {
 	oldUnref := update.Unref
@@ -430,6 +557,18 @@ func (ccs *crChains) makeChainForNewOp(targetPtr BlockPointer, newOp op) error {
 		return ccs.makeChainForNewOpWithUpdate(targetPtr, newOp, &realOp.Dir)
 	case *syncOp:
 		return ccs.makeChainForNewOpWithUpdate(targetPtr, newOp, &realOp.File)
+	case *linkOp:
+		if realOp.NewName == "" {
+			return ccs.makeChainForNewOpWithUpdate(
+				targetPtr, newOp, &realOp.Links)
+		}
+		return ccs.makeChainForNewOpWithUpdate(targetPtr, newOp, &realOp.Dir)
+	case *unlinkOp:
+		if realOp.Dir == (blockUpdate{}) {
+			return ccs.makeChainForNewOpWithUpdate(
+				targetPtr, newOp, &realOp.Links)
+		}
+		return ccs.makeChainForNewOpWithUpdate(targetPtr, newOp, &realOp.Dir)
 	default:
 		return fmt.Errorf("Couldn't make chain with unknown operation %s",
 			newOp)
@@ -630,6 +769,16 @@ func (ccs *crChains) copyOpAndRevertUnrefsToOriginals(currOp op) op {
 	case *gcOp:
 		// No need to copy a gcOp, it won't be modified
 		newOp = realOp
+	case *linkOp:
+		newLinkOp := *realOp
+		unrefs = append(unrefs, &newLinkOp.Dir.Unref, &newLinkOp.Links.Unref,
+			&newLinkOp.OldDir.Unref, &newLinkOp.Linked)
+		newOp = &newLinkOp
+	case *unlinkOp:
+		newUnlinkOp := *realOp
+		unrefs = append(unrefs, &newUnlinkOp.Dir.Unref,
+			&newUnlinkOp.Links.Unref)
+		newOp = &newUnlinkOp
 	}
 	for _, unref := range unrefs {
 		original, ok := ccs.originals[*unref]
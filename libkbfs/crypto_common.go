@@ -6,9 +6,11 @@ package libkbfs
 
 import (
 	"bytes"
+	"compress/flate"
 	"crypto/rand"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
@@ -436,12 +438,48 @@ func (c *CryptoCommon) depadBlock(paddedBlock []byte) ([]byte, error) {
 	return buf.Next(int(blockLen)), nil
 }
 
+// compressBlock returns the flate-compressed version of the given
+// encoded block, or nil if compressing it wouldn't make its padded
+// size any smaller, or if the block is bigger than maxSize (which
+// readers wouldn't decompress).
+func (c *CryptoCommon) compressBlock(encodedBlock []byte, maxSize int) (
+	[]byte, error) {
+	if len(encodedBlock) > maxSize {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(encodedBlock); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if nextPowerOfTwo(uint32(buf.Len())) >=
+		nextPowerOfTwo(uint32(len(encodedBlock))) {
+		return nil, nil
+	}
+	return buf.Bytes(), nil
+}
+
 // EncryptBlock implements the Crypto interface for CryptoCommon.
-func (c *CryptoCommon) EncryptBlock(block Block, key BlockCryptKey) (plainSize int, encryptedBlock EncryptedBlock, err error) {
+func (c *CryptoCommon) EncryptBlock(block Block, key BlockCryptKey, maxSize int) (plainSize int, encryptedBlock EncryptedBlock, err error) {
 	encodedBlock, err := c.codec.Encode(block)
 	if err != nil {
 		return
 	}
+	plainSize = len(encodedBlock)
+
+	compressedBlock, err := c.compressBlock(encodedBlock, maxSize)
+	if err != nil {
+		return
+	}
+	if compressedBlock != nil {
+		encodedBlock = compressedBlock
+	}
 
 	paddedBlock, err := c.padBlock(encodedBlock)
 	if err != nil {
@@ -452,15 +490,23 @@ func (c *CryptoCommon) EncryptBlock(block Block, key BlockCryptKey) (plainSize i
 	if err != nil {
 		return
 	}
+	if compressedBlock != nil {
+		encryptedData.Version = EncryptionSecretboxFlate
+	}
 
-	plainSize = len(encodedBlock)
 	encryptedBlock = EncryptedBlock(encryptedData)
 	return
 }
 
 // DecryptBlock implements the Crypto interface for CryptoCommon.
-func (c *CryptoCommon) DecryptBlock(encryptedBlock EncryptedBlock, key BlockCryptKey, block Block) error {
-	paddedBlock, err := c.decryptData(encryptedData(encryptedBlock), key.data)
+func (c *CryptoCommon) DecryptBlock(encryptedBlock EncryptedBlock, key BlockCryptKey, maxSize int, block Block) error {
+	data := encryptedData(encryptedBlock)
+	compressed := data.Version == EncryptionSecretboxFlate
+	if compressed {
+		// Compression doesn't change how the data is encrypted.
+		data.Version = EncryptionSecretbox
+	}
+	paddedBlock, err := c.decryptData(data, key.data)
 	if err != nil {
 		return err
 	}
@@ -470,6 +516,21 @@ func (c *CryptoCommon) DecryptBlock(encryptedBlock EncryptedBlock, key BlockCryp
 		return err
 	}
 
+	if compressed {
+		r := flate.NewReader(bytes.NewReader(encodedBlock))
+		defer r.Close()
+		// Read one byte past the limit, to tell a block of exactly
+		// maxSize bytes from a bigger one.
+		encodedBlock, err = ioutil.ReadAll(
+			io.LimitReader(r, int64(maxSize)+1))
+		if err != nil {
+			return err
+		}
+		if len(encodedBlock) > maxSize {
+			return DecompressedBlockTooBigError{maxSize}
+		}
+	}
+
 	return c.codec.Decode(encodedBlock, &block)
 }
 
@@ -529,3 +590,14 @@ func (c *CryptoCommon) DecryptMerkleLeaf(encryptedLeaf EncryptedMerkleLeaf, priv
 	}
 	return &leaf, nil
 }
+
+// makeFileLockID returns an opaque ID for the advisory locks on the
+// file with the given path within its folder, by hashing the path
+// with the given key.
+func makeFileLockID(key TLFCryptKey, filePath string) (string, error) {
+	mac, err := DefaultHMAC(key.data[:], []byte(filePath))
+	if err != nil {
+		return "", err
+	}
+	return mac.String(), nil
+}
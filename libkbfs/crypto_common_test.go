@@ -256,13 +256,13 @@ func TestCryptoCommonEncryptDecryptBlock(t *testing.T) {
 	block := TestBlock{42}
 	key := BlockCryptKey{}
 
-	_, encryptedBlock, err := c.EncryptBlock(block, key)
+	_, encryptedBlock, err := c.EncryptBlock(block, key, 64*1024)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	var decryptedBlock TestBlock
-	err = c.DecryptBlock(encryptedBlock, key, &decryptedBlock)
+	err = c.DecryptBlock(encryptedBlock, key, 64*1024, &decryptedBlock)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -577,7 +577,7 @@ func checkDecryptionFailures(
 	// Wrong version.
 
 	encryptedDataWrongVersion := encryptedData
-	encryptedDataWrongVersion.Version++
+	encryptedDataWrongVersion.Version = EncryptionSecretboxFlate + 1
 	expectedErr = UnknownEncryptionVer{encryptedDataWrongVersion.Version}
 	err = decryptFn(encryptedDataWrongVersion, key)
 	if err != expectedErr {
@@ -669,7 +669,7 @@ func TestEncryptBlock(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	plainSize, encryptedBlock, err := c.EncryptBlock(block, cryptKey)
+	plainSize, encryptedBlock, err := c.EncryptBlock(block, cryptKey, 64*1024)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -712,7 +712,7 @@ func TestDecryptBlockSecretboxSeal(t *testing.T) {
 	encryptedBlock := EncryptedBlock(secretboxSealEncoded(t, &c, paddedBlock, cryptKey.data))
 
 	var decryptedBlock TestBlock
-	err = c.DecryptBlock(encryptedBlock, cryptKey, &decryptedBlock)
+	err = c.DecryptBlock(encryptedBlock, cryptKey, 64*1024, &decryptedBlock)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -732,13 +732,13 @@ func TestDecryptEncryptedBlock(t *testing.T) {
 
 	block := TestBlock{50}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey, 64*1024)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	var decryptedBlock TestBlock
-	err = c.DecryptBlock(encryptedBlock, cryptKey, &decryptedBlock)
+	err = c.DecryptBlock(encryptedBlock, cryptKey, 64*1024, &decryptedBlock)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -757,7 +757,7 @@ func TestDecryptBlockFailures(t *testing.T) {
 
 	block := TestBlock{50}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey, 64*1024)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -765,7 +765,7 @@ func TestDecryptBlockFailures(t *testing.T) {
 	checkDecryptionFailures(t, encryptedData(encryptedBlock), cryptKey,
 		func(encryptedData encryptedData, key interface{}) error {
 			var dummy TestBlock
-			return c.DecryptBlock(EncryptedBlock(encryptedData), key.(BlockCryptKey), &dummy)
+			return c.DecryptBlock(EncryptedBlock(encryptedData), key.(BlockCryptKey), 64*1024, &dummy)
 		},
 		func(key interface{}) interface{} {
 			cryptKey := key.(BlockCryptKey)
@@ -775,6 +775,128 @@ func TestDecryptBlockFailures(t *testing.T) {
 		})
 }
 
+// Test that crypto.EncryptBlock() compresses blocks that shrink
+// enough to pad to a smaller size, and that crypto.DecryptBlock()
+// decompresses them again.
+func TestEncryptDecryptCompressedBlock(t *testing.T) {
+	config := testCryptoClientConfig(t)
+	c := MakeCryptoCommon(config)
+
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = bytes.Repeat([]byte("compressible "), 1000)
+	encodedBlock, err := config.Codec().Encode(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainSize, encryptedBlock, err := c.EncryptBlock(block, cryptKey, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryptedBlock.Version != EncryptionSecretboxFlate {
+		t.Fatalf("Expected version %v, got %v",
+			EncryptionSecretboxFlate, encryptedBlock.Version)
+	}
+	if plainSize != len(encodedBlock) {
+		t.Errorf("Plain size %d doesn't match the encoded size %d",
+			plainSize, len(encodedBlock))
+	}
+	if len(encryptedBlock.EncryptedData) >= len(encodedBlock) {
+		t.Errorf("Encrypted size %d isn't smaller than the encoded size %d",
+			len(encryptedBlock.EncryptedData), len(encodedBlock))
+	}
+
+	decryptedBlock := NewFileBlock().(*FileBlock)
+	err = c.DecryptBlock(encryptedBlock, cryptKey, 64*1024, decryptedBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decryptedBlock.Contents, block.Contents) {
+		t.Errorf("Decrypted block doesn't match the original")
+	}
+}
+
+// Test that crypto.EncryptBlock() doesn't compress blocks bigger than
+// the max size, and that crypto.DecryptBlock() refuses to decompress
+// them.
+func TestEncryptDecryptCompressedBlockTooBig(t *testing.T) {
+	config := testCryptoClientConfig(t)
+	c := MakeCryptoCommon(config)
+
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = bytes.Repeat([]byte("compressible "), 1000)
+	encodedBlock, err := config.Codec().Encode(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxSize := len(encodedBlock) - 1
+
+	_, encryptedBlock, err := c.EncryptBlock(block, cryptKey, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryptedBlock.Version != EncryptionSecretbox {
+		t.Fatalf("Expected version %v, got %v",
+			EncryptionSecretbox, encryptedBlock.Version)
+	}
+
+	_, encryptedBlock, err = c.EncryptBlock(block, cryptKey, maxSize+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryptedBlock.Version != EncryptionSecretboxFlate {
+		t.Fatalf("Expected version %v, got %v",
+			EncryptionSecretboxFlate, encryptedBlock.Version)
+	}
+
+	decryptedBlock := NewFileBlock().(*FileBlock)
+	err = c.DecryptBlock(encryptedBlock, cryptKey, maxSize, decryptedBlock)
+	if _, ok := err.(DecompressedBlockTooBigError); !ok {
+		t.Errorf("Expected DecompressedBlockTooBigError, got %v", err)
+	}
+}
+
+// Test that a full block of incompressible data isn't compressed, so
+// that it still pads to the size the block splitter aimed for.
+func TestEncryptIncompressibleBlock(t *testing.T) {
+	config := testCryptoClientConfig(t)
+	c := MakeCryptoCommon(config)
+
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	desiredBlockSize := int64(64 * 1024)
+	bsplit, err := NewBlockSplitterSimple(
+		desiredBlockSize, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = make([]byte, bsplit.maxSize)
+	if err := cryptoRandRead(block.Contents); err != nil {
+		t.Fatal(err)
+	}
+
+	_, encryptedBlock, err := c.EncryptBlock(
+		block, cryptKey, int(bsplit.MaxSize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryptedBlock.Version != EncryptionSecretbox {
+		t.Fatalf("Expected version %v, got %v",
+			EncryptionSecretbox, encryptedBlock.Version)
+	}
+	paddedBlock := checkSecretboxOpen(
+		t, encryptedData(encryptedBlock), cryptKey.data)
+	if g, e := int64(len(paddedBlock)), desiredBlockSize+padPrefixSize; g != e {
+		t.Errorf("Padded block size %d doesn't match desired block size %d",
+			g, e)
+	}
+}
+
 // Test padding of blocks results in a larger block, with length
 // equal to power of 2 + 4.
 func TestBlockPadding(t *testing.T) {
@@ -914,7 +1036,7 @@ func TestBlockEncryptedLen(t *testing.T) {
 	var expectedLen int
 	for i := 1025; i < 2000; i++ {
 		data := randomData[:i]
-		_, encBlock, err := c.EncryptBlock(data, cryptKey)
+		_, encBlock, err := c.EncryptBlock(data, cryptKey, 64*1024)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -33,6 +34,19 @@ const (
 // user-created directory entry name.
 var disallowedPrefixes = [...]string{".kbfs"}
 
+// linksDirName is the hidden directory at the root of each TLF that
+// holds every file with more than one name, keyed by link ID.
+const linksDirName = ".kbfs_links"
+
+const (
+	// maxXattrNameBytes is the longest allowed extended attribute
+	// name, as on Linux.
+	maxXattrNameBytes = 255
+	// maxXattrBytes bounds the combined size of all the names and
+	// values of the extended attributes of a single entry.
+	maxXattrBytes = 64 * 1024
+)
+
 // UserInfo contains all the info about a keybase user that kbfs cares
 // about.
 type UserInfo struct {
@@ -108,6 +122,10 @@ const (
 	// EncryptionSecretbox is the encryption version that uses
 	// nacl/secretbox or nacl/box.
 	EncryptionSecretbox EncryptionVer = 1
+	// EncryptionSecretboxFlate is the same as EncryptionSecretbox,
+	// except the data was compressed with flate before it was
+	// padded.  It is only used for blocks.
+	EncryptionSecretboxFlate EncryptionVer = 2
 )
 
 // encryptedData is encrypted data with a nonce and a version.
@@ -186,8 +204,47 @@ const (
 	// valid data version. Note that the nil value is not
 	// considered valid.
 	FirstValidDataVer = 1
+	// FilesWithHolesDataVer is the data version for files with
+	// holes, i.e. with leaf blocks that end before the next leaf
+	// block begins.
+	FilesWithHolesDataVer = 2
+	// CompressedBlocksDataVer is the data version for blocks that
+	// were compressed before they were encrypted.
+	CompressedBlocksDataVer = 3
+	// HardLinksDataVer is the data version for directory blocks
+	// that contain hard links.
+	HardLinksDataVer = 4
+	// MultiLevelFilesDataVer is the data version for file blocks
+	// with indirect blocks under indirect blocks, i.e. with more
+	// than one level of indirection.
+	MultiLevelFilesDataVer = 5
+	// IndirectDirsDataVer is the data version for directory blocks
+	// that were split into indirect blocks.
+	IndirectDirsDataVer = 6
 )
 
+// defaultNewBlockDataVersion returns the data version to use for a
+// new block, which is the oldest version that can describe it.
+func defaultNewBlockDataVersion(holes bool, compressed bool,
+	hardLinks bool, multiLevel bool, indirectDir bool) DataVer {
+	if indirectDir {
+		return IndirectDirsDataVer
+	}
+	if multiLevel {
+		return MultiLevelFilesDataVer
+	}
+	if hardLinks {
+		return HardLinksDataVer
+	}
+	if compressed {
+		return CompressedBlocksDataVer
+	}
+	if holes {
+		return FilesWithHolesDataVer
+	}
+	return FirstValidDataVer
+}
+
 // BlockRefNonce is a 64-bit unique sequence of bytes for identifying
 // this reference of a block ID from other references to the same
 // (duplicated) block.
@@ -339,6 +396,9 @@ type ReadyBlockData struct {
 	// These fields should not be used outside of BlockOps.Put().
 	buf        []byte
 	serverHalf BlockCryptKeyServerHalf
+	// compressed is whether the block was compressed before it was
+	// encrypted.
+	compressed bool
 }
 
 // GetEncodedSize returns the size of the encoded (and encrypted)
@@ -409,8 +469,39 @@ const (
 	// folder.  Set to the empty string so that the default will be
 	// the master branch.
 	MasterBranch BranchName = ""
+
+	// archivedBranchPrefix starts the name of every read-only branch
+	// that views an older revision of a top-level folder.
+	archivedBranchPrefix = "rev="
 )
 
+// MakeRevBranchName returns the name of the read-only branch that
+// views the given revision of a top-level folder.
+func MakeRevBranchName(rev MetadataRevision) BranchName {
+	return BranchName(archivedBranchPrefix + strconv.FormatInt(int64(rev), 10))
+}
+
+// IsArchived returns true if the branch is a read-only view of an
+// older revision.
+func (bn BranchName) IsArchived() bool {
+	_, ok := bn.RevisionIfSpecified()
+	return ok
+}
+
+// RevisionIfSpecified returns the revision viewed by an archived
+// branch, and whether this branch is archived at all.
+func (bn BranchName) RevisionIfSpecified() (MetadataRevision, bool) {
+	if !strings.HasPrefix(string(bn), archivedBranchPrefix) {
+		return MetadataRevisionUninitialized, false
+	}
+	rev, err := strconv.ParseInt(
+		strings.TrimPrefix(string(bn), archivedBranchPrefix), 10, 64)
+	if err != nil || MetadataRevision(rev) < MetadataRevisionInitial {
+		return MetadataRevisionUninitialized, false
+	}
+	return MetadataRevision(rev), true
+}
+
 // FolderBranch represents a unique pair of top-level folder and a
 // branch of that folder.
 type FolderBranch struct {
@@ -606,6 +697,10 @@ const (
 	Dir
 	// Sym is a symbolic link.
 	Sym
+	// HardLink is one of several names for the same file.  It
+	// carries no blocks of its own; the file lives in the TLF's
+	// hidden links directory under the entry's LinkID.
+	HardLink
 )
 
 // String implements the fmt.Stringer interface for EntryType
@@ -619,6 +714,8 @@ func (et EntryType) String() string {
 		return "DIR"
 	case Sym:
 		return "SYM"
+	case HardLink:
+		return "HARDLINK"
 	}
 	return "<invalid EntryType>"
 }
@@ -637,6 +734,12 @@ type EntryInfo struct {
 	Mtime int64
 	// Ctime is in unix nanoseconds
 	Ctime int64
+	// LinkID names the file in the links directory that a HardLink
+	// entry refers to.
+	LinkID string `codec:"l,omitempty"`
+	// Nlink is the number of names a hard-linked file has.  Zero
+	// means the file has never been linked, i.e. it has one name.
+	Nlink uint32 `codec:"n,omitempty"`
 }
 
 // extCode is used to register codec extensions
@@ -827,6 +930,95 @@ type TLFUpdateHistory struct {
 	Updates []UpdateSummary
 }
 
+// DiffChangeType says how a path in a top-level folder changed
+// between two revisions.
+type DiffChangeType string
+
+const (
+	// DiffAdded means the path was created.
+	DiffAdded DiffChangeType = "added"
+	// DiffRemoved means the path was removed.
+	DiffRemoved DiffChangeType = "removed"
+	// DiffRenamed means the entry at the path was renamed from
+	// somewhere else.
+	DiffRenamed DiffChangeType = "renamed"
+	// DiffModified means the file at the path was written to, or
+	// the entry had its attributes changed.
+	DiffModified DiffChangeType = "modified"
+)
+
+// DiffEntry describes how one path changed between two revisions.
+type DiffEntry struct {
+	Change DiffChangeType
+	// Path is relative to the root of the folder, as of the later
+	// revision (or as of the earlier one, for removed entries).
+	Path string
+	// OldPath is where a renamed entry was as of the earlier
+	// revision.
+	OldPath string
+	// Writes are the byte ranges of a modified file that were
+	// written to.  A range with a zero length means the file was
+	// truncated at that offset.
+	Writes []WriteRange
+	// Attrs are the attributes of a modified entry that changed.
+	Attrs []string
+}
+
+// RevisionDiff describes what changed in a TLF between two merged
+// revisions, and is suitable for encoding directly as JSON.
+type RevisionDiff struct {
+	ID      string
+	Name    string
+	From    MetadataRevision
+	To      MetadataRevision
+	Entries []DiffEntry
+}
+
+// DeletedEntry describes an entry that was removed from a top-level
+// folder, and that can still be restored with
+// KBFSOps.RestoreDeletedEntry.
+type DeletedEntry struct {
+	// EntryInfo is the entry's info as of just before it was
+	// removed.
+	EntryInfo
+	// Name is the name the entry had when it was removed.
+	Name string
+	// Dir holds the names of the directories leading from the root
+	// of the folder to the one the entry was removed from.
+	Dir []string
+	// Revision is the merged revision that removed the entry.
+	Revision MetadataRevision
+	// Date is when the entry was removed.
+	Date time.Time
+	// SnapshotRevision is the latest merged revision that has the
+	// entry, with all of its contents, at Dir/Name.  It's the one
+	// before Revision, unless the entry is a directory whose
+	// contents were removed just before it, like with `rm -rf`.
+	SnapshotRevision MetadataRevision
+
+	tlf TlfID
+	// de is the entry as of SnapshotRevision.
+	de DirEntry
+}
+
+// FileVersion describes a merged revision that changed a file, and
+// is suitable for encoding directly as JSON.
+type FileVersion struct {
+	Revision MetadataRevision
+	Date     time.Time
+	Writer   string
+	Device   string
+	// Size is the size of the file as of this revision.
+	Size uint64
+	// Ops describes the changes made to the file in this revision,
+	// in order.
+	Ops []string
+
+	// md is the revision itself, and p is the file's path in it.
+	md *RootMetadata
+	p  path
+}
+
 // writerInfo is the keybase username and device that generated the operation.
 type writerInfo struct {
 	name       libkb.NormalizedUsername
@@ -10,6 +10,11 @@ import "github.com/keybase/go-codec/codec"
 type DirEntry struct {
 	BlockInfo
 	EntryInfo
+	// Xattrs holds the extended attributes of the entry, by name.
+	// They're stored (and encrypted) along with the rest of the
+	// parent directory block, so their total size is bounded by
+	// maxXattrBytes.
+	Xattrs map[string][]byte `codec:"x,omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -33,7 +33,10 @@ func makeFakeDirEntryFuture(t *testing.T) dirEntryFuture {
 				"fake sym path",
 				101,
 				102,
+				"fake link id",
+				2,
 			},
+			map[string][]byte{"user.fake": []byte("fake value")},
 			codec.UnknownFieldSetHandler{},
 		},
 		makeExtraOrBust("dirEntry", t),
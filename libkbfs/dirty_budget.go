@@ -0,0 +1,379 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+const (
+	// How much weight a new upload throughput measurement gets in
+	// the moving average.
+	dirtyThroughputWeight = 0.3
+	// Syncs that upload fewer bytes than this in total are too
+	// dominated by latency to say much about throughput.
+	minDirtyThroughputSampleBytes = 256 << 10
+	// The longest a single write is delayed to pace its writer.
+	maxDirtyPaceDelay = 1 * time.Second
+)
+
+// dirtyFileUsage is how much data of one file hasn't been synced
+// yet.
+type dirtyFileUsage struct {
+	// unsynced counts the bytes written since the file's last sync
+	// started.
+	unsynced int64
+	// syncing counts the bytes being uploaded by the file's
+	// ongoing syncs.
+	syncing int64
+	// syncs is the number of ongoing syncs of the file.
+	syncs int
+}
+
+func (u *dirtyFileUsage) total() int64 {
+	return u.unsynced + u.syncing
+}
+
+// DirtyBudgetStandard implements the DirtyBudget interface.  The
+// budget is how much data the measured upload throughput can sync
+// in a target amount of time, within configured bounds.  It's split
+// evenly among the folders with unsynced data, and each folder's
+// share evenly among its files.  Writers of files over their share
+// are slowed down to their share of the throughput, and once the
+// block cache holds the maximum amount of dirty data, writers of the
+// folders over their share of that maximum must wait for a sync.
+type DirtyBudgetStandard struct {
+	config   Config
+	minBytes int64
+	maxBytes int64
+	syncTime time.Duration
+
+	budgetGauge     metrics.Gauge
+	throughputGauge metrics.Gauge
+	unsyncedGauge   metrics.Gauge
+	syncingGauge    metrics.Gauge
+	pacedMeter      metrics.Meter
+	blockedMeter    metrics.Meter
+
+	lock sync.Mutex
+	// throughput is a moving average of the upload throughput of
+	// syncs, in bytes per second, or 0 if it's not known yet.
+	throughput float64
+	// usage tracks the unsynced data of each file of each folder.
+	usage map[TlfID]map[NodeID]*dirtyFileUsage
+	// activeSyncs counts the ongoing syncs across all folders.
+	activeSyncs int
+	// busySince is when the current run of back-to-back syncs
+	// started, and busyBytes is how many bytes it has synced so
+	// far.
+	busySince time.Time
+	busyBytes int64
+}
+
+var _ DirtyBudget = (*DirtyBudgetStandard)(nil)
+
+// NewDirtyBudgetStandard returns a DirtyBudgetStandard whose budget
+// is the amount of data that can be uploaded in syncTime, but at
+// least minBytes and at most maxBytes.  maxBytes also limits how
+// much dirty data the block cache may hold before writes block.
+// Non-positive minBytes and syncTime get the defaults.
+func NewDirtyBudgetStandard(config Config, minBytes, maxBytes int64,
+	syncTime time.Duration) *DirtyBudgetStandard {
+	if minBytes <= 0 {
+		minBytes = dirtyBudgetMinBytesDefault
+	}
+	if syncTime <= 0 {
+		syncTime = dirtyBudgetSyncTimeDefault
+	}
+	if maxBytes < minBytes {
+		maxBytes = minBytes
+	}
+	b := &DirtyBudgetStandard{
+		config:   config,
+		minBytes: minBytes,
+		maxBytes: maxBytes,
+		syncTime: syncTime,
+		usage:    make(map[TlfID]map[NodeID]*dirtyFileUsage),
+	}
+	if registry := config.MetricsRegistry(); registry != nil {
+		b.budgetGauge = metrics.GetOrRegisterGauge(
+			"DirtyBudget.BudgetBytes", registry)
+		b.throughputGauge = metrics.GetOrRegisterGauge(
+			"DirtyBudget.ThroughputBytesPerSecond", registry)
+		b.unsyncedGauge = metrics.GetOrRegisterGauge(
+			"DirtyBudget.UnsyncedBytes", registry)
+		b.syncingGauge = metrics.GetOrRegisterGauge(
+			"DirtyBudget.SyncingBytes", registry)
+		b.pacedMeter = metrics.GetOrRegisterMeter(
+			"DirtyBudget.PacedWrites", registry)
+		b.blockedMeter = metrics.GetOrRegisterMeter(
+			"DirtyBudget.BlockedWrites", registry)
+	} else {
+		b.budgetGauge = metrics.NilGauge{}
+		b.throughputGauge = metrics.NilGauge{}
+		b.unsyncedGauge = metrics.NilGauge{}
+		b.syncingGauge = metrics.NilGauge{}
+		b.pacedMeter = metrics.NilMeter{}
+		b.blockedMeter = metrics.NilMeter{}
+	}
+	b.updateMetricsLocked()
+	return b
+}
+
+// throughputLocked returns the upload throughput to plan with.
+// Until it's been measured, assume the minimum budget can be
+// synced in time.
+func (b *DirtyBudgetStandard) throughputLocked() float64 {
+	if b.throughput > 0 {
+		return b.throughput
+	}
+	return float64(b.minBytes) / b.syncTime.Seconds()
+}
+
+// budgetLocked returns the current total budget, in bytes.
+func (b *DirtyBudgetStandard) budgetLocked() int64 {
+	budget := int64(b.throughputLocked() * b.syncTime.Seconds())
+	if budget < b.minBytes {
+		return b.minBytes
+	} else if budget > b.maxBytes {
+		return b.maxBytes
+	}
+	return budget
+}
+
+func (b *DirtyBudgetStandard) updateMetricsLocked() {
+	var unsynced, syncing int64
+	for _, files := range b.usage {
+		for _, u := range files {
+			unsynced += u.unsynced
+			syncing += u.syncing
+		}
+	}
+	b.budgetGauge.Update(b.budgetLocked())
+	b.throughputGauge.Update(int64(b.throughput))
+	b.unsyncedGauge.Update(unsynced)
+	b.syncingGauge.Update(syncing)
+}
+
+// sharesLocked returns the shares of the given folder and file in a
+// total of the given size, counting them as active even if they
+// have no unsynced data yet.  It also returns the number of active
+// folders and files overall.
+func (b *DirtyBudgetStandard) sharesLocked(tlf TlfID, file NodeID,
+	total int64) (tlfShare, fileShare int64, numTlfs, numFiles int) {
+	numTlfs = len(b.usage)
+	files, ok := b.usage[tlf]
+	if !ok {
+		numTlfs++
+	}
+	numTlfFiles := len(files)
+	if _, ok := files[file]; !ok {
+		numTlfFiles++
+	}
+	for id, files := range b.usage {
+		if id != tlf {
+			numFiles += len(files)
+		}
+	}
+	numFiles += numTlfFiles
+	tlfShare = total / int64(numTlfs)
+	return tlfShare, tlfShare / int64(numTlfFiles), numTlfs, numFiles
+}
+
+func (b *DirtyBudgetStandard) tlfUsageLocked(tlf TlfID) (total int64) {
+	for _, u := range b.usage[tlf] {
+		total += u.total()
+	}
+	return total
+}
+
+// writeDelay returns how long to delay a write of n bytes to the
+// given file, or whether it must wait for a sync instead.
+func (b *DirtyBudgetStandard) writeDelay(tlf TlfID, file NodeID,
+	n int64) (delay time.Duration, mustWait bool) {
+	// Check the block cache first, since it has its own lock.
+	dirtyBytes := b.config.BlockCache().DirtyBytesEstimate()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if dirtyBytes >= uint64(b.maxBytes) {
+		// Only hold up the folders with more than their share of
+		// the dirty data, so one big copy doesn't stall everyone.
+		maxShare, _, numTlfs, _ := b.sharesLocked(tlf, file, b.maxBytes)
+		if numTlfs == 1 || b.tlfUsageLocked(tlf) >= maxShare {
+			b.blockedMeter.Mark(1)
+			return 0, true
+		}
+	}
+
+	_, fileShare, _, numFiles := b.sharesLocked(tlf, file, b.budgetLocked())
+	var used int64
+	if u, ok := b.usage[tlf][file]; ok {
+		used = u.total()
+	}
+	if used < fileShare || n == 0 {
+		return 0, false
+	}
+	// Let the file's writer go only as fast as the file's share of
+	// the throughput can sync its data.
+	rate := b.throughputLocked() / float64(numFiles)
+	delay = time.Duration(float64(n) / rate * float64(time.Second))
+	if delay > maxDirtyPaceDelay {
+		delay = maxDirtyPaceDelay
+	}
+	b.pacedMeter.Mark(1)
+	return delay, false
+}
+
+// BeginWrite implements the DirtyBudget interface for
+// DirtyBudgetStandard.
+func (b *DirtyBudgetStandard) BeginWrite(ctx context.Context, tlf TlfID,
+	file NodeID, n int64) (mustWait bool, err error) {
+	delay, mustWait := b.writeDelay(tlf, file, n)
+	if mustWait || delay == 0 {
+		return mustWait, nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (b *DirtyBudgetStandard) getUsageLocked(
+	tlf TlfID, file NodeID) *dirtyFileUsage {
+	files, ok := b.usage[tlf]
+	if !ok {
+		files = make(map[NodeID]*dirtyFileUsage)
+		b.usage[tlf] = files
+	}
+	u, ok := files[file]
+	if !ok {
+		u = &dirtyFileUsage{}
+		files[file] = u
+	}
+	return u
+}
+
+func (b *DirtyBudgetStandard) maybeForgetLocked(tlf TlfID, file NodeID) {
+	files := b.usage[tlf]
+	if u, ok := files[file]; ok && u.syncs == 0 && u.total() == 0 {
+		delete(files, file)
+	}
+	if len(files) == 0 {
+		delete(b.usage, tlf)
+	}
+}
+
+// Dirtied implements the DirtyBudget interface for
+// DirtyBudgetStandard.
+func (b *DirtyBudgetStandard) Dirtied(tlf TlfID, file NodeID, n int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.getUsageLocked(tlf, file).unsynced += n
+	b.updateMetricsLocked()
+}
+
+// ShouldForceSync implements the DirtyBudget interface for
+// DirtyBudgetStandard.
+func (b *DirtyBudgetStandard) ShouldForceSync(tlf TlfID) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	files, ok := b.usage[tlf]
+	if !ok {
+		return false
+	}
+	tlfShare := b.budgetLocked() / int64(len(b.usage))
+	var unsynced int64
+	for _, u := range files {
+		unsynced += u.unsynced
+	}
+	return unsynced >= tlfShare
+}
+
+// SyncStarted implements the DirtyBudget interface for
+// DirtyBudgetStandard.
+func (b *DirtyBudgetStandard) SyncStarted(tlf TlfID, file NodeID) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	u := b.getUsageLocked(tlf, file)
+	u.syncing += u.unsynced
+	u.unsynced = 0
+	u.syncs++
+	if b.activeSyncs == 0 {
+		b.busySince = b.config.Clock().Now()
+		b.busyBytes = 0
+	}
+	b.activeSyncs++
+	b.updateMetricsLocked()
+}
+
+// sampleThroughputLocked folds the throughput of the current run of
+// syncs into the moving average, and starts a new run if syncs are
+// still going on.
+func (b *DirtyBudgetStandard) sampleThroughputLocked() {
+	now := b.config.Clock().Now()
+	elapsed := now.Sub(b.busySince).Seconds()
+	if b.busyBytes < minDirtyThroughputSampleBytes || elapsed <= 0 {
+		return
+	}
+	sample := float64(b.busyBytes) / elapsed
+	if b.throughput == 0 {
+		b.throughput = sample
+	} else {
+		b.throughput = dirtyThroughputWeight*sample +
+			(1-dirtyThroughputWeight)*b.throughput
+	}
+	b.busySince = now
+	b.busyBytes = 0
+}
+
+// SyncFinished implements the DirtyBudget interface for
+// DirtyBudgetStandard.
+func (b *DirtyBudgetStandard) SyncFinished(tlf TlfID, file NodeID,
+	stillDirty bool, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	u := b.getUsageLocked(tlf, file)
+	if u.syncs > 0 {
+		u.syncs--
+		b.activeSyncs--
+	}
+	if err != nil {
+		// The data is still waiting to be synced.
+		u.unsynced += u.syncing
+	} else {
+		b.busyBytes += u.syncing
+		if !stillDirty {
+			// Any writes that raced with the start of the sync
+			// made it in, too.
+			u.unsynced = 0
+		}
+	}
+	u.syncing = 0
+	if b.activeSyncs == 0 ||
+		b.config.Clock().Now().Sub(b.busySince) >= b.syncTime {
+		b.sampleThroughputLocked()
+	}
+	b.maybeForgetLocked(tlf, file)
+	b.updateMetricsLocked()
+}
+
+// Discarded implements the DirtyBudget interface for
+// DirtyBudgetStandard.
+func (b *DirtyBudgetStandard) Discarded(tlf TlfID, file NodeID) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.getUsageLocked(tlf, file).unsynced = 0
+	b.maybeForgetLocked(tlf, file)
+	b.updateMetricsLocked()
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+func checkDirtyBudgetGauge(t *testing.T, config Config, name string,
+	expected int64) {
+	gauge, ok := config.MetricsRegistry().Get(
+		"DirtyBudget." + name).(metrics.Gauge)
+	if !ok {
+		t.Fatalf("No %s gauge", name)
+	}
+	if v := gauge.Value(); v != expected {
+		t.Errorf("%s is %d, expected %d", name, v, expected)
+	}
+}
+
+func TestDirtyBudgetAdaptsToThroughput(t *testing.T) {
+	config := NewConfigLocal()
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	b := NewDirtyBudgetStandard(config, 1<<20, 100<<20, time.Second)
+	tlf := FakeTlfID(1, false)
+	file := newNodeCore(BlockPointer{}, "a", nil, nil)
+
+	// Until the throughput is known, the budget is the minimum.
+	checkDirtyBudgetGauge(t, config, "BudgetBytes", 1<<20)
+
+	b.Dirtied(tlf, file, 10<<20)
+	checkDirtyBudgetGauge(t, config, "UnsyncedBytes", 10<<20)
+	b.SyncStarted(tlf, file)
+	checkDirtyBudgetGauge(t, config, "UnsyncedBytes", 0)
+	checkDirtyBudgetGauge(t, config, "SyncingBytes", 10<<20)
+	clock.Add(time.Second)
+	b.SyncFinished(tlf, file, false, nil)
+	checkDirtyBudgetGauge(t, config, "SyncingBytes", 0)
+	checkDirtyBudgetGauge(t, config, "ThroughputBytesPerSecond", 10<<20)
+	checkDirtyBudgetGauge(t, config, "BudgetBytes", 10<<20)
+
+	// A failed sync leaves its data dirty, and says nothing about
+	// the throughput.
+	b.Dirtied(tlf, file, 10<<20)
+	b.SyncStarted(tlf, file)
+	clock.Add(10 * time.Second)
+	b.SyncFinished(tlf, file, false, errors.New("sync failed"))
+	checkDirtyBudgetGauge(t, config, "UnsyncedBytes", 10<<20)
+	checkDirtyBudgetGauge(t, config, "ThroughputBytesPerSecond", 10<<20)
+
+	// A really fast link can't make the budget go over the maximum.
+	b.SyncStarted(tlf, file)
+	clock.Add(time.Millisecond)
+	b.SyncFinished(tlf, file, false, nil)
+	checkDirtyBudgetGauge(t, config, "BudgetBytes", 100<<20)
+
+	// Discarded data doesn't count as dirty anymore.
+	b.Dirtied(tlf, file, 10<<20)
+	b.Discarded(tlf, file)
+	checkDirtyBudgetGauge(t, config, "UnsyncedBytes", 0)
+}
+
+func TestDirtyBudgetFairShares(t *testing.T) {
+	config := NewConfigLocal()
+	b := NewDirtyBudgetStandard(config, 1<<20, 1<<20, time.Second)
+	tlf1 := FakeTlfID(1, false)
+	tlf2 := FakeTlfID(2, false)
+	fileA := newNodeCore(BlockPointer{}, "a", nil, nil)
+	fileB := newNodeCore(BlockPointer{}, "b", nil, nil)
+	fileC := newNodeCore(BlockPointer{}, "c", nil, nil)
+
+	checkDelay := func(tlf TlfID, file NodeID, expected time.Duration) {
+		delay, mustWait := b.writeDelay(tlf, file, 64<<10)
+		if mustWait {
+			t.Fatalf("Write unexpectedly has to wait for a sync")
+		}
+		if delay != expected {
+			t.Errorf("Write delayed by %s, expected %s", delay, expected)
+		}
+	}
+
+	// While it's the only file being written, a file gets the
+	// whole budget.
+	b.Dirtied(tlf1, fileA, 600<<10)
+	checkDelay(tlf1, fileA, 0)
+	checkDelay(tlf1, fileB, 0)
+	checkDelay(tlf2, fileC, 0)
+	if b.ShouldForceSync(tlf1) {
+		t.Errorf("Unexpected forced sync with the whole budget")
+	}
+
+	// Once another folder is being written too, the first file is
+	// over its half of the budget, and is paced to half of the
+	// assumed throughput of 1 MiB/s.
+	b.Dirtied(tlf2, fileC, 100<<10)
+	checkDelay(tlf1, fileA, 125*time.Millisecond)
+	checkDelay(tlf2, fileC, 0)
+	if !b.ShouldForceSync(tlf1) {
+		t.Errorf("No forced sync for a folder over its share")
+	}
+	if b.ShouldForceSync(tlf2) {
+		t.Errorf("Unexpected forced sync for a folder under its share")
+	}
+
+	b.SyncStarted(tlf1, fileA)
+	b.SyncFinished(tlf1, fileA, false, nil)
+	checkDelay(tlf1, fileA, 0)
+	if b.ShouldForceSync(tlf1) {
+		t.Errorf("Unexpected forced sync after a sync")
+	}
+}
+
+// stallingBlockServer stalls the block puts of one folder until
+// they're let through.
+type stallingBlockServer struct {
+	BlockServer
+	tlf     TlfID
+	stalled chan<- struct{}
+	unstall <-chan struct{}
+}
+
+func (s *stallingBlockServer) Put(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	if tlfID == s.tlf {
+		select {
+		case s.stalled <- struct{}{}:
+		default:
+		}
+		select {
+		case <-s.unstall:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return s.BlockServer.Put(ctx, id, tlfID, context, buf, serverHalf)
+}
+
+// Test that a folder with too much dirty data only blocks its own
+// writers, and not those of other folders.
+func TestDirtyBudgetBlocksOnlyFolderOverShare(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	const maxDirtyBytes = 64 << 10
+	config.SetDirtyBudget(NewDirtyBudgetStandard(
+		config, maxDirtyBytes, maxDirtyBytes, dirtyBudgetSyncTimeDefault))
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	publicRootNode := GetRootNodeOrBust(t, config, "test_user", true)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	publicFileNode, _, err := kbfsOps.CreateFile(
+		ctx, publicRootNode, "b", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	stalled := make(chan struct{}, 1)
+	unstall := make(chan struct{})
+	bserver := config.BlockServer()
+	config.SetBlockServer(&stallingBlockServer{
+		BlockServer: bserver,
+		tlf:         rootNode.GetFolderBranch().Tlf,
+		stalled:     stalled,
+		unstall:     unstall,
+	})
+
+	// Fill up the dirty data of the private folder, and get it
+	// stuck syncing.
+	data := make([]byte, maxDirtyBytes+1)
+	if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	syncErrCh := make(chan error, 1)
+	go func() {
+		syncErrCh <- kbfsOps.Sync(ctx, fileNode)
+	}()
+	<-stalled
+
+	// The public folder can still be written to.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err = kbfsOps.Write(timeoutCtx, publicFileNode, []byte{1}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write to the other folder: %v", err)
+	}
+
+	// But more writes to the private folder have to wait.
+	writeErrCh := make(chan error, 1)
+	go func() {
+		writeErrCh <- kbfsOps.Write(
+			ctx, fileNode, []byte{1}, int64(len(data)))
+	}()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	func() {
+		lState := makeFBOLockState()
+		ops.blocks.blockLock.Lock(lState)
+		defer ops.blocks.blockLock.Unlock(lState)
+		for len(ops.blocks.syncListeners) == 0 {
+			ops.blocks.blockLock.Unlock(lState)
+			runtime.Gosched()
+			ops.blocks.blockLock.Lock(lState)
+		}
+	}()
+	select {
+	case err := <-writeErrCh:
+		t.Fatalf("Write wasn't blocked: %v", err)
+	default:
+	}
+
+	close(unstall)
+	if err := <-syncErrCh; err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	if err := <-writeErrCh; err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	meter, ok := config.MetricsRegistry().Get(
+		"DirtyBudget.BlockedWrites").(metrics.Meter)
+	if !ok || meter.Count() == 0 {
+		t.Errorf("No blocked writes recorded")
+	}
+
+	// The state checker needs the real block server.
+	config.SetBlockServer(bserver)
+	for _, n := range []Node{fileNode, publicFileNode} {
+		if err := kbfsOps.Sync(ctx, n); err != nil {
+			t.Fatalf("Couldn't sync file: %v", err)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	// diskBlockCacheBlockPrefix prefixes the keys of the encrypted
+	// block entries.
+	diskBlockCacheBlockPrefix = 'b'
+	// diskBlockCacheUsagePrefix prefixes the keys of the usage
+	// records, which are used to rebuild the LRU order on startup
+	// without reading every block.
+	diskBlockCacheUsagePrefix = 'u'
+	// diskBlockCacheMaxUnflushedUses is the number of cache hits
+	// that can be recorded only in memory before their usage records
+	// are written to the db in one batch.
+	diskBlockCacheMaxUnflushedUses = 100
+)
+
+type diskBlockCacheEntry struct {
+	// These fields are only exported for serialization purposes.
+	Buf        []byte
+	ServerHalf BlockCryptKeyServerHalf
+}
+
+type diskBlockCacheUsage struct {
+	// These fields are only exported for serialization purposes.
+	LastUsed int64 // in nanoseconds since the Unix epoch
+	Size     int64
+}
+
+type diskBlockCacheLRUEntry struct {
+	id       BlockID
+	size     int64
+	lastUsed int64 // in nanoseconds since the Unix epoch
+}
+
+// DiskBlockCacheStandard implements the DiskBlockCache interface
+// with a leveldb instance, evicting the least recently used blocks
+// once the total size of the cached entries would exceed maxBytes.
+//
+// Each block is written in the same leveldb batch as its usage
+// record, so a crash can lose recent entries but never leaves a
+// partial one behind.  Cache hits only update the usage records in
+// memory; they're written to the db along with the next put, or in
+// their own batch once enough of them have accumulated, so a crash
+// can also lose some recent uses.
+type DiskBlockCacheStandard struct {
+	config    Config
+	log       logger.Logger
+	maxBytes  int64
+	hitMeter  metrics.Meter
+	missMeter metrics.Meter
+
+	lock    sync.Mutex
+	storage storage.Storage
+	// db is nil after shutdown.
+	db *leveldb.DB
+	// lru holds diskBlockCacheLRUEntry objects, with the most
+	// recently used one at the front.
+	lru       *list.List
+	elems     map[BlockID]*list.Element
+	currBytes int64
+	// unflushedUses holds the IDs of entries that have been used
+	// since their usage records were last written to the db.
+	unflushedUses map[BlockID]bool
+}
+
+var _ DiskBlockCache = (*DiskBlockCacheStandard)(nil)
+
+func newDiskBlockCacheStandardWithStorage(config Config,
+	storage storage.Storage, maxBytes int64) (*DiskBlockCacheStandard, error) {
+	db, err := leveldb.Open(storage, leveldbOptions)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	var hitMeter, missMeter metrics.Meter
+	if registry := config.MetricsRegistry(); registry != nil {
+		hitMeter = metrics.GetOrRegisterMeter(
+			"DiskBlockCache.HitCount", registry)
+		missMeter = metrics.GetOrRegisterMeter(
+			"DiskBlockCache.MissCount", registry)
+	} else {
+		hitMeter = metrics.NilMeter{}
+		missMeter = metrics.NilMeter{}
+	}
+
+	cache := &DiskBlockCacheStandard{
+		config:    config,
+		log:       config.MakeLogger(""),
+		maxBytes:  maxBytes,
+		hitMeter:  hitMeter,
+		missMeter: missMeter,
+		storage:   storage,
+		db:        db,
+		lru:       list.New(),
+		elems:     make(map[BlockID]*list.Element),
+
+		unflushedUses: make(map[BlockID]bool),
+	}
+	err = cache.load()
+	if err != nil {
+		cache.Shutdown()
+		return nil, err
+	}
+	return cache, nil
+}
+
+// NewDiskBlockCacheStandard returns a DiskBlockCacheStandard with a
+// leveldb instance in the given directory, holding at most maxBytes
+// of cached entries.
+func NewDiskBlockCacheStandard(config Config, dirPath string,
+	maxBytes int64) (*DiskBlockCacheStandard, error) {
+	storage, err := storage.OpenFile(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	return newDiskBlockCacheStandardWithStorage(config, storage, maxBytes)
+}
+
+// NewDiskBlockCacheMemory returns a DiskBlockCacheStandard with an
+// in-memory leveldb instance, holding at most maxBytes of cached
+// entries.
+func NewDiskBlockCacheMemory(config Config, maxBytes int64) (
+	*DiskBlockCacheStandard, error) {
+	return newDiskBlockCacheStandardWithStorage(
+		config, storage.NewMemStorage(), maxBytes)
+}
+
+type diskBlockCacheIDUsage struct {
+	id    BlockID
+	usage diskBlockCacheUsage
+}
+
+// diskBlockCacheUsagesByLastUsed sorts usage records from the least
+// recently used to the most recently used.
+type diskBlockCacheUsagesByLastUsed []diskBlockCacheIDUsage
+
+func (u diskBlockCacheUsagesByLastUsed) Len() int {
+	return len(u)
+}
+
+func (u diskBlockCacheUsagesByLastUsed) Less(i, j int) bool {
+	return u[i].usage.LastUsed < u[j].usage.LastUsed
+}
+
+func (u diskBlockCacheUsagesByLastUsed) Swap(i, j int) {
+	u[i], u[j] = u[j], u[i]
+}
+
+func diskBlockCacheKey(prefix byte, id BlockID) []byte {
+	return append([]byte{prefix}, id.Bytes()...)
+}
+
+// load rebuilds the LRU list from the usage records in the db, and
+// evicts entries in case the size limit has shrunk since they were
+// written.
+func (c *DiskBlockCacheStandard) load() error {
+	var usages []diskBlockCacheIDUsage
+	iter := c.db.NewIterator(
+		util.BytesPrefix([]byte{diskBlockCacheUsagePrefix}), nil)
+	for iter.Next() {
+		var id BlockID
+		err := id.UnmarshalBinary(iter.Key()[1:])
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		var usage diskBlockCacheUsage
+		err = c.config.Codec().Decode(iter.Value(), &usage)
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		usages = append(usages, diskBlockCacheIDUsage{id, usage})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	sort.Sort(diskBlockCacheUsagesByLastUsed(usages))
+	for _, u := range usages {
+		c.elems[u.id] = c.lru.PushFront(diskBlockCacheLRUEntry{
+			u.id, u.usage.Size, u.usage.LastUsed})
+		c.currBytes += u.usage.Size
+	}
+
+	batch := new(leveldb.Batch)
+	evicted := c.evictLocked(batch, 0)
+	if batch.Len() == 0 {
+		return nil
+	}
+	err := c.db.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+	for _, id := range evicted {
+		c.removeLocked(id)
+	}
+	return nil
+}
+
+// evictLocked adds deletions to batch for the least recently used
+// entries, until there's room for another entry of the given size,
+// and returns the IDs of those entries.  It doesn't change the
+// in-memory state; the caller must call removeLocked on the
+// returned IDs once the batch has been written successfully.  It
+// must be called with c.lock held.
+func (c *DiskBlockCacheStandard) evictLocked(batch *leveldb.Batch,
+	size int64) (evicted []BlockID) {
+	currBytes := c.currBytes
+	elem := c.lru.Back()
+	for ; elem != nil && currBytes+size > c.maxBytes; elem = elem.Prev() {
+		entry := elem.Value.(diskBlockCacheLRUEntry)
+		batch.Delete(diskBlockCacheKey(diskBlockCacheBlockPrefix, entry.id))
+		batch.Delete(diskBlockCacheKey(diskBlockCacheUsagePrefix, entry.id))
+		evicted = append(evicted, entry.id)
+		currBytes -= entry.size
+	}
+	return evicted
+}
+
+// addUnflushedUsesLocked adds the usage records of all the entries
+// used since the last flush to batch.  The caller must clear
+// c.unflushedUses once the batch has been written successfully.  It
+// must be called with c.lock held.
+func (c *DiskBlockCacheStandard) addUnflushedUsesLocked(
+	batch *leveldb.Batch) error {
+	for id := range c.unflushedUses {
+		elem, ok := c.elems[id]
+		if !ok {
+			continue
+		}
+		entry := elem.Value.(diskBlockCacheLRUEntry)
+		usageBuf, err := c.encodeUsage(entry.lastUsed, entry.size)
+		if err != nil {
+			return err
+		}
+		batch.Put(diskBlockCacheKey(diskBlockCacheUsagePrefix, id), usageBuf)
+	}
+	return nil
+}
+
+// flushUsesLocked writes the usage records of all the entries used
+// since the last flush to the db.  It must be called with c.lock
+// held.
+func (c *DiskBlockCacheStandard) flushUsesLocked() error {
+	if len(c.unflushedUses) == 0 {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	err := c.addUnflushedUsesLocked(batch)
+	if err != nil {
+		return err
+	}
+	err = c.db.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+	c.unflushedUses = make(map[BlockID]bool)
+	return nil
+}
+
+// useLocked moves the given entry to the front of the LRU list, and
+// marks its usage record as needing to be written.  It must be
+// called with c.lock held.
+func (c *DiskBlockCacheStandard) useLocked(elem *list.Element) {
+	entry := elem.Value.(diskBlockCacheLRUEntry)
+	entry.lastUsed = c.config.Clock().Now().UnixNano()
+	elem.Value = entry
+	c.lru.MoveToFront(elem)
+	c.unflushedUses[entry.id] = true
+}
+
+func (c *DiskBlockCacheStandard) removeLocked(id BlockID) {
+	elem, ok := c.elems[id]
+	if !ok {
+		return
+	}
+	c.currBytes -= elem.Value.(diskBlockCacheLRUEntry).size
+	c.lru.Remove(elem)
+	delete(c.elems, id)
+	delete(c.unflushedUses, id)
+}
+
+func (c *DiskBlockCacheStandard) encodeUsage(lastUsed, size int64) (
+	[]byte, error) {
+	return c.config.Codec().Encode(diskBlockCacheUsage{
+		LastUsed: lastUsed,
+		Size:     size,
+	})
+}
+
+var errDiskBlockCacheShutdown = errors.New("Disk block cache already shut down")
+
+// Get implements the DiskBlockCache interface for DiskBlockCacheStandard.
+func (c *DiskBlockCacheStandard) Get(ctx context.Context, id BlockID) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.db == nil {
+		return nil, BlockCryptKeyServerHalf{}, errDiskBlockCacheShutdown
+	}
+
+	elem, ok := c.elems[id]
+	if !ok {
+		c.missMeter.Mark(1)
+		return nil, BlockCryptKeyServerHalf{}, NoSuchBlockError{id}
+	}
+
+	buf, err := c.db.Get(diskBlockCacheKey(diskBlockCacheBlockPrefix, id), nil)
+	if err == leveldb.ErrNotFound {
+		c.removeLocked(id)
+		c.missMeter.Mark(1)
+		return nil, BlockCryptKeyServerHalf{}, NoSuchBlockError{id}
+	} else if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+
+	var entry diskBlockCacheEntry
+	err = c.config.Codec().Decode(buf, &entry)
+	if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+
+	c.useLocked(elem)
+	if len(c.unflushedUses) >= diskBlockCacheMaxUnflushedUses {
+		// Failing to record the uses only affects the eviction
+		// order after a restart, so don't fail the get over it.
+		err := c.flushUsesLocked()
+		if err != nil {
+			c.log.CDebugf(ctx, "Couldn't record block uses: %v", err)
+		}
+	}
+	c.hitMeter.Mark(1)
+	return entry.Buf, entry.ServerHalf, nil
+}
+
+// Put implements the DiskBlockCache interface for DiskBlockCacheStandard.
+func (c *DiskBlockCacheStandard) Put(ctx context.Context, id BlockID,
+	buf []byte, serverHalf BlockCryptKeyServerHalf) error {
+	entryBuf, err := c.config.Codec().Encode(diskBlockCacheEntry{
+		Buf:        buf,
+		ServerHalf: serverHalf,
+	})
+	if err != nil {
+		return err
+	}
+	size := int64(len(entryBuf))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.db == nil {
+		return errDiskBlockCacheShutdown
+	}
+	if size > c.maxBytes {
+		// It would only evict everything else.
+		return nil
+	}
+	if elem, ok := c.elems[id]; ok {
+		// Blocks are immutable, so there's nothing new to write.
+		c.useLocked(elem)
+		return nil
+	}
+
+	now := c.config.Clock().Now().UnixNano()
+	usageBuf, err := c.encodeUsage(now, size)
+	if err != nil {
+		return err
+	}
+
+	// Write the pending uses first, so that the deletions of any
+	// evicted entries come after them in the batch.
+	batch := new(leveldb.Batch)
+	err = c.addUnflushedUsesLocked(batch)
+	if err != nil {
+		return err
+	}
+	evicted := c.evictLocked(batch, size)
+	batch.Put(diskBlockCacheKey(diskBlockCacheBlockPrefix, id), entryBuf)
+	batch.Put(diskBlockCacheKey(diskBlockCacheUsagePrefix, id), usageBuf)
+	err = c.db.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+
+	c.unflushedUses = make(map[BlockID]bool)
+	for _, evictedID := range evicted {
+		c.removeLocked(evictedID)
+	}
+	c.elems[id] = c.lru.PushFront(diskBlockCacheLRUEntry{id, size, now})
+	c.currBytes += size
+	return nil
+}
+
+// Delete implements the DiskBlockCache interface for DiskBlockCacheStandard.
+func (c *DiskBlockCacheStandard) Delete(ctx context.Context,
+	ids []BlockID) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.db == nil {
+		return errDiskBlockCacheShutdown
+	}
+
+	batch := new(leveldb.Batch)
+	var deleted []BlockID
+	for _, id := range ids {
+		if _, ok := c.elems[id]; !ok {
+			continue
+		}
+		batch.Delete(diskBlockCacheKey(diskBlockCacheBlockPrefix, id))
+		batch.Delete(diskBlockCacheKey(diskBlockCacheUsagePrefix, id))
+		deleted = append(deleted, id)
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	err := c.db.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+	for _, id := range deleted {
+		c.removeLocked(id)
+	}
+	return nil
+}
+
+// Size returns the total encoded size of the cached entries.
+func (c *DiskBlockCacheStandard) Size() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.currBytes
+}
+
+// Shutdown implements the DiskBlockCache interface for DiskBlockCacheStandard.
+func (c *DiskBlockCacheStandard) Shutdown() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.db == nil {
+		return
+	}
+	err := c.flushUsesLocked()
+	if err != nil {
+		c.log.Debug("Couldn't record block uses on shutdown: %v", err)
+	}
+	c.db.Close()
+	c.db = nil
+	// Unlike with leveldb.OpenFile, closing the db doesn't close
+	// the storage it was opened with.
+	c.storage.Close()
+}
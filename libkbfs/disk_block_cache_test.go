@@ -0,0 +1,236 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+func diskBlockCacheTestConfig(t *testing.T) (*ConfigLocal, *TestClock) {
+	config := NewConfigLocal()
+	config.SetLoggerMaker(func(m string) logger.Logger {
+		return logger.NewTestLogger(t)
+	})
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	return config, clock
+}
+
+func checkDiskBlockCacheHit(ctx context.Context, t *testing.T,
+	cache DiskBlockCache, id BlockID, expectedBuf []byte,
+	expectedServerHalf BlockCryptKeyServerHalf) {
+	buf, serverHalf, err := cache.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("Couldn't get block %s: %v", id, err)
+	}
+	if !bytes.Equal(buf, expectedBuf) {
+		t.Errorf("Got buf %v for block %s, expected %v",
+			buf, id, expectedBuf)
+	}
+	if serverHalf != expectedServerHalf {
+		t.Errorf("Got server half %v for block %s, expected %v",
+			serverHalf, id, expectedServerHalf)
+	}
+}
+
+func checkDiskBlockCacheMiss(ctx context.Context, t *testing.T,
+	cache DiskBlockCache, id BlockID) {
+	_, _, err := cache.Get(ctx, id)
+	if _, ok := err.(NoSuchBlockError); !ok {
+		t.Errorf("Got unexpected error for block %s: %v", id, err)
+	}
+}
+
+func TestDiskBlockCachePutGetDelete(t *testing.T) {
+	config, _ := diskBlockCacheTestConfig(t)
+	registry := metrics.NewRegistry()
+	config.SetMetricsRegistry(registry)
+	cache, err := NewDiskBlockCacheMemory(config, 1024*1024)
+	if err != nil {
+		t.Fatalf("Couldn't make cache: %v", err)
+	}
+	defer cache.Shutdown()
+	ctx := context.Background()
+
+	id := fakeBlockID(1)
+	buf := []byte{1, 2, 3, 4}
+	serverHalf := MakeBlockCryptKeyServerHalf([32]byte{5})
+
+	checkDiskBlockCacheMiss(ctx, t, cache, id)
+	err = cache.Put(ctx, id, buf, serverHalf)
+	if err != nil {
+		t.Fatalf("Couldn't put block: %v", err)
+	}
+	checkDiskBlockCacheHit(ctx, t, cache, id, buf, serverHalf)
+
+	err = cache.Delete(ctx, []BlockID{id, fakeBlockID(2)})
+	if err != nil {
+		t.Fatalf("Couldn't delete block: %v", err)
+	}
+	checkDiskBlockCacheMiss(ctx, t, cache, id)
+	if size := cache.Size(); size != 0 {
+		t.Errorf("Cache still has %d bytes after delete", size)
+	}
+
+	hits := registry.Get("DiskBlockCache.HitCount").(metrics.Meter)
+	if count := hits.Count(); count != 1 {
+		t.Errorf("Got %d hits, expected 1", count)
+	}
+	misses := registry.Get("DiskBlockCache.MissCount").(metrics.Meter)
+	if count := misses.Count(); count != 2 {
+		t.Errorf("Got %d misses, expected 2", count)
+	}
+}
+
+func TestDiskBlockCacheEvictLRU(t *testing.T) {
+	config, clock := diskBlockCacheTestConfig(t)
+	ctx := context.Background()
+
+	// Find out how big each entry is.
+	sizeCache, err := NewDiskBlockCacheMemory(config, 1024*1024)
+	if err != nil {
+		t.Fatalf("Couldn't make cache: %v", err)
+	}
+	defer sizeCache.Shutdown()
+	err = sizeCache.Put(ctx, fakeBlockID(1), []byte{1, 2, 3, 4},
+		BlockCryptKeyServerHalf{})
+	if err != nil {
+		t.Fatalf("Couldn't put block: %v", err)
+	}
+	entrySize := sizeCache.Size()
+
+	cache, err := NewDiskBlockCacheMemory(config, 2*entrySize)
+	if err != nil {
+		t.Fatalf("Couldn't make cache: %v", err)
+	}
+	defer cache.Shutdown()
+
+	put := func(b byte) {
+		clock.Add(time.Second)
+		err := cache.Put(ctx, fakeBlockID(b), []byte{b, b, b, b},
+			BlockCryptKeyServerHalf{})
+		if err != nil {
+			t.Fatalf("Couldn't put block: %v", err)
+		}
+	}
+	put(1)
+	put(2)
+	// Use block 1, so that block 2 is the one evicted.
+	clock.Add(time.Second)
+	checkDiskBlockCacheHit(ctx, t, cache, fakeBlockID(1),
+		[]byte{1, 1, 1, 1}, BlockCryptKeyServerHalf{})
+	put(3)
+
+	checkDiskBlockCacheMiss(ctx, t, cache, fakeBlockID(2))
+	checkDiskBlockCacheHit(ctx, t, cache, fakeBlockID(1),
+		[]byte{1, 1, 1, 1}, BlockCryptKeyServerHalf{})
+	checkDiskBlockCacheHit(ctx, t, cache, fakeBlockID(3),
+		[]byte{3, 3, 3, 3}, BlockCryptKeyServerHalf{})
+	if size := cache.Size(); size != 2*entrySize {
+		t.Errorf("Cache has %d bytes, expected %d", size, 2*entrySize)
+	}
+}
+
+func TestDiskBlockCacheRestart(t *testing.T) {
+	config, clock := diskBlockCacheTestConfig(t)
+	ctx := context.Background()
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "kbfs_disk_block_cache")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	cache, err := NewDiskBlockCacheStandard(config, tempdir, 1024*1024)
+	if err != nil {
+		t.Fatalf("Couldn't make cache: %v", err)
+	}
+	for b := byte(1); b <= 3; b++ {
+		clock.Add(time.Second)
+		err := cache.Put(ctx, fakeBlockID(b), []byte{b, b, b, b},
+			BlockCryptKeyServerHalf{})
+		if err != nil {
+			t.Fatalf("Couldn't put block: %v", err)
+		}
+	}
+	entrySize := cache.Size() / 3
+	// Use block 1, so that block 2 is the least recently used.
+	clock.Add(time.Second)
+	checkDiskBlockCacheHit(ctx, t, cache, fakeBlockID(1),
+		[]byte{1, 1, 1, 1}, BlockCryptKeyServerHalf{})
+	cache.Shutdown()
+
+	// Reopen with room for only two of the blocks.
+	cache, err = NewDiskBlockCacheStandard(config, tempdir, 2*entrySize)
+	if err != nil {
+		t.Fatalf("Couldn't reopen cache: %v", err)
+	}
+	defer cache.Shutdown()
+
+	checkDiskBlockCacheMiss(ctx, t, cache, fakeBlockID(2))
+	checkDiskBlockCacheHit(ctx, t, cache, fakeBlockID(1),
+		[]byte{1, 1, 1, 1}, BlockCryptKeyServerHalf{})
+	checkDiskBlockCacheHit(ctx, t, cache, fakeBlockID(3),
+		[]byte{3, 3, 3, 3}, BlockCryptKeyServerHalf{})
+}
+
+func TestDiskBlockCacheFlushUses(t *testing.T) {
+	config, clock := diskBlockCacheTestConfig(t)
+	cache, err := NewDiskBlockCacheMemory(config, 1024*1024)
+	if err != nil {
+		t.Fatalf("Couldn't make cache: %v", err)
+	}
+	defer cache.Shutdown()
+	ctx := context.Background()
+
+	getLastUsed := func(id BlockID) int64 {
+		buf, err := cache.db.Get(
+			diskBlockCacheKey(diskBlockCacheUsagePrefix, id), nil)
+		if err != nil {
+			t.Fatalf("Couldn't get usage of block %s: %v", id, err)
+		}
+		var usage diskBlockCacheUsage
+		err = config.Codec().Decode(buf, &usage)
+		if err != nil {
+			t.Fatalf("Couldn't decode usage of block %s: %v", id, err)
+		}
+		return usage.LastUsed
+	}
+
+	id := fakeBlockID(1)
+	err = cache.Put(ctx, id, []byte{1, 2, 3, 4}, BlockCryptKeyServerHalf{})
+	if err != nil {
+		t.Fatalf("Couldn't put block: %v", err)
+	}
+	putTime := clock.Now().UnixNano()
+
+	// Hits are only recorded in memory at first.
+	for i := 0; i < diskBlockCacheMaxUnflushedUses-1; i++ {
+		clock.Add(time.Second)
+		checkDiskBlockCacheHit(ctx, t, cache, id,
+			[]byte{1, 2, 3, 4}, BlockCryptKeyServerHalf{})
+	}
+	if lastUsed := getLastUsed(id); lastUsed != putTime {
+		t.Errorf("Usage written after %d hits", diskBlockCacheMaxUnflushedUses-1)
+	}
+
+	// The next put writes them out.
+	err = cache.Put(ctx, fakeBlockID(2), []byte{5, 6, 7, 8},
+		BlockCryptKeyServerHalf{})
+	if err != nil {
+		t.Fatalf("Couldn't put block: %v", err)
+	}
+	if lastUsed := getLastUsed(id); lastUsed != clock.Now().UnixNano() {
+		t.Errorf("Usage not written on put")
+	}
+}
@@ -0,0 +1,420 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"golang.org/x/net/context"
+)
+
+const (
+	// diskMDCacheHeadPrefix prefixes the keys of the persisted
+	// heads, which are TLF IDs.
+	diskMDCacheHeadPrefix = 'h'
+	// diskMDCacheNamePrefix prefixes the keys of the index from
+	// canonical TLF paths to TLF IDs.
+	diskMDCacheNamePrefix = 'n'
+	// diskMDCacheRevisionPrefix prefixes the keys of the revisions
+	// of the persisted heads, so they can be checked without
+	// decoding the whole head.
+	diskMDCacheRevisionPrefix = 'r'
+	// diskMDCacheKeyPrefix is the key of the sealed cache key.
+	diskMDCacheKeyPrefix = 'k'
+)
+
+// diskMDCacheSealedKey is the key that the persisted heads are
+// encrypted with, itself encrypted for the current device the same
+// way a TLF crypt key client half is, so that only this device's
+// private key (held by the keybase service) can unlock the cache.
+type diskMDCacheSealedKey struct {
+	// These fields are only exported for serialization purposes.
+	DeviceKey  CryptPublicKey
+	EPubKey    TLFEphemeralPublicKey
+	ClientHalf EncryptedTLFCryptKeyClientHalf
+}
+
+type diskMDCacheEntry struct {
+	// These fields are only exported for serialization purposes.
+	MD        *RootMetadata
+	Data      PrivateMetadata
+	Keys      map[KeyGen]TLFCryptKey
+	Usernames map[keybase1.UID]libkb.NormalizedUsername
+}
+
+// diskMDCacheUsernames resolves UIDs to the usernames persisted with
+// a head, so that its handle can be rebuilt without the help of the
+// keybase service.
+type diskMDCacheUsernames map[keybase1.UID]libkb.NormalizedUsername
+
+var _ normalizedUsernameGetter = diskMDCacheUsernames(nil)
+
+func (u diskMDCacheUsernames) GetNormalizedUsername(
+	ctx context.Context, uid keybase1.UID) (libkb.NormalizedUsername, error) {
+	name, ok := u[uid]
+	if !ok {
+		return "", NoSuchUserError{uid.String()}
+	}
+	return name, nil
+}
+
+// DiskMDCacheStandard implements the DiskMDCache interface with a
+// leveldb instance.  Since the heads hold decrypted metadata and the
+// keys for the folders, they're encrypted with a random key that's
+// sealed for the current device; the index of handles is keyed by
+// an HMAC of the folder names, so that they aren't stored in the
+// clear either.  If a different device opens the cache, it's wiped
+// and started again with a new key.
+type DiskMDCacheStandard struct {
+	config Config
+	crypto CryptoCommon
+
+	lock    sync.Mutex
+	storage storage.Storage
+	// db is nil after shutdown.
+	db *leveldb.DB
+	// key is the unsealed cache key for deviceKey, or nil if it
+	// hasn't been needed yet.
+	key       *TLFCryptKey
+	deviceKey CryptPublicKey
+}
+
+var _ DiskMDCache = (*DiskMDCacheStandard)(nil)
+
+func newDiskMDCacheStandardWithStorage(config Config,
+	storage storage.Storage) (*DiskMDCacheStandard, error) {
+	db, err := leveldb.Open(storage, leveldbOptions)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return &DiskMDCacheStandard{
+		config:  config,
+		crypto:  MakeCryptoCommon(config),
+		storage: storage,
+		db:      db,
+	}, nil
+}
+
+// NewDiskMDCacheStandard returns a DiskMDCacheStandard with a leveldb
+// instance in the given directory, which is created if needed with
+// permissions that keep out other users.
+func NewDiskMDCacheStandard(config Config, dirPath string) (
+	*DiskMDCacheStandard, error) {
+	err := os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := storage.OpenFile(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	return newDiskMDCacheStandardWithStorage(config, storage)
+}
+
+// NewDiskMDCacheMemory returns a DiskMDCacheStandard with an
+// in-memory leveldb instance.
+func NewDiskMDCacheMemory(config Config) (*DiskMDCacheStandard, error) {
+	return newDiskMDCacheStandardWithStorage(config, storage.NewMemStorage())
+}
+
+func diskMDCacheTlfKey(prefix byte, id TlfID) []byte {
+	return append([]byte{prefix}, id.Bytes()...)
+}
+
+func diskMDCacheNameKey(key TLFCryptKey, handle *TlfHandle) ([]byte, error) {
+	mac, err := DefaultHMAC(key.data[:], []byte(handle.GetCanonicalPath()))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{diskMDCacheNamePrefix}, mac.Bytes()...), nil
+}
+
+var errDiskMDCacheShutdown = errors.New("Disk MD cache already shut down")
+
+// getKeyLocked returns the key that the persisted heads are
+// encrypted with, unsealing it with the current device's key, or
+// making a new one if there isn't one for this device yet.  It must
+// be called with c.lock held.
+func (c *DiskMDCacheStandard) getKeyLocked(ctx context.Context) (
+	TLFCryptKey, error) {
+	if c.db == nil {
+		return TLFCryptKey{}, errDiskMDCacheShutdown
+	}
+	deviceKey, err := c.config.KBPKI().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return TLFCryptKey{}, err
+	}
+	if c.key != nil && c.deviceKey == deviceKey {
+		return *c.key, nil
+	}
+
+	buf, err := c.db.Get([]byte{diskMDCacheKeyPrefix}, nil)
+	switch err {
+	case nil:
+		var sealed diskMDCacheSealedKey
+		err := c.config.Codec().Decode(buf, &sealed)
+		if err != nil {
+			return TLFCryptKey{}, err
+		}
+		if sealed.DeviceKey != deviceKey {
+			break
+		}
+		clientHalf, err := c.config.Crypto().DecryptTLFCryptKeyClientHalf(
+			ctx, sealed.EPubKey, sealed.ClientHalf)
+		if err != nil {
+			return TLFCryptKey{}, err
+		}
+		key := MakeTLFCryptKey(clientHalf.data)
+		c.key, c.deviceKey = &key, deviceKey
+		return key, nil
+	case leveldb.ErrNotFound:
+	default:
+		return TLFCryptKey{}, err
+	}
+
+	// This device can't read anything that's already there, so
+	// replace it all.
+	_, _, ePubKey, ePrivKey, key, err :=
+		c.config.Crypto().MakeRandomTLFKeys()
+	if err != nil {
+		return TLFCryptKey{}, err
+	}
+	encryptedClientHalf, err := c.config.Crypto().EncryptTLFCryptKeyClientHalf(
+		ePrivKey, deviceKey, MakeTLFCryptKeyClientHalf(key.data))
+	if err != nil {
+		return TLFCryptKey{}, err
+	}
+	buf, err = c.config.Codec().Encode(diskMDCacheSealedKey{
+		DeviceKey:  deviceKey,
+		EPubKey:    ePubKey,
+		ClientHalf: encryptedClientHalf,
+	})
+	if err != nil {
+		return TLFCryptKey{}, err
+	}
+
+	batch := new(leveldb.Batch)
+	iter := c.db.NewIterator(nil, nil)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return TLFCryptKey{}, err
+	}
+	batch.Put([]byte{diskMDCacheKeyPrefix}, buf)
+	err = c.db.Write(batch, nil)
+	if err != nil {
+		return TLFCryptKey{}, err
+	}
+	c.key, c.deviceKey = &key, deviceKey
+	return key, nil
+}
+
+// getLocked returns the persisted entry for the given TLF, or nil if
+// there isn't one.  It must be called with c.lock held.
+func (c *DiskMDCacheStandard) getLocked(ctx context.Context, id TlfID) (
+	*diskMDCacheEntry, error) {
+	key, err := c.getKeyLocked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := c.db.Get(diskMDCacheTlfKey(diskMDCacheHeadPrefix, id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var encryptedEntry encryptedData
+	err = c.config.Codec().Decode(buf, &encryptedEntry)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = c.crypto.decryptData(encryptedEntry, key.data)
+	if err != nil {
+		return nil, err
+	}
+	var entry diskMDCacheEntry
+	err = c.config.Codec().Decode(buf, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Get implements the DiskMDCache interface for DiskMDCacheStandard.
+func (c *DiskMDCacheStandard) Get(ctx context.Context, id TlfID) (
+	*RootMetadata, error) {
+	entry, err := func() (*diskMDCacheEntry, error) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.getLocked(ctx, id)
+	}()
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	md := entry.MD
+	bareHandle, err := md.MakeBareTlfHandle()
+	if err != nil {
+		return nil, err
+	}
+	handle, err := MakeTlfHandle(
+		ctx, bareHandle, diskMDCacheUsernames(entry.Usernames))
+	if err != nil {
+		return nil, err
+	}
+	md.tlfHandle = handle
+	md.data = entry.Data
+
+	kcache := c.config.KeyCache()
+	for keyGen, key := range entry.Keys {
+		err := kcache.PutTLFCryptKey(md.ID, keyGen, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return md, nil
+}
+
+// GetForHandle implements the DiskMDCache interface for
+// DiskMDCacheStandard.
+func (c *DiskMDCacheStandard) GetForHandle(ctx context.Context,
+	handle *TlfHandle) (*RootMetadata, error) {
+	id, err := func() (TlfID, error) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		key, err := c.getKeyLocked(ctx)
+		if err != nil {
+			return NullTlfID, err
+		}
+		nameKey, err := diskMDCacheNameKey(key, handle)
+		if err != nil {
+			return NullTlfID, err
+		}
+		buf, err := c.db.Get(nameKey, nil)
+		if err == leveldb.ErrNotFound {
+			return NullTlfID, nil
+		} else if err != nil {
+			return NullTlfID, err
+		}
+		var id TlfID
+		err = id.UnmarshalBinary(buf)
+		return id, err
+	}()
+	if err != nil || id == NullTlfID {
+		return nil, err
+	}
+	return c.Get(ctx, id)
+}
+
+// Put implements the DiskMDCache interface for DiskMDCacheStandard.
+func (c *DiskMDCacheStandard) Put(ctx context.Context,
+	md *RootMetadata) error {
+	handle := md.GetTlfHandle()
+	entry := diskMDCacheEntry{
+		MD:        md,
+		Data:      md.data,
+		Usernames: make(map[keybase1.UID]libkb.NormalizedUsername),
+	}
+	for uid, name := range handle.resolvedWriters {
+		entry.Usernames[uid] = name
+	}
+	for uid, name := range handle.resolvedReaders {
+		entry.Usernames[uid] = name
+	}
+	if !md.ID.IsPublic() {
+		// Only take the keys that are already known, so this
+		// never has to go to the network.
+		entry.Keys = make(map[KeyGen]TLFCryptKey)
+		kcache := c.config.KeyCache()
+		latest := md.LatestKeyGeneration()
+		for keyGen := KeyGen(FirstValidKeyGen); keyGen <= latest; keyGen++ {
+			key, err := kcache.GetTLFCryptKey(md.ID, keyGen)
+			if _, ok := err.(KeyCacheMissError); ok {
+				continue
+			} else if err != nil {
+				return err
+			}
+			entry.Keys[keyGen] = key
+		}
+	}
+
+	buf, err := c.config.Codec().Encode(entry)
+	if err != nil {
+		return err
+	}
+	idBuf, err := md.ID.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	revBuf, err := c.config.Codec().Encode(md.Revision)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key, err := c.getKeyLocked(ctx)
+	if err != nil {
+		return err
+	}
+	encryptedEntry, err := c.crypto.encryptData(buf, key.data)
+	if err != nil {
+		return err
+	}
+	buf, err = c.config.Codec().Encode(encryptedEntry)
+	if err != nil {
+		return err
+	}
+	nameKey, err := diskMDCacheNameKey(key, handle)
+	if err != nil {
+		return err
+	}
+
+	oldRevBuf, err := c.db.Get(
+		diskMDCacheTlfKey(diskMDCacheRevisionPrefix, md.ID), nil)
+	switch err {
+	case nil:
+		var oldRev MetadataRevision
+		err := c.config.Codec().Decode(oldRevBuf, &oldRev)
+		if err != nil {
+			return err
+		}
+		if oldRev >= md.Revision {
+			return nil
+		}
+	case leveldb.ErrNotFound:
+	default:
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put(diskMDCacheTlfKey(diskMDCacheHeadPrefix, md.ID), buf)
+	batch.Put(diskMDCacheTlfKey(diskMDCacheRevisionPrefix, md.ID), revBuf)
+	batch.Put(nameKey, idBuf)
+	return c.db.Write(batch, nil)
+}
+
+// Shutdown implements the DiskMDCache interface for DiskMDCacheStandard.
+func (c *DiskMDCacheStandard) Shutdown() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.db == nil {
+		return
+	}
+	c.db.Close()
+	c.db = nil
+	c.key = nil
+	c.storage.Close()
+}
@@ -0,0 +1,183 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// makeDiskMDCacheTestMD returns a readable private head for
+// alice,bob at the given revision, whose root directory has the
+// given block ID.  The head's key is put into the config's key
+// cache.
+func makeDiskMDCacheTestMD(t *testing.T, config Config,
+	rev MetadataRevision, rootID BlockID) *RootMetadata {
+	h := parseTlfHandleOrBust(t, config, "alice,bob", false)
+	id := FakeTlfID(1, false)
+	md := newRootMetadataOrBust(t, id, h)
+	FakeInitialRekey(md, h.BareTlfHandle)
+	md.Revision = rev
+	md.data.Dir.BlockPointer = BlockPointer{ID: rootID}
+	md.data.Dir.Type = Dir
+	err := config.KeyCache().PutTLFCryptKey(
+		id, FirstValidKeyGen, MakeTLFCryptKey([32]byte{1}))
+	if err != nil {
+		t.Fatalf("Couldn't put key: %v", err)
+	}
+	return md
+}
+
+func checkDiskMDCacheHead(t *testing.T, md *RootMetadata,
+	expectedRev MetadataRevision, expectedRootID BlockID) {
+	if md == nil {
+		t.Fatalf("No persisted head")
+	}
+	if md.Revision != expectedRev {
+		t.Errorf("Got revision %d, expected %d", md.Revision, expectedRev)
+	}
+	if md.data.Dir.ID != expectedRootID {
+		t.Errorf("Got root %s, expected %s", md.data.Dir.ID, expectedRootID)
+	}
+	if name := md.GetTlfHandle().GetCanonicalName(); name != "alice,bob" {
+		t.Errorf("Got handle %s, expected alice,bob", name)
+	}
+}
+
+func TestDiskMDCachePutGet(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config)
+	cache, err := NewDiskMDCacheMemory(config)
+	if err != nil {
+		t.Fatalf("Couldn't make cache: %v", err)
+	}
+	defer cache.Shutdown()
+	ctx := context.Background()
+
+	md := makeDiskMDCacheTestMD(t, config, 3, fakeBlockID(3))
+	if got, err := cache.Get(ctx, md.ID); err != nil || got != nil {
+		t.Fatalf("Got unexpected head before put: %v, %v", got, err)
+	}
+	err = cache.Put(ctx, md)
+	if err != nil {
+		t.Fatalf("Couldn't put head: %v", err)
+	}
+
+	got, err := cache.Get(ctx, md.ID)
+	if err != nil {
+		t.Fatalf("Couldn't get head: %v", err)
+	}
+	checkDiskMDCacheHead(t, got, 3, fakeBlockID(3))
+	got, err = cache.GetForHandle(ctx, md.GetTlfHandle())
+	if err != nil {
+		t.Fatalf("Couldn't get head for handle: %v", err)
+	}
+	checkDiskMDCacheHead(t, got, 3, fakeBlockID(3))
+
+	// An older head doesn't replace a newer one.
+	err = cache.Put(ctx, makeDiskMDCacheTestMD(t, config, 2, fakeBlockID(2)))
+	if err != nil {
+		t.Fatalf("Couldn't put older head: %v", err)
+	}
+	got, err = cache.Get(ctx, md.ID)
+	if err != nil {
+		t.Fatalf("Couldn't get head: %v", err)
+	}
+	checkDiskMDCacheHead(t, got, 3, fakeBlockID(3))
+}
+
+func TestDiskMDCacheRestart(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "kbfs_disk_md_cache")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	cache, err := NewDiskMDCacheStandard(config, tempdir)
+	if err != nil {
+		t.Fatalf("Couldn't make cache: %v", err)
+	}
+	md := makeDiskMDCacheTestMD(t, config, 3, fakeBlockID(3))
+	err = cache.Put(ctx, md)
+	if err != nil {
+		t.Fatalf("Couldn't put head: %v", err)
+	}
+	cache.Shutdown()
+
+	// The restarted process has none of the keys yet.
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	cache, err = NewDiskMDCacheStandard(config2, tempdir)
+	if err != nil {
+		t.Fatalf("Couldn't reopen cache: %v", err)
+	}
+	defer cache.Shutdown()
+
+	got, err := cache.GetForHandle(ctx, md.GetTlfHandle())
+	if err != nil {
+		t.Fatalf("Couldn't get head for handle: %v", err)
+	}
+	checkDiskMDCacheHead(t, got, 3, fakeBlockID(3))
+	key, err := config2.KeyCache().GetTLFCryptKey(md.ID, FirstValidKeyGen)
+	if err != nil {
+		t.Fatalf("Persisted key wasn't restored: %v", err)
+	}
+	if key != MakeTLFCryptKey([32]byte{1}) {
+		t.Errorf("Got unexpected key %v", key)
+	}
+}
+
+func TestDiskMDCacheOtherDevice(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "kbfs_disk_md_cache")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	cache, err := NewDiskMDCacheStandard(config, tempdir)
+	if err != nil {
+		t.Fatalf("Couldn't make cache: %v", err)
+	}
+	md := makeDiskMDCacheTestMD(t, config, 3, fakeBlockID(3))
+	err = cache.Put(ctx, md)
+	if err != nil {
+		t.Fatalf("Couldn't put head: %v", err)
+	}
+	cache.Shutdown()
+
+	// Another device can't unseal the cache key, so it starts
+	// over with an empty cache.
+	config2 := ConfigAsUser(config, "bob")
+	defer CheckConfigAndShutdown(t, config2)
+	cache, err = NewDiskMDCacheStandard(config2, tempdir)
+	if err != nil {
+		t.Fatalf("Couldn't reopen cache: %v", err)
+	}
+	defer cache.Shutdown()
+
+	if got, err := cache.Get(ctx, md.ID); err != nil || got != nil {
+		t.Fatalf("Got unexpected head on another device: %v, %v", got, err)
+	}
+	got, err := cache.GetForHandle(ctx, md.GetTlfHandle())
+	if err != nil || got != nil {
+		t.Fatalf("Got unexpected head for handle on another device: %v, %v",
+			got, err)
+	}
+	if _, err := config2.KeyCache().GetTLFCryptKey(
+		md.ID, FirstValidKeyGen); err == nil {
+		t.Errorf("Key restored on another device")
+	}
+}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	keybase1 "github.com/keybase/client/go/protocol"
@@ -132,6 +133,40 @@ func (e RenameAcrossDirsError) Error() string {
 	return fmt.Sprintf("Cannot rename across directories")
 }
 
+// EntryChangedDuringMoveError indicates that an entry that was being
+// moved into another top-level folder was changed before it could be
+// removed from the old one.  The copy in the new folder is removed
+// again, unless it has been changed too.
+type EntryChangedDuringMoveError struct {
+	Name string
+}
+
+// Error implements the error interface for EntryChangedDuringMoveError
+func (e EntryChangedDuringMoveError) Error() string {
+	return fmt.Sprintf("%s changed while being moved, so it wasn't "+
+		"removed from its old folder", e.Name)
+}
+
+// LinkAcrossFoldersError indicates that the user tried to make a hard
+// link to a file in a different top-level folder.
+type LinkAcrossFoldersError struct {
+}
+
+// Error implements the error interface for LinkAcrossFoldersError
+func (e LinkAcrossFoldersError) Error() string {
+	return fmt.Sprintf("Cannot hard link across top-level folders")
+}
+
+// CopyAcrossFoldersError indicates that the user tried to copy a
+// file by reference into a different top-level folder.
+type CopyAcrossFoldersError struct {
+}
+
+// Error implements the error interface for CopyAcrossFoldersError
+func (e CopyAcrossFoldersError) Error() string {
+	return fmt.Sprintf("Cannot copy by reference across top-level folders")
+}
+
 // ErrorFileAccessError indicates that the user tried to perform an
 // operation on the ErrorFile that is not allowed.
 type ErrorFileAccessError struct {
@@ -458,6 +493,18 @@ func (e TooLowByteCountError) Error() string {
 		e.ExpectedMinByteCount, e.ByteCount)
 }
 
+// DecompressedBlockTooBigError indicates that a compressed block
+// decompresses to more bytes than any block should have.
+type DecompressedBlockTooBigError struct {
+	MaxSize int
+}
+
+// Error implements the error interface for DecompressedBlockTooBigError
+func (e DecompressedBlockTooBigError) Error() string {
+	return fmt.Sprintf("Compressed block decompresses to more than %d bytes",
+		e.MaxSize)
+}
+
 // InconsistentEncodedSizeError is raised when a dirty block has a
 // non-zero encoded size.
 type InconsistentEncodedSizeError struct {
@@ -1007,3 +1054,165 @@ type MetadataIsFinalError struct {
 func (e MetadataIsFinalError) Error() string {
 	return "Metadata is final"
 }
+
+// NoDataAfterOffsetError indicates that a seek in a file asked for
+// an offset past the end of the file, or for data where only a hole
+// remains.
+type NoDataAfterOffsetError struct {
+	Offset int64
+}
+
+// Error implements the error interface for NoDataAfterOffsetError.
+func (e NoDataAfterOffsetError) Error() string {
+	return fmt.Sprintf("No data at or after offset %d", e.Offset)
+}
+
+// NoSuchXattrError indicates that the user tried to read or remove
+// an extended attribute that an entry doesn't have.
+type NoSuchXattrError struct {
+	Name string
+}
+
+// Error implements the error interface for NoSuchXattrError.
+func (e NoSuchXattrError) Error() string {
+	return fmt.Sprintf("No extended attribute %s", e.Name)
+}
+
+// XattrTooBigError indicates that the user tried to set an extended
+// attribute with a name or value that is too big.
+type XattrTooBigError struct {
+	Name string
+	Size uint64
+	Max  uint64
+}
+
+// Error implements the error interface for XattrTooBigError.
+func (e XattrTooBigError) Error() string {
+	return fmt.Sprintf("Extended attribute %s would make the size %d, "+
+		"more than the maximum %d", e.Name, e.Size, e.Max)
+}
+
+// FileLockedError indicates that an advisory lock on a file couldn't
+// be taken, because a conflicting lock is held by another owner on
+// this device or by another device.
+type FileLockedError struct {
+	Name string
+}
+
+// Error implements the error interface for FileLockedError.
+func (e FileLockedError) Error() string {
+	return fmt.Sprintf("%s is locked", e.Name)
+}
+
+// FileLocksUnsupportedError indicates that the MD server doesn't
+// support advisory file locks.
+type FileLocksUnsupportedError struct {
+}
+
+// Error implements the error interface for FileLocksUnsupportedError.
+func (e FileLocksUnsupportedError) Error() string {
+	return "The metadata server doesn't support file locks"
+}
+
+// WriteToArchivedRevisionError indicates that the user tried to
+// modify a folder through a read-only view of an older revision.
+type WriteToArchivedRevisionError struct {
+	Revision MetadataRevision
+}
+
+// Error implements the error interface for
+// WriteToArchivedRevisionError.
+func (e WriteToArchivedRevisionError) Error() string {
+	return fmt.Sprintf("Revision %d of this folder is read-only", e.Revision)
+}
+
+// OfflineReadOnlyError indicates that the user tried to modify a
+// folder while disconnected from the MD server.
+type OfflineReadOnlyError struct{}
+
+// Error implements the error interface for OfflineReadOnlyError.
+func (e OfflineReadOnlyError) Error() string {
+	return "Folders are read-only while disconnected from the " +
+		"metadata server"
+}
+
+// NoSuchRevisionError indicates that the user tried to view a
+// revision of a folder that doesn't exist.
+type NoSuchRevisionError struct {
+	Revision MetadataRevision
+}
+
+// Error implements the error interface for NoSuchRevisionError.
+func (e NoSuchRevisionError) Error() string {
+	return fmt.Sprintf("Revision %d of this folder doesn't exist", e.Revision)
+}
+
+// InvalidRevisionRangeError indicates that the user asked for the
+// changes between two revisions in the wrong order.
+type InvalidRevisionRangeError struct {
+	From MetadataRevision
+	To   MetadataRevision
+}
+
+// Error implements the error interface for InvalidRevisionRangeError.
+func (e InvalidRevisionRangeError) Error() string {
+	return fmt.Sprintf("Revision %d comes after revision %d", e.From, e.To)
+}
+
+// NoSuchFileVersionError indicates that the user tried to restore a
+// file to a revision from before the start of its history.
+type NoSuchFileVersionError struct {
+	Revision MetadataRevision
+}
+
+// Error implements the error interface for NoSuchFileVersionError.
+func (e NoSuchFileVersionError) Error() string {
+	return fmt.Sprintf("This file has no version as of revision %d",
+		e.Revision)
+}
+
+// NoRevisionAtTimeError indicates that the user tried to view a
+// folder as of a time before its first revision.
+type NoRevisionAtTimeError struct {
+	Time time.Time
+}
+
+// Error implements the error interface for NoRevisionAtTimeError.
+func (e NoRevisionAtTimeError) Error() string {
+	return fmt.Sprintf("This folder had no revisions as of %s",
+		e.Time.Format(time.RFC3339))
+}
+
+// TxInProgressError indicates that an operation couldn't be done
+// because a transaction is in progress on the folder.
+type TxInProgressError struct {
+	Tlf TlfID
+}
+
+// Error implements the error interface for TxInProgressError.
+func (e TxInProgressError) Error() string {
+	return fmt.Sprintf("A transaction is in progress on folder %s", e.Tlf)
+}
+
+// TxDoneError indicates that the user tried to use a transaction
+// that was already committed or aborted.
+type TxDoneError struct {
+}
+
+// Error implements the error interface for TxDoneError.
+func (e TxDoneError) Error() string {
+	return "The transaction is already over"
+}
+
+// TxWhileStagedError indicates that the user tried to start a
+// transaction on a folder whose local changes are still waiting for
+// conflict resolution.
+type TxWhileStagedError struct {
+	Tlf TlfID
+}
+
+// Error implements the error interface for TxWhileStagedError.
+func (e TxWhileStagedError) Error() string {
+	return fmt.Sprintf("Can't start a transaction on folder %s while "+
+		"local changes are unmerged", e.Tlf)
+}
@@ -124,3 +124,91 @@ var _ fuse.ErrorNumber = NoSuchFolderListError{}
 func (e NoSuchFolderListError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOENT)
 }
+
+var _ fuse.ErrorNumber = NoDataAfterOffsetError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoDataAfterOffsetError.
+func (e NoDataAfterOffsetError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENXIO)
+}
+
+var _ fuse.ErrorNumber = NoSuchXattrError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchXattrError.
+func (e NoSuchXattrError) Errno() fuse.Errno {
+	return fuse.ErrNoXattr
+}
+
+var _ fuse.ErrorNumber = XattrTooBigError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// XattrTooBigError.
+func (e XattrTooBigError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.E2BIG)
+}
+
+var _ fuse.ErrorNumber = FileLockedError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// FileLockedError.
+func (e FileLockedError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EAGAIN)
+}
+
+var _ fuse.ErrorNumber = RenameAcrossDirsError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// RenameAcrossDirsError.
+func (e RenameAcrossDirsError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EXDEV)
+}
+
+var _ fuse.ErrorNumber = CopyAcrossFoldersError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// CopyAcrossFoldersError.
+func (e CopyAcrossFoldersError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EXDEV)
+}
+
+var _ fuse.ErrorNumber = WriteToArchivedRevisionError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// WriteToArchivedRevisionError.
+func (e WriteToArchivedRevisionError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = OfflineReadOnlyError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// OfflineReadOnlyError.
+func (e OfflineReadOnlyError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = NoSuchRevisionError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchRevisionError.
+func (e NoSuchRevisionError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOENT)
+}
+
+var _ fuse.ErrorNumber = NoRevisionAtTimeError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoRevisionAtTimeError.
+func (e NoRevisionAtTimeError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOENT)
+}
+
+var _ fuse.ErrorNumber = NoSuchFileVersionError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchFileVersionError.
+func (e NoSuchFileVersionError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOENT)
+}
@@ -0,0 +1,30 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "strings"
+
+// StringListFlag is for flags that can be given more than once with
+// the flag package, each time adding a value to the list.
+type StringListFlag struct {
+	v *[]string
+}
+
+// Get for flag interface.
+func (lf StringListFlag) Get() interface{} { return *lf.v }
+
+// String for flag interface.
+func (lf StringListFlag) String() string {
+	if lf.v == nil {
+		return ""
+	}
+	return strings.Join(*lf.v, " ")
+}
+
+// Set for flag interface.
+func (lf StringListFlag) Set(raw string) error {
+	*lf.v = append(*lf.v, raw)
+	return nil
+}
@@ -0,0 +1,21 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "testing"
+
+func TestStringListFlag(t *testing.T) {
+	var list []string
+	f := StringListFlag{&list}
+	for _, v := range []string{"/keybase/private/a,b", "/keybase/public/c"} {
+		if err := f.Set(v); err != nil {
+			t.Fatalf("Couldn't set %q: %v", v, err)
+		}
+	}
+	if len(list) != 2 || list[0] != "/keybase/private/a,b" ||
+		list[1] != "/keybase/public/c" {
+		t.Errorf("Unexpected list after two flags: %v", list)
+	}
+}
@@ -52,6 +52,10 @@ type folderBlockManager struct {
 	archiveCancelLock sync.Mutex
 	archiveCancel     context.CancelFunc
 
+	// lastArchivedRev is the last revision archived by this
+	// manager; should only be accessed by the archive goroutine.
+	lastArchivedRev MetadataRevision
+
 	// blocksToDeleteAfterError is a list of blocks, for a given
 	// metadata revision, that may have been Put as part of a failed
 	// MD write.  These blocks should be deleted as soon as we know
@@ -82,6 +86,12 @@ type folderBlockManager struct {
 	lastQRHeadRev      MetadataRevision
 	lastQROldEnoughRev MetadataRevision
 	wasLastQRComplete  bool
+
+	// pinnedRevs counts the viewers of each older revision being
+	// viewed on this device.  Quota reclamation must not delete
+	// blocks that are still referenced by any of them.
+	pinnedRevsLock sync.Mutex
+	pinnedRevs     map[MetadataRevision]int
 }
 
 func newFolderBlockManager(config Config, fb FolderBranch,
@@ -98,6 +108,7 @@ func newFolderBlockManager(config Config, fb FolderBranch,
 		blocksToDeleteAfterError: make(map[*RootMetadata][]BlockPointer),
 		forceReclamationChan:     make(chan struct{}, 1),
 		helper:                   helper,
+		pinnedRevs:               make(map[MetadataRevision]int),
 	}
 	// Pass in the BlockOps here so that the archive goroutine
 	// doesn't do possibly-racy-in-tests access to
@@ -444,13 +455,73 @@ func (fbm *folderBlockManager) archiveBlockRefs(ctx context.Context,
 	return err
 }
 
+// archiveExpiredRemovals archives the blocks unreferenced by the rm
+// ops in the revisions that the given revision pushes out of the
+// trash (the revisions searched by GetDeletedEntries), since those
+// entries can no longer be restored.  Revisions that were pushed out
+// by the last revision this manager archived are skipped.
+func (fbm *folderBlockManager) archiveExpiredRemovals(ctx context.Context,
+	md *RootMetadata) error {
+	start := fbm.lastArchivedRev - maxDeletedEntriesRevisions + 1
+	if fbm.lastArchivedRev == MetadataRevisionUninitialized ||
+		fbm.lastArchivedRev >= md.Revision {
+		start = md.Revision - maxDeletedEntriesRevisions
+	}
+	end := md.Revision - maxDeletedEntriesRevisions
+	fbm.lastArchivedRev = md.Revision
+	if start < MetadataRevisionInitial {
+		start = MetadataRevisionInitial
+	}
+
+	for ; start <= end; start += maxMDsAtATime {
+		stop := start + maxMDsAtATime - 1
+		if stop > end {
+			stop = end
+		}
+		rmds, err := getMDRange(
+			ctx, fbm.config, fbm.id, NullBranchID, start, stop, Merged)
+		if err != nil {
+			return err
+		}
+		if err := fbm.helper.reembedForFBM(ctx, rmds); err != nil {
+			return err
+		}
+		for _, rmd := range rmds {
+			var ptrs []BlockPointer
+			for _, op := range rmd.data.Changes.Ops {
+				if ro, ok := op.(*rmOp); ok {
+					ptrs = append(ptrs, ro.Unrefs()...)
+				}
+			}
+			if len(ptrs) == 0 {
+				continue
+			}
+			fbm.log.CDebugf(ctx, "Archiving %d block pointers removed "+
+				"in revision %d", len(ptrs), rmd.Revision)
+			err := fbm.archiveBlockRefs(ctx, rmd, ptrs)
+			if _, ok := err.(BServerErrorBlockNonExistent); ok {
+				// Quota reclamation already got to this revision.
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (fbm *folderBlockManager) archiveBlocksInBackground() {
 	for {
 		select {
 		case md := <-fbm.archiveChan:
 			var ptrs []BlockPointer
 			for _, op := range md.data.Changes.Ops {
-				ptrs = append(ptrs, op.Unrefs()...)
+				// Removed entries stay referenced while they're
+				// in the trash, so they can still be restored;
+				// see archiveExpiredRemovals.
+				if _, ok := op.(*rmOp); !ok {
+					ptrs = append(ptrs, op.Unrefs()...)
+				}
 				for _, update := range op.AllUpdates() {
 					// It's legal for there to be an "update" between
 					// two identical pointers (usually because of
@@ -479,6 +550,13 @@ func (fbm *folderBlockManager) archiveBlocksInBackground() {
 					return err
 				}
 
+				err = fbm.archiveExpiredRemovals(ctx, md)
+				if err != nil {
+					fbm.log.CWarningf(ctx, "Couldn't archive the blocks "+
+						"of expired removals: %v", err)
+					return err
+				}
+
 				// Also see if we can delete any blocks.
 				if err := fbm.processBlocksToDelete(ctx); err != nil {
 					fbm.log.CDebugf(ctx, "Error deleting blocks: %v", err)
@@ -720,6 +798,43 @@ func (fbm *folderBlockManager) finalizeReclamation(ctx context.Context,
 		func() error { return fbm.helper.finalizeGCOp(ctx, gco) })
 }
 
+// pinRevision keeps quota reclamation from deleting any blocks
+// referenced by the given revision, until every pin of it is undone
+// by unpinRevision.
+func (fbm *folderBlockManager) pinRevision(rev MetadataRevision) {
+	fbm.pinnedRevsLock.Lock()
+	defer fbm.pinnedRevsLock.Unlock()
+	fbm.pinnedRevs[rev]++
+}
+
+// unpinRevision undoes one earlier call to pinRevision for the given
+// revision, and returns how many pins of it are left.
+func (fbm *folderBlockManager) unpinRevision(rev MetadataRevision) int {
+	fbm.pinnedRevsLock.Lock()
+	defer fbm.pinnedRevsLock.Unlock()
+	count := fbm.pinnedRevs[rev] - 1
+	if count <= 0 {
+		delete(fbm.pinnedRevs, rev)
+		return 0
+	}
+	fbm.pinnedRevs[rev] = count
+	return count
+}
+
+// getEarliestPinnedRevision returns the earliest pinned revision, or
+// MetadataRevisionUninitialized if there isn't one.
+func (fbm *folderBlockManager) getEarliestPinnedRevision() MetadataRevision {
+	fbm.pinnedRevsLock.Lock()
+	defer fbm.pinnedRevsLock.Unlock()
+	earliest := MetadataRevisionUninitialized
+	for rev := range fbm.pinnedRevs {
+		if earliest == MetadataRevisionUninitialized || rev < earliest {
+			earliest = rev
+		}
+	}
+	return earliest
+}
+
 func (fbm *folderBlockManager) isQRNecessary(head *RootMetadata) bool {
 	if head == nil {
 		return false
@@ -811,6 +926,14 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 	if err != nil {
 		return err
 	}
+	// A block unreferenced after a pinned revision is still needed
+	// to read that revision.
+	if pinnedRev := fbm.getEarliestPinnedRevision(); pinnedRev !=
+		MetadataRevisionUninitialized && pinnedRev < mostRecentOldEnoughRev {
+		fbm.log.CDebugf(ctx, "Not reclaiming past pinned revision %d "+
+			"(instead of %d)", pinnedRev, mostRecentOldEnoughRev)
+		mostRecentOldEnoughRev = pinnedRev
+	}
 	if mostRecentOldEnoughRev == MetadataRevisionUninitialized ||
 		mostRecentOldEnoughRev <= lastGCRev {
 		// TODO: need a log level more fine-grained than Debug to
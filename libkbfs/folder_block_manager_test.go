@@ -108,6 +108,90 @@ func TestQuotaReclamationSimple(t *testing.T) {
 	}
 }
 
+// Test that quota reclamation doesn't delete blocks that are still
+// needed by an archived revision being viewed on this device.
+func TestQuotaReclamationPinnedRevision(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config)
+
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if err := kbfsOps.Write(ctx, fileNode, []byte("hello"), 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	rev := ops.getCurrMDRevision(makeFBOLockState())
+	if err := kbfsOps.RemoveEntry(ctx, rootNode, "a"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+
+	h := parseTlfHandleOrBust(t, config, userName.String(), false)
+	archivedRoot, _, err := kbfsOps.GetRootNodeAtRevision(ctx, h, rev)
+	if err != nil {
+		t.Fatalf("Couldn't get root node at revision %d: %v", rev, err)
+	}
+	archivedFile, _, err := kbfsOps.Lookup(ctx, archivedRoot, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up archived file: %v", err)
+	}
+	archivedOps := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(
+		archivedRoot.GetFolderBranch())
+	filePtr := archivedOps.nodeCache.PathFromNode(archivedFile).tailPointer()
+
+	// Make the removal old enough to be reclaimed.
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	err = kbfsOps.SyncFromServerForTesting(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	bserverLocal, ok := config.BlockServer().(*BlockServerLocal)
+	if !ok {
+		t.Fatalf("Bad block server")
+	}
+	preQRBlocks, err := bserverLocal.getAll(rootNode.GetFolderBranch().Tlf)
+	if err != nil {
+		t.Fatalf("Couldn't get blocks: %v", err)
+	}
+
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for QR: %v", err)
+	}
+
+	postQRBlocks, err := bserverLocal.getAll(rootNode.GetFolderBranch().Tlf)
+	if err != nil {
+		t.Fatalf("Couldn't get blocks: %v", err)
+	}
+
+	// Blocks unreferenced up to the pinned revision are still
+	// reclaimed.
+	if pre, post := totalBlockRefs(preQRBlocks),
+		totalBlockRefs(postQRBlocks); post >= pre {
+		t.Errorf("Blocks didn't shrink after reclamation: pre: %d, post %d",
+			pre, post)
+	}
+	if _, ok := postQRBlocks[filePtr.ID]; !ok {
+		t.Fatalf("Block %v of the pinned revision was reclaimed", filePtr)
+	}
+}
+
 // Test that a single quota reclamation run doesn't try to reclaim too
 // much quota at once.
 func TestQuotaReclamationIncrementalReclamation(t *testing.T) {
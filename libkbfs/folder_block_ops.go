@@ -6,6 +6,8 @@ package libkbfs
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"time"
 
 	"github.com/keybase/client/go/logger"
@@ -134,6 +136,10 @@ type folderBlockOps struct {
 	// call PathFromNode() only under blockLock (see nodeCache
 	// comments in folder_branch_ops.go).
 	nodeCache NodeCache
+
+	// prefetcher is goroutine-safe, and fetches blocks into the
+	// block cache in the background.
+	prefetcher *blockPrefetcher
 }
 
 // Only exported methods of folderBlockOps should be used outside of this
@@ -396,28 +402,148 @@ func (fbo *folderBlockOps) getFileLocked(ctx context.Context,
 		ctx, lState, md, file.tailPointer(), file, rtype)
 }
 
+// getIndirectFileBlockInfosLocked returns a list of BlockInfos for
+// all the blocks under the given file block, at every level of
+// indirection.  Only the indirect blocks are fetched; the leaf
+// blocks' infos come from their parents.
+func (fbo *folderBlockOps) getIndirectFileBlockInfosLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata, file path,
+	block *FileBlock) ([]BlockInfo, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	if !block.IsInd {
+		return nil, nil
+	}
+
+	// All leaf blocks are at the same depth, so the first child
+	// tells us whether the children are leaves.
+	child, err := fbo.getFileBlockHelperLocked(ctx, lState, md,
+		block.IPtrs[0].BlockPointer, file.Branch, file)
+	if err != nil {
+		return nil, err
+	}
+	childrenAreLeaves := !child.IsInd
+
+	var blockInfos []BlockInfo
+	for _, iptr := range block.IPtrs {
+		blockInfos = append(blockInfos, iptr.BlockInfo)
+		if childrenAreLeaves {
+			continue
+		}
+		child, err := fbo.getFileBlockHelperLocked(
+			ctx, lState, md, iptr.BlockPointer, file.Branch, file)
+		if err != nil {
+			return nil, err
+		}
+		childInfos, err := fbo.getIndirectFileBlockInfosLocked(
+			ctx, lState, md, file, child)
+		if err != nil {
+			return nil, err
+		}
+		blockInfos = append(blockInfos, childInfos...)
+	}
+	return blockInfos, nil
+}
+
 // GetIndirectFileBlockInfos returns a list of BlockInfos for all
-// indirect blocks of the given file.
+// indirect blocks of the given file, at every level of indirection.
 func (fbo *folderBlockOps) GetIndirectFileBlockInfos(ctx context.Context,
 	lState *lockState, md *RootMetadata, file path) ([]BlockInfo, error) {
-	// TODO: handle multiple levels of indirection.
-	fBlock, err := func() (*FileBlock, error) {
-		fbo.blockLock.RLock(lState)
-		defer fbo.blockLock.RUnlock(lState)
-		return fbo.getFileBlockLocked(
-			ctx, lState, md, file.tailPointer(), file, blockRead)
-	}()
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	fBlock, err := fbo.getFileBlockHelperLocked(
+		ctx, lState, md, file.tailPointer(), file.Branch, file)
 	if err != nil {
 		return nil, err
 	}
-	if !fBlock.IsInd {
-		return nil, nil
+	return fbo.getIndirectFileBlockInfosLocked(ctx, lState, md, file, fBlock)
+}
+
+// CopyFile readies a copy of the given file that shares all of its
+// leaf blocks with the original: each leaf block just gets a new
+// reference, and only the indirect blocks above them are copied as
+// new blocks.  Everything that needs to be put is added to bps, and
+// the infos of all the new pointers are returned, starting with the
+// copy's top block.  The caller must make sure the file isn't dirty.
+func (fbo *folderBlockOps) CopyFile(ctx context.Context,
+	lState *lockState, md *RootMetadata, uid keybase1.UID, file path,
+	info BlockInfo, bps *blockPutState) ([]BlockInfo, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	fblock, err := fbo.getFileBlockHelperLocked(
+		ctx, lState, md, file.tailPointer(), file.Branch, file)
+	if err != nil {
+		return nil, err
 	}
-	blockInfos := make([]BlockInfo, len(fBlock.IPtrs))
-	for i, ptr := range fBlock.IPtrs {
-		blockInfos[i] = ptr.BlockInfo
+	if fblock.IsInd {
+		return fbo.copyIndirectFileBlockLocked(
+			ctx, lState, md, uid, file, fblock, false, bps)
 	}
-	return blockInfos, nil
+
+	info.RefNonce, err = fbo.config.Crypto().MakeBlockRefNonce()
+	if err != nil {
+		return nil, err
+	}
+	info.SetWriter(uid)
+	bps.addNewBlock(info.BlockPointer, fblock, ReadyBlockData{})
+	return []BlockInfo{info}, nil
+}
+
+func (fbo *folderBlockOps) copyIndirectFileBlockLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	uid keybase1.UID, file path, fblock *FileBlock, isChild bool,
+	bps *blockPutState) ([]BlockInfo, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	fblock, err := fblock.DeepCopy(fbo.config.Codec())
+	if err != nil {
+		return nil, err
+	}
+
+	// All leaf blocks are at the same depth, so the first child
+	// tells us whether the children are leaves.
+	child, err := fbo.getFileBlockHelperLocked(ctx, lState, md,
+		fblock.IPtrs[0].BlockPointer, file.Branch, file)
+	if err != nil {
+		return nil, err
+	}
+	childrenAreLeaves := !child.IsInd
+
+	var childInfos []BlockInfo
+	for i, iptr := range fblock.IPtrs {
+		if childrenAreLeaves {
+			iptr.RefNonce, err = fbo.config.Crypto().MakeBlockRefNonce()
+			if err != nil {
+				return nil, err
+			}
+			iptr.SetWriter(uid)
+			fblock.IPtrs[i] = iptr
+			// The leaf block itself isn't needed for adding a
+			// reference.
+			bps.addNewBlock(iptr.BlockPointer, nil, ReadyBlockData{})
+			childInfos = append(childInfos, iptr.BlockInfo)
+			continue
+		}
+
+		child, err := fbo.getFileBlockHelperLocked(
+			ctx, lState, md, iptr.BlockPointer, file.Branch, file)
+		if err != nil {
+			return nil, err
+		}
+		infos, err := fbo.copyIndirectFileBlockLocked(
+			ctx, lState, md, uid, file, child, true, bps)
+		if err != nil {
+			return nil, err
+		}
+		fblock.IPtrs[i].BlockInfo = infos[0]
+		childInfos = append(childInfos, infos...)
+	}
+
+	info, _, readyBlockData, err := fbo.readyBlock(
+		ctx, md, fblock, uid, isChild)
+	if err != nil {
+		return nil, err
+	}
+	bps.addNewBlock(info.BlockPointer, fblock, readyBlockData)
+	return append([]BlockInfo{info}, childInfos...), nil
 }
 
 // getDirLocked retrieves the block pointed to by the tail pointer of
@@ -435,14 +561,23 @@ func (fbo *folderBlockOps) GetIndirectFileBlockInfos(ctx context.Context,
 // block within a single operation, it is the caller's responsibility
 // to write that block back to the cache as dirty.
 //
+// If the directory block is indirect, the returned block's Children
+// map only holds the entries of the child blocks covering the given
+// names (whether or not those names exist).  In that case, when
+// rtype == blockRead, the returned block is a new partial copy
+// rather than the cached block itself.  Writers must make sure any
+// entry they look up or modify has been loaded this way (see
+// loadDirEntriesLocked), so that the changes can be written back to
+// the right child block by ReadyDirBlock.
+//
 // Note that blockLock must be either r-locked or locked, but
 // independently of rtype. (This differs from getFileLocked and
 // getFileBlockLocked.) File write operations (which lock blockLock)
 // don't need a copy of parent dir blocks, and non-file write
 // operations do need to copy dir blocks for modifications.
 func (fbo *folderBlockOps) getDirLocked(ctx context.Context,
-	lState *lockState, md *RootMetadata, dir path, rtype blockReqType) (
-	*DirBlock, error) {
+	lState *lockState, md *RootMetadata, dir path, rtype blockReqType,
+	names ...string) (*DirBlock, error) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
 	// Callers should have already done this check, but it doesn't
@@ -467,9 +602,150 @@ func (fbo *folderBlockOps) getDirLocked(ctx context.Context,
 			return nil, err
 		}
 	}
+
+	if dblock.IsInd && len(names) > 0 {
+		if rtype == blockRead {
+			// Never modify the cached block.
+			dblock = &DirBlock{
+				CommonBlock: dblock.CommonBlock,
+				Children:    make(map[string]DirEntry),
+				IPtrs:       dblock.IPtrs,
+			}
+		}
+		err = fbo.loadDirEntriesLocked(ctx, lState, md, dir, dblock, names)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return dblock, nil
 }
 
+// loadDirEntriesLocked merges the entries from the child blocks of
+// the given indirect directory block that cover the given names into
+// the block's Children map, if they haven't been merged already.
+// dblock must be a local copy of the directory's top block.
+func (fbo *folderBlockOps) loadDirEntriesLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, dblock *DirBlock,
+	names []string) error {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	if !dblock.IsInd {
+		return nil
+	}
+
+	for _, name := range names {
+		iptr := dblock.IPtrs[dblock.leafIndex(name)]
+		if _, ok := dblock.loadedLeaves[iptr.Off]; ok {
+			continue
+		}
+
+		leaf, err := fbo.getDirBlockHelperLocked(
+			ctx, lState, md, iptr.BlockPointer, fbo.branch(), dir)
+		if err != nil {
+			return err
+		}
+		if leaf.IsInd {
+			// We only ever make one level of indirection.
+			return BadDataError{iptr.ID}
+		}
+
+		for childName, de := range leaf.Children {
+			dblock.Children[childName] = de
+		}
+		if dblock.loadedLeaves == nil {
+			dblock.loadedLeaves = make(map[string]*DirBlock)
+		}
+		dblock.loadedLeaves[iptr.Off] = leaf
+	}
+	return nil
+}
+
+// loadAllDirEntriesLocked is loadDirEntriesLocked for every child
+// block of the given directory block.
+func (fbo *folderBlockOps) loadAllDirEntriesLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, dblock *DirBlock) error {
+	if !dblock.IsInd {
+		return nil
+	}
+	offs := make([]string, len(dblock.IPtrs))
+	for i, iptr := range dblock.IPtrs {
+		offs[i] = iptr.Off
+	}
+	return fbo.loadDirEntriesLocked(ctx, lState, md, dir, dblock, offs)
+}
+
+// LoadDirEntries makes sure that the entries for the given names (if
+// they exist) are present in the Children map of the given local
+// copy of a directory block, which might be indirect.
+func (fbo *folderBlockOps) LoadDirEntries(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, dblock *DirBlock,
+	names ...string) error {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	return fbo.loadDirEntriesLocked(ctx, lState, md, dir, dblock, names)
+}
+
+// LoadAllDirEntries makes sure that every entry of the directory is
+// present in the Children map of the given local copy of a directory
+// block, which might be indirect.  This should only be used by
+// "internal" operations like conflict resolution, since it fetches
+// every block of the directory.
+func (fbo *folderBlockOps) LoadAllDirEntries(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, dblock *DirBlock) error {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	return fbo.loadAllDirEntriesLocked(ctx, lState, md, dir, dblock)
+}
+
+// getFullDirLocked is like getDirLocked with blockRead, except that
+// the returned block always contains every entry of the directory.
+func (fbo *folderBlockOps) getFullDirLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path) (*DirBlock, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	dblock, err := fbo.getDirLocked(ctx, lState, md, dir, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	if !dblock.IsInd {
+		return dblock, nil
+	}
+	offs := make([]string, len(dblock.IPtrs))
+	for i, iptr := range dblock.IPtrs {
+		offs[i] = iptr.Off
+	}
+	return fbo.getDirLocked(ctx, lState, md, dir, blockRead, offs...)
+}
+
+// GetFullDir is like GetDir with blockRead, except that the returned
+// block always contains every entry of the directory.
+func (fbo *folderBlockOps) GetFullDir(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path) (*DirBlock, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	return fbo.getFullDirLocked(ctx, lState, md, dir)
+}
+
+// GetIndirectDirBlockInfos returns a list of BlockInfos for all
+// child blocks of the given directory, if it is indirect.
+func (fbo *folderBlockOps) GetIndirectDirBlockInfos(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path) ([]BlockInfo, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	dblock, err := fbo.getDirLocked(ctx, lState, md, dir, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	if !dblock.IsInd {
+		return nil, nil
+	}
+	blockInfos := make([]BlockInfo, len(dblock.IPtrs))
+	for i, ptr := range dblock.IPtrs {
+		blockInfos[i] = ptr.BlockInfo
+	}
+	return blockInfos, nil
+}
+
 // GetDir retrieves the block pointed to by the tail pointer of the
 // given path, which must be valid, either from the cache or from the
 // server. An error is returned if the retrieved block is not a dir
@@ -484,25 +760,46 @@ func (fbo *folderBlockOps) getDirLocked(ctx context.Context,
 // and returns it.  If this method might be called again for the same
 // block within a single operation, it is the caller's responsibility
 // to write that block back to the cache as dirty.
+//
+// If the directory is indirect, only the entries covering the given
+// names are present in the returned block's Children.
 func (fbo *folderBlockOps) GetDir(
 	ctx context.Context, lState *lockState, md *RootMetadata, dir path,
-	rtype blockReqType) (*DirBlock, error) {
+	rtype blockReqType, names ...string) (*DirBlock, error) {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
-	return fbo.getDirLocked(ctx, lState, md, dir, rtype)
+	return fbo.getDirLocked(ctx, lState, md, dir, rtype, names...)
+}
+
+// parentBlockAndChildIndex is an indirect file block, along with the
+// index of one of its child pointers.
+type parentBlockAndChildIndex struct {
+	pblock     *FileBlock
+	childIndex int
 }
 
+func (pbci parentBlockAndChildIndex) childIPtr() IndirectFilePtr {
+	return pbci.pblock.IPtrs[pbci.childIndex]
+}
+
+// getFileBlockAtOffsetLocked returns the leaf block containing the
+// given offset, along with its pointer and the list of indirect
+// blocks on the way down to it from topBlock (and the index of the
+// pointer taken in each).  The first parent block, if any, is always
+// topBlock.  It also returns the offset where the next leaf block
+// starts, or -1 if this is the last one.  If that is past the end of
+// the returned block's contents, there is a hole in between.
 func (fbo *folderBlockOps) getFileBlockAtOffsetLocked(ctx context.Context,
 	lState *lockState, md *RootMetadata, file path, topBlock *FileBlock,
 	off int64, rtype blockReqType) (
-	ptr BlockPointer, parentBlock *FileBlock, indexInParent int,
-	block *FileBlock, more bool, startOff int64, err error) {
+	ptr BlockPointer, parentBlocks []parentBlockAndChildIndex,
+	block *FileBlock, nextBlockStartOff, startOff int64, err error) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
 	// find the block matching the offset, if it exists
 	ptr = file.tailPointer()
 	block = topBlock
-	more = false
+	nextBlockStartOff = -1
 	startOff = 0
 	// search until it's not an indirect block
 	for block.IsInd {
@@ -520,12 +817,15 @@ func (fbo *folderBlockOps) getFileBlockAtOffsetLocked(ctx context.Context,
 			}
 		}
 		nextPtr := block.IPtrs[nextIndex]
-		parentBlock = block
-		indexInParent = nextIndex
+		parentBlocks = append(parentBlocks,
+			parentBlockAndChildIndex{block, nextIndex})
 		startOff = nextPtr.Off
 		// there is more to read if we ever took a path through a
-		// ptr that wasn't the final ptr in its respective list
-		more = more || (nextIndex != len(block.IPtrs)-1)
+		// ptr that wasn't the final ptr in its respective list, and
+		// the lowest such ptr has the closest next block
+		if nextIndex != len(block.IPtrs)-1 {
+			nextBlockStartOff = block.IPtrs[nextIndex+1].Off
+		}
 		ptr = nextPtr.BlockPointer
 		if block, err = fbo.getFileBlockLocked(ctx, lState, md, ptr, file, rtype); err != nil {
 			return
@@ -582,11 +882,11 @@ func (fbo *folderBlockOps) updateWithDirtyEntriesLocked(ctx context.Context,
 // has entries possibly pointing to dirty files, not that it's dirty
 // itself.
 func (fbo *folderBlockOps) getDirtyDirLocked(ctx context.Context,
-	lState *lockState, md *RootMetadata, dir path, rtype blockReqType) (
-	*DirBlock, error) {
+	lState *lockState, md *RootMetadata, dir path, rtype blockReqType,
+	names ...string) (*DirBlock, error) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
-	dblock, err := fbo.getDirLocked(ctx, lState, md, dir, rtype)
+	dblock, err := fbo.getDirLocked(ctx, lState, md, dir, rtype, names...)
 	if err != nil {
 		return nil, err
 	}
@@ -599,24 +899,40 @@ func (fbo *folderBlockOps) getDirtyDirLocked(ctx context.Context,
 func (fbo *folderBlockOps) GetDirtyDirChildren(
 	ctx context.Context, lState *lockState, md *RootMetadata, dir path) (
 	map[string]EntryInfo, error) {
-	dblock, err := func() (*DirBlock, error) {
-		fbo.blockLock.RLock(lState)
-		defer fbo.blockLock.RUnlock(lState)
-		dblock, err := fbo.getDirtyDirLocked(
-			ctx, lState, md, dir, blockRead)
-		if err != nil {
-			return nil, err
-		}
-		return dblock, nil
-	}()
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	dblock, err := fbo.getFullDirLocked(ctx, lState, md, dir)
+	if err != nil {
+		return nil, err
+	}
+	dblock, err = fbo.updateWithDirtyEntriesLocked(ctx, lState, dblock)
 	if err != nil {
 		return nil, err
 	}
 
 	children := make(map[string]EntryInfo)
+	var subdirPtrs []BlockPointer
 	for k, de := range dblock.Children {
+		if len(dir.path) == 1 && k == linksDirName {
+			continue
+		}
+		if de.Type == Dir {
+			subdirPtrs = append(subdirPtrs, de.BlockPointer)
+		}
+		if de.Type == HardLink {
+			// Show the attributes of the file itself; fall back to
+			// the link entry if it can't be found.
+			_, fileDe, err := fbo.getHardLinkTargetLocked(
+				ctx, lState, md, dir, de)
+			if err == nil {
+				de = fileDe
+			}
+		}
 		children[k] = de.EntryInfo
 	}
+	if fbo.config.DoDirPrefetch() {
+		fbo.prefetcher.prefetch(md, subdirPtrs, dir.Branch, NewDirBlock)
+	}
 	return children, nil
 }
 
@@ -631,14 +947,14 @@ func (fbo *folderBlockOps) getDirtyParentAndEntryLocked(ctx context.Context,
 	}
 
 	parentPath := file.parentPath()
+	name := file.tailName()
 	dblock, err := fbo.getDirtyDirLocked(
-		ctx, lState, md, *parentPath, rtype)
+		ctx, lState, md, *parentPath, rtype, name)
 	if err != nil {
 		return nil, DirEntry{}, err
 	}
 
 	// make sure it exists
-	name := file.tailName()
 	de, ok := dblock.Children[name]
 	if !ok {
 		return nil, DirEntry{}, NoSuchNameError{name}
@@ -681,6 +997,37 @@ func (fbo *folderBlockOps) GetDirtyEntry(
 	return fbo.getDirtyEntryLocked(ctx, lState, md, file)
 }
 
+func (fbo *folderBlockOps) getHardLinkTargetLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, de DirEntry) (
+	path, DirEntry, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	rootPath := path{FolderBranch: dir.FolderBranch, path: dir.path[:1]}
+	linksDe, err := fbo.getDirtyEntryLocked(
+		ctx, lState, md, rootPath.ChildPathNoPtr(linksDirName))
+	if err != nil {
+		return path{}, DirEntry{}, err
+	}
+	linksPath := rootPath.ChildPath(linksDirName, linksDe.BlockPointer)
+	fileDe, err := fbo.getDirtyEntryLocked(
+		ctx, lState, md, linksPath.ChildPathNoPtr(de.LinkID))
+	if err != nil {
+		return path{}, DirEntry{}, err
+	}
+	return linksPath.ChildPath(de.LinkID, fileDe.BlockPointer), fileDe, nil
+}
+
+// GetHardLinkTarget returns the path and possibly-dirty DirEntry of
+// the file named by the given hard link entry in dir.  The returned
+// path goes through the TLF's links directory, not through dir.
+func (fbo *folderBlockOps) GetHardLinkTarget(
+	ctx context.Context, lState *lockState, md *RootMetadata, dir path,
+	de DirEntry) (path, DirEntry, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	return fbo.getHardLinkTargetLocked(ctx, lState, md, dir, de)
+}
+
 // cacheBlockIfNotYetDirtyLocked puts a block into the cache, but only
 // does so if the block isn't already marked as dirty in the cache.
 // This is useful when operating on a dirty copy of a block that may
@@ -715,50 +1062,389 @@ func (fbo *folderBlockOps) cacheBlockIfNotYetDirtyLocked(
 	return nil
 }
 
-func (fbo *folderBlockOps) newRightBlockLocked(
-	ctx context.Context, lState *lockState, ptr BlockPointer,
-	branch BranchName, pblock *FileBlock,
-	off int64, md *RootMetadata) error {
+// newTemporaryFilePtrLocked returns a new pointer, with a temporary
+// ID, for a new dirty file block.
+func (fbo *folderBlockOps) newTemporaryFilePtrLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata) (BlockPointer, error) {
 	fbo.blockLock.AssertLocked(lState)
 
-	newRID, err := fbo.config.Crypto().MakeTemporaryBlockID()
+	newID, err := fbo.config.Crypto().MakeTemporaryBlockID()
 	if err != nil {
-		return err
+		return BlockPointer{}, err
 	}
 	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
 	if err != nil {
-		return err
+		return BlockPointer{}, err
 	}
-	rblock := &FileBlock{}
-
-	newPtr := BlockPointer{
-		ID:       newRID,
+	return BlockPointer{
+		ID:       newID,
 		KeyGen:   md.LatestKeyGeneration(),
 		DataVer:  fbo.config.DataVersion(),
 		Creator:  uid,
 		RefNonce: zeroBlockRefNonce,
-	}
+	}, nil
+}
 
-	pblock.IPtrs = append(pblock.IPtrs, IndirectFilePtr{
-		BlockInfo: BlockInfo{
-			BlockPointer: newPtr,
-			EncodedSize:  0,
+// makeIndirectTopBlockLocked replaces the direct top block of the
+// given file with a new, dirty, indirect one, with a single pointer
+// to the old contents under a new temporary ID.  It returns the new
+// top block and that pointer; the caller is responsible for caching
+// the old block under it.
+func (fbo *folderBlockOps) makeIndirectTopBlockLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, file path) (
+	*FileBlock, BlockPointer, error) {
+	fbo.blockLock.AssertLocked(lState)
+	// pick a new id for this block, and use this block's ID for
+	// the parent
+	newPtr, err := fbo.newTemporaryFilePtrLocked(ctx, lState, md)
+	if err != nil {
+		return nil, BlockPointer{}, err
+	}
+	fblock := &FileBlock{
+		CommonBlock: CommonBlock{
+			IsInd: true,
 		},
-		Off: off,
-	})
-
+		IPtrs: []IndirectFilePtr{
+			{
+				BlockInfo: BlockInfo{
+					BlockPointer: newPtr,
+					EncodedSize:  0,
+				},
+				Off: 0,
+			},
+		},
+	}
 	if err := fbo.config.BlockCache().PutDirty(
-		newPtr, branch, rblock); err != nil {
-		return err
+		file.tailPointer(), file.Branch, fblock); err != nil {
+		return nil, BlockPointer{}, err
+	}
+	return fblock, newPtr, nil
+}
+
+// parentPtr returns the pointer to the block at the given level of
+// parentBlocks, which must be the path to a block of the given file.
+func parentPtr(file path, parentBlocks []parentBlockAndChildIndex,
+	level int) BlockPointer {
+	if level == 0 {
+		return file.tailPointer()
 	}
+	return parentBlocks[level-1].childIPtr().BlockPointer
+}
 
-	if err = fbo.cacheBlockIfNotYetDirtyLocked(
-		lState, ptr, branch, pblock); err != nil {
-		return err
+// newRightBlockLocked adds a new, empty leaf block starting at the
+// given offset to the right end of the given file.  parentBlocks
+// must be the path from topBlock to the current rightmost leaf
+// block, and must already be marked dirty.  If none of the indirect
+// blocks on that path have room for another pointer, a new level of
+// indirection is added by moving the current contents of topBlock
+// into a new child block.  All the modified indirect blocks are
+// marked as dirty, and the pointers of all the new blocks are
+// returned.
+func (fbo *folderBlockOps) newRightBlockLocked(
+	ctx context.Context, lState *lockState, file path,
+	topBlock *FileBlock, parentBlocks []parentBlockAndChildIndex,
+	off int64, md *RootMetadata) ([]BlockPointer, error) {
+	fbo.blockLock.AssertLocked(lState)
+
+	bcache := fbo.config.BlockCache()
+
+	var newPtrs []BlockPointer
+
+	// Find the lowest indirect block with room for a new pointer.
+	level := len(parentBlocks) - 1
+	if maxPtrs := fbo.config.BlockSplitter().MaxPtrsPerBlock(); maxPtrs > 0 {
+		for ; level >= 0; level-- {
+			if len(parentBlocks[level].pblock.IPtrs) < maxPtrs {
+				break
+			}
+		}
+	}
+
+	if level < 0 {
+		// Every block is full, so push the contents of the top
+		// block down into a new child block.
+		newPtr, err := fbo.newTemporaryFilePtrLocked(ctx, lState, md)
+		if err != nil {
+			return nil, err
+		}
+		child := &FileBlock{
+			CommonBlock: CommonBlock{IsInd: true},
+			IPtrs:       topBlock.IPtrs,
+		}
+		if err := bcache.PutDirty(newPtr, file.Branch, child); err != nil {
+			return nil, err
+		}
+		newPtrs = append(newPtrs, newPtr)
+		topBlock.IPtrs = []IndirectFilePtr{{
+			BlockInfo: BlockInfo{BlockPointer: newPtr, EncodedSize: 0},
+			Off:       0,
+			Holes:     child.hasHoles(),
+		}}
+		parentBlocks = append([]parentBlockAndChildIndex{{topBlock, 0}},
+			parentBlocks...)
+		parentBlocks[1].pblock = child
+		level = 0
+	}
+
+	// Make a new chain of blocks below the chosen indirect block,
+	// ending with the new leaf block.
+	pblock := parentBlocks[level].pblock
+	for i := level + 1; i <= len(parentBlocks); i++ {
+		newPtr, err := fbo.newTemporaryFilePtrLocked(ctx, lState, md)
+		if err != nil {
+			return nil, err
+		}
+		child := &FileBlock{}
+		if i < len(parentBlocks) {
+			child.IsInd = true
+		}
+		pblock.IPtrs = append(pblock.IPtrs, IndirectFilePtr{
+			BlockInfo: BlockInfo{BlockPointer: newPtr, EncodedSize: 0},
+			Off:       off,
+		})
+		if err := bcache.PutDirty(newPtr, file.Branch, child); err != nil {
+			return nil, err
+		}
+		newPtrs = append(newPtrs, newPtr)
+		pblock = child
+	}
+
+	// The chosen indirect block and everything above it is now
+	// dirty.
+	for i := level; i >= 0; i-- {
+		if err := fbo.cacheBlockIfNotYetDirtyLocked(lState,
+			parentPtr(file, parentBlocks, i), file.Branch,
+			parentBlocks[i].pblock); err != nil {
+			return nil, err
+		}
+	}
+	return newPtrs, nil
+}
+
+// markParentsDirtyLocked makes sure that all of the given parent
+// blocks of a newly-dirtied block of the given file are marked as
+// dirty, remembering the old info of each pointer along the path in
+// si so it can be unreferenced later.  It returns the pointers of
+// the indirect blocks it dirtied, not including the top block.
+func (fbo *folderBlockOps) markParentsDirtyLocked(lState *lockState,
+	file path, parentBlocks []parentBlockAndChildIndex, si *syncInfo) (
+	[]BlockPointer, error) {
+	fbo.blockLock.AssertLocked(lState)
+	var dirtyPtrs []BlockPointer
+	for i, pb := range parentBlocks {
+		// remember how many bytes it was
+		si.unrefs = append(si.unrefs, pb.childIPtr().BlockInfo)
+		pb.pblock.IPtrs[pb.childIndex].EncodedSize = 0
+		if i == 0 {
+			// The caller is responsible for the top block.
+			continue
+		}
+		ptr := parentPtr(file, parentBlocks, i)
+		if err := fbo.cacheBlockIfNotYetDirtyLocked(
+			lState, ptr, file.Branch, pb.pblock); err != nil {
+			return nil, err
+		}
+		dirtyPtrs = append(dirtyPtrs, ptr)
+	}
+	return dirtyPtrs, nil
+}
+
+// unrefAndDirtyPathLocked is like markParentsDirtyLocked, but
+// unreferences the old pointer infos directly in md.  This is for
+// use during a sync.
+func (fbo *folderBlockOps) unrefAndDirtyPathLocked(lState *lockState,
+	md *RootMetadata, file path,
+	parentBlocks []parentBlockAndChildIndex) error {
+	fbo.blockLock.AssertLocked(lState)
+	for i, pb := range parentBlocks {
+		md.AddUnrefBlock(pb.childIPtr().BlockInfo)
+		pb.pblock.IPtrs[pb.childIndex].EncodedSize = 0
+		if i == 0 {
+			continue
+		}
+		if err := fbo.cacheBlockIfNotYetDirtyLocked(lState,
+			parentPtr(file, parentBlocks, i), file.Branch,
+			pb.pblock); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// setParentOffsets sets the offset of the pointer at the bottom of
+// parentBlocks, and then keeps going up the path for as long as that
+// pointer is the first one in its block, since an indirect pointer
+// always has the same offset as its first child.
+func setParentOffsets(parentBlocks []parentBlockAndChildIndex, off int64) {
+	for i := len(parentBlocks) - 1; i >= 0; i-- {
+		pb := parentBlocks[i]
+		pb.pblock.IPtrs[pb.childIndex].Off = off
+		if pb.childIndex > 0 {
+			break
+		}
+	}
+}
+
+// removeLeafLocked removes the leaf block at the bottom of the given
+// path from the file, along with any indirect blocks that become
+// empty as a result, unreferencing all of them in md.  The remaining
+// blocks on the path are marked as dirty.
+func (fbo *folderBlockOps) removeLeafLocked(lState *lockState,
+	md *RootMetadata, file path,
+	parentBlocks []parentBlockAndChildIndex) error {
+	fbo.blockLock.AssertLocked(lState)
+	level := len(parentBlocks) - 1
+	for ; level >= 0; level-- {
+		pb := parentBlocks[level]
+		md.AddUnrefBlock(pb.childIPtr().BlockInfo)
+		pb.pblock.IPtrs = append(pb.pblock.IPtrs[:pb.childIndex],
+			pb.pblock.IPtrs[pb.childIndex+1:]...)
+		if len(pb.pblock.IPtrs) > 0 || level == 0 {
+			break
+		}
+	}
+	if level < 0 {
+		return nil
+	}
+	remaining := parentBlocks[:level]
+	if pb := parentBlocks[level]; pb.childIndex == 0 &&
+		len(pb.pblock.IPtrs) > 0 && level > 0 {
+		setParentOffsets(remaining, pb.pblock.IPtrs[0].Off)
+	}
+	if level > 0 {
+		if err := fbo.cacheBlockIfNotYetDirtyLocked(lState,
+			parentPtr(file, parentBlocks, level), file.Branch,
+			parentBlocks[level].pblock); err != nil {
+			return err
+		}
+	}
+	return fbo.unrefAndDirtyPathLocked(lState, md, file, remaining)
+}
+
+// setHolesOnPath records whether the leaf block at the bottom of
+// parentBlocks has a hole after its contents, and updates the Holes
+// flags of the indirect pointers above it to match.
+func setHolesOnPath(parentBlocks []parentBlockAndChildIndex, holes bool) {
+	for i := len(parentBlocks) - 1; i >= 0; i-- {
+		pb := parentBlocks[i]
+		pb.pblock.IPtrs[pb.childIndex].Holes = holes
+		holes = pb.pblock.hasHoles()
+	}
+}
+
+// insertPtrLocked inserts iptr into the indirect block at the given
+// level of parentBlocks, right after that level's child pointer.  If
+// that leaves the block with too many pointers, it is split in half,
+// and the pointer to the new right half is inserted one level up in
+// turn.  When the top block itself is split, both halves move down
+// into new child blocks.  parentBlocks must already be marked dirty.
+// It returns the pointers of all the new blocks.
+func (fbo *folderBlockOps) insertPtrLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, file path, topBlock *FileBlock,
+	parentBlocks []parentBlockAndChildIndex, level int,
+	iptr IndirectFilePtr) ([]BlockPointer, error) {
+	fbo.blockLock.AssertLocked(lState)
+
+	pb := parentBlocks[level]
+	pblock := pb.pblock
+	i := pb.childIndex + 1
+	pblock.IPtrs = append(pblock.IPtrs, IndirectFilePtr{})
+	copy(pblock.IPtrs[i+1:], pblock.IPtrs[i:])
+	pblock.IPtrs[i] = iptr
+
+	maxPtrs := fbo.config.BlockSplitter().MaxPtrsPerBlock()
+	if maxPtrs == 0 || len(pblock.IPtrs) <= maxPtrs {
+		if level == 0 {
+			return nil, nil
+		}
+		return nil, fbo.cacheBlockIfNotYetDirtyLocked(lState,
+			parentPtr(file, parentBlocks, level), file.Branch, pblock)
+	}
+
+	bcache := fbo.config.BlockCache()
+	half := len(pblock.IPtrs) / 2
+	right := &FileBlock{
+		CommonBlock: CommonBlock{IsInd: true},
+		IPtrs:       append([]IndirectFilePtr(nil), pblock.IPtrs[half:]...),
+	}
+	pblock.IPtrs = pblock.IPtrs[:half]
+	rightPtr, err := fbo.newTemporaryFilePtrLocked(ctx, lState, md)
+	if err != nil {
+		return nil, err
+	}
+	if err := bcache.PutDirty(rightPtr, file.Branch, right); err != nil {
+		return nil, err
+	}
+	newPtrs := []BlockPointer{rightPtr}
+	rightIPtr := IndirectFilePtr{
+		BlockInfo: BlockInfo{BlockPointer: rightPtr, EncodedSize: 0},
+		Off:       right.IPtrs[0].Off,
+		Holes:     right.hasHoles(),
+	}
+
+	if level == 0 {
+		leftPtr, err := fbo.newTemporaryFilePtrLocked(ctx, lState, md)
+		if err != nil {
+			return nil, err
+		}
+		left := &FileBlock{
+			CommonBlock: CommonBlock{IsInd: true},
+			IPtrs:       pblock.IPtrs,
+		}
+		if err := bcache.PutDirty(leftPtr, file.Branch, left); err != nil {
+			return nil, err
+		}
+		topBlock.IPtrs = []IndirectFilePtr{{
+			BlockInfo: BlockInfo{BlockPointer: leftPtr, EncodedSize: 0},
+			Off:       left.IPtrs[0].Off,
+			Holes:     left.hasHoles(),
+		}, rightIPtr}
+		return append(newPtrs, leftPtr), nil
+	}
+
+	ppb := parentBlocks[level-1]
+	ppb.pblock.IPtrs[ppb.childIndex].Holes = pblock.hasHoles()
+	if err := fbo.cacheBlockIfNotYetDirtyLocked(lState,
+		parentPtr(file, parentBlocks, level), file.Branch,
+		pblock); err != nil {
+		return nil, err
+	}
+	morePtrs, err := fbo.insertPtrLocked(
+		ctx, lState, md, file, topBlock, parentBlocks, level-1, rightIPtr)
+	if err != nil {
+		return nil, err
+	}
+	return append(newPtrs, morePtrs...), nil
+}
+
+// insertLeafLocked adds a new, empty leaf block starting at the
+// given offset, right after the leaf block at the bottom of
+// parentBlocks, which must already be marked dirty.  It returns the
+// pointers of all the new blocks.
+func (fbo *folderBlockOps) insertLeafLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, file path, topBlock *FileBlock,
+	parentBlocks []parentBlockAndChildIndex, off int64) (
+	[]BlockPointer, error) {
+	fbo.blockLock.AssertLocked(lState)
+	newPtr, err := fbo.newTemporaryFilePtrLocked(ctx, lState, md)
+	if err != nil {
+		return nil, err
+	}
+	if err := fbo.config.BlockCache().PutDirty(
+		newPtr, file.Branch, &FileBlock{}); err != nil {
+		return nil, err
+	}
+	newPtrs, err := fbo.insertPtrLocked(ctx, lState, md, file, topBlock,
+		parentBlocks, len(parentBlocks)-1, IndirectFilePtr{
+			BlockInfo: BlockInfo{BlockPointer: newPtr, EncodedSize: 0},
+			Off:       off,
+		})
+	if err != nil {
+		return nil, err
+	}
+	return append([]BlockPointer{newPtr}, newPtrs...), nil
+}
+
 func (fbo *folderBlockOps) getOrCreateSyncInfoLocked(
 	lState *lockState, de DirEntry) *syncInfo {
 	fbo.blockLock.AssertLocked(lState)
@@ -825,37 +1511,53 @@ func (fbo *folderBlockOps) fixChildBlocksAfterRecoverableError(
 			"top-block for %v: %v", file.tailPointer(), err)
 		return
 	}
-	for newPtr, oldPtr := range redirtyOnRecoverableError {
-		found := false
+	var redirtyChildren func(fblock *FileBlock)
+	redirtyChildren = func(fblock *FileBlock) {
 		for i, iptr := range fblock.IPtrs {
-			if iptr.BlockPointer == newPtr {
-				found = true
-				fblock.IPtrs[i].EncodedSize = 0
+			newPtr := iptr.BlockPointer
+			oldPtr, ok := redirtyOnRecoverableError[newPtr]
+			if !ok {
+				// An indirect block that was dirtied during the
+				// sync may still point to sync'd blocks.
+				if !bcache.IsDirty(newPtr, fbo.branch()) {
+					continue
+				}
+				b, err := bcache.Get(newPtr, fbo.branch())
+				if childBlock, ok := b.(*FileBlock); err == nil && ok &&
+					childBlock.IsInd {
+					redirtyChildren(childBlock)
+				}
+				continue
+			}
+			fblock.IPtrs[i].EncodedSize = 0
+
+			fbo.log.CDebugf(ctx, "Re-dirtying %v (and deleting dirty block %v)",
+				newPtr, oldPtr)
+			// These block would have been permanent,
+			// so they're definitely still in the
+			// cache
+			b, err := bcache.Get(newPtr, fbo.branch())
+			if err != nil {
+				fbo.log.CWarningf(ctx, "Couldn't re-dirty %v: %v", newPtr, err)
+				continue
+			}
+			err = bcache.PutDirty(newPtr, fbo.branch(), b)
+			if err != nil {
+				fbo.log.CWarningf(ctx, "Couldn't re-dirty %v: %v", newPtr, err)
+			}
+			err = bcache.DeleteDirty(oldPtr, fbo.branch())
+			if err != nil {
+				fbo.log.CDebugf(ctx, "Couldn't del-dirty %v: %v", oldPtr, err)
 			}
-		}
-		if !found {
-			continue
-		}
 
-		fbo.log.CDebugf(ctx, "Re-dirtying %v (and deleting dirty block %v)",
-			newPtr, oldPtr)
-		// These block would have been permanent,
-		// so they're definitely still in the
-		// cache
-		b, err := bcache.Get(newPtr, fbo.branch())
-		if err != nil {
-			fbo.log.CWarningf(ctx, "Couldn't re-dirty %v: %v", newPtr, err)
-			continue
-		}
-		err = bcache.PutDirty(newPtr, fbo.branch(), b)
-		if err != nil {
-			fbo.log.CWarningf(ctx, "Couldn't re-dirty %v: %v", newPtr, err)
-		}
-		err = bcache.DeleteDirty(oldPtr, fbo.branch())
-		if err != nil {
-			fbo.log.CDebugf(ctx, "Couldn't del-dirty %v: %v", oldPtr, err)
+			// The children of a re-dirtied indirect block
+			// need to be re-dirtied as well.
+			if childBlock, ok := b.(*FileBlock); ok && childBlock.IsInd {
+				redirtyChildren(childBlock)
+			}
 		}
 	}
+	redirtyChildren(fblock)
 }
 
 func (fbo *folderBlockOps) nowUnixNano() int64 {
@@ -876,7 +1578,7 @@ func (fbo *folderBlockOps) PrepRename(
 
 	// look up in the old path
 	oldPBlock, err = fbo.getDirLocked(
-		ctx, lState, md, oldParent, blockWrite)
+		ctx, lState, md, oldParent, blockWrite, oldName)
 	if err != nil {
 		return nil, nil, DirEntry{}, nil, err
 	}
@@ -894,9 +1596,14 @@ func (fbo *folderBlockOps) PrepRename(
 	// dedup'd blocks that share an ID but can be updated separately.
 	if oldParent.tailPointer().ID == newParent.tailPointer().ID {
 		newPBlock = oldPBlock
+		err = fbo.loadDirEntriesLocked(
+			ctx, lState, md, newParent, newPBlock, []string{newName})
+		if err != nil {
+			return nil, nil, DirEntry{}, nil, err
+		}
 	} else {
 		newPBlock, err = fbo.getDirLocked(
-			ctx, lState, md, newParent, blockWrite)
+			ctx, lState, md, newParent, blockWrite, newName)
 		if err != nil {
 			return nil, nil, DirEntry{}, nil, err
 		}
@@ -909,7 +1616,8 @@ func (fbo *folderBlockOps) PrepRename(
 			// case, the syncBlockAndCheckEmbedLocked call by the
 			// caller will take care of it).
 			if oldGrandparent.tailPointer().ID != newParent.tailPointer().ID {
-				b, err := fbo.getDirLocked(ctx, lState, md, oldGrandparent, blockWrite)
+				b, err := fbo.getDirLocked(ctx, lState, md, oldGrandparent,
+					blockWrite, oldParent.tailName())
 				if err != nil {
 					return nil, nil, DirEntry{}, nil, err
 				}
@@ -947,11 +1655,15 @@ func (fbo *folderBlockOps) Read(
 	nRead := int64(0)
 	n := int64(len(dest))
 
+	var parentBlocks []parentBlockAndChildIndex
 	for nRead < n {
 		nextByte := nRead + off
 		toRead := n - nRead
-		_, _, _, block, _, startOff, err := fbo.getFileBlockAtOffsetLocked(
-			ctx, lState, md, file, fblock, nextByte, blockRead)
+		var block *FileBlock
+		var nextBlockOff, startOff int64
+		_, parentBlocks, block, nextBlockOff, startOff, err =
+			fbo.getFileBlockAtOffsetLocked(
+				ctx, lState, md, file, fblock, nextByte, blockRead)
 		if err != nil {
 			return 0, err
 		}
@@ -959,7 +1671,18 @@ func (fbo *folderBlockOps) Read(
 		lastByteInBlock := startOff + blockLen
 
 		if nextByte >= lastByteInBlock {
-			return nRead, nil
+			if nextBlockOff < 0 {
+				return nRead, nil
+			}
+			// Fill in zeroes for the hole before the next block.
+			if toRead > nextBlockOff-nextByte {
+				toRead = nextBlockOff - nextByte
+			}
+			for i := nRead; i < nRead+toRead; i++ {
+				dest[i] = 0
+			}
+			nRead += toRead
+			continue
 		} else if toRead > lastByteInBlock-nextByte {
 			toRead = lastByteInBlock - nextByte
 		}
@@ -970,35 +1693,164 @@ func (fbo *folderBlockOps) Read(
 		nRead += toRead
 	}
 
+	fbo.maybeReadAhead(md, file, parentBlocks, off, n)
 	return n, nil
 }
 
+// maybeReadAhead starts prefetching the blocks that follow the leaf
+// block at the end of a read of n bytes at off, if the read
+// continues a sequential run of reads of the file.  parentBlocks is
+// the path down to that leaf block.
+func (fbo *folderBlockOps) maybeReadAhead(md *RootMetadata, file path,
+	parentBlocks []parentBlockAndChildIndex, off, n int64) {
+	readAhead := fbo.config.ReadAheadBlocks()
+	if readAhead <= 0 || len(parentBlocks) == 0 {
+		return
+	}
+	if !fbo.prefetcher.noteRead(file.tailPointer().ref(), off, n) {
+		return
+	}
+
+	// Only the siblings of the leaf block are prefetched, since
+	// fetching the next parent would hold up this read.
+	pbci := parentBlocks[len(parentBlocks)-1]
+	var ptrs []BlockPointer
+	for i := pbci.childIndex + 1; i < len(pbci.pblock.IPtrs) &&
+		len(ptrs) < readAhead; i++ {
+		ptrs = append(ptrs, pbci.pblock.IPtrs[i].BlockPointer)
+	}
+	fbo.prefetcher.prefetch(md, ptrs, file.Branch, NewFileBlock)
+}
+
+// findHoleLocked returns the offset of the first hole at or after
+// off within the part of the file covered by the given indirect
+// block, which ends at end (or at the end of the file, if end is
+// negative).  Only the subtrees marked as having holes are fetched.
+// It returns -1 if there is no such hole.
+func (fbo *folderBlockOps) findHoleLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, file path, pblock *FileBlock,
+	off int64, end int64) (int64, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	for i, iptr := range pblock.IPtrs {
+		iptrEnd := end
+		if i < len(pblock.IPtrs)-1 {
+			iptrEnd = pblock.IPtrs[i+1].Off
+		}
+		if !iptr.Holes || (iptrEnd >= 0 && iptrEnd <= off) {
+			continue
+		}
+		block, err := fbo.getFileBlockHelperLocked(
+			ctx, lState, md, iptr.BlockPointer, file.Branch, file)
+		if err != nil {
+			return 0, err
+		}
+		if block.IsInd {
+			holeOff, err := fbo.findHoleLocked(
+				ctx, lState, md, file, block, off, iptrEnd)
+			if err != nil {
+				return 0, err
+			}
+			if holeOff >= 0 {
+				return holeOff, nil
+			}
+			continue
+		}
+		contentsEnd := iptr.Off + int64(len(block.Contents))
+		if iptrEnd >= 0 && contentsEnd < iptrEnd {
+			if off > contentsEnd {
+				return off, nil
+			}
+			return contentsEnd, nil
+		}
+	}
+	return -1, nil
+}
+
+// Seek returns the offset of the first byte at or after off in the
+// given file that's in a hole, if hole is true, or that holds data
+// otherwise.  The end of the file counts as a hole.  It returns
+// NoDataAfterOffsetError if off is at or past the end of the file,
+// or if hole is false and the rest of the file is a hole.
+func (fbo *folderBlockOps) Seek(ctx context.Context, lState *lockState,
+	md *RootMetadata, file path, off int64, hole bool) (int64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, md, file)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(de.Size)
+	if off < 0 || off >= size {
+		return 0, NoDataAfterOffsetError{off}
+	}
+
+	// getFileLocked already checks read permissions
+	fblock, err := fbo.getFileLocked(ctx, lState, md, file, blockRead)
+	if err != nil {
+		return 0, err
+	}
+	if !fblock.IsInd {
+		if hole {
+			return size, nil
+		}
+		return off, nil
+	}
+
+	if hole {
+		holeOff, err := fbo.findHoleLocked(
+			ctx, lState, md, file, fblock, off, -1)
+		if err != nil {
+			return 0, err
+		}
+		if holeOff < 0 || holeOff > size {
+			return size, nil
+		}
+		return holeOff, nil
+	}
+
+	_, _, block, nextBlockOff, startOff, err :=
+		fbo.getFileBlockAtOffsetLocked(
+			ctx, lState, md, file, fblock, off, blockRead)
+	if err != nil {
+		return 0, err
+	}
+	if off < startOff+int64(len(block.Contents)) {
+		return off, nil
+	}
+	// Only the last block can be empty, so if the next block starts
+	// before the end of the file, that's where the data is.
+	if nextBlockOff < 0 || nextBlockOff >= size {
+		return 0, NoDataAfterOffsetError{off}
+	}
+	return nextBlockOff, nil
+}
+
+// maybeWaitOnDeferredWrites paces a write of n bytes to the given
+// file according to the dirty-data budget.  If there is too much
+// unflushed data, it waits until some of it gets flushed, so our
+// memory usage doesn't grow without bound.
 func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
-	ctx context.Context, lState *lockState) error {
-	// If there is too much unflushed data, we should wait until some
-	// of it gets flush so our memory usage doesn't grow without
-	// bound.
-	bcache := fbo.config.BlockCache()
+	ctx context.Context, lState *lockState, file Node, n int64) error {
+	budget := fbo.config.DirtyBudget()
 	var syncBlockingCh chan error
 	for {
-		overThreshold := func() bool {
-			fbo.blockLock.Lock(lState)
-			defer fbo.blockLock.Unlock(lState)
-			dirtyBytes := bcache.DirtyBytesEstimate()
-			if dirtyBytes < dirtyBytesThreshold {
-				return false
-			}
-			fbo.log.CDebugf(ctx, "Blocking a write because of %d dirty bytes",
-				dirtyBytes)
-			if syncBlockingCh == nil {
-				syncBlockingCh = make(chan error, 1)
+		mustWait, err := budget.BeginWrite(ctx, fbo.id(), file.GetID(), n)
+		if err != nil {
+			return err
+		}
+		if !mustWait {
+			break
+		}
+		fbo.log.CDebugf(ctx, "Blocking a write because of too much dirty data")
+		if syncBlockingCh == nil {
+			syncBlockingCh = make(chan error, 1)
+			func() {
+				fbo.blockLock.Lock(lState)
+				defer fbo.blockLock.Unlock(lState)
 				fbo.syncListeners =
 					append(fbo.syncListeners, syncBlockingCh)
-			}
-			return true
-		}()
-		if !overThreshold {
-			break
+			}()
 		}
 
 		select {
@@ -1046,7 +1898,8 @@ func (fbo *folderBlockOps) pathFromNodeForBlockWriteLocked(
 // to be cleaned up if the write is deferred.
 func (fbo *folderBlockOps) writeDataLocked(
 	ctx context.Context, lState *lockState, md *RootMetadata, file path,
-	data []byte, off int64) (WriteRange, []BlockPointer, error) {
+	data []byte, off int64, appending bool) (
+	WriteRange, []BlockPointer, error) {
 	fbo.blockLock.AssertLocked(lState)
 
 	if sz := off + int64(len(data)); uint64(sz) > fbo.config.MaxFileBytes() {
@@ -1067,7 +1920,6 @@ func (fbo *folderBlockOps) writeDataLocked(
 		return WriteRange{}, nil, err
 	}
 
-	bcache := fbo.config.BlockCache()
 	bsplit := fbo.config.BlockSplitter()
 	n := int64(len(data))
 	nCopied := int64(0)
@@ -1080,7 +1932,7 @@ func (fbo *folderBlockOps) writeDataLocked(
 	si := fbo.getOrCreateSyncInfoLocked(lState, de)
 	var dirtyPtrs []BlockPointer
 	for nCopied < n {
-		ptr, parentBlock, indexInParent, block, more, startOff, err :=
+		ptr, parentBlocks, block, nextBlockOff, startOff, err :=
 			fbo.getFileBlockAtOffsetLocked(
 				ctx, lState, md, file, fblock,
 				off+nCopied, blockWrite)
@@ -1089,79 +1941,98 @@ func (fbo *folderBlockOps) writeDataLocked(
 		}
 
 		oldLen := len(block.Contents)
-		nCopied += bsplit.CopyUntilSplit(block, !more, data[nCopied:],
-			off+nCopied-startOff)
+		writeOff := off + nCopied
+		toCopy := data[nCopied:]
+		if nextBlockOff >= 0 && startOff+int64(oldLen) < nextBlockOff &&
+			writeOff+int64(len(toCopy)) > nextBlockOff {
+			// Only fill in the hole up to the next block.
+			toCopy = toCopy[:nextBlockOff-writeOff]
+		}
+		copied := bsplit.CopyUntilSplit(block, nextBlockOff < 0, toCopy,
+			writeOff-startOff)
+		// A block in the middle of the file can be short, if a hole
+		// after it was filled in, so the splitter may have grown it
+		// past the start of the next block; leave those bytes to the
+		// next block instead.
+		if nextBlockOff >= 0 {
+			over := startOff + int64(len(block.Contents)) - nextBlockOff
+			if over > 0 && over <= copied {
+				block.Contents = block.Contents[:nextBlockOff-startOff]
+				copied -= over
+			}
+		}
+		nCopied += copied
 
 		// the block splitter could only have copied to the end of the
-		// existing block (or appended to the end of the final block), so
-		// we shouldn't ever hit this case:
-		if more && oldLen < len(block.Contents) {
+		// existing block (or appended to the end of the final block,
+		// or into a hole), so we shouldn't ever hit this case:
+		if nextBlockOff >= 0 &&
+			startOff+int64(len(block.Contents)) > nextBlockOff {
 			return WriteRange{}, nil, BadSplitError{}
 		}
 
-		// TODO: support multiple levels of indirection.  Right now the
-		// code only does one but it should be straightforward to
-		// generalize, just annoying
+		// Figure out whether the rest of the write needs a new
+		// block after this one.
+		newBlockOff := int64(-1)
+		if copied == 0 && writeOff > startOff+int64(oldLen) {
+			// This block has no room for zeroes up to the write,
+			// so leave a hole instead.
+			block.Contents = block.Contents[:oldLen]
+			newBlockOff = writeOff
+		} else if blockEnd := startOff + int64(len(block.Contents)); copied <
+			int64(len(toCopy)) && (nextBlockOff < 0 || blockEnd < nextBlockOff) {
+			// The rest goes in a new block, either at the end of
+			// the file or in the remainder of the hole.
+			newBlockOff = blockEnd
+		}
+
+		// Mark the whole path to this block as dirty, before
+		// any new blocks get added to the tree below.
+		parentPtrs, err := fbo.markParentsDirtyLocked(
+			lState, file, parentBlocks, si)
+		if err != nil {
+			return WriteRange{}, nil, err
+		}
+		dirtyPtrs = append(dirtyPtrs, parentPtrs...)
 
-		// if we need another block but there are no more, then make one
-		if nCopied < n && !more {
+		// if we need another block, then make one
+		if newBlockOff >= 0 {
 			// If the block doesn't already have a parent block, make one.
 			if ptr == file.tailPointer() {
-				// pick a new id for this block, and use this block's ID for
-				// the parent
-				newID, err := fbo.config.Crypto().MakeTemporaryBlockID()
+				fblock, ptr, err = fbo.makeIndirectTopBlockLocked(
+					ctx, lState, md, file)
 				if err != nil {
 					return WriteRange{}, nil, err
 				}
-				fblock = &FileBlock{
-					CommonBlock: CommonBlock{
-						IsInd: true,
-					},
-					IPtrs: []IndirectFilePtr{
-						{
-							BlockInfo: BlockInfo{
-								BlockPointer: BlockPointer{
-									ID:       newID,
-									KeyGen:   md.LatestKeyGeneration(),
-									DataVer:  fbo.config.DataVersion(),
-									Creator:  uid,
-									RefNonce: zeroBlockRefNonce,
-								},
-								EncodedSize: 0,
-							},
-							Off: 0,
-						},
-					},
-				}
-				if err := bcache.PutDirty(
-					file.tailPointer(), file.Branch, fblock); err != nil {
-					return WriteRange{}, nil, err
-				}
-				ptr = fblock.IPtrs[0].BlockPointer
+				parentBlocks = []parentBlockAndChildIndex{{fblock, 0}}
 			}
+		}
 
-			// Make a new right block and update the parent's
-			// indirect block list
-			err := fbo.newRightBlockLocked(ctx, lState, file.tailPointer(),
-				file.Branch, fblock, startOff+int64(len(block.Contents)), md)
+		blockEnd := startOff + int64(len(block.Contents))
+		if newBlockOff >= 0 {
+			setHolesOnPath(parentBlocks, blockEnd < newBlockOff)
+		} else if nextBlockOff >= 0 {
+			setHolesOnPath(parentBlocks, blockEnd < nextBlockOff)
+		}
+
+		if newBlockOff >= 0 {
+			// Make a new block, either at the right end of the
+			// file, or in the middle of a hole, and update the
+			// indirect block lists.
+			var newPtrs []BlockPointer
+			if nextBlockOff < 0 {
+				newPtrs, err = fbo.newRightBlockLocked(ctx, lState, file,
+					fblock, parentBlocks, newBlockOff, md)
+			} else {
+				newPtrs, err = fbo.insertLeafLocked(ctx, lState, md, file,
+					fblock, parentBlocks, newBlockOff)
+			}
 			if err != nil {
 				return WriteRange{}, nil, err
 			}
+			dirtyPtrs = append(dirtyPtrs, newPtrs...)
 		}
 
-		if oldLen != len(block.Contents) {
-			de.EncodedSize = 0
-			// update the file info
-			de.Size += uint64(len(block.Contents) - oldLen)
-			fbo.deCache[file.tailPointer().ref()] = de
-		}
-
-		if parentBlock != nil {
-			// remember how many bytes it was
-			si.unrefs = append(si.unrefs,
-				parentBlock.IPtrs[indexInParent].BlockInfo)
-			parentBlock.IPtrs[indexInParent].EncodedSize = 0
-		}
 		// keep the old block ID while it's dirty
 		if err = fbo.cacheBlockIfNotYetDirtyLocked(lState, ptr, file.Branch,
 			block); err != nil {
@@ -1170,6 +2041,13 @@ func (fbo *folderBlockOps) writeDataLocked(
 		dirtyPtrs = append(dirtyPtrs, ptr)
 	}
 
+	// update the file info
+	if newSize := uint64(off + n); n > 0 && newSize > de.Size {
+		de.EncodedSize = 0
+		de.Size = newSize
+		fbo.deCache[file.tailPointer().ref()] = de
+	}
+
 	if fblock.IsInd {
 		// Always make the top block dirty, so we will sync its
 		// indirect blocks.  This has the added benefit of ensuring
@@ -1183,16 +2061,11 @@ func (fbo *folderBlockOps) writeDataLocked(
 		}
 		dirtyPtrs = append(dirtyPtrs, file.tailPointer())
 	}
-	latestWrite := si.op.addWrite(uint64(off), uint64(len(data)))
-
-	if d := bcache.DirtyBytesEstimate(); d > dirtyBytesThreshold {
-		fbo.log.CDebugf(ctx, "Forcing a sync due to %d dirty bytes", d)
-		select {
-		// If we can't send on the channel, that means a sync is
-		// already in progress
-		case fbo.forceSyncChan <- struct{}{}:
-		default:
-		}
+	var latestWrite WriteRange
+	if appending {
+		latestWrite = si.op.addAppend(uint64(off), uint64(len(data)))
+	} else {
+		latestWrite = si.op.addWrite(uint64(off), uint64(len(data)))
 	}
 
 	return latestWrite, dirtyPtrs, nil
@@ -1203,8 +2076,27 @@ func (fbo *folderBlockOps) writeDataLocked(
 // future sync (as controlled by NotifyBlockedWrites).
 func (fbo *folderBlockOps) Write(
 	ctx context.Context, lState *lockState, md *RootMetadata,
-	file Node, data []byte, off int64) error {
-	if err := fbo.maybeWaitOnDeferredWrites(ctx, lState); err != nil {
+	file Node, data []byte, off int64) error {
+	return fbo.write(ctx, lState, md, file, data, off, false)
+}
+
+// Append writes the given data to the end of the given file, as of
+// when the write happens.  Like Write, it may block if there is too
+// much unflushed data.
+func (fbo *folderBlockOps) Append(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	file Node, data []byte) error {
+	return fbo.write(ctx, lState, md, file, data, 0, true)
+}
+
+// write writes the given data to the given file, either at the given
+// offset, or at the end of the file if appending is set.
+func (fbo *folderBlockOps) write(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	file Node, data []byte, off int64, appending bool) error {
+	err := fbo.maybeWaitOnDeferredWrites(
+		ctx, lState, file, int64(len(data)))
+	if err != nil {
 		return err
 	}
 
@@ -1220,12 +2112,32 @@ func (fbo *folderBlockOps) Write(
 		fbo.doDeferWrite = false
 	}()
 
+	if appending {
+		de, err := fbo.getDirtyEntryLocked(ctx, lState, md, filePath)
+		if err != nil {
+			return err
+		}
+		off = int64(de.Size)
+	}
+
 	latestWrite, dirtyPtrs, err := fbo.writeDataLocked(
-		ctx, lState, md, filePath, data, off)
+		ctx, lState, md, filePath, data, off, appending)
 	if err != nil {
 		return err
 	}
 
+	budget := fbo.config.DirtyBudget()
+	budget.Dirtied(fbo.id(), file.GetID(), int64(len(data)))
+	if budget.ShouldForceSync(fbo.id()) {
+		fbo.log.CDebugf(ctx, "Forcing a sync due to too much dirty data")
+		select {
+		// If we can't send on the channel, that means a sync is
+		// already in progress
+		case fbo.forceSyncChan <- struct{}{}:
+		default:
+		}
+	}
+
 	fbo.observers.localChange(ctx, file, latestWrite)
 
 	if fbo.doDeferWrite {
@@ -1248,7 +2160,7 @@ func (fbo *folderBlockOps) Write(
 				// Write the data again.  We know this won't be
 				// deferred, so no need to check the new ptrs.
 				_, _, err = fbo.writeDataLocked(
-					ctx, lState, rmd, f, dataCopy, off)
+					ctx, lState, rmd, f, dataCopy, off, appending)
 				return err
 			})
 	}
@@ -1279,25 +2191,22 @@ func (fbo *folderBlockOps) truncateLocked(
 
 	// find the block where the file should now end
 	iSize := int64(size) // TODO: deal with overflow
-	ptr, parentBlock, indexInParent, block, more, startOff, err :=
+	ptr, parentBlocks, block, nextBlockOff, startOff, err :=
 		fbo.getFileBlockAtOffsetLocked(
 			ctx, lState, md, file, fblock, iSize, blockWrite)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	currLen := int64(startOff) + int64(len(block.Contents))
-	if currLen < iSize {
-		// if we need to extend the file, let's just do a write
-		moreNeeded := iSize - currLen
-		latestWrite, dirtyPtrs, err := fbo.writeDataLocked(
-			ctx, lState, md, file,
-			make([]byte, moreNeeded, moreNeeded), currLen)
-		if err != nil {
-			return nil, nil, err
-		}
-		return &latestWrite, dirtyPtrs, err
-	} else if currLen == iSize {
+	if nextBlockOff < 0 && currLen == iSize {
 		// same size!
 		return nil, nil, nil
 	}
+	// An extension past the end of the file is like a write of
+	// zeroes, but it never needs to store more than one block's
+	// worth of them.
+	extending := nextBlockOff < 0 && currLen < iSize
 
 	// update the local entry size
 	de, err := fbo.getDirtyEntryLocked(ctx, lState, md, file)
@@ -1305,21 +2214,75 @@ func (fbo *folderBlockOps) truncateLocked(
 		return nil, nil, err
 	}
 
+	si := fbo.getOrCreateSyncInfoLocked(lState, de)
+	if nextBlockOff >= 0 {
+		// TODO: if every remaining block has just one child, we
+		// can remove levels of indirection.
+		for i, pb := range parentBlocks {
+			for _, iptr := range pb.pblock.IPtrs[pb.childIndex+1:] {
+				si.unrefs = append(si.unrefs, iptr.BlockInfo)
+				if i == len(parentBlocks)-1 {
+					// All leaf blocks are at the same depth,
+					// so this is a leaf.
+					continue
+				}
+				// Unref everything below the removed
+				// pointer too.
+				child, err := fbo.getFileBlockHelperLocked(
+					ctx, lState, md, iptr.BlockPointer, file.Branch, file)
+				if err != nil {
+					return nil, nil, err
+				}
+				childInfos, err := fbo.getIndirectFileBlockInfosLocked(
+					ctx, lState, md, file, child)
+				if err != nil {
+					return nil, nil, err
+				}
+				si.unrefs = append(si.unrefs, childInfos...)
+			}
+			pb.pblock.IPtrs = pb.pblock.IPtrs[:pb.childIndex+1]
+		}
+	}
+
 	// otherwise, we need to delete some data (and possibly entire blocks)
-	block.Contents = append([]byte(nil), block.Contents[:iSize-startOff]...)
+	if currLen > iSize {
+		block.Contents = append([]byte(nil), block.Contents[:iSize-startOff]...)
+	}
 
-	si := fbo.getOrCreateSyncInfoLocked(lState, de)
-	if more {
-		// TODO: if indexInParent == 0, we can remove the level of indirection
-		for _, ptr := range parentBlock.IPtrs[indexInParent+1:] {
-			si.unrefs = append(si.unrefs, ptr.BlockInfo)
+	// always make the parent blocks dirty, so we will sync them
+	dirtyPtrs, err := fbo.markParentsDirtyLocked(lState, file, parentBlocks, si)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// This is the last block now, so fill in any space up to the
+	// new size with zeroes, or if there's no room for that, leave a
+	// hole before a new, empty last block.
+	holes := false
+	if oldLen := len(block.Contents); startOff+int64(oldLen) < iSize {
+		fbo.config.BlockSplitter().CopyUntilSplit(
+			block, true, nil, iSize-startOff)
+		if startOff+int64(len(block.Contents)) != iSize {
+			block.Contents = block.Contents[:oldLen]
+			holes = true
 		}
-		parentBlock.IPtrs = parentBlock.IPtrs[:indexInParent+1]
-		// always make the parent block dirty, so we will sync it
-		if err = fbo.cacheBlockIfNotYetDirtyLocked(lState,
-			file.tailPointer(), file.Branch, parentBlock); err != nil {
+	}
+	if holes && ptr == file.tailPointer() {
+		fblock, ptr, err = fbo.makeIndirectTopBlockLocked(
+			ctx, lState, md, file)
+		if err != nil {
+			return nil, nil, err
+		}
+		parentBlocks = []parentBlockAndChildIndex{{fblock, 0}}
+	}
+	setHolesOnPath(parentBlocks, holes)
+	if holes {
+		newPtrs, err := fbo.newRightBlockLocked(
+			ctx, lState, file, fblock, parentBlocks, iSize, md)
+		if err != nil {
 			return nil, nil, err
 		}
+		dirtyPtrs = append(dirtyPtrs, newPtrs...)
 	}
 
 	if fblock.IsInd {
@@ -1333,19 +2296,16 @@ func (fbo *folderBlockOps) truncateLocked(
 			file.tailPointer(), file.Branch, fblock); err != nil {
 			return nil, nil, err
 		}
+		dirtyPtrs = append(dirtyPtrs, file.tailPointer())
 	}
 
-	if parentBlock != nil {
-		// TODO: When we implement more than one level of indirection,
-		// make sure that the pointer to parentBlock in the grandparent block
-		// has EncodedSize 0.
-		si.unrefs = append(si.unrefs,
-			parentBlock.IPtrs[indexInParent].BlockInfo)
-		parentBlock.IPtrs[indexInParent].EncodedSize = 0
+	var latestWrite WriteRange
+	if extending {
+		latestWrite = si.op.addWrite(uint64(currLen), uint64(iSize-currLen))
+	} else {
+		latestWrite = si.op.addTruncate(size)
 	}
 
-	latestWrite := si.op.addTruncate(size)
-
 	de.EncodedSize = 0
 	de.Size = size
 	fbo.deCache[file.tailPointer().ref()] = de
@@ -1355,8 +2315,9 @@ func (fbo *folderBlockOps) truncateLocked(
 		ptr, file.Branch, block); err != nil {
 		return nil, nil, err
 	}
+	dirtyPtrs = append(dirtyPtrs, ptr)
 
-	return &latestWrite, nil, nil
+	return &latestWrite, dirtyPtrs, nil
 }
 
 // Truncate truncates or extends the given file to the given size.
@@ -1366,7 +2327,7 @@ func (fbo *folderBlockOps) truncateLocked(
 func (fbo *folderBlockOps) Truncate(
 	ctx context.Context, lState *lockState, md *RootMetadata,
 	file Node, size uint64) error {
-	if err := fbo.maybeWaitOnDeferredWrites(ctx, lState); err != nil {
+	if err := fbo.maybeWaitOnDeferredWrites(ctx, lState, file, 0); err != nil {
 		return err
 	}
 
@@ -1436,6 +2397,34 @@ func (fbo *folderBlockOps) ClearCacheInfo(lState *lockState, file path) {
 	fbo.clearCacheInfoLocked(lState, file)
 }
 
+// DiscardDirtyFile drops all the dirty blocks and cached info of the
+// given file, as if none of the writes since its last sync had
+// happened.  It must not be called while the file is being synced.
+func (fbo *folderBlockOps) DiscardDirtyFile(ctx context.Context,
+	lState *lockState, file path) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	bcache := fbo.config.BlockCache()
+	var discard func(ptr BlockPointer)
+	discard = func(ptr BlockPointer) {
+		if !bcache.IsDirty(ptr, fbo.branch()) {
+			return
+		}
+		b, err := bcache.Get(ptr, fbo.branch())
+		if fblock, ok := b.(*FileBlock); err == nil && ok && fblock.IsInd {
+			for _, iptr := range fblock.IPtrs {
+				discard(iptr.BlockPointer)
+			}
+		}
+		if err := bcache.DeleteDirty(ptr, fbo.branch()); err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't del-dirty %v: %v", ptr, err)
+		}
+	}
+	discard(file.tailPointer())
+	fbo.clearCacheInfoLocked(lState, file)
+}
+
 // revertSyncInfoAfterRecoverableError updates the saved sync info to
 // include all the blocks from before the error, except for those that
 // have encountered recoverable block errors themselves.
@@ -1469,6 +2458,22 @@ func (fbo *folderBlockOps) revertSyncInfoAfterRecoverableError(
 func (fbo *folderBlockOps) ReadyBlock(ctx context.Context, md *RootMetadata,
 	block Block, uid keybase1.UID) (
 	info BlockInfo, plainSize int, readyBlockData ReadyBlockData, err error) {
+	return fbo.readyBlock(ctx, md, block, uid, false)
+}
+
+// ReadyFileChildBlock is like ReadyBlock, for a block under an
+// indirect file block.
+func (fbo *folderBlockOps) ReadyFileChildBlock(ctx context.Context,
+	md *RootMetadata, block *FileBlock, uid keybase1.UID) (
+	info BlockInfo, plainSize int, readyBlockData ReadyBlockData, err error) {
+	return fbo.readyBlock(ctx, md, block, uid, true)
+}
+
+// readyBlock readies the given block; isChild says whether it's
+// under an indirect file block.
+func (fbo *folderBlockOps) readyBlock(ctx context.Context, md *RootMetadata,
+	block Block, uid keybase1.UID, isChild bool) (
+	info BlockInfo, plainSize int, readyBlockData ReadyBlockData, err error) {
 	var ptr BlockPointer
 	if fBlock, ok := block.(*FileBlock); ok && !fBlock.IsInd {
 		// first see if we are duplicating any known blocks in this folder
@@ -1494,10 +2499,34 @@ func (fbo *folderBlockOps) ReadyBlock(ctx context.Context, md *RootMetadata,
 		}
 		ptr.SetWriter(uid)
 	} else {
+		// Older clients can't read the indirect blocks of files with
+		// holes, compressed blocks, directories with hard links,
+		// indirect file blocks under other indirect blocks, or
+		// indirect directory blocks (which they would see as empty);
+		// mark the blocks above any compressed or multi-level ones
+		// too, so those clients find out up front.
+		holes := false
+		compressed := readyBlockData.compressed
+		hardLinks := false
+		multiLevel := false
+		indirectDir := false
+		switch b := block.(type) {
+		case *FileBlock:
+			if b.IsInd {
+				holes = b.hasHoles()
+				compressed = compressed || b.hasCompressedChildren()
+				multiLevel = isChild || b.hasIndirectChildren()
+			}
+		case *DirBlock:
+			hardLinks = b.hasHardLinks()
+			indirectDir = b.IsInd
+		}
+		dataVer := defaultNewBlockDataVersion(
+			holes, compressed, hardLinks, multiLevel, indirectDir)
 		ptr = BlockPointer{
 			ID:       id,
 			KeyGen:   md.LatestKeyGeneration(),
-			DataVer:  fbo.config.DataVersion(),
+			DataVer:  dataVer,
 			Creator:  uid,
 			RefNonce: zeroBlockRefNonce,
 		}
@@ -1510,6 +2539,258 @@ func (fbo *folderBlockOps) ReadyBlock(ctx context.Context, md *RootMetadata,
 	return
 }
 
+// dirLeaf is a child block of an indirect directory block that is
+// being readied.  block is nil if the child block is unchanged.
+type dirLeaf struct {
+	iptr  IndirectDirPtr
+	block *DirBlock
+}
+
+// splitDirEntries divides the given entries into new leaves, one
+// starting at firstOff and then one starting at each of the given
+// split names.
+func splitDirEntries(children map[string]DirEntry, firstOff string,
+	splits []string) []dirLeaf {
+	offs := append([]string{firstOff}, splits...)
+	leaves := make([]dirLeaf, len(offs))
+	for i, off := range offs {
+		leaves[i] = dirLeaf{
+			iptr:  IndirectDirPtr{Off: off},
+			block: NewDirBlock().(*DirBlock),
+		}
+	}
+	for name, de := range children {
+		// Find the last offset that is <= name.
+		i := sort.Search(len(offs), func(i int) bool {
+			return offs[i] > name
+		}) - 1
+		leaves[i].block.Children[name] = de
+	}
+	return leaves
+}
+
+// collectDirLeavesLocked writes the entries of the given local copy
+// of an indirect directory block back into its child blocks.  It
+// returns the resulting list of child blocks, in order, where only
+// the new and modified ones have a non-nil block, splitting any
+// modified ones that have grown too big.  Replaced child blocks are
+// unreferenced in md.
+func (fbo *folderBlockOps) collectDirLeavesLocked(
+	lState *lockState, md *RootMetadata, dblock *DirBlock) []dirLeaf {
+	fbo.blockLock.AssertAnyLocked(lState)
+	bsplit := fbo.config.BlockSplitter()
+
+	names := make([]string, 0, len(dblock.Children))
+	for name := range dblock.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	leaves := make([]dirLeaf, 0, len(dblock.IPtrs))
+	for i, iptr := range dblock.IPtrs {
+		orig, ok := dblock.loadedLeaves[iptr.Off]
+		if !ok {
+			leaves = append(leaves, dirLeaf{iptr: iptr})
+			continue
+		}
+
+		start := sort.SearchStrings(names, iptr.Off)
+		end := len(names)
+		if endOff, bounded := dblock.leafEnd(i); bounded {
+			end = sort.SearchStrings(names, endOff)
+		}
+		children := make(map[string]DirEntry, end-start)
+		for _, name := range names[start:end] {
+			children[name] = dblock.Children[name]
+		}
+		if reflect.DeepEqual(children, orig.Children) {
+			leaves = append(leaves, dirLeaf{iptr: iptr})
+			continue
+		}
+
+		md.AddUnrefBlock(iptr.BlockInfo)
+		if len(children) == 0 {
+			// Drop empty child blocks completely.
+			continue
+		}
+		splits := bsplit.SplitDirIfNeeded(&DirBlock{Children: children})
+		leaves = append(leaves, splitDirEntries(children, iptr.Off, splits)...)
+	}
+	return leaves
+}
+
+// getDirLeafBlockLocked returns the block for the given leaf,
+// fetching it if it's unchanged.  The returned block must not be
+// modified.
+func (fbo *folderBlockOps) getDirLeafBlockLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, leaf dirLeaf) (*DirBlock, error) {
+	if leaf.block != nil {
+		return leaf.block, nil
+	}
+	return fbo.getDirBlockHelperLocked(
+		ctx, lState, md, leaf.iptr.BlockPointer, fbo.branch(), path{})
+}
+
+// mergeDirLeavesLocked combines each new or modified leaf with its
+// neighbors, for as long as the BlockSplitter says they are small
+// enough.  Unchanged neighbors that get merged are unreferenced in
+// md.
+func (fbo *folderBlockOps) mergeDirLeavesLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, leaves []dirLeaf) (
+	[]dirLeaf, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	bsplit := fbo.config.BlockSplitter()
+	emptyBlock := NewDirBlock().(*DirBlock)
+
+	for i := 0; i < len(leaves); {
+		block := leaves[i].block
+		// Avoid fetching neighbors for leaves that are too big to
+		// merge with anything.
+		if block == nil || !bsplit.ShouldMergeDirBlocks(block, emptyBlock) {
+			i++
+			continue
+		}
+
+		merged := false
+		for _, j := range []int{i + 1, i - 1} {
+			if j < 0 || j >= len(leaves) {
+				continue
+			}
+			other, err := fbo.getDirLeafBlockLocked(ctx, lState, md, leaves[j])
+			if err != nil {
+				return nil, err
+			}
+			left, right := i, j
+			leftBlock, rightBlock := block, other
+			if j < i {
+				left, right = j, i
+				leftBlock, rightBlock = other, block
+			}
+			if !bsplit.ShouldMergeDirBlocks(leftBlock, rightBlock) {
+				continue
+			}
+
+			if leaves[j].block == nil {
+				md.AddUnrefBlock(leaves[j].iptr.BlockInfo)
+			}
+			children := make(map[string]DirEntry,
+				len(leftBlock.Children)+len(rightBlock.Children))
+			for name, de := range leftBlock.Children {
+				children[name] = de
+			}
+			for name, de := range rightBlock.Children {
+				children[name] = de
+			}
+			mergedLeaf := dirLeaf{
+				iptr:  IndirectDirPtr{Off: leaves[left].iptr.Off},
+				block: &DirBlock{Children: children},
+			}
+			leaves = append(append(leaves[:left], mergedLeaf),
+				leaves[right+1:]...)
+			i = left
+			merged = true
+			break
+		}
+		if !merged {
+			i++
+		}
+	}
+	return leaves, nil
+}
+
+// ReadyDirBlock readies the given directory block, and adds it to bps
+// along with any new child blocks.  If dblock is a local copy of an
+// indirect block, the entries loaded into its Children are first
+// written back into new child blocks, which are split or merged as
+// needed; if dblock is a direct block that has grown too big, it is
+// split into a new indirect block.  md is updated to reference any
+// new child blocks and unreference the replaced ones.  dblock itself
+// is left untouched, since callers may still need to look up entries
+// in it.  The returned plainSize includes the sizes of all the child
+// blocks.
+func (fbo *folderBlockOps) ReadyDirBlock(ctx context.Context,
+	lState *lockState, md *RootMetadata, dblock *DirBlock,
+	uid keybase1.UID, bps *blockPutState) (
+	info BlockInfo, plainSize int, err error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	readyBlock := func(block *DirBlock) (BlockInfo, int, error) {
+		info, plainSize, readyBlockData, err :=
+			fbo.ReadyBlock(ctx, md, block, uid)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		bps.addNewBlock(info.BlockPointer, block, readyBlockData)
+		return info, plainSize, nil
+	}
+
+	var leaves []dirLeaf
+	if dblock.IsInd {
+		leaves = fbo.collectDirLeavesLocked(lState, md, dblock)
+	} else if splits := fbo.config.BlockSplitter().SplitDirIfNeeded(
+		dblock); len(splits) > 0 {
+		leaves = splitDirEntries(dblock.Children, "", splits)
+	} else {
+		return readyBlock(dblock)
+	}
+
+	leaves, err = fbo.mergeDirLeavesLocked(ctx, lState, md, leaves)
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+
+	newBlock := &DirBlock{CommonBlock: dblock.CommonBlock}
+	switch len(leaves) {
+	case 0:
+		newBlock.IsInd = false
+		newBlock.Children = make(map[string]DirEntry)
+	case 1:
+		// Remove the layer of indirection.
+		leafBlock, err := fbo.getDirLeafBlockLocked(
+			ctx, lState, md, leaves[0])
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		if leaves[0].block == nil {
+			md.AddUnrefBlock(leaves[0].iptr.BlockInfo)
+		}
+		newBlock.IsInd = false
+		newBlock.Children = make(map[string]DirEntry, len(leafBlock.Children))
+		for name, de := range leafBlock.Children {
+			newBlock.Children[name] = de
+		}
+	default:
+		newBlock.IsInd = true
+		// The first child block must always cover the start of the
+		// range, in case the original first one was removed.
+		leaves[0].iptr.Off = ""
+		newBlock.IPtrs = make([]IndirectDirPtr, len(leaves))
+		var leavesSize uint64
+		for i, leaf := range leaves {
+			if leaf.block != nil {
+				leafInfo, leafSize, err := readyBlock(leaf.block)
+				if err != nil {
+					return BlockInfo{}, 0, err
+				}
+				md.AddRefBlock(leafInfo)
+				leaf.iptr.BlockInfo = leafInfo
+				leaf.iptr.Size = uint64(leafSize)
+			}
+			newBlock.IPtrs[i] = leaf.iptr
+			leavesSize += leaf.iptr.Size
+		}
+		// The size of an indirect directory covers all of its
+		// child blocks, so that it's still limited by MaxDirBytes.
+		info, plainSize, err = readyBlock(newBlock)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		return info, plainSize + int(leavesSize), nil
+	}
+	return readyBlock(newBlock)
+}
+
 // fileSyncState holds state for a sync operation for a single
 // file.
 type fileSyncState struct {
@@ -1605,8 +2886,6 @@ func (fbo *folderBlockOps) startSyncWriteLocked(ctx context.Context,
 		si.unrefBytes = md.UnrefBytes
 	}()
 
-	bcache := fbo.config.BlockCache()
-
 	// Note: below we add possibly updated file blocks as "unref" and
 	// "ref" blocks.  This is fine, since conflict resolution or
 	// notifications will never happen within a file.
@@ -1626,134 +2905,134 @@ func (fbo *folderBlockOps) startSyncWriteLocked(ctx context.Context,
 		// TODO: Verify that any getFileBlock... calls here
 		// only use the dirty cache and not the network, since
 		// the blocks are be dirty.
-		for i := 0; i < len(fblock.IPtrs); i++ {
-			ptr := fblock.IPtrs[i]
-			isDirty := bcache.IsDirty(ptr.BlockPointer, file.Branch)
-			if (ptr.EncodedSize > 0) && isDirty {
-				return nil, nil, syncState, InconsistentEncodedSizeError{ptr.BlockInfo}
+		var off int64
+		afterOff := false
+		for {
+			leafOff, found, err := fbo.findNextDirtyLeafLocked(
+				ctx, lState, md, file, fblock, off, afterOff)
+			if err != nil {
+				return nil, nil, syncState, err
 			}
-			if isDirty {
-				_, _, _, block, more, _, err :=
+			if !found {
+				break
+			}
+			_, parentBlocks, block, nextBlockOff, startOff, err :=
+				fbo.getFileBlockAtOffsetLocked(
+					ctx, lState, md, file, fblock, leafOff, blockWrite)
+			if err != nil {
+				return nil, nil, syncState, err
+			}
+
+			splitAt := bsplit.CheckSplit(block)
+			endOfBlock := startOff + int64(len(block.Contents))
+			hole := nextBlockOff >= 0 && endOfBlock < nextBlockOff
+			switch {
+			case splitAt == 0:
+			case splitAt > 0 && hole:
+				// The extra bytes can't move into the next block
+				// without filling in the hole, so give them a new
+				// block of their own, in front of the hole.
+				extraBytes := block.Contents[splitAt:]
+				block.Contents = block.Contents[:splitAt]
+				splitOff := startOff + int64(splitAt)
+				setHolesOnPath(parentBlocks, false)
+				if _, err := fbo.insertLeafLocked(ctx, lState, md, file,
+					fblock, parentBlocks, splitOff); err != nil {
+					return nil, nil, syncState, err
+				}
+				rPtr, rParentBlocks, rblock, _, _, err :=
 					fbo.getFileBlockAtOffsetLocked(
 						ctx, lState, md, file, fblock,
-						ptr.Off, blockWrite)
+						splitOff, blockWrite)
 				if err != nil {
 					return nil, nil, syncState, err
 				}
-
-				splitAt := bsplit.CheckSplit(block)
-				switch {
-				case splitAt == 0:
-					continue
-				case splitAt > 0:
-					endOfBlock := ptr.Off + int64(len(block.Contents))
-					extraBytes := block.Contents[splitAt:]
-					block.Contents = block.Contents[:splitAt]
-					// put the extra bytes in front of the next block
-					if !more {
-						// need to make a new block
-						if err := fbo.newRightBlockLocked(
-							ctx, lState, file.tailPointer(), file.Branch, fblock,
-							endOfBlock, md); err != nil {
-							return nil, nil, syncState, err
-						}
-					}
-					rPtr, _, _, rblock, _, _, err :=
-						fbo.getFileBlockAtOffsetLocked(
-							ctx, lState, md, file, fblock,
-							endOfBlock, blockWrite)
-					if err != nil {
-						return nil, nil, syncState, err
-					}
-					rblock.Contents = append(extraBytes, rblock.Contents...)
-					if err = fbo.cacheBlockIfNotYetDirtyLocked(
-						lState, rPtr, file.Branch, rblock); err != nil {
-						return nil, nil, syncState, err
-					}
-					fblock.IPtrs[i+1].Off = ptr.Off + int64(len(block.Contents))
-					md.AddUnrefBlock(fblock.IPtrs[i+1].BlockInfo)
-					fblock.IPtrs[i+1].EncodedSize = 0
-				case splitAt < 0:
-					if !more {
-						// end of the line
-						continue
-					}
-
-					endOfBlock := ptr.Off + int64(len(block.Contents))
-					rPtr, _, _, rblock, _, _, err :=
-						fbo.getFileBlockAtOffsetLocked(
-							ctx, lState, md, file, fblock,
-							endOfBlock, blockWrite)
-					if err != nil {
+				rblock.Contents = extraBytes
+				if err = fbo.cacheBlockIfNotYetDirtyLocked(
+					lState, rPtr, file.Branch, rblock); err != nil {
+					return nil, nil, syncState, err
+				}
+				setHolesOnPath(rParentBlocks, true)
+				if err := fbo.unrefAndDirtyPathLocked(
+					lState, md, file, rParentBlocks); err != nil {
+					return nil, nil, syncState, err
+				}
+			case splitAt > 0:
+				extraBytes := block.Contents[splitAt:]
+				block.Contents = block.Contents[:splitAt]
+				// put the extra bytes in front of the next block
+				if nextBlockOff < 0 {
+					// need to make a new block
+					if _, err := fbo.newRightBlockLocked(
+						ctx, lState, file, fblock, parentBlocks,
+						endOfBlock, md); err != nil {
 						return nil, nil, syncState, err
 					}
-					// copy some of that block's data into this block
-					nCopied := bsplit.CopyUntilSplit(block, false,
-						rblock.Contents, int64(len(block.Contents)))
-					rblock.Contents = rblock.Contents[nCopied:]
-					if len(rblock.Contents) > 0 {
-						if err = fbo.cacheBlockIfNotYetDirtyLocked(
-							lState, rPtr, file.Branch, rblock); err != nil {
-							return nil, nil, syncState, err
-						}
-						fblock.IPtrs[i+1].Off =
-							ptr.Off + int64(len(block.Contents))
-						md.AddUnrefBlock(fblock.IPtrs[i+1].BlockInfo)
-						fblock.IPtrs[i+1].EncodedSize = 0
-					} else {
-						// TODO: delete the block, and if we're down
-						// to just one indirect block, remove the
-						// layer of indirection
-						//
-						// TODO: When we implement more than one level
-						// of indirection, make sure that the pointer
-						// to the parent block in the grandparent
-						// block has EncodedSize 0.
-						md.AddUnrefBlock(fblock.IPtrs[i+1].BlockInfo)
-						fblock.IPtrs =
-							append(fblock.IPtrs[:i+1], fblock.IPtrs[i+2:]...)
-					}
 				}
-			}
-		}
-
-		for i, ptr := range fblock.IPtrs {
-			localPtr := ptr.BlockPointer
-			isDirty := bcache.IsDirty(localPtr, file.Branch)
-			if (ptr.EncodedSize > 0) && isDirty {
-				return nil, nil, syncState, InconsistentEncodedSizeError{ptr.BlockInfo}
-			}
-			if isDirty {
-				_, _, _, block, _, _, err := fbo.getFileBlockAtOffsetLocked(
-					ctx, lState, md, file, fblock, ptr.Off, blockWrite)
+				rPtr, rParentBlocks, rblock, _, _, err :=
+					fbo.getFileBlockAtOffsetLocked(
+						ctx, lState, md, file, fblock,
+						endOfBlock, blockWrite)
 				if err != nil {
 					return nil, nil, syncState, err
 				}
-
-				newInfo, _, readyBlockData, err :=
-					fbo.ReadyBlock(ctx, md, block, uid)
-				if err != nil {
+				rblock.Contents = append(extraBytes, rblock.Contents...)
+				if err = fbo.cacheBlockIfNotYetDirtyLocked(
+					lState, rPtr, file.Branch, rblock); err != nil {
+					return nil, nil, syncState, err
+				}
+				setParentOffsets(rParentBlocks,
+					startOff+int64(len(block.Contents)))
+				if err := fbo.unrefAndDirtyPathLocked(
+					lState, md, file, rParentBlocks); err != nil {
 					return nil, nil, syncState, err
 				}
+			case splitAt < 0:
+				if nextBlockOff < 0 || hole {
+					// end of the line, or of this stretch of data
+					break
+				}
 
-				syncState.newIndirectFileBlockPtrs = append(syncState.newIndirectFileBlockPtrs, newInfo.BlockPointer)
-				err = bcache.Put(newInfo.BlockPointer, fbo.id(), block, PermanentEntry)
+				rPtr, rParentBlocks, rblock, _, _, err :=
+					fbo.getFileBlockAtOffsetLocked(
+						ctx, lState, md, file, fblock,
+						endOfBlock, blockWrite)
 				if err != nil {
 					return nil, nil, syncState, err
 				}
-
-				// Defer the DeleteDirty until after the new path is
-				// ready, in case anyone tries to read the dirty file
-				// in the meantime.
-				syncState.oldFileBlockPtrs =
-					append(syncState.oldFileBlockPtrs, localPtr)
-
-				fblock.IPtrs[i].BlockInfo = newInfo
-				md.AddRefBlock(newInfo)
-				si.bps.addNewBlock(newInfo.BlockPointer, block, readyBlockData)
-				fbo.fileBlockStates[localPtr] = blockSyncingNotDirty
-				syncState.redirtyOnRecoverableError[newInfo.BlockPointer] = localPtr
+				// copy some of that block's data into this block
+				nCopied := bsplit.CopyUntilSplit(block, false,
+					rblock.Contents, int64(len(block.Contents)))
+				rblock.Contents = rblock.Contents[nCopied:]
+				if len(rblock.Contents) > 0 {
+					if err = fbo.cacheBlockIfNotYetDirtyLocked(
+						lState, rPtr, file.Branch, rblock); err != nil {
+						return nil, nil, syncState, err
+					}
+					setParentOffsets(rParentBlocks,
+						startOff+int64(len(block.Contents)))
+					if err := fbo.unrefAndDirtyPathLocked(
+						lState, md, file, rParentBlocks); err != nil {
+						return nil, nil, syncState, err
+					}
+				} else {
+					// TODO: if we're down to just one leaf block,
+					// remove the layers of indirection.
+					if err := fbo.removeLeafLocked(
+						lState, md, file, rParentBlocks); err != nil {
+						return nil, nil, syncState, err
+					}
+				}
 			}
+			// Only an empty last block can end where it starts, so
+			// make sure not to find it again.
+			off = startOff + int64(len(block.Contents))
+			afterOff = off == startOff
+		}
+
+		if err := fbo.readyDirtyFileChildrenLocked(ctx, lState, md, uid,
+			file, fblock, si, &syncState); err != nil {
+			return nil, nil, syncState, err
 		}
 	}
 
@@ -1764,6 +3043,109 @@ func (fbo *folderBlockOps) startSyncWriteLocked(ctx context.Context,
 	return fblock, si.bps, syncState, nil
 }
 
+// findNextDirtyLeafLocked returns the starting offset of the first
+// dirty leaf block under the given indirect file block that starts
+// at or after minOff (or strictly after minOff, if afterOff is set).
+// Only dirty blocks are visited, so this never needs to fetch a block
+// from the server.
+func (fbo *folderBlockOps) findNextDirtyLeafLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, file path, block *FileBlock,
+	minOff int64, afterOff bool) (int64, bool, error) {
+	fbo.blockLock.AssertLocked(lState)
+	bcache := fbo.config.BlockCache()
+	for i, iptr := range block.IPtrs {
+		if i+1 < len(block.IPtrs) && block.IPtrs[i+1].Off <= minOff {
+			// This whole subtree comes before minOff.
+			continue
+		}
+		if !bcache.IsDirty(iptr.BlockPointer, file.Branch) {
+			continue
+		}
+		child, err := fbo.getFileBlockHelperLocked(
+			ctx, lState, md, iptr.BlockPointer, file.Branch, file)
+		if err != nil {
+			return 0, false, err
+		}
+		if child.IsInd {
+			off, found, err := fbo.findNextDirtyLeafLocked(
+				ctx, lState, md, file, child, minOff, afterOff)
+			if err != nil || found {
+				return off, found, err
+			}
+			continue
+		}
+		if iptr.Off > minOff || (iptr.Off == minOff && !afterOff) {
+			return iptr.Off, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// readyDirtyFileChildrenLocked readies all the dirty descendants of
+// the given indirect file block, bottom-up, replacing their pointers
+// in block with the new ones, and recording everything needed to
+// finish (or undo) the sync in si and syncState.  Dirty indirect
+// children are readied as copies, so that the dirty blocks keep
+// pointing to their dirty children in case the sync fails.
+func (fbo *folderBlockOps) readyDirtyFileChildrenLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	uid keybase1.UID, file path, block *FileBlock, si *syncInfo,
+	syncState *fileSyncState) error {
+	fbo.blockLock.AssertLocked(lState)
+	bcache := fbo.config.BlockCache()
+	for i, ptr := range block.IPtrs {
+		localPtr := ptr.BlockPointer
+		isDirty := bcache.IsDirty(localPtr, file.Branch)
+		if (ptr.EncodedSize > 0) && isDirty {
+			return InconsistentEncodedSizeError{ptr.BlockInfo}
+		}
+		if !isDirty {
+			continue
+		}
+		child, err := fbo.getFileBlockLocked(
+			ctx, lState, md, localPtr, file, blockWrite)
+		if err != nil {
+			return err
+		}
+		if child.IsInd {
+			child, err = child.DeepCopy(fbo.config.Codec())
+			if err != nil {
+				return err
+			}
+			if err := fbo.readyDirtyFileChildrenLocked(ctx, lState, md,
+				uid, file, child, si, syncState); err != nil {
+				return err
+			}
+		}
+
+		newInfo, _, readyBlockData, err :=
+			fbo.ReadyFileChildBlock(ctx, md, child, uid)
+		if err != nil {
+			return err
+		}
+
+		syncState.newIndirectFileBlockPtrs = append(
+			syncState.newIndirectFileBlockPtrs, newInfo.BlockPointer)
+		err = bcache.Put(newInfo.BlockPointer, fbo.id(), child, PermanentEntry)
+		if err != nil {
+			return err
+		}
+
+		// Defer the DeleteDirty until after the new path is
+		// ready, in case anyone tries to read the dirty file
+		// in the meantime.
+		syncState.oldFileBlockPtrs =
+			append(syncState.oldFileBlockPtrs, localPtr)
+
+		block.IPtrs[i].BlockInfo = newInfo
+		md.AddRefBlock(newInfo)
+		si.bps.addNewBlock(newInfo.BlockPointer, child, readyBlockData)
+		fbo.fileBlockStates[localPtr] = blockSyncingNotDirty
+		syncState.redirtyOnRecoverableError[newInfo.BlockPointer] = localPtr
+	}
+	return nil
+}
+
 func (fbo *folderBlockOps) makeLocalBcache(ctx context.Context,
 	lState *lockState, md *RootMetadata, file path, si *syncInfo) (
 	lbc localBcache, err error) {
@@ -1773,7 +3155,7 @@ func (fbo *folderBlockOps) makeLocalBcache(ctx context.Context,
 	parentPath := file.parentPath()
 
 	dblock, err := fbo.getDirLocked(
-		ctx, lState, md, *parentPath, blockWrite)
+		ctx, lState, md, *parentPath, blockWrite, file.tailName())
 	if err != nil {
 		return nil, err
 	}
@@ -1960,8 +3342,7 @@ func (fbo *folderBlockOps) searchForNodesInDirLocked(ctx context.Context,
 	numNodesFoundSoFar int) (int, error) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
-	dirBlock, err := fbo.getDirLocked(
-		ctx, lState, md, currDir, blockRead)
+	dirBlock, err := fbo.getFullDirLocked(ctx, lState, md, currDir)
 	if err != nil {
 		return 0, err
 	}
@@ -2078,7 +3459,7 @@ func (fbo *folderBlockOps) getUndirtiedEntry(
 
 	// Get the undirtied dir block.
 	dblock, err := fbo.getDirLocked(
-		ctx, lState, md, *file.parentPath(), blockRead)
+		ctx, lState, md, *file.parentPath(), blockRead, file.tailName())
 	if err != nil {
 		return nil, err
 	}
@@ -2107,7 +3488,26 @@ func (fbo *folderBlockOps) setCachedAttr(
 		fileEntry.Type = realEntry.Type
 	case mtimeAttr:
 		fileEntry.Mtime = realEntry.Mtime
+	case xattrAttr:
+		fileEntry.Xattrs = realEntry.Xattrs
+	}
+	fbo.deCache[ref] = fileEntry
+}
+
+// SetCachedLinkCount updates the link count and ctime of any cached
+// dirty entry for the given file, so that the next sync of the file
+// doesn't undo a link count change made in the meantime.
+func (fbo *folderBlockOps) SetCachedLinkCount(
+	lState *lockState, ref blockRef, nlink uint32, ctime int64) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	fileEntry, ok := fbo.deCache[ref]
+	if !ok {
+		return
 	}
+	fileEntry.Nlink = nlink
+	fileEntry.Ctime = ctime
 	fbo.deCache[ref] = fileEntry
 }
 
@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"reflect"
@@ -54,10 +55,18 @@ const (
 	secondsBetweenBackgroundFlushes = 10
 	// Cap the number of times we retry after a recoverable error
 	maxRetriesOnRecoverableErrors = 10
-	// When the number of dirty bytes exceeds this level, force a sync.
-	dirtyBytesThreshold = maxParallelBlockPuts * (512 << 10)
+	// The block puts of syncs up to this many bytes go ahead of
+	// those of bigger syncs.
+	maxInteractivePutBytes = 1 << 20
 	// The timeout for any background task.
 	backgroundTaskTimeout = 1 * time.Minute
+	// How long a transaction can go without any changes before
+	// it's aborted, so that it can't block the folder forever.
+	defaultTxLease = 1 * time.Minute
+	// The copied blocks of an entry moved in from another folder
+	// are put once they add up to this many bytes, so that the
+	// whole copy never has to be held in memory.
+	maxImportPutBytes = 8 << 20
 )
 
 type fboMutexLevel mutexLevel
@@ -264,10 +273,37 @@ type folderBranchOps struct {
 	// Helper class for archiving and cleaning up the blocks for this TLF
 	fbm *folderBlockManager
 
+	// Advisory file locks held by owners on this device
+	fileLocks *folderFileLocks
+
 	// rekeyWithPromptTimer tracks a timed function that will try to
 	// rekey with a paper key prompt, if enough time has passed.
 	// Protected by mdWriterLock
 	rekeyWithPromptTimer *time.Timer
+
+	// mdBatch, if non-nil, is the head MD, whose changes have been
+	// made locally but haven't been put to the MD server yet, so
+	// that more changes can be batched into the same revision.
+	// mdBatchTimer puts it once the batch window is over.  Both are
+	// protected by mdWriterLock.
+	mdBatch      *RootMetadata
+	mdBatchTimer *time.Timer
+
+	// tx, if non-nil, is the transaction in progress, which holds
+	// the pending batch until it's over.  Protected by
+	// mdWriterLock.
+	tx *folderBranchTx
+	// txLease is how long a transaction can go without any changes
+	// before it's aborted.
+	txLease time.Duration
+
+	// deletedEntries caches, for each merged revision with rm ops
+	// in it, the entries removed by each of those ops, since
+	// finding them means searching the folder as of that
+	// revision.  Merged revisions never change, so the entries
+	// stay valid for as long as the revision is in the trash.
+	deletedEntriesLock sync.Mutex
+	deletedEntries     map[MetadataRevision][]*DeletedEntry
 }
 
 var _ KBFSOps = (*folderBranchOps)(nil)
@@ -323,7 +359,8 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 			deCache:         make(map[blockRef]DirEntry),
 			deferredWrites: make(
 				[]func(context.Context, *lockState, *RootMetadata, path) error, 0),
-			nodeCache: nodeCache,
+			nodeCache:  nodeCache,
+			prefetcher: newBlockPrefetcher(config, fb, log),
 		},
 		nodeCache:       nodeCache,
 		log:             log,
@@ -331,9 +368,13 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 		shutdownChan:    make(chan struct{}),
 		updatePauseChan: make(chan (<-chan struct{})),
 		forceSyncChan:   forceSyncChan,
+		deletedEntries:  make(map[MetadataRevision][]*DeletedEntry),
+		txLease:         defaultTxLease,
 	}
 	fbo.cr = NewConflictResolver(config, fbo)
 	fbo.fbm = newFolderBlockManager(config, fb, fbo)
+	fbo.fileLocks = newFolderFileLocks(
+		config, log, fb.Tlf, fbo.shutdownChan, fbo.fileLockID)
 	if config.DoBackgroundFlushes() {
 		go fbo.backgroundFlusher(secondsBetweenBackgroundFlushes * time.Second)
 	}
@@ -354,7 +395,14 @@ func (fbo *folderBranchOps) markForReIdentifyIfNeeded(now time.Time, maxValid ti
 // Shutdown safely shuts down any background goroutines that may have
 // been launched by folderBranchOps.
 func (fbo *folderBranchOps) Shutdown() error {
-	if fbo.config.CheckStateOnShutdown() {
+	if err := fbo.abortTx(fbo.ctxWithFBOID(context.TODO()), nil); err != nil {
+		fbo.log.CWarningf(nil, "Couldn't abort transaction: %v", err)
+	}
+	if err := fbo.commitMDBatch(fbo.ctxWithFBOID(context.TODO())); err != nil {
+		fbo.log.CWarningf(nil, "Couldn't commit batched changes: %v", err)
+	}
+
+	if fbo.config.CheckStateOnShutdown() && !fbo.branch().IsArchived() {
 		ctx := context.TODO()
 		lState := makeFBOLockState()
 
@@ -379,6 +427,7 @@ func (fbo *folderBranchOps) Shutdown() error {
 	close(fbo.shutdownChan)
 	fbo.cr.Shutdown()
 	fbo.fbm.shutdown()
+	fbo.blocks.prefetcher.shutdown()
 	// Wait for the update goroutine to finish, so that we don't have
 	// any races with logging during test reporting.
 	if fbo.updateDoneChan != nil {
@@ -415,6 +464,10 @@ func (fbo *folderBranchOps) addToFavorites(ctx context.Context,
 		// Can't favorite while not logged in
 		return nil
 	}
+	if fbo.branch().IsArchived() {
+		// An older revision may have an outdated handle.
+		return nil
+	}
 
 	lState := makeFBOLockState()
 	head := fbo.getHead(lState)
@@ -489,7 +542,12 @@ func (fbo *folderBranchOps) setHeadLocked(ctx context.Context,
 	wasReadable := false
 	if !isFirstHead {
 		wasReadable = fbo.head.IsReadable()
+		oldHandle = fbo.head.GetTlfHandle()
+	}
 
+	// A batch MD has no ID until it's put, and always differs from
+	// the MD it replaces or is replaced by.
+	if !isFirstHead && md != fbo.mdBatch && fbo.head != fbo.mdBatch {
 		mdID, err := md.MetadataID(fbo.config)
 		if err != nil {
 			return err
@@ -504,8 +562,6 @@ func (fbo *folderBranchOps) setHeadLocked(ctx context.Context,
 			// only save this new MD if the MDID has changed
 			return nil
 		}
-
-		oldHandle = fbo.head.GetTlfHandle()
 	}
 
 	fbo.log.CDebugf(ctx, "Setting head revision to %d", md.Revision)
@@ -526,6 +582,16 @@ func (fbo *folderBranchOps) setHeadLocked(ctx context.Context,
 
 	fbo.head = md
 	fbo.status.setRootMetadata(md)
+	if dmcache := fbo.config.DiskMDCache(); dmcache != nil &&
+		fbo.branch() == MasterBranch && md.MergedStatus() == Merged &&
+		md.data.Dir.IsInitialized() && md != fbo.mdBatch {
+		// Persist the new head, so that this folder can still be
+		// read after a restart while disconnected.
+		if err := dmcache.Put(ctx, md); err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't persist head revision %d: %v",
+				md.Revision, err)
+		}
+	}
 	if isFirstHead {
 		// Start registering for updates right away, using this MD
 		// as a starting point. For now only the master branch can
@@ -605,19 +671,39 @@ func (fbo *folderBranchOps) getMDLocked(
 
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	// An archived branch only ever views its own revision, and never
+	// initializes the folder.
+	if rev, ok := fbo.branch().RevisionIfSpecified(); ok {
+		rmds, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+			rev, rev, Merged)
+		if err != nil {
+			return nil, err
+		}
+		if len(rmds) != 1 {
+			return nil, NoSuchRevisionError{rev}
+		}
+		md = rmds[0]
+		fbo.headLock.Lock(lState)
+		defer fbo.headLock.Unlock(lState)
+		err = fbo.setHeadLocked(ctx, lState, md)
+		if err != nil {
+			return nil, err
+		}
+		return md, nil
+	}
+
 	// Not in cache, fetch from server and add to cache.  First, see
 	// if this device has any unmerged commits -- take the latest one.
 	mdops := fbo.config.MDOps()
 
 	// get the head of the unmerged branch for this device (if any)
 	md, err = mdops.GetUnmergedForTLF(ctx, fbo.id(), NullBranchID)
-	if err != nil {
-		return nil, err
-	}
-	if md == nil {
+	if err == nil && md == nil {
 		// no unmerged MDs for this device, so just get the current head
 		md, err = mdops.GetForTLF(ctx, fbo.id())
-		if err != nil {
+	}
+	if err != nil {
+		if md = fbo.getPersistedHeadWhileDisconnected(ctx); md == nil {
 			return nil, err
 		}
 	}
@@ -639,6 +725,27 @@ func (fbo *folderBranchOps) getMDLocked(
 	return md, err
 }
 
+// getPersistedHeadWhileDisconnected returns the head persisted in
+// the DiskMDCache for this folder, if the MD server can't be reached
+// and there is one.
+func (fbo *folderBranchOps) getPersistedHeadWhileDisconnected(
+	ctx context.Context) *RootMetadata {
+	dmcache := fbo.config.DiskMDCache()
+	if dmcache == nil || fbo.config.MDServer().IsConnected() {
+		return nil
+	}
+	md, err := dmcache.Get(ctx, fbo.id())
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't get the persisted head: %v", err)
+		return nil
+	}
+	if md != nil {
+		fbo.log.CDebugf(ctx, "Using persisted head revision %d while "+
+			"disconnected", md.Revision)
+	}
+	return md
+}
+
 func (fbo *folderBranchOps) getMDForReadHelper(
 	ctx context.Context, lState *lockState, rtype mdReqType) (*RootMetadata, error) {
 	md, err := fbo.getMDLocked(ctx, lState, rtype)
@@ -674,10 +781,69 @@ func (fbo *folderBranchOps) getMDForReadNeedIdentify(
 	return fbo.getMDForReadHelper(ctx, lState, mdReadNeedIdentify)
 }
 
+// checkWritable returns an error if this folder-branch is a
+// read-only view of an older revision, or if the MD server can't be
+// reached and there's no write journal to hold the changes.
+func (fbo *folderBranchOps) checkWritable() error {
+	if rev, ok := fbo.branch().RevisionIfSpecified(); ok {
+		return WriteToArchivedRevisionError{rev}
+	}
+	if !fbo.config.MDServer().IsConnected() {
+		if _, err := GetJournalServer(fbo.config); err != nil {
+			return OfflineReadOnlyError{}
+		}
+	}
+	return nil
+}
+
+// onTLFBranchChange switches this folder-branch onto the given
+// branch, which the write journal has moved its journaled updates
+// onto, and starts resolving the conflict that caused the move.
+func (fbo *folderBranchOps) onTLFBranchChange(
+	ctx context.Context, newBID BranchID) error {
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	if fbo.staged {
+		// Already switched on an earlier try.
+		return nil
+	}
+	if jServer, err := GetJournalServer(fbo.config); err == nil &&
+		jServer.queuedCount(fbo.id()) > 0 {
+		// Wait until the head is on the branch too.
+		return errJournalNotFlushed
+	}
+
+	md, err := fbo.config.MDOps().GetUnmergedForTLF(ctx, fbo.id(), newBID)
+	if err != nil {
+		return err
+	}
+	if md == nil {
+		return fmt.Errorf("No MD on branch %s", newBID)
+	}
+	fbo.log.CDebugf(ctx, "Switching to branch %s at revision %d",
+		newBID, md.Revision)
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	fbo.setStagedLocked(lState, true, newBID)
+	err = fbo.setHeadLocked(ctx, lState, md)
+	if err != nil {
+		return err
+	}
+	fbo.cr.Resolve(md.Revision, MetadataRevisionUninitialized)
+	return nil
+}
+
 func (fbo *folderBranchOps) getMDForWriteLocked(
 	ctx context.Context, lState *lockState) (*RootMetadata, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if err := fbo.checkWritable(); err != nil {
+		return nil, err
+	}
+
 	md, err := fbo.getMDLocked(ctx, lState, mdWrite)
 	if err != nil {
 		return nil, err
@@ -692,6 +858,12 @@ func (fbo *folderBranchOps) getMDForWriteLocked(
 			NewWriteAccessError(md.GetTlfHandle(), username)
 	}
 
+	if fbo.mdBatch != nil {
+		// Add the coming writes to the pending batch instead, so
+		// they get put along with it.
+		return fbo.copyMDBatchLocked()
+	}
+
 	// Make a new successor of the current MD to hold the coming
 	// writes.  The caller must pass this into
 	// syncBlockAndCheckEmbedLocked or the changes will be lost.
@@ -707,6 +879,10 @@ func (fbo *folderBranchOps) getMDForRekeyWriteLocked(
 	ctx context.Context, lState *lockState) (rmd *RootMetadata, wasRekeySet bool, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if err := fbo.commitMDBatchLocked(ctx, lState); err != nil {
+		return nil, false, err
+	}
+
 	md, err := fbo.getMDLocked(ctx, lState, mdRekey)
 	if err != nil {
 		return nil, false, err
@@ -850,6 +1026,28 @@ func (fbo *folderBranchOps) GetOrCreateRootNode(
 	return
 }
 
+func (fbo *folderBranchOps) GetRootNodeAtRevision(
+	ctx context.Context, h *TlfHandle, rev MetadataRevision) (
+	node Node, ei EntryInfo, err error) {
+	err = errors.New("GetRootNodeAtRevision is not supported by " +
+		"folderBranchOps")
+	return
+}
+
+func (fbo *folderBranchOps) ReleaseRevision(
+	ctx context.Context, folderBranch FolderBranch) error {
+	return errors.New("ReleaseRevision is not supported by " +
+		"folderBranchOps")
+}
+
+func (fbo *folderBranchOps) GetRevisionAtTime(
+	ctx context.Context, h *TlfHandle, serverTime time.Time) (
+	rev MetadataRevision, err error) {
+	err = errors.New("GetRevisionAtTime is not supported by " +
+		"folderBranchOps")
+	return
+}
+
 func (fbo *folderBranchOps) checkNode(node Node) error {
 	fb := node.GetFolderBranch()
 	if fb != fbo.folderBranch {
@@ -1062,6 +1260,11 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 			return err
 		}
 
+		if len(dirPath.path) == 1 && name == linksDirName {
+			// The links directory is an implementation detail.
+			return NoSuchNameError{name}
+		}
+
 		childPath := dirPath.ChildPathNoPtr(name)
 
 		de, err = fbo.blocks.GetDirtyEntry(ctx, lState, md, childPath)
@@ -1071,6 +1274,31 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 
 		if de.Type == Sym {
 			node = nil
+		} else if de.Type == HardLink {
+			// The node for a hard-linked file always lives under the
+			// links directory, no matter which name found it.
+			var filePath path
+			filePath, de, err = fbo.blocks.GetHardLinkTarget(
+				ctx, lState, md, dirPath, de)
+			if err != nil {
+				return err
+			}
+			err = fbo.checkDataVersion(filePath, de.BlockPointer)
+			if err != nil {
+				return err
+			}
+
+			node = fbo.nodeCache.Get(filePath.path[0].ref())
+			if node == nil {
+				return fmt.Errorf("No node for root %v", filePath.path[0])
+			}
+			for _, pn := range filePath.path[1:] {
+				node, err = fbo.nodeCache.GetOrCreate(
+					pn.BlockPointer, pn.Name, node)
+				if err != nil {
+					return err
+				}
+			}
 		} else {
 			err = fbo.checkDataVersion(childPath, de.BlockPointer)
 			if err != nil {
@@ -1140,6 +1368,16 @@ type blockState struct {
 	readyBlockData ReadyBlockData
 }
 
+// putSize returns the number of bytes that putting the block sends
+// to the block server.
+func (bs blockState) putSize() int {
+	if bs.blockPtr.RefNonce != zeroBlockRefNonce {
+		// Only a new reference to an existing block is sent.
+		return 0
+	}
+	return bs.readyBlockData.GetEncodedSize()
+}
+
 func (fbo *folderBranchOps) Stat(ctx context.Context, node Node) (
 	ei EntryInfo, err error) {
 	fbo.log.CDebugf(ctx, "Stat %p", node.GetID())
@@ -1259,8 +1497,16 @@ func (fbo *folderBranchOps) syncBlock(
 	doSetTime := true
 	now := fbo.nowUnixNano()
 	for len(newPath.path) < len(dir.path)+1 {
-		info, plainSize, err :=
-			fbo.readyBlockMultiple(ctx, md, currBlock, uid, bps)
+		var info BlockInfo
+		var plainSize int
+		var err error
+		if dblock, ok := currBlock.(*DirBlock); ok {
+			info, plainSize, err = fbo.blocks.ReadyDirBlock(
+				ctx, lState, md, dblock, uid, bps)
+		} else {
+			info, plainSize, err =
+				fbo.readyBlockMultiple(ctx, md, currBlock, uid, bps)
+		}
 		if err != nil {
 			return path{}, DirEntry{}, nil, err
 		}
@@ -1296,7 +1542,13 @@ func (fbo *folderBranchOps) syncBlock(
 				// modified while holding mdWriterLock, so it's
 				// safe to fetch them one at a time.
 				prevDblock, err = fbo.blocks.GetDir(
-					ctx, lState, md, prevDir, blockWrite)
+					ctx, lState, md, prevDir, blockWrite, currName)
+				if err != nil {
+					return path{}, DirEntry{}, nil, err
+				}
+			} else {
+				err = fbo.blocks.LoadDirEntries(
+					ctx, lState, md, prevDir, prevDblock, currName)
 				if err != nil {
 					return path{}, DirEntry{}, nil, err
 				}
@@ -1336,9 +1588,8 @@ func (fbo *folderBranchOps) syncBlock(
 		}
 
 		if de.Type == Dir {
-			// TODO: When we use indirect dir blocks,
-			// we'll have to calculate the size some other
-			// way.
+			// For indirect dir blocks, this includes the sizes
+			// of all the child blocks.
 			de.Size = uint64(plainSize)
 		}
 
@@ -1437,9 +1688,10 @@ func (fbo *folderBranchOps) syncBlockAndCheckEmbedLocked(ctx context.Context,
 		return path{}, DirEntry{}, nil, err
 	}
 
-	// do the block changes need their own blocks?
+	// do the block changes need their own blocks?  (The changes of
+	// a transaction only get their own block once it's committed.)
 	bsplit := fbo.config.BlockSplitter()
-	if !bsplit.ShouldEmbedBlockChanges(&md.data.Changes) {
+	if fbo.tx == nil && !bsplit.ShouldEmbedBlockChanges(&md.data.Changes) {
 		err = fbo.unembedBlockChanges(ctx, bps, md, &md.data.Changes,
 			uid)
 		if err != nil {
@@ -1463,10 +1715,15 @@ func isRetriableError(err error, retries int) bool {
 }
 
 func (fbo *folderBranchOps) doOneBlockPut(ctx context.Context,
-	md *RootMetadata, blockState blockState,
+	md *RootMetadata, blockState blockState, prio TransferPriority,
 	errChan chan error, blocksToRemoveChan chan *FileBlock) {
-	err := fbo.config.BlockOps().
-		Put(ctx, md, blockState.blockPtr, blockState.readyBlockData)
+	done, err := fbo.config.TransferScheduler().BeginPut(
+		ctx, blockState.putSize(), prio)
+	if err == nil {
+		err = fbo.config.BlockOps().
+			Put(ctx, md, blockState.blockPtr, blockState.readyBlockData)
+		done()
+	}
 	if err != nil {
 		if isRecoverableBlockError(err) {
 			fblock, ok := blockState.block.(*FileBlock)
@@ -1500,8 +1757,17 @@ func (fbo *folderBranchOps) doBlockPuts(ctx context.Context,
 	var wg sync.WaitGroup
 
 	numWorkers := len(bps.blockStates)
-	if numWorkers > maxParallelBlockPuts {
-		numWorkers = maxParallelBlockPuts
+	maxPuts := fbo.config.TransferScheduler().MaxPuts()
+	if numWorkers > maxPuts {
+		numWorkers = maxPuts
+	}
+	prio := InteractiveTransfer
+	totalBytes := 0
+	for _, blockState := range bps.blockStates {
+		totalBytes += blockState.putSize()
+	}
+	if totalBytes > maxInteractivePutBytes {
+		prio = BulkTransfer
 	}
 	wg.Add(numWorkers)
 	// A channel to list any blocks that have been archived or
@@ -1512,7 +1778,8 @@ func (fbo *folderBranchOps) doBlockPuts(ctx context.Context,
 	worker := func() {
 		defer wg.Done()
 		for blockState := range blocks {
-			fbo.doOneBlockPut(ctx, md, blockState, errChan, blocksToRemoveChan)
+			fbo.doOneBlockPut(
+				ctx, md, blockState, prio, errChan, blocksToRemoveChan)
 			select {
 			// return early if the context has been canceled
 			case <-ctx.Done():
@@ -1581,6 +1848,12 @@ func (fbo *folderBranchOps) finalizeBlocks(bps *blockPutState) error {
 
 // Returns true if the passed error indicates a revision conflict.
 func (fbo *folderBranchOps) isRevisionConflict(err error) bool {
+	return isRevisionConflict(err)
+}
+
+// isRevisionConflict returns whether the given error from an MD put
+// means that the MD server has moved on from the put's base revision.
+func isRevisionConflict(err error) bool {
 	if err == nil {
 		return false
 	}
@@ -1594,8 +1867,10 @@ func (fbo *folderBranchOps) isRevisionConflict(err error) bool {
 		isConflictFolderMapping
 }
 
-func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
-	lState *lockState, md *RootMetadata, bps *blockPutState) (err error) {
+// putMDLocked puts the given MD to the MD server, on the merged
+// branch if possible, or else on an unmerged branch.
+func (fbo *folderBranchOps) putMDLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	// finally, write out the new metadata
@@ -1641,7 +1916,11 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 			return err
 		}
 		fbo.setStagedLocked(lState, true, bid)
-		fbo.cr.Resolve(md.Revision, mergedRev)
+		// A transaction that was moved onto a branch is only
+		// resolved once it's committed.
+		if fbo.tx == nil {
+			fbo.cr.Resolve(md.Revision, mergedRev)
+		}
 	} else {
 		if fbo.staged {
 			// If we were staged, prune all unmerged history now
@@ -1675,6 +1954,42 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 		md.data.Changes.Ops[0].
 			AddRefBlock(md.data.cachedChanges.Info.BlockPointer)
 	}
+	return nil
+}
+
+// shouldBatchMDLocked returns whether the given MD, which holds a new
+// change, can wait for more changes before being put.
+func (fbo *folderBranchOps) shouldBatchMDLocked(
+	lState *lockState, md *RootMetadata) bool {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if fbo.tx != nil {
+		return true
+	}
+	if fbo.config.MDBatchWindow() <= 0 || fbo.staged ||
+		md.MergedStatus() != Merged {
+		return false
+	}
+	// Changes that had to be moved out into their own block can't
+	// be added to anymore.
+	if md.data.Changes.Ops == nil {
+		return false
+	}
+	maxBytes := fbo.config.MDBatchBytes()
+	return maxBytes == 0 || md.RefBytes < maxBytes
+}
+
+func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, bps *blockPutState) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	batch := fbo.shouldBatchMDLocked(lState, md)
+	if !batch {
+		err = fbo.putMDLocked(ctx, lState, md)
+		if err != nil {
+			return err
+		}
+	}
 
 	err = fbo.finalizeBlocks(bps)
 	if err != nil {
@@ -1683,18 +1998,192 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
+	if batch {
+		fbo.startMDBatchLocked(ctx, lState, md)
+	} else {
+		// Any pending batch was put along with this MD.
+		defer fbo.stopMDBatchLocked(lState)
+	}
 	err = fbo.setHeadLocked(ctx, lState, md)
 	if err != nil {
 		return err
 	}
 
-	// Archive the old, unref'd blocks
-	fbo.fbm.archiveUnrefBlocks(md)
+	if !batch {
+		// Archive the old, unref'd blocks
+		fbo.fbm.archiveUnrefBlocks(md)
+	}
 
 	fbo.notifyBatchLocked(ctx, lState, md)
 	return nil
 }
 
+// copyMDBatchLocked returns a copy of the pending batch MD, to hold
+// more changes.
+func (fbo *folderBranchOps) copyMDBatchLocked() (*RootMetadata, error) {
+	md, err := fbo.mdBatch.deepCopy(fbo.config.Codec(), true)
+	if err != nil {
+		return nil, err
+	}
+	md.data.Changes.sizeEstimate = fbo.mdBatch.data.Changes.sizeEstimate
+	return md, nil
+}
+
+// startMDBatchLocked makes the given MD the pending batch, and makes
+// sure it gets put once the batch window is over.
+func (fbo *folderBranchOps) startMDBatchLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	// A transaction's batch waits for the transaction to be over.
+	if fbo.mdBatchTimer == nil && fbo.tx == nil {
+		d := fbo.config.MDBatchWindow()
+		fbo.log.CDebugf(ctx, "Batching changes at revision %d for %s",
+			md.Revision, d)
+		fbo.mdBatchTimer = time.AfterFunc(d, fbo.commitMDBatchInBackground)
+	}
+	fbo.mdBatch = md
+}
+
+func (fbo *folderBranchOps) stopMDBatchLocked(lState *lockState) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	if fbo.mdBatchTimer != nil {
+		fbo.mdBatchTimer.Stop()
+		fbo.mdBatchTimer = nil
+	}
+	fbo.mdBatch = nil
+}
+
+// commitMDBatchLocked puts the pending batch of changes, if any, to
+// the MD server.
+func (fbo *folderBranchOps) commitMDBatchLocked(
+	ctx context.Context, lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	if fbo.mdBatch == nil {
+		return nil
+	}
+	if fbo.tx != nil {
+		return TxInProgressError{fbo.id()}
+	}
+	return fbo.putMDBatchLocked(ctx, lState)
+}
+
+// putMDBatchLocked puts the pending batch of changes, which must
+// exist, and makes it the head.
+func (fbo *folderBranchOps) putMDBatchLocked(
+	ctx context.Context, lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// Put a copy, since putting fills in and signs the MD, which
+	// readers of the current head might be looking at.
+	md, err := fbo.copyMDBatchLocked()
+	if err != nil {
+		return err
+	}
+
+	// A transaction's changes might have outgrown the MD.
+	if !fbo.config.BlockSplitter().ShouldEmbedBlockChanges(&md.data.Changes) {
+		_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+		if err != nil {
+			return err
+		}
+
+		bps := newBlockPutState(1)
+		err = fbo.unembedBlockChanges(ctx, bps, md, &md.data.Changes, uid)
+		if err != nil {
+			return err
+		}
+
+		ptrsToDelete, err := fbo.doBlockPuts(ctx, md, *bps)
+		if err != nil {
+			return err
+		}
+		if len(ptrsToDelete) > 0 {
+			return fmt.Errorf("Unexpected pointers to delete after "+
+				"unembedding batched block changes: %v", ptrsToDelete)
+		}
+	}
+	fbo.log.CDebugf(ctx, "Committing %d batched ops at revision %d",
+		len(md.data.Changes.Ops), md.Revision)
+	err = fbo.putMDLocked(ctx, lState, md)
+	if err != nil {
+		// Try again later, in case nothing else does first.
+		if fbo.mdBatchTimer != nil {
+			fbo.mdBatchTimer.Reset(
+				secondsBetweenBackgroundFlushes * time.Second)
+		}
+		return err
+	}
+	if md.MergedStatus() != Merged {
+		// The local version of the batch was cached as a merged
+		// revision, which it never became.
+		fbo.config.MDCache().Delete(md.ID, md.Revision, NullBranchID)
+	}
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	defer fbo.stopMDBatchLocked(lState)
+	err = fbo.setHeadLocked(ctx, lState, md)
+	if err != nil {
+		return err
+	}
+	fbo.fbm.archiveUnrefBlocks(md)
+	return nil
+}
+
+// stageTxIfBehindLocked puts the pending batch of the transaction in
+// progress onto a new branch if another device has changed the
+// folder since the transaction's changes started, so that updates
+// from other devices don't have to wait for the transaction to be
+// over.  The rest of the transaction's changes go onto the same
+// branch, and it's resolved like any other unmerged changes once
+// it's committed.
+func (fbo *folderBranchOps) stageTxIfBehindLocked(
+	ctx context.Context, lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	// The pending batch has the same revision as the first update,
+	// so look at the server's head rather than the local one.
+	head, err := fbo.config.MDOps().GetForTLF(ctx, fbo.id())
+	if err != nil {
+		return err
+	}
+	if head == nil || head.Revision <= fbo.tx.base.Revision {
+		return nil
+	}
+
+	bid, err := fbo.config.Crypto().MakeRandomBranchID()
+	if err != nil {
+		return err
+	}
+	fbo.log.CDebugf(ctx, "Moving the transaction onto branch %s", bid)
+	fbo.setStagedLocked(lState, true, bid)
+	err = fbo.putMDBatchLocked(ctx, lState)
+	if err != nil {
+		fbo.setStagedLocked(lState, false, NullBranchID)
+		return err
+	}
+	fbo.tx.base = fbo.head
+	fbo.tx.staged = true
+	return nil
+}
+
+func (fbo *folderBranchOps) commitMDBatch(ctx context.Context) error {
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	return fbo.commitMDBatchLocked(ctx, lState)
+}
+
+// commitMDBatchInBackground puts the pending batch of changes once
+// the batch window is over.  If that fails, the batch stays pending
+// until the next change or sync tries again.
+func (fbo *folderBranchOps) commitMDBatchInBackground() {
+	fbo.runUnlessShutdown(func(ctx context.Context) (err error) {
+		fbo.log.CDebugf(ctx, "Committing batched changes")
+		defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+		return fbo.commitMDBatch(ctx)
+	})
+}
+
 func (fbo *folderBranchOps) finalizeMDRekeyWriteLocked(ctx context.Context,
 	lState *lockState, md *RootMetadata) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
@@ -1731,6 +2220,10 @@ func (fbo *folderBranchOps) finalizeGCOp(ctx context.Context, gco *gcOp) (
 	fbo.mdWriterLock.Lock(lState)
 	defer fbo.mdWriterLock.Unlock(lState)
 
+	if err := fbo.commitMDBatchLocked(ctx, lState); err != nil {
+		return err
+	}
+
 	md, err := fbo.getMDForWriteLocked(ctx, lState)
 	if err != nil {
 		return err
@@ -1814,22 +2307,121 @@ func (fbo *folderBranchOps) syncBlockAndFinalizeLocked(ctx context.Context,
 	return de, nil
 }
 
-func checkDisallowedPrefixes(name string) error {
-	for _, prefix := range disallowedPrefixes {
-		if strings.HasPrefix(name, prefix) {
-			return DisallowedPrefixError{name, prefix}
-		}
-	}
-	return nil
+// modifiedDir is a locally-modified directory block that still needs
+// to be synced, along with the path it was read from.
+type modifiedDir struct {
+	p      path
+	dblock *DirBlock
 }
 
-func (fbo *folderBranchOps) checkNewDirSize(ctx context.Context,
-	lState *lockState, md *RootMetadata, dirPath path, newName string) error {
-	// Check that the directory isn't past capacity already.
-	var currSize uint64
-	if dirPath.hasValidParent() {
-		de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md, dirPath)
-		if err != nil {
+// syncDirsAndFinalizeLocked syncs several modified directories of the
+// same TLF in a single MD update.  Like renameLocked, it syncs each
+// directory up to the closest ancestor it shares with the others, and
+// then syncs that ancestor along with the remaining directories.
+func (fbo *folderBranchOps) syncDirsAndFinalizeLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dirs []modifiedDir) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	lbc := make(localBcache)
+	for _, d := range dirs {
+		lbc[d.p.tailPointer()] = d.dblock
+	}
+
+	var bps *blockPutState
+	defer func() {
+		if err != nil && bps != nil {
+			fbo.fbm.cleanUpBlockState(md, bps)
+		}
+	}()
+
+	for len(dirs) > 0 {
+		// Always sync the deepest directory first, so that no
+		// directory is readied before all of its modified
+		// descendants have been written into it.
+		deepest := 0
+		for i, d := range dirs {
+			if len(d.p.path) > len(dirs[deepest].p.path) {
+				deepest = i
+			}
+		}
+		d := dirs[deepest]
+		dirs = append(dirs[:deepest], dirs[deepest+1:]...)
+
+		// Find the deepest ancestor shared with any other
+		// remaining directory.
+		anc := -1
+		for _, other := range dirs {
+			for i := 0; i < len(d.p.path)-1 && i < len(other.p.path); i++ {
+				if d.p.path[i].ID != other.p.path[i].ID {
+					break
+				}
+				if i > anc {
+					anc = i
+				}
+			}
+		}
+		stopAt := zeroPtr
+		if anc >= 0 {
+			stopAt = d.p.path[anc].BlockPointer
+		}
+
+		_, _, dirBps, err := fbo.syncBlockAndCheckEmbedLocked(
+			ctx, lState, md, d.dblock, *d.p.parentPath(), d.p.tailName(),
+			Dir, true, true, stopAt, lbc)
+		if err != nil {
+			return err
+		}
+		if bps == nil {
+			bps = dirBps
+		} else {
+			bps.mergeOtherBps(dirBps)
+		}
+
+		if anc < 0 {
+			continue
+		}
+		found := false
+		for _, other := range dirs {
+			if other.p.tailPointer() == stopAt {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dirs = append(dirs, modifiedDir{
+				p: path{
+					FolderBranch: d.p.FolderBranch,
+					path:         d.p.path[:anc+1],
+				},
+				dblock: lbc[stopAt],
+			})
+		}
+	}
+
+	_, err = fbo.doBlockPuts(ctx, md, *bps)
+	if err != nil {
+		return err
+	}
+
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps)
+}
+
+func checkDisallowedPrefixes(name string) error {
+	for _, prefix := range disallowedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return DisallowedPrefixError{name, prefix}
+		}
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) checkNewDirSize(ctx context.Context,
+	lState *lockState, md *RootMetadata, dirPath path, newName string) error {
+	// Check that the directory isn't past capacity already.
+	var currSize uint64
+	if dirPath.hasValidParent() {
+		de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md, dirPath)
+		if err != nil {
 			return err
 		}
 		currSize = de.Size
@@ -1858,6 +2450,16 @@ func (fbo *folderBranchOps) createEntryLocked(
 		return nil, DirEntry{}, err
 	}
 
+	return fbo.createEntryAnyNameLocked(ctx, lState, dir, name, entryType)
+}
+
+// createEntryAnyNameLocked is like createEntryLocked, but it allows
+// names with disallowed prefixes, for KBFS's own hidden entries.
+func (fbo *folderBranchOps) createEntryAnyNameLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	entryType EntryType) (Node, DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
 	if uint32(len(name)) > fbo.config.MaxNameBytes() {
 		return nil, DirEntry{},
 			NameTooLongError{name, fbo.config.MaxNameBytes()}
@@ -1874,7 +2476,8 @@ func (fbo *folderBranchOps) createEntryLocked(
 		return nil, DirEntry{}, err
 	}
 
-	dblock, err := fbo.blocks.GetDir(ctx, lState, md, dirPath, blockWrite)
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md, dirPath, blockWrite, name)
 	if err != nil {
 		return nil, DirEntry{}, err
 	}
@@ -1935,7 +2538,28 @@ func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
 		default:
 		}
 
+		// Writes that aren't part of the transaction in progress,
+		// if any, wait until it's over.
+		if tx := txFromContext(ctx); tx != fbo.tx {
+			if tx != nil {
+				return TxDoneError{}
+			}
+			txDone := fbo.tx.done
+			doUnlock = false
+			fbo.mdWriterLock.Unlock(lState)
+			select {
+			case <-txDone:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			i--
+			continue
+		}
+
 		err := fn(lState)
+		if fbo.tx != nil && fbo.tx == txFromContext(ctx) {
+			fbo.tx.deadline = time.Now().Add(fbo.txLease)
+		}
 		if isRetriableError(err, i) {
 			fbo.log.CDebugf(ctx, "Trying again after retriable error: %v", err)
 			// Release the lock to give someone else a chance
@@ -2050,7 +2674,8 @@ func (fbo *folderBranchOps) createLinkLocked(
 		return DirEntry{}, err
 	}
 
-	dblock, err := fbo.blocks.GetDir(ctx, lState, md, dirPath, blockWrite)
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md, dirPath, blockWrite, fromName)
 	if err != nil {
 		return DirEntry{}, err
 	}
@@ -2109,9 +2734,1421 @@ func (fbo *folderBranchOps) CreateLink(
 			return err
 		})
 	if err != nil {
-		return EntryInfo{}, err
+		return EntryInfo{}, err
+	}
+	return ei, nil
+}
+
+// getLinksDirLocked returns the path to the TLF's links directory, as
+// seen from the given path, creating the directory in its own MD
+// update if it doesn't exist yet.  Since that means md may no longer
+// be the head, the caller should fetch a fresh MD and fresh paths
+// (including the links path) whenever created is true.
+func (fbo *folderBranchOps) getLinksDirLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, p path) (
+	linksPath path, created bool, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	rootPath := path{FolderBranch: p.FolderBranch, path: p.path[:1]}
+	rootBlock, err := fbo.blocks.GetDir(
+		ctx, lState, md, rootPath, blockRead, linksDirName)
+	if err != nil {
+		return path{}, false, err
+	}
+	if de, ok := rootBlock.Children[linksDirName]; ok {
+		return rootPath.ChildPath(linksDirName, de.BlockPointer), false, nil
+	}
+
+	rootNode := fbo.nodeCache.Get(rootPath.tailPointer().ref())
+	if rootNode == nil {
+		return path{}, false,
+			fmt.Errorf("No node for root %v", rootPath.tailPointer())
+	}
+	_, de, err := fbo.createEntryAnyNameLocked(
+		ctx, lState, rootNode, linksDirName, Dir)
+	if err != nil {
+		return path{}, false, err
+	}
+	return rootPath.ChildPath(linksDirName, de.BlockPointer), true, nil
+}
+
+func (fbo *folderBranchOps) createHardLinkLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	file Node) (DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(name); err != nil {
+		return DirEntry{}, err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return DirEntry{},
+			NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	linksPath, created, err := fbo.getLinksDirLocked(ctx, lState, md, dirPath)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	if created {
+		md, err = fbo.getMDForWriteLocked(ctx, lState)
+		if err != nil {
+			return DirEntry{}, err
+		}
+		dirPath, err = fbo.pathFromNodeForMDWriteLocked(lState, dir)
+		if err != nil {
+			return DirEntry{}, err
+		}
+		linksPath, _, err = fbo.getLinksDirLocked(ctx, lState, md, dirPath)
+		if err != nil {
+			return DirEntry{}, err
+		}
+	}
+
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	if !filePath.hasValidParent() {
+		return DirEntry{}, NotFileError{filePath}
+	}
+
+	// The directories involved may overlap, so make sure each one
+	// is only ever fetched (and modified) once.
+	dblocks := make(map[BlockPointer]*DirBlock)
+	getDir := func(p path, names ...string) (*DirBlock, error) {
+		if dblock, ok := dblocks[p.tailPointer()]; ok {
+			err := fbo.blocks.LoadDirEntries(ctx, lState, md, p, dblock,
+				names...)
+			return dblock, err
+		}
+		dblock, err := fbo.blocks.GetDir(
+			ctx, lState, md, p, blockWrite, names...)
+		if err != nil {
+			return nil, err
+		}
+		dblocks[p.tailPointer()] = dblock
+		return dblock, nil
+	}
+
+	dblock, err := getDir(dirPath, name)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	// does name already exist?
+	if _, ok := dblock.Children[name]; ok {
+		return DirEntry{}, NameExistsError{name}
+	}
+
+	if err := fbo.checkNewDirSize(ctx, lState, md, dirPath, name); err != nil {
+		return DirEntry{}, err
+	}
+
+	fileDe, err := fbo.blocks.GetDirtyEntry(ctx, lState, md, filePath)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	now := fbo.nowUnixNano()
+	parentPath := *filePath.parentPath()
+	var lo *linkOp
+	dirs := []modifiedDir{{dirPath, dblock}}
+	if parentPath.tailPointer() == linksPath.tailPointer() {
+		// Already hard-linked, so just count the new name.
+		lo = newLinkOp(name, dirPath.tailPointer(), filePath.tailName(),
+			linksPath.tailPointer())
+		if fileDe.Nlink < 1 {
+			fileDe.Nlink = 1
+		}
+		fileDe.Nlink++
+	} else {
+		if fileDe.Type == Dir {
+			return DirEntry{}, NotFileError{filePath}
+		}
+
+		// First hard link to this file: move it into the links
+		// directory, and replace its old name with a link to it.
+		nonce, err := fbo.config.Crypto().MakeBlockRefNonce()
+		if err != nil {
+			return DirEntry{}, err
+		}
+		linkID := hex.EncodeToString(nonce[:])
+		lo = newLinkOp(name, dirPath.tailPointer(), linkID,
+			linksPath.tailPointer())
+		lo.convertFrom(filePath.tailName(), parentPath.tailPointer(),
+			fileDe.BlockPointer)
+
+		pblock, err := getDir(parentPath, filePath.tailName())
+		if err != nil {
+			return DirEntry{}, err
+		}
+		pblock.Children[filePath.tailName()] = DirEntry{
+			EntryInfo: EntryInfo{
+				Type:   HardLink,
+				LinkID: linkID,
+				Mtime:  now,
+				Ctime:  now,
+			},
+		}
+		if parentPath.tailPointer() != dirPath.tailPointer() {
+			dirs = append(dirs, modifiedDir{parentPath, pblock})
+		}
+		fileDe.Nlink = 2
+	}
+	fileDe.Ctime = now
+	fbo.blocks.SetCachedLinkCount(
+		lState, filePath.tailPointer().ref(), fileDe.Nlink, fileDe.Ctime)
+
+	linksBlock, err := getDir(linksPath, lo.LinkID)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	linksBlock.Children[lo.LinkID] = fileDe
+	dirs = append(dirs, modifiedDir{linksPath, linksBlock})
+
+	dblock.Children[name] = DirEntry{
+		EntryInfo: EntryInfo{
+			Type:   HardLink,
+			LinkID: lo.LinkID,
+			Mtime:  now,
+			Ctime:  now,
+		},
+	}
+
+	md.AddOp(lo)
+	err = fbo.syncDirsAndFinalizeLocked(ctx, lState, md, dirs)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	return fileDe, nil
+}
+
+func (fbo *folderBranchOps) CreateHardLink(
+	ctx context.Context, dir Node, name string, file Node) (
+	ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CreateHardLink %p %s -> %p",
+		dir.GetID(), name, file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	err = fbo.checkNode(file)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			de, err := fbo.createHardLinkLocked(ctx, lState, dir, name, file)
+			ei = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	return ei, nil
+}
+
+func (fbo *folderBranchOps) copyFileLocked(
+	ctx context.Context, lState *lockState, file Node, dir Node,
+	name string) (Node, DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(name); err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return nil, DirEntry{},
+			NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	if !filePath.hasValidParent() {
+		return nil, DirEntry{}, NotFileError{filePath}
+	}
+
+	// The copy is made from the file's blocks on the server, so
+	// flush out any pending writes first.
+	if fbo.blocks.IsDirty(lState, filePath) {
+		budget := fbo.config.DirtyBudget()
+		budget.SyncStarted(fbo.id(), file.GetID())
+		stillDirty, err := fbo.syncLocked(ctx, lState, filePath)
+		budget.SyncFinished(fbo.id(), file.GetID(), stillDirty, err)
+		if err != nil {
+			return nil, DirEntry{}, err
+		}
+		if !stillDirty {
+			fbo.status.rmDirtyNode(file)
+		}
+		filePath, err = fbo.pathFromNodeForMDWriteLocked(lState, file)
+		if err != nil {
+			return nil, DirEntry{}, err
+		}
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md, dirPath, blockWrite, name)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	fileDe, err := fbo.blocks.GetDirtyEntry(ctx, lState, md, filePath)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	if fileDe.Type != File && fileDe.Type != Exec {
+		return nil, DirEntry{}, NotFileError{filePath}
+	}
+
+	// An existing empty file can be copied into, which is how
+	// copy_file_range(2) and friends see a copy: first the new file
+	// is created, and then its contents are filled in.
+	oldDe, replace := dblock.Children[name]
+	if replace {
+		if (oldDe.Type != File && oldDe.Type != Exec) || oldDe.Size != 0 ||
+			fbo.blocks.IsDirty(lState,
+				dirPath.ChildPath(name, oldDe.BlockPointer)) {
+			return nil, DirEntry{}, NameExistsError{name}
+		}
+	} else if err := fbo.checkNewDirSize(
+		ctx, lState, md, dirPath, name); err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	bps := newBlockPutState(1)
+	infos, err := fbo.blocks.CopyFile(
+		ctx, lState, md, uid, filePath, fileDe.BlockInfo, bps)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	now := fbo.nowUnixNano()
+	var de DirEntry
+	if replace {
+		// This is just a write of the whole file.
+		de = oldDe
+		so := newSyncOp(oldDe.BlockPointer)
+		so.addWrite(0, fileDe.Size)
+		md.AddOp(so)
+		md.AddUpdate(oldDe.BlockInfo, infos[0])
+	} else {
+		de.Type = fileDe.Type
+		md.AddOp(newCopyOp(name, dirPath.tailPointer(), de.Type))
+		md.AddRefBlock(infos[0])
+	}
+	for _, info := range infos[1:] {
+		md.AddRefBlock(info)
+	}
+	de.BlockInfo = infos[0]
+	de.Size = fileDe.Size
+	de.Mtime = now
+	de.Ctime = now
+	dblock.Children[name] = de
+
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(md, bps)
+		}
+	}()
+
+	// Only the new indirect blocks are uploaded; the rest are
+	// just new references.
+	_, err = fbo.doBlockPuts(ctx, md, *bps)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	err = fbo.syncDirsAndFinalizeLocked(
+		ctx, lState, md, []modifiedDir{{dirPath, dblock}})
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	node, err := fbo.nodeCache.GetOrCreate(de.BlockPointer, name, dir)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	return node, de, nil
+}
+
+func (fbo *folderBranchOps) CopyFile(
+	ctx context.Context, file Node, dir Node, name string) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CopyFile %p -> %p %s",
+		file.GetID(), dir.GetID(), name)
+	defer func() {
+		if err != nil {
+			fbo.deferLog.CDebugf(ctx, "Error: %v", err)
+		} else {
+			fbo.deferLog.CDebugf(ctx, "Done: %p", n.GetID())
+		}
+	}()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			node, de, err := fbo.copyFileLocked(ctx, lState, file, dir, name)
+			n = node
+			ei = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return n, ei, nil
+}
+
+// movedBlocks tracks the blocks of an entry that's being moved into
+// another top-level folder: the old blocks, to unreference in the old
+// folder, and their re-encrypted copies, to reference in the new one.
+type movedBlocks struct {
+	old []BlockInfo
+	new []BlockInfo
+}
+
+// getEntryForMove returns the entry with the given name in the given
+// directory, along with the MD it comes from, so the entry can be
+// moved into another top-level folder.
+func (fbo *folderBranchOps) getEntryForMove(ctx context.Context,
+	dir Node, name string) (md *RootMetadata, de DirEntry, err error) {
+	fbo.log.CDebugf(ctx, "getEntryForMove %p %s", dir.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	// The entry is copied from its blocks on the server, so flush
+	// out any pending writes first.
+	lState := makeFBOLockState()
+	for _, ref := range fbo.blocks.GetDirtyRefs(lState) {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+		if err := fbo.Sync(ctx, node); err != nil {
+			return nil, DirEntry{}, err
+		}
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		md, err = fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+		dirPath, err := fbo.pathFromNodeForRead(dir)
+		if err != nil {
+			return err
+		}
+		if len(dirPath.path) == 1 && name == linksDirName {
+			return NoSuchNameError{name}
+		}
+		de, err = fbo.blocks.GetDirtyEntry(
+			ctx, lState, md, dirPath.ChildPathNoPtr(name))
+		return err
+	})
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	if de.Type == HardLink {
+		// The other names of the file would have to stay behind.
+		return nil, DirEntry{}, RenameAcrossDirsError{}
+	}
+	return md, de, nil
+}
+
+// importPutState tracks the copied blocks of an entry being moved in
+// from another folder.  Blocks are readied into bps, and moved to put
+// (without their contents) once they've been put, so that they can
+// still be cleaned up if the move fails later on.
+type importPutState struct {
+	bps   *blockPutState
+	bytes int
+	put   *blockPutState
+}
+
+func newImportPutState() *importPutState {
+	return &importPutState{
+		bps: newBlockPutState(1),
+		put: newBlockPutState(1),
+	}
+}
+
+// putImportedBlocks puts all the blocks readied so far in ips.
+func (fbo *folderBranchOps) putImportedBlocks(ctx context.Context,
+	md *RootMetadata, ips *importPutState) error {
+	_, err := fbo.doBlockPuts(ctx, md, *ips.bps)
+	if err != nil {
+		return err
+	}
+	for _, bs := range ips.bps.blockStates {
+		ips.put.addNewBlock(bs.blockPtr, nil, ReadyBlockData{})
+	}
+	ips.bps = newBlockPutState(1)
+	ips.bytes = 0
+	return nil
+}
+
+// importBlock copies the block with the given info from the folder of
+// srcMD, along with all the blocks under it, re-encrypting them for
+// this folder.  It returns the info of the copy.  The copies are put
+// in batches of up to maxImportPutBytes as they're made.
+func (fbo *folderBranchOps) importBlock(ctx context.Context,
+	md *RootMetadata, uid keybase1.UID, srcMD *RootMetadata,
+	info BlockInfo, entryType EntryType, ips *importPutState,
+	mb *movedBlocks) (BlockInfo, error) {
+	mb.old = append(mb.old, info)
+
+	var block Block
+	switch entryType {
+	case Dir:
+		dblock := NewDirBlock().(*DirBlock)
+		err := fbo.config.BlockOps().Get(ctx, srcMD, info.BlockPointer, dblock)
+		if err != nil {
+			return BlockInfo{}, err
+		}
+		for i, iptr := range dblock.IPtrs {
+			newInfo, err := fbo.importBlock(ctx, md, uid, srcMD,
+				iptr.BlockInfo, Dir, ips, mb)
+			if err != nil {
+				return BlockInfo{}, err
+			}
+			dblock.IPtrs[i].BlockInfo = newInfo
+		}
+		for name, de := range dblock.Children {
+			switch de.Type {
+			case Sym:
+				continue
+			case HardLink:
+				return BlockInfo{}, RenameAcrossDirsError{}
+			}
+			newInfo, err := fbo.importBlock(ctx, md, uid, srcMD,
+				de.BlockInfo, de.Type, ips, mb)
+			if err != nil {
+				return BlockInfo{}, err
+			}
+			de.BlockInfo = newInfo
+			dblock.Children[name] = de
+		}
+		block = dblock
+	case File, Exec:
+		fblock := NewFileBlock().(*FileBlock)
+		err := fbo.config.BlockOps().Get(ctx, srcMD, info.BlockPointer, fblock)
+		if err != nil {
+			return BlockInfo{}, err
+		}
+		for i, iptr := range fblock.IPtrs {
+			newInfo, err := fbo.importBlock(ctx, md, uid, srcMD,
+				iptr.BlockInfo, File, ips, mb)
+			if err != nil {
+				return BlockInfo{}, err
+			}
+			fblock.IPtrs[i].BlockInfo = newInfo
+		}
+		block = fblock
+	default:
+		return BlockInfo{}, fmt.Errorf("Unexpected entry type %s", entryType)
+	}
+
+	newInfo, _, err := fbo.readyBlockMultiple(ctx, md, block, uid, ips.bps)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	mb.new = append(mb.new, newInfo)
+	ips.bytes += ips.bps.blockStates[len(ips.bps.blockStates)-1].putSize()
+	if ips.bytes >= maxImportPutBytes {
+		if err := fbo.putImportedBlocks(ctx, md, ips); err != nil {
+			return BlockInfo{}, err
+		}
+	}
+	return newInfo, nil
+}
+
+func (fbo *folderBranchOps) importEntryLocked(ctx context.Context,
+	lState *lockState, dir Node, name string, srcMD *RootMetadata,
+	srcDe DirEntry) (*movedBlocks, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(name); err != nil {
+		return nil, err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return nil, NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md, dirPath, blockWrite, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := dblock.Children[name]; ok {
+		// Replacing an entry isn't atomic across folders; let the
+		// caller fall back to a copy.
+		return nil, RenameAcrossDirsError{}
+	}
+	if err := fbo.checkNewDirSize(
+		ctx, lState, md, dirPath, name); err != nil {
+		return nil, err
+	}
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the times and type of the old entry, but with copies of
+	// all the blocks.
+	de := srcDe
+	mb := &movedBlocks{}
+	ips := newImportPutState()
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(md, ips.bps)
+			fbo.fbm.cleanUpBlockState(md, ips.put)
+		}
+	}()
+	if de.Type != Sym {
+		de.BlockInfo, err = fbo.importBlock(
+			ctx, md, uid, srcMD, srcDe.BlockInfo, de.Type, ips, mb)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	md.AddOp(newCreateOp(name, dirPath.tailPointer(), de.Type))
+	for _, info := range mb.new {
+		md.AddRefBlock(info)
+	}
+	dblock.Children[name] = de
+
+	err = fbo.putImportedBlocks(ctx, md, ips)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fbo.syncDirsAndFinalizeLocked(
+		ctx, lState, md, []modifiedDir{{dirPath, dblock}})
+	if err != nil {
+		return nil, err
+	}
+
+	// The old entry is removed once this returns, so the new one
+	// must be on the server by then.
+	err = fbo.commitMDBatchLocked(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	return mb, nil
+}
+
+// importEntry copies the given entry, from the folder of the given
+// MD, into the given directory of this folder.  It returns the blocks
+// of the old entry and of the copy.
+func (fbo *folderBranchOps) importEntry(ctx context.Context, dir Node,
+	name string, srcMD *RootMetadata, srcDe DirEntry) (
+	mb *movedBlocks, err error) {
+	fbo.log.CDebugf(ctx, "importEntry %p %s from folder %s",
+		dir.GetID(), name, srcMD.ID)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			mb, err = fbo.importEntryLocked(
+				ctx, lState, dir, name, srcMD, srcDe)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return mb, nil
+}
+
+// removeMovedEntry removes the given entry, which was moved into
+// another folder, along with all of its blocks.  If the entry has
+// changed since it was copied, it's left in place.
+func (fbo *folderBranchOps) removeMovedEntry(ctx context.Context,
+	dir Node, name string, ptr BlockPointer, mb *movedBlocks) (err error) {
+	fbo.log.CDebugf(ctx, "removeMovedEntry %p %s", dir.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			md, err := fbo.getMDForWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+
+			dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+			if err != nil {
+				return err
+			}
+
+			pblock, err := fbo.blocks.GetDir(
+				ctx, lState, md, dirPath, blockWrite, name)
+			if err != nil {
+				return err
+			}
+			de, ok := pblock.Children[name]
+			if !ok {
+				return NoSuchNameError{name}
+			}
+			if de.BlockPointer != ptr {
+				return EntryChangedDuringMoveError{name}
+			}
+
+			md.AddOp(newRmOp(name, dirPath.tailPointer()))
+			for _, info := range mb.old {
+				md.AddUnrefBlock(info)
+			}
+			delete(pblock.Children, name)
+
+			_, err = fbo.syncBlockAndFinalizeLocked(
+				ctx, lState, md, pblock, *dirPath.parentPath(),
+				dirPath.tailName(), Dir, true, true, zeroPtr)
+			return err
+		})
+}
+
+// maxDeletedEntriesRevisions is how many of the most recent merged
+// revisions are searched for removed entries that can be restored.
+const maxDeletedEntriesRevisions = 1000
+
+// searchForPathsInMD returns the paths to the given pointers as of
+// the given merged revision, following only the directories updated
+// in that revision.  Pointers that can't be found are left out.
+func (fbo *folderBranchOps) searchForPathsInMD(ctx context.Context,
+	rmd *RootMetadata, ptrs []BlockPointer) (map[BlockPointer]path, error) {
+	newPtrs := make(map[BlockPointer]bool)
+	for _, op := range rmd.data.Changes.Ops {
+		for _, update := range op.AllUpdates() {
+			newPtrs[update.Ref] = true
+		}
+	}
+	return fbo.searchForPaths(ctx, rmd, ptrs, newPtrs)
+}
+
+// searchForPaths returns the paths to the given pointers as of the
+// given merged revision, only looking in the directories in newPtrs.
+// Pointers that can't be found are left out.
+func (fbo *folderBranchOps) searchForPaths(ctx context.Context,
+	rmd *RootMetadata, ptrs []BlockPointer,
+	newPtrs map[BlockPointer]bool) (map[BlockPointer]path, error) {
+	cache := newNodeCacheStandard(fbo.folderBranch)
+	_, err := cache.GetOrCreate(rmd.data.Dir.BlockPointer,
+		string(rmd.GetTlfHandle().GetCanonicalName()), nil)
+	if err != nil {
+		return nil, err
+	}
+	nodeMap, err := fbo.blocks.SearchForNodes(ctx, cache, ptrs, newPtrs, rmd)
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[BlockPointer]path, len(nodeMap))
+	for ptr, node := range nodeMap {
+		if node != nil {
+			paths[ptr] = cache.PathFromNode(node)
+		}
+	}
+	return paths, nil
+}
+
+// latestGCRevision returns the latest revision covered by a quota
+// reclamation among the given ones.  The blocks unreferenced by that
+// revision and those before it may already be gone.
+func latestGCRevision(rmds []*RootMetadata) MetadataRevision {
+	var gcRev MetadataRevision
+	for _, rmd := range rmds {
+		for _, op := range rmd.data.Changes.Ops {
+			if gco, ok := op.(*gcOp); ok && gco.LatestRev > gcRev {
+				gcRev = gco.LatestRev
+			}
+		}
+	}
+	return gcRev
+}
+
+// getDeletedEntriesInMD returns the entries removed by each of the
+// given rm ops (all of those in the given merged revision, in
+// order), using the cached ones if there are any.  The entry for an
+// op is nil if it can't be found.
+func (fbo *folderBranchOps) getDeletedEntriesInMD(ctx context.Context,
+	lState *lockState, rmd *RootMetadata, ros []*rmOp) (
+	[]*DeletedEntry, error) {
+	if len(ros) == 0 {
+		return nil, nil
+	}
+	fbo.deletedEntriesLock.Lock()
+	entries, ok := fbo.deletedEntries[rmd.Revision]
+	fbo.deletedEntriesLock.Unlock()
+	if ok {
+		return entries, nil
+	}
+
+	entries, err := fbo.findDeletedEntriesInMD(ctx, lState, rmd, ros)
+	if err != nil {
+		return nil, err
+	}
+	fbo.deletedEntriesLock.Lock()
+	defer fbo.deletedEntriesLock.Unlock()
+	fbo.deletedEntries[rmd.Revision] = entries
+	return entries, nil
+}
+
+// findDeletedEntriesInMD searches the given merged revision for the
+// entries removed by each of the given rm ops from it.
+func (fbo *folderBranchOps) findDeletedEntriesInMD(ctx context.Context,
+	lState *lockState, rmd *RootMetadata, ros []*rmOp) (
+	[]*DeletedEntry, error) {
+	entries := make([]*DeletedEntry, len(ros))
+
+	ptrs := make([]BlockPointer, 0, len(ros))
+	for _, ro := range ros {
+		ptrs = append(ptrs, ro.Dir.Ref)
+	}
+	paths, err := fbo.searchForPathsInMD(ctx, rmd, ptrs)
+	if err != nil {
+		return nil, err
+	}
+
+	date := time.Unix(0, rmd.data.Dir.Mtime)
+	for i, ro := range ros {
+		dirPath, ok := paths[ro.Dir.Ref]
+		if !ok {
+			fbo.log.CDebugf(ctx, "Couldn't find the directory that %s "+
+				"was removed from in revision %d", ro.OldName, rmd.Revision)
+			continue
+		}
+		dir := make([]string, 0, len(dirPath.path)-1)
+		for _, pn := range dirPath.path[1:] {
+			dir = append(dir, pn.Name)
+		}
+		if len(dir) > 0 && dir[0] == linksDirName {
+			// Files behind hard links are removed along with
+			// their last link, which is the entry to restore.
+			continue
+		}
+
+		// The entry is only in the version of the directory from
+		// before the removal.
+		oldDirPath := path{FolderBranch: fbo.folderBranch,
+			path: make([]pathNode, len(dirPath.path))}
+		copy(oldDirPath.path, dirPath.path)
+		oldDirPath.path[len(oldDirPath.path)-1].BlockPointer = ro.Dir.Unref
+		dblock, err := fbo.blocks.GetDir(
+			ctx, lState, rmd, oldDirPath, blockRead, ro.OldName)
+		if err != nil {
+			return nil, err
+		}
+		de, ok := dblock.Children[ro.OldName]
+		if !ok {
+			continue
+		}
+		entries[i] = &DeletedEntry{
+			EntryInfo:        de.EntryInfo,
+			Name:             ro.OldName,
+			Dir:              dir,
+			Revision:         rmd.Revision,
+			Date:             date,
+			SnapshotRevision: rmd.Revision - 1,
+			tlf:              rmd.ID,
+			de:               de,
+		}
+	}
+	return entries, nil
+}
+
+func (fbo *folderBranchOps) GetDeletedEntries(ctx context.Context,
+	folderBranch FolderBranch) (entries []DeletedEntry, err error) {
+	fbo.log.CDebugf(ctx, "GetDeletedEntries")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	start := md.Revision - maxDeletedEntriesRevisions + 1
+	if start < MetadataRevisionInitial {
+		start = MetadataRevisionInitial
+	}
+	rmds, err := getMergedMDUpdates(ctx, fbo.config, fbo.id(), start)
+	if err != nil {
+		return nil, err
+	}
+	err = fbo.reembedBlockChanges(ctx, lState, rmds)
+	if err != nil {
+		return nil, err
+	}
+
+	gcRev := latestGCRevision(rmds)
+
+	// Go back through the history, newest first.  A removed
+	// directory keeps being followed back through the removals of
+	// its own contents, for as long as the revisions only have
+	// removals in them, so that the directory can be restored as it
+	// was before something like `rm -rf`.  tracked maps the block
+	// pointer of each such directory, as of the current revision,
+	// to its index in entries.
+	tracked := make(map[BlockPointer]int)
+	for i := len(rmds) - 1; i >= 0 && rmds[i].Revision > gcRev; i-- {
+		rmd := rmds[i]
+		var ros []*rmOp
+		for _, op := range rmd.data.Changes.Ops {
+			if ro, ok := op.(*rmOp); ok {
+				ros = append(ros, ro)
+			} else {
+				tracked = make(map[BlockPointer]int)
+			}
+		}
+		mdEntries, err := fbo.getDeletedEntriesInMD(ctx, lState, rmd, ros)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := len(ros) - 1; j >= 0; j-- {
+			ro := ros[j]
+			covered := false
+			for _, update := range ro.AllUpdates() {
+				index, ok := tracked[update.Ref]
+				if !ok {
+					continue
+				}
+				delete(tracked, update.Ref)
+				tracked[update.Unref] = index
+				entries[index].de.BlockInfo = BlockInfo{
+					BlockPointer: update.Unref}
+				entries[index].SnapshotRevision = rmd.Revision - 1
+				covered = true
+			}
+			if covered || mdEntries[j] == nil {
+				continue
+			}
+			if mdEntries[j].Type == Dir {
+				tracked[mdEntries[j].de.BlockPointer] = len(entries)
+			}
+			entries = append(entries, *mdEntries[j])
+		}
+	}
+
+	// Forget the revisions that have left the trash.
+	fbo.deletedEntriesLock.Lock()
+	defer fbo.deletedEntriesLock.Unlock()
+	for rev := range fbo.deletedEntries {
+		if rev < start || rev <= gcRev {
+			delete(fbo.deletedEntries, rev)
+		}
+	}
+	return entries, nil
+}
+
+// copyDeletedEntryLocked returns a copy of the given entry, found at
+// path p within the given snapshot of the folder, with new references
+// (added to md) to all of its blocks and those of everything under
+// it.  Hard links are copied as the files they refer to.
+func (fbo *folderBranchOps) copyDeletedEntryLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, uid keybase1.UID,
+	snapshot *RootMetadata, p path, de DirEntry, bps *blockPutState) (
+	DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if de.Type == HardLink {
+		_, fileDe, err := fbo.blocks.GetHardLinkTarget(
+			ctx, lState, snapshot, *p.parentPath(), de)
+		if err != nil {
+			return DirEntry{}, err
+		}
+		de.BlockInfo = fileDe.BlockInfo
+		de.Type = fileDe.Type
+		de.Size = fileDe.Size
+		de.LinkID = ""
+		de.Nlink = 0
+		p = p.parentPath().ChildPath(p.tailName(), de.BlockPointer)
+	}
+
+	switch de.Type {
+	case File, Exec:
+		infos, err := fbo.blocks.CopyFile(
+			ctx, lState, md, uid, p, de.BlockInfo, bps)
+		if err != nil {
+			return DirEntry{}, err
+		}
+		for _, info := range infos {
+			md.AddRefBlock(info)
+		}
+		de.BlockInfo = infos[0]
+	case Dir:
+		dblock, err := fbo.blocks.GetFullDir(ctx, lState, md, p)
+		if err != nil {
+			return DirEntry{}, err
+		}
+		newBlock := NewDirBlock().(*DirBlock)
+		for name, childDe := range dblock.Children {
+			newChildDe, err := fbo.copyDeletedEntryLocked(ctx, lState, md,
+				uid, snapshot, p.ChildPath(name, childDe.BlockPointer),
+				childDe, bps)
+			if err != nil {
+				return DirEntry{}, err
+			}
+			newBlock.Children[name] = newChildDe
+		}
+		info, plainSize, err := fbo.blocks.ReadyDirBlock(
+			ctx, lState, md, newBlock, uid, bps)
+		if err != nil {
+			return DirEntry{}, err
+		}
+		md.AddRefBlock(info)
+		de.BlockInfo = info
+		de.Size = uint64(plainSize)
+	}
+	return de, nil
+}
+
+func (fbo *folderBranchOps) restoreDeletedEntryLocked(ctx context.Context,
+	lState *lockState, entry DeletedEntry, dir Node, name string) (
+	Node, DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(name); err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return nil, DirEntry{},
+			NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md, dirPath, blockWrite, name)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	if _, ok := dblock.Children[name]; ok {
+		return nil, DirEntry{}, NameExistsError{name}
+	}
+	if err := fbo.checkNewDirSize(
+		ctx, lState, md, dirPath, name); err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	// The snapshot is needed to find the files behind any hard
+	// links.
+	snapshots, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+		entry.SnapshotRevision, entry.SnapshotRevision, Merged)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	if len(snapshots) != 1 {
+		return nil, DirEntry{}, NoSuchRevisionError{entry.SnapshotRevision}
+	}
+	snapshot := snapshots[0]
+	snapshotRoot := path{FolderBranch: fbo.folderBranch,
+		path: []pathNode{{snapshot.data.Dir.BlockPointer,
+			string(snapshot.GetTlfHandle().GetCanonicalName())}}}
+
+	co := newCopyOp(name, dirPath.tailPointer(), entry.de.Type)
+	md.AddOp(co)
+	bps := newBlockPutState(1)
+	de, err := fbo.copyDeletedEntryLocked(ctx, lState, md, uid, snapshot,
+		snapshotRoot.ChildPath(entry.Name, entry.de.BlockPointer),
+		entry.de, bps)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	co.Type = de.Type
+	// The restored entry's top block must be the op's first ref,
+	// but the blocks under it were readied first.
+	for i, ptr := range co.RefBlocks {
+		if ptr == de.BlockPointer {
+			copy(co.RefBlocks[1:i+1], co.RefBlocks[:i])
+			co.RefBlocks[0] = ptr
+			break
+		}
+	}
+	de.Ctime = fbo.nowUnixNano()
+	dblock.Children[name] = de
+
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(md, bps)
+		}
+	}()
+
+	// Only the new directory and indirect file blocks are uploaded;
+	// the rest are just new references.
+	_, err = fbo.doBlockPuts(ctx, md, *bps)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	err = fbo.syncDirsAndFinalizeLocked(
+		ctx, lState, md, []modifiedDir{{dirPath, dblock}})
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	if de.Type == Sym {
+		return nil, de, nil
+	}
+	node, err := fbo.nodeCache.GetOrCreate(de.BlockPointer, name, dir)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	return node, de, nil
+}
+
+func (fbo *folderBranchOps) RestoreDeletedEntry(
+	ctx context.Context, entry DeletedEntry, dir Node, name string) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "RestoreDeletedEntry %s (revision %d) -> %p %s",
+		entry.Name, entry.Revision, dir.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			node, de, err := fbo.restoreDeletedEntryLocked(
+				ctx, lState, entry, dir, name)
+			n = node
+			ei = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return n, ei, nil
+}
+
+// getFileVersions returns the merged versions of the file at the
+// given path, most recent first.  The file is followed back through
+// the history by its block pointer, which changes with every sync.
+func (fbo *folderBranchOps) getFileVersions(ctx context.Context,
+	lState *lockState, file path) ([]FileVersion, error) {
+	rmds, err := getMergedMDUpdates(ctx, fbo.config, fbo.id(),
+		MetadataRevisionInitial)
+	if err != nil {
+		return nil, err
+	}
+	err = fbo.reembedBlockChanges(ctx, lState, rmds)
+	if err != nil {
+		return nil, err
+	}
+	gcRev := latestGCRevision(rmds)
+
+	type writerKey struct {
+		uid keybase1.UID
+		kid keybase1.KID
+	}
+	writers := make(map[writerKey]writerInfo)
+	ptr := file.tailPointer()
+	name := file.tailName()
+	var versions []FileVersion
+	for i := len(rmds) - 1; i >= 0 && rmds[i].Revision > gcRev; i-- {
+		rmd := rmds[i]
+		versionPtr := ptr
+		// Go back through the ops that changed the file, keeping
+		// track of its pointer and name before each of them.  The
+		// creation of an entry with the file's name might be the
+		// creation of the file, which is checked once its path is
+		// known.
+		var ops []string
+		var creates []op
+		for j := len(rmd.data.Changes.Ops) - 1; j >= 0; j-- {
+			o := rmd.data.Changes.Ops[j]
+			switch realOp := o.(type) {
+			case *syncOp:
+				if realOp.File.Ref != ptr {
+					continue
+				}
+				ptr = realOp.File.Unref
+			case *setAttrOp:
+				if realOp.File != ptr {
+					continue
+				}
+			case *renameOp:
+				if realOp.Renamed != ptr {
+					continue
+				}
+				name = realOp.OldName
+			case *createOp:
+				if realOp.NewName == name {
+					creates = append(creates, realOp)
+				}
+				continue
+			case *copyOp:
+				if realOp.NewName == name {
+					creates = append(creates, realOp)
+				}
+				continue
+			default:
+				continue
+			}
+			ops = append([]string{o.String()}, ops...)
+		}
+		if len(ops) == 0 && len(creates) == 0 {
+			continue
+		}
+
+		paths, err := fbo.searchForPathsInMD(
+			ctx, rmd, []BlockPointer{versionPtr})
+		if err != nil {
+			return nil, err
+		}
+		p, ok := paths[versionPtr]
+		if !ok {
+			if len(ops) > 0 {
+				fbo.log.CDebugf(ctx, "Couldn't find file %v in revision %d",
+					versionPtr, rmd.Revision)
+			}
+			continue
+		}
+		parentPath := *p.parentPath()
+		created := false
+		for _, o := range creates {
+			var dir blockUpdate
+			switch realOp := o.(type) {
+			case *createOp:
+				dir = realOp.Dir
+			case *copyOp:
+				dir = realOp.Dir
+			}
+			if dir.Ref == parentPath.tailPointer() {
+				ops = append([]string{o.String()}, ops...)
+				created = true
+				break
+			}
+		}
+		if len(ops) == 0 {
+			continue
+		}
+
+		dblock, err := fbo.blocks.GetDir(
+			ctx, lState, rmd, parentPath, blockRead, p.tailName())
+		if err != nil {
+			return nil, err
+		}
+		de, ok := dblock.Children[p.tailName()]
+		if !ok {
+			return nil, NoSuchNameError{p.tailName()}
+		}
+		key := writerKey{rmd.LastModifyingWriter, rmd.writerKID()}
+		winfo, ok := writers[key]
+		if !ok {
+			winfo, err = newWriterInfo(ctx, fbo.config, key.uid, key.kid)
+			if err != nil {
+				return nil, err
+			}
+			writers[key] = winfo
+		}
+		versions = append(versions, FileVersion{
+			Revision: rmd.Revision,
+			Date:     time.Unix(0, rmd.data.Dir.Mtime),
+			Writer:   string(winfo.name),
+			Device:   winfo.deviceName,
+			Size:     de.Size,
+			Ops:      ops,
+			md:       rmd,
+			p:        p,
+		})
+		if created {
+			break
+		}
+	}
+	return versions, nil
+}
+
+// GetFileHistory implements the KBFSOps interface for folderBranchOps
+func (fbo *folderBranchOps) GetFileHistory(ctx context.Context, file Node) (
+	versions []FileVersion, err error) {
+	fbo.log.CDebugf(ctx, "GetFileHistory %p", file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return nil, err
+	}
+	lState := makeFBOLockState()
+	return fbo.getFileVersions(ctx, lState, filePath)
+}
+
+// restoreFileVersionChunkSize is how much of an old version of a
+// file is read at a time while restoring it.
+const restoreFileVersionChunkSize = 1 << 20
+
+// RestoreFileVersion implements the KBFSOps interface for
+// folderBranchOps
+func (fbo *folderBranchOps) RestoreFileVersion(ctx context.Context,
+	file Node, rev MetadataRevision) (err error) {
+	fbo.log.CDebugf(ctx, "RestoreFileVersion %p %d", file.GetID(), rev)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return err
+	}
+	lState := makeFBOLockState()
+	versions, err := fbo.getFileVersions(ctx, lState, filePath)
+	if err != nil {
+		return err
+	}
+	var version *FileVersion
+	for i := range versions {
+		if versions[i].Revision <= rev {
+			version = &versions[i]
+			break
+		}
+	}
+	if version == nil {
+		return NoSuchFileVersionError{rev}
+	}
+
+	// Drop the current contents and write back only the ranges of
+	// the old version that hold data, then extend the file to the
+	// old size.  That way the old holes, including any at the end,
+	// come back as holes rather than as blocks full of zeroes.
+	err = fbo.Truncate(ctx, file, 0)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, restoreFileVersionChunkSize)
+	size := int64(version.Size)
+	for off := int64(0); off < size; {
+		off, err = fbo.blocks.Seek(
+			ctx, lState, version.md, version.p, off, false)
+		if _, ok := err.(NoDataAfterOffsetError); ok {
+			break
+		} else if err != nil {
+			return err
+		}
+		holeOff, err := fbo.blocks.Seek(
+			ctx, lState, version.md, version.p, off, true)
+		if err != nil {
+			return err
+		}
+		for off < holeOff {
+			dest := buf
+			if holeOff-off < int64(len(dest)) {
+				dest = dest[:holeOff-off]
+			}
+			n, err := fbo.blocks.Read(
+				ctx, lState, version.md, version.p, dest, off)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				// The old version ends early, so there's nothing
+				// more to write.
+				off = size
+				break
+			}
+			err = fbo.Write(ctx, file, dest[:n], off)
+			if err != nil {
+				return err
+			}
+			off += n
+		}
+	}
+	err = fbo.Truncate(ctx, file, version.Size)
+	if err != nil {
+		return err
 	}
-	return ei, nil
+	return fbo.Sync(ctx, file)
 }
 
 // unrefEntry modifies md to unreference all relevant blocks for the
@@ -2124,18 +4161,23 @@ func (fbo *folderBranchOps) unrefEntry(ctx context.Context,
 	childPath := dir.ChildPath(name, de.BlockPointer)
 
 	// If this is an indirect block, we need to delete all of its
-	// children as well. NOTE: non-empty directories can't be
-	// removed, so no need to check for indirect directory blocks
-	// here.
-	if de.Type == File || de.Type == Exec {
-		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
+	// children as well.
+	var blockInfos []BlockInfo
+	var err error
+	switch de.Type {
+	case File, Exec:
+		blockInfos, err = fbo.blocks.GetIndirectFileBlockInfos(
 			ctx, lState, md, childPath)
-		if err != nil {
-			return NoSuchBlockError{de.ID}
-		}
-		for _, blockInfo := range blockInfos {
-			md.AddUnrefBlock(blockInfo)
-		}
+	case Dir:
+		// A directory replaced by a rename may be non-empty.
+		blockInfos, err = fbo.blocks.GetIndirectDirBlockInfos(
+			ctx, lState, md, childPath)
+	}
+	if err != nil {
+		return NoSuchBlockError{de.ID}
+	}
+	for _, blockInfo := range blockInfos {
+		md.AddUnrefBlock(blockInfo)
 	}
 	return nil
 }
@@ -2144,7 +4186,7 @@ func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
 	lState *lockState, md *RootMetadata, dir path, name string) error {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	pblock, err := fbo.blocks.GetDir(ctx, lState, md, dir, blockWrite)
+	pblock, err := fbo.blocks.GetDir(ctx, lState, md, dir, blockWrite, name)
 	if err != nil {
 		return err
 	}
@@ -2155,6 +4197,10 @@ func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
 		return NoSuchNameError{name}
 	}
 
+	if de.Type == HardLink {
+		return fbo.removeHardLinkLocked(ctx, lState, md, dir, pblock, name, de)
+	}
+
 	md.AddOp(newRmOp(name, dir.tailPointer()))
 	err = fbo.unrefEntry(ctx, lState, md, dir, de, name)
 	if err != nil {
@@ -2174,6 +4220,50 @@ func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
 	return nil
 }
 
+// removeHardLinkLocked removes one name of a hard-linked file.  The
+// file itself, and all of its blocks, only go away along with its
+// last name.
+func (fbo *folderBranchOps) removeHardLinkLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, pblock *DirBlock,
+	name string, de DirEntry) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	filePath, fileDe, err := fbo.blocks.GetHardLinkTarget(
+		ctx, lState, md, dir, de)
+	if err != nil {
+		return err
+	}
+	linksPath := *filePath.parentPath()
+	linksBlock, err := fbo.blocks.GetDir(
+		ctx, lState, md, linksPath, blockWrite, de.LinkID)
+	if err != nil {
+		return err
+	}
+
+	md.AddOp(newUnlinkOp(name, dir.tailPointer(), de.LinkID,
+		linksPath.tailPointer()))
+	delete(pblock.Children, name)
+
+	if fileDe.Nlink <= 1 {
+		err = fbo.unrefEntry(ctx, lState, md, linksPath, fileDe, de.LinkID)
+		if err != nil {
+			return err
+		}
+		delete(linksBlock.Children, de.LinkID)
+	} else {
+		fileDe.Nlink--
+		fileDe.Ctime = fbo.nowUnixNano()
+		linksBlock.Children[de.LinkID] = fileDe
+		fbo.blocks.SetCachedLinkCount(lState, filePath.tailPointer().ref(),
+			fileDe.Nlink, fileDe.Ctime)
+	}
+
+	return fbo.syncDirsAndFinalizeLocked(ctx, lState, md, []modifiedDir{
+		{dir, pblock},
+		{linksPath, linksBlock},
+	})
+}
+
 func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
 	lState *lockState, dir Node, dirName string) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
@@ -2189,7 +4279,11 @@ func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
 		return err
 	}
 
-	pblock, err := fbo.blocks.GetDir(ctx, lState, md, dirPath, blockRead)
+	pblock, err := fbo.blocks.GetDir(
+		ctx, lState, md, dirPath, blockRead, dirName)
+	if err != nil {
+		return err
+	}
 	de, ok := pblock.Children[dirName]
 	if !ok {
 		return NoSuchNameError{dirName}
@@ -2204,7 +4298,8 @@ func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
 		return err
 	}
 
-	if len(childBlock.Children) > 0 {
+	// Empty indirect blocks are always collapsed into direct blocks.
+	if childBlock.IsInd || len(childBlock.Children) > 0 {
 		return DirNotEmptyError{dirName}
 	}
 
@@ -2378,6 +4473,42 @@ func (fbo *folderBranchOps) renameLocked(
 	return fbo.finalizeMDWriteLocked(ctx, lState, md, newBps)
 }
 
+// removeHardLinkTargetLocked removes newName from newParent, in its
+// own MD update, if it is a hard link that a rename is about to
+// replace.  It returns true if it did so.
+func (fbo *folderBranchOps) removeHardLinkTargetLocked(
+	ctx context.Context, lState *lockState, oldParent path, oldName string,
+	newParent path, newName string) (bool, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if oldParent.tailPointer() == newParent.tailPointer() &&
+		oldName == newName {
+		return false, nil
+	}
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return false, err
+	}
+
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md, newParent.ChildPathNoPtr(newName))
+	if _, ok := err.(NoSuchNameError); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if de.Type != HardLink {
+		return false, nil
+	}
+
+	err = fbo.removeEntryLocked(ctx, lState, md, newParent, newName)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (fbo *folderBranchOps) Rename(
 	ctx context.Context, oldParent Node, oldName string, newParent Node,
 	newName string) (err error) {
@@ -2407,6 +4538,27 @@ func (fbo *folderBranchOps) Rename(
 				return RenameAcrossDirsError{}
 			}
 
+			// Renaming over a hard link only drops that one name
+			// of the file.  TODO: do this in the same MD update as
+			// the rename itself.
+			removed, err := fbo.removeHardLinkTargetLocked(ctx, lState,
+				oldParentPath, oldName, newParentPath, newName)
+			if err != nil {
+				return err
+			}
+			if removed {
+				oldParentPath, err =
+					fbo.pathFromNodeForMDWriteLocked(lState, oldParent)
+				if err != nil {
+					return err
+				}
+				newParentPath, err =
+					fbo.pathFromNodeForMDWriteLocked(lState, newParent)
+				if err != nil {
+					return err
+				}
+			}
+
 			return fbo.renameLocked(ctx, lState, oldParentPath, oldName,
 				newParentPath, newName)
 		})
@@ -2451,6 +4603,51 @@ func (fbo *folderBranchOps) Read(
 	return bytesRead, nil
 }
 
+func (fbo *folderBranchOps) seek(
+	ctx context.Context, file Node, off int64, hole bool) (
+	newOff int64, err error) {
+	fbo.log.CDebugf(ctx, "Seek %p %d %t", file.GetID(), off, hole)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %d %v", newOff, err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return 0, err
+	}
+
+	var seekOff int64
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// verify we have permission to read
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		filePath, err := fbo.pathFromNodeForRead(file)
+		if err != nil {
+			return err
+		}
+
+		seekOff, err = fbo.blocks.Seek(ctx, lState, md, filePath, off, hole)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return seekOff, nil
+}
+
+func (fbo *folderBranchOps) SeekData(
+	ctx context.Context, file Node, off int64) (int64, error) {
+	return fbo.seek(ctx, file, off, false)
+}
+
+func (fbo *folderBranchOps) SeekHole(
+	ctx context.Context, file Node, off int64) (int64, error) {
+	return fbo.seek(ctx, file, off, true)
+}
+
 func (fbo *folderBranchOps) Write(
 	ctx context.Context, file Node, data []byte, off int64) (err error) {
 	fbo.log.CDebugf(ctx, "Write %p %d %d", file.GetID(), len(data), off)
@@ -2461,6 +4658,11 @@ func (fbo *folderBranchOps) Write(
 		return err
 	}
 
+	err = fbo.checkWritable()
+	if err != nil {
+		return err
+	}
+
 	return runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 
@@ -2482,6 +4684,40 @@ func (fbo *folderBranchOps) Write(
 	})
 }
 
+func (fbo *folderBranchOps) Append(
+	ctx context.Context, file Node, data []byte) (err error) {
+	fbo.log.CDebugf(ctx, "Append %p %d", file.GetID(), len(data))
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	err = fbo.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// As with Write, the MD is only read here.
+		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+
+		err = fbo.blocks.Append(ctx, lState, md, file, data)
+		if err != nil {
+			return err
+		}
+
+		fbo.status.addDirtyNode(file)
+		return nil
+	})
+}
+
 func (fbo *folderBranchOps) Truncate(
 	ctx context.Context, file Node, size uint64) (err error) {
 	fbo.log.CDebugf(ctx, "Truncate %p %d", file.GetID(), size)
@@ -2492,6 +4728,11 @@ func (fbo *folderBranchOps) Truncate(
 		return err
 	}
 
+	err = fbo.checkWritable()
+	if err != nil {
+		return err
+	}
+
 	return runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 
@@ -2613,25 +4854,232 @@ func (fbo *folderBranchOps) SetMtime(
 	fbo.log.CDebugf(ctx, "SetMtime %p %v", file.GetID(), mtime)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	if mtime == nil {
-		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
-		return nil
+	if mtime == nil {
+		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
+		return nil
+	}
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setMtimeLocked(ctx, lState, filePath, mtime)
+		})
+}
+
+func (fbo *folderBranchOps) setXattrLocked(
+	ctx context.Context, lState *lockState, file path, name string,
+	value []byte, remove bool) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if !file.hasValidParent() {
+		return InvalidParentPathError{file}
+	}
+
+	if len(name) > maxXattrNameBytes {
+		return XattrTooBigError{name, uint64(len(name)), maxXattrNameBytes}
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md, file)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := de.Xattrs[name]; remove && !ok {
+		return NoSuchXattrError{name}
+	}
+
+	// Never modify the existing map in place, since it may be shared
+	// with cached copies of the entry.
+	xattrs := make(map[string][]byte, len(de.Xattrs)+1)
+	var size uint64
+	for k, v := range de.Xattrs {
+		if k == name {
+			continue
+		}
+		xattrs[k] = v
+		size += uint64(len(k) + len(v))
+	}
+	if !remove {
+		size += uint64(len(name) + len(value))
+		if size > maxXattrBytes {
+			return XattrTooBigError{name, size, maxXattrBytes}
+		}
+		xattrs[name] = append([]byte(nil), value...)
+	}
+	if len(xattrs) == 0 {
+		xattrs = nil
+	}
+
+	parentPath := file.parentPath()
+	sao := newSetAttrOp(file.tailName(), parentPath.tailPointer(), xattrAttr,
+		file.tailPointer())
+	sao.XattrName = name
+	md.AddOp(sao)
+
+	de.Xattrs = xattrs
+	de.Ctime = fbo.nowUnixNano()
+	dblock.Children[file.tailName()] = de
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr)
+	return err
+}
+
+func (fbo *folderBranchOps) setOrRemoveXattr(
+	ctx context.Context, node Node, name string, value []byte,
+	remove bool) error {
+	err := fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			nodePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setXattrLocked(
+				ctx, lState, nodePath, name, value, remove)
+		})
+}
+
+func (fbo *folderBranchOps) SetXattr(
+	ctx context.Context, node Node, name string, value []byte) (err error) {
+	fbo.log.CDebugf(ctx, "SetXattr %p %s", node.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	return fbo.setOrRemoveXattr(ctx, node, name, value, false)
+}
+
+func (fbo *folderBranchOps) RemoveXattr(
+	ctx context.Context, node Node, name string) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveXattr %p %s", node.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	return fbo.setOrRemoveXattr(ctx, node, name, nil, true)
+}
+
+func (fbo *folderBranchOps) GetXattrs(ctx context.Context, node Node) (
+	xattrs map[string][]byte, err error) {
+	fbo.log.CDebugf(ctx, "GetXattrs %p", node.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	var de DirEntry
+	err = runUnlessCanceled(ctx, func() error {
+		de, err = fbo.statEntry(ctx, node)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs = make(map[string][]byte, len(de.Xattrs))
+	for k, v := range de.Xattrs {
+		xattrs[k] = append([]byte(nil), v...)
+	}
+	return xattrs, nil
+}
+
+func (fbo *folderBranchOps) LockFile(
+	ctx context.Context, file Node, lock FileLock) (err error) {
+	fbo.log.CDebugf(ctx, "LockFile %p owner=%d %d-%d exclusive=%t",
+		file.GetID(), lock.Owner, lock.Start, lock.End, lock.Exclusive)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return err
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		return fbo.fileLocks.Lock(ctx, file, filePath.tailName(), lock)
+	})
+}
+
+// fileLockID returns the ID that the MD server knows the advisory
+// locks on the given file by.  It's a hash of the file's path within
+// the folder, keyed with the folder's first crypt key, so the server
+// learns nothing about the file.  Unlike the file's block pointers,
+// the path doesn't change when the file is written, so every device
+// agrees on the ID whichever version of the file it has seen.  It
+// does change when the file is renamed.
+func (fbo *folderBranchOps) fileLockID(
+	ctx context.Context, file Node) (string, error) {
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNoIdentify(ctx, lState)
+	if err != nil {
+		return "", err
+	}
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return "", err
+	}
+	// Every device with access to the folder has the first key, and
+	// it never changes, unlike the latest one.
+	key, err := fbo.config.KeyManager().GetTLFCryptKeyForBlockDecryption(
+		ctx, md, BlockPointer{KeyGen: FirstValidKeyGen})
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(filePath.path)-1)
+	for _, node := range filePath.path[1:] {
+		names = append(names, node.Name)
+	}
+	return makeFileLockID(key, strings.Join(names, "/"))
+}
+
+func (fbo *folderBranchOps) UnlockFile(
+	ctx context.Context, file Node, owner uint64, start uint64,
+	end uint64) (err error) {
+	fbo.log.CDebugf(ctx, "UnlockFile %p owner=%d %d-%d",
+		file.GetID(), owner, start, end)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
 	}
 
+	// Don't look up the path, since this may be called after the
+	// file has been unlinked.
+	return runUnlessCanceled(ctx, func() error {
+		return fbo.fileLocks.Unlock(ctx, file, owner, start, end)
+	})
+}
+
+func (fbo *folderBranchOps) GetConflictingFileLock(
+	ctx context.Context, file Node, lock FileLock) (
+	conflict FileLock, ok bool, err error) {
 	err = fbo.checkNode(file)
 	if err != nil {
-		return
+		return FileLock{}, false, err
 	}
 
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
-			if err != nil {
-				return err
-			}
-
-			return fbo.setMtimeLocked(ctx, lState, filePath, mtime)
-		})
+	conflict, ok = fbo.fileLocks.GetConflict(file, lock)
+	return conflict, ok, nil
 }
 
 func (fbo *folderBranchOps) syncLocked(ctx context.Context,
@@ -2742,6 +5190,11 @@ func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) (err error) {
 	}()
 
 	var stillDirty bool
+	budget := fbo.config.DirtyBudget()
+	budget.SyncStarted(fbo.id(), file.GetID())
+	defer func() {
+		budget.SyncFinished(fbo.id(), file.GetID(), stillDirty, err)
+	}()
 	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
 			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
@@ -2750,7 +5203,15 @@ func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) (err error) {
 			}
 
 			stillDirty, err = fbo.syncLocked(ctx, lState, filePath)
-			return err
+			if err != nil {
+				return err
+			}
+			if ctx.Value(CtxBackgroundSyncKey) != nil ||
+				txFromContext(ctx) != nil {
+				return nil
+			}
+			// An explicit sync puts any batched changes right away.
+			return fbo.commitMDBatchLocked(ctx, lState)
 		})
 	if err != nil {
 		return err
@@ -2760,6 +5221,13 @@ func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) (err error) {
 		fbo.status.rmDirtyNode(file)
 	}
 
+	// The file's lock ID has changed along with its contents, so
+	// make sure other devices still see any locks held here.
+	if err := fbo.fileLocks.Renew(ctx, file); err != nil {
+		fbo.log.CWarningf(ctx, "Couldn't renew file locks after sync: %v",
+			err)
+	}
+
 	return nil
 }
 
@@ -2777,7 +5245,19 @@ func (fbo *folderBranchOps) FolderStatus(
 	// Wait for conflict resolution to settle down, if necessary.
 	fbo.cr.Wait(ctx)
 
-	return fbo.status.getStatus(ctx)
+	fbs, updateChan, err = fbo.status.getStatus(ctx)
+	if err != nil {
+		return FolderBranchStatus{}, nil, err
+	}
+	fbs.Disconnected = !fbo.config.MDServer().IsConnected()
+	if jServer, err := GetJournalServer(fbo.config); err == nil {
+		status, err := jServer.tlfStatus(fbo.id())
+		if err != nil {
+			return FolderBranchStatus{}, nil, err
+		}
+		fbs.Journal = &status
+	}
+	return fbs, updateChan, nil
 }
 
 func (fbo *folderBranchOps) Status(
@@ -2894,6 +5374,17 @@ func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
 			Node:       node,
 			DirUpdated: []string{realOp.NewName},
 		})
+	case *copyOp:
+		node := fbo.nodeCache.Get(realOp.Dir.Ref.ref())
+		if node == nil {
+			return
+		}
+		fbo.log.CDebugf(ctx, "notifyOneOp: copy %s in node %p",
+			realOp.NewName, node.GetID())
+		changes = append(changes, NodeChange{
+			Node:       node,
+			DirUpdated: []string{realOp.NewName},
+		})
 	case *rmOp:
 		node := fbo.nodeCache.Get(realOp.Dir.Ref.ref())
 		if node == nil {
@@ -2988,6 +5479,95 @@ func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
 				}
 			}
 		}
+	case *linkOp:
+		if realOp.NewName != "" {
+			if node := fbo.nodeCache.Get(realOp.Dir.Ref.ref()); node != nil {
+				changes = append(changes, NodeChange{
+					Node:       node,
+					DirUpdated: []string{realOp.NewName},
+				})
+			}
+		}
+		if realOp.OldName != "" {
+			oldDir := realOp.OldDir
+			if oldDir == (blockUpdate{}) {
+				oldDir = realOp.Dir
+			}
+			if node := fbo.nodeCache.Get(oldDir.Ref.ref()); node != nil {
+				changes = append(changes, NodeChange{
+					Node:       node,
+					DirUpdated: []string{realOp.OldName},
+				})
+			}
+		}
+		if realOp.Links == (blockUpdate{}) {
+			break
+		}
+
+		linksNode := fbo.nodeCache.Get(realOp.Links.Ref.ref())
+		if realOp.OldName != "" {
+			// The linked file now lives in the links directory, so
+			// its node must too.
+			if childNode :=
+				fbo.nodeCache.Get(realOp.Linked.ref()); childNode != nil {
+				if linksNode == nil {
+					var err error
+					linksNode, err =
+						fbo.searchForNode(ctx, realOp.Links.Ref, md)
+					if linksNode == nil {
+						fbo.log.CErrorf(ctx, "Couldn't find the links node: %v",
+							err)
+					}
+				}
+				if linksNode != nil {
+					fbo.log.CDebugf(ctx, "notifyOneOp: link %v from %s to %s",
+						realOp.Linked, realOp.OldName, realOp.LinkID)
+					err := fbo.nodeCache.Move(
+						realOp.Linked.ref(), linksNode, realOp.LinkID)
+					if err != nil {
+						fbo.log.CErrorf(ctx, "Couldn't move node in cache: %v",
+							err)
+						return
+					}
+				}
+			}
+		}
+		if linksNode != nil {
+			changes = append(changes, NodeChange{
+				Node:       linksNode,
+				DirUpdated: []string{realOp.LinkID},
+			})
+		}
+	case *unlinkOp:
+		if realOp.Dir != (blockUpdate{}) {
+			if node := fbo.nodeCache.Get(realOp.Dir.Ref.ref()); node != nil {
+				fbo.log.CDebugf(ctx, "notifyOneOp: unlink %s in node %p",
+					realOp.OldName, node.GetID())
+				changes = append(changes, NodeChange{
+					Node:       node,
+					DirUpdated: []string{realOp.OldName},
+				})
+			}
+		}
+		if realOp.Links == (blockUpdate{}) {
+			break
+		}
+		linksNode := fbo.nodeCache.Get(realOp.Links.Ref.ref())
+		if linksNode == nil {
+			break
+		}
+		changes = append(changes, NodeChange{
+			Node:       linksNode,
+			DirUpdated: []string{realOp.LinkID},
+		})
+		if realOp.removesFile() {
+			err := fbo.unlinkFromCache(
+				op, realOp.Links.Unref, linksNode, realOp.LinkID)
+			if err != nil {
+				fbo.log.CErrorf(ctx, "Couldn't unlink from cache: %v", err)
+				return
+			}
+		}
 	case *syncOp:
 		node := fbo.nodeCache.Get(realOp.File.Ref.ref())
 		if node == nil {
@@ -3097,13 +5677,30 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 	lState *lockState, rmds []*RootMetadata) error {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	// The updates can't be applied on top of local changes that
+	// aren't on the server; putting them first either makes the
+	// updates apply cleanly, or stages them for conflict
+	// resolution.  The changes of a transaction in progress are
+	// moved onto a branch instead.
+	if fbo.tx != nil {
+		if fbo.mdBatch != nil && !fbo.staged {
+			if err := fbo.stageTxIfBehindLocked(ctx, lState); err != nil {
+				return err
+			}
+		}
+	} else if err := fbo.commitMDBatchLocked(ctx, lState); err != nil {
+		return err
+	}
+
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
 
 	// if we have staged changes, ignore all updates until conflict
 	// resolution kicks in.  TODO: cache these for future use.
 	if fbo.staged {
-		if len(rmds) > 0 {
+		// A transaction in progress is resolved once it's
+		// committed.
+		if len(rmds) > 0 && fbo.tx == nil {
 			unmergedRev := MetadataRevisionUninitialized
 			if fbo.head != nil {
 				unmergedRev = fbo.head.Revision
@@ -3151,6 +5748,11 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 			fbo.notifyOneOpLocked(ctx, lState, op, rmd)
 		}
 	}
+	if fbo.tx != nil {
+		// The transaction hasn't changed anything yet, so an abort
+		// should keep these updates.
+		fbo.tx.base = fbo.head
+	}
 	return nil
 }
 
@@ -3583,6 +6185,10 @@ func (fbo *folderBranchOps) SyncFromServerForTesting(
 		return WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
+	if err := fbo.commitMDBatch(ctx); err != nil {
+		return err
+	}
+
 	lState := makeFBOLockState()
 
 	if fbo.getStaged(lState) {
@@ -3807,7 +6413,11 @@ func (fbo *folderBranchOps) backgroundFlusher(betweenFlushes time.Duration) {
 				if node == nil {
 					continue
 				}
-				err := fbo.Sync(longCtx, node)
+				syncCtx, ok := fbo.backgroundSyncCtx(longCtx, lState, node)
+				if !ok {
+					continue
+				}
+				err := fbo.Sync(syncCtx, node)
 				if err != nil {
 					// Just log the warning and keep trying to
 					// sync the rest of the dirty files.
@@ -3977,6 +6587,354 @@ func (fbo *folderBranchOps) GetUpdateHistory(ctx context.Context,
 	return history, nil
 }
 
+// GetRevisionDiff implements the KBFSOps interface for folderBranchOps
+func (fbo *folderBranchOps) GetRevisionDiff(ctx context.Context,
+	folderBranch FolderBranch, from, to MetadataRevision) (
+	diff RevisionDiff, err error) {
+	fbo.log.CDebugf(ctx, "GetRevisionDiff %d %d", from, to)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return RevisionDiff{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if from > to {
+		return RevisionDiff{}, InvalidRevisionRangeError{from, to}
+	}
+
+	lState := makeFBOLockState()
+	rmds, err := getMDRange(
+		ctx, fbo.config, fbo.id(), NullBranchID, from, to, Merged)
+	if err != nil {
+		return RevisionDiff{}, err
+	}
+	if len(rmds) == 0 || rmds[0].Revision != from {
+		return RevisionDiff{}, NoSuchRevisionError{from}
+	}
+	if rmds[len(rmds)-1].Revision != to {
+		return RevisionDiff{}, NoSuchRevisionError{to}
+	}
+	err = fbo.reembedBlockChanges(ctx, lState, rmds)
+	if err != nil {
+		return RevisionDiff{}, err
+	}
+
+	fromMD, toMD := rmds[0], rmds[len(rmds)-1]
+	chains, err := newCRChains(ctx, fbo.config, rmds[1:])
+	if err != nil {
+		return RevisionDiff{}, err
+	}
+
+	// Find the nodes of the chains in both revisions.  Only the
+	// directories in the chains can lead to them.
+	var originals, mostRecents []BlockPointer
+	oldPtrs := make(map[BlockPointer]bool)
+	newPtrs := make(map[BlockPointer]bool)
+	for original, chain := range chains.byOriginal {
+		originals = append(originals, original)
+		mostRecents = append(mostRecents, chain.mostRecent)
+		oldPtrs[original] = true
+		newPtrs[chain.mostRecent] = true
+	}
+	oldPaths, err := fbo.searchForPaths(ctx, fromMD, originals, oldPtrs)
+	if err != nil {
+		return RevisionDiff{}, err
+	}
+	newPaths, err := fbo.searchForPaths(ctx, toMD, mostRecents, newPtrs)
+	if err != nil {
+		return RevisionDiff{}, err
+	}
+
+	diff.ID = toMD.ID.String()
+	diff.Name = toMD.GetTlfHandle().GetCanonicalPath()
+	diff.From = from
+	diff.To = to
+	diff.Entries = chains.diffEntries(oldPaths, newPaths)
+	return diff, nil
+}
+
+// BeginTx implements the KBFSOps interface for folderBranchOps
+func (fbo *folderBranchOps) BeginTx(ctx context.Context,
+	folderBranch FolderBranch) (tx KBFSTx, err error) {
+	fbo.log.CDebugf(ctx, "BeginTx")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			if err := fbo.checkWritable(); err != nil {
+				return err
+			}
+			if fbo.staged {
+				return TxWhileStagedError{fbo.id()}
+			}
+
+			// Put any batched changes first, so that they aren't
+			// dropped if the transaction is aborted.
+			if err := fbo.commitMDBatchLocked(ctx, lState); err != nil {
+				return err
+			}
+			md, err := fbo.getMDLocked(ctx, lState, mdWrite)
+			if err != nil {
+				return err
+			}
+
+			newTx := &folderBranchTx{
+				fbo:      fbo,
+				base:     md,
+				done:     make(chan struct{}),
+				deadline: time.Now().Add(fbo.txLease),
+				files:    make(map[NodeID]Node),
+			}
+			newTx.timer = time.AfterFunc(fbo.txLease, func() {
+				fbo.abortExpiredTx(newTx)
+			})
+			fbo.tx = newTx
+			tx = newTx
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (fbo *folderBranchOps) endTxLocked(lState *lockState) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	fbo.tx.timer.Stop()
+	close(fbo.tx.done)
+	fbo.tx = nil
+}
+
+// commitTx puts all the changes of the given transaction, as one
+// new revision.
+func (fbo *folderBranchOps) commitTx(ctx context.Context,
+	tx *folderBranchTx) (err error) {
+	fbo.log.CDebugf(ctx, "Commit transaction")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	if fbo.tx != tx {
+		return TxDoneError{}
+	}
+
+	fbo.tx = nil
+	err = fbo.commitMDBatchLocked(ctx, lState)
+	fbo.tx = tx
+	if err != nil {
+		// The changes are still pending, so the transaction isn't
+		// over yet.
+		return err
+	}
+	fbo.endTxLocked(lState)
+	if tx.staged {
+		// The transaction was moved onto a branch while it was in
+		// progress, so now it can be resolved.
+		fbo.cr.Resolve(
+			fbo.getCurrMDRevision(lState), MetadataRevisionUninitialized)
+	}
+	return nil
+}
+
+// abortTx drops all the changes of the given transaction, or of the
+// transaction in progress if tx is nil.
+func (fbo *folderBranchOps) abortTx(ctx context.Context,
+	tx *folderBranchTx) (err error) {
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	if tx == nil {
+		if fbo.tx == nil {
+			return nil
+		}
+		tx = fbo.tx
+	} else if fbo.tx != tx {
+		return TxDoneError{}
+	}
+	return fbo.abortTxLocked(ctx, lState, tx)
+}
+
+// abortExpiredTx aborts the given transaction if it's still in
+// progress and hasn't had any changes for fbo.txLease.
+func (fbo *folderBranchOps) abortExpiredTx(tx *folderBranchTx) {
+	fbo.runUnlessShutdown(func(ctx context.Context) error {
+		lState := makeFBOLockState()
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+		if fbo.tx != tx {
+			return nil
+		}
+		if left := tx.deadline.Sub(time.Now()); left > 0 {
+			// The lease was renewed in the meantime.
+			tx.timer.Reset(left)
+			return nil
+		}
+		fbo.log.CDebugf(ctx, "Transaction lease expired")
+		return fbo.abortTxLocked(ctx, lState, tx)
+	})
+}
+
+// abortTxLocked drops all the changes of the given transaction, which
+// must be the one in progress.
+func (fbo *folderBranchOps) abortTxLocked(ctx context.Context,
+	lState *lockState, tx *folderBranchTx) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	fbo.log.CDebugf(ctx, "Abort transaction")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	// Writes that weren't synced into the batch yet are dropped
+	// too, rather than being put later as a revision of their own.
+	for _, file := range tx.files {
+		fbo.discardDirtyFileLocked(ctx, lState, file)
+	}
+
+	// The transaction is over even if its blocks can't be cleaned
+	// up.
+	err = fbo.undoMDBatchLocked(ctx, lState, tx.base)
+	fbo.endTxLocked(lState)
+	if err != nil {
+		return err
+	}
+
+	if tx.staged {
+		// The changes already moved onto a branch have to be
+		// undone too, which also catches up with the updates
+		// ignored since then.
+		return fbo.unstageLocked(ctx, lState)
+	}
+
+	// Catch up with any updates that couldn't be applied yet.
+	err = fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdatesLocked)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't apply updates after aborting "+
+			"the transaction: %v", err)
+	}
+	return nil
+}
+
+// writeInTx writes to the given file as part of the given
+// transaction.  The file is recorded in the transaction first, so
+// that an abort drops the write if it hasn't been synced yet, even
+// if the write was still waiting on the dirty budget at the time.
+func (fbo *folderBranchOps) writeInTx(ctx context.Context,
+	tx *folderBranchTx, file Node, data []byte, off int64) error {
+	lState := makeFBOLockState()
+	err := func() error {
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+		if fbo.tx != tx {
+			return TxDoneError{}
+		}
+		tx.files[file.GetID()] = file
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	err = fbo.Write(ctx, file, data, off)
+
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	if fbo.tx != tx {
+		// The transaction ended during the write, so nothing can
+		// sync the write into it anymore.
+		fbo.discardDirtyFileLocked(ctx, lState, file)
+		return TxDoneError{}
+	}
+	return err
+}
+
+// discardDirtyFileLocked drops the given file's writes that haven't
+// been synced yet.
+func (fbo *folderBranchOps) discardDirtyFileLocked(ctx context.Context,
+	lState *lockState, file Node) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	filePath := fbo.nodeCache.PathFromNode(file)
+	if !filePath.isValid() {
+		return
+	}
+	fbo.log.CDebugf(ctx, "Discarding unsynced writes to %v",
+		filePath.tailPointer())
+	fbo.blocks.DiscardDirtyFile(ctx, lState, filePath)
+	fbo.config.DirtyBudget().Discarded(fbo.id(), file.GetID())
+	fbo.status.rmDirtyNode(file)
+}
+
+// backgroundSyncCtx returns the context with which the background
+// flusher should sync the given file, and false if it can't be
+// synced right now.  A file written as part of the transaction in
+// progress is synced within it, so that writes to it that are
+// waiting on the dirty budget don't have to wait for the transaction
+// to end; other files have to wait, so they are skipped instead.
+func (fbo *folderBranchOps) backgroundSyncCtx(ctx context.Context,
+	lState *lockState, file Node) (context.Context, bool) {
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	if fbo.tx == nil {
+		return ctx, true
+	}
+	if _, ok := fbo.tx.files[file.GetID()]; !ok {
+		return nil, false
+	}
+	return context.WithValue(ctx, CtxTxKey, fbo.tx), true
+}
+
+// undoMDBatchLocked drops the pending batch of changes, if any, and
+// makes the given MD, which the batch started from, the head again.
+func (fbo *folderBranchOps) undoMDBatchLocked(ctx context.Context,
+	lState *lockState, base *RootMetadata) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	md := fbo.mdBatch
+	if md == nil {
+		return nil
+	}
+
+	err := func() error {
+		fbo.headLock.Lock(lState)
+		defer fbo.headLock.Unlock(lState)
+		defer fbo.stopMDBatchLocked(lState)
+		err := fbo.setHeadLocked(ctx, lState, base)
+		if err != nil {
+			return err
+		}
+		fbo.config.MDCache().Delete(md.ID, md.Revision, md.BID)
+
+		// iterate the ops in reverse and invert each one
+		ops := md.data.Changes.Ops
+		for j := len(ops) - 1; j >= 0; j-- {
+			fbo.notifyOneOpLocked(
+				ctx, lState, invertOpForLocalNotifications(ops[j]), base)
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	// The blocks of the batch were already put, but nothing will
+	// ever reference them.
+	var ptrs []BlockPointer
+	for _, op := range md.data.Changes.Ops {
+		for _, ptr := range op.Refs() {
+			if ptr != zeroPtr {
+				ptrs = append(ptrs, ptr)
+			}
+		}
+		for _, update := range op.AllUpdates() {
+			if update.Ref != zeroPtr {
+				ptrs = append(ptrs, update.Ref)
+			}
+		}
+	}
+	_, err = fbo.fbm.deleteBlockRefs(ctx, md, ptrs)
+	return err
+}
+
 // PushConnectionStatusChange pushes human readable connection status changes.
 func (fbo *folderBranchOps) PushConnectionStatusChange(service string, newStatus error) {
 	fbo.config.KBFSOps().PushConnectionStatusChange(service, newStatus)
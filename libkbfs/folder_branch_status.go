@@ -22,6 +22,14 @@ type FolderBranchStatus struct {
 	RekeyPending bool
 	FolderID     string
 
+	// Disconnected is true if the MD server can't be reached, in
+	// which case the folder is served from locally cached data, and
+	// is read-only unless writes are journaled.
+	Disconnected bool
+	// Journal describes the writes waiting to be flushed from the
+	// write journal, if writes are journaled.
+	Journal *TLFJournalStatus `json:",omitempty"`
+
 	// DirtyPaths are files that have been written, but not flushed.
 	// They do not represent unstaged changes in your local instance.
 	DirtyPaths []string
@@ -0,0 +1,142 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// CtxTxTagKey is the type used for the transaction tag within
+// folderBranchOps.
+type CtxTxTagKey int
+
+const (
+	// CtxTxKey is the type of the tag for the transaction that an
+	// operation is part of.
+	CtxTxKey CtxTxTagKey = iota
+)
+
+// txFromContext returns the transaction that the operation with the
+// given context is part of, if any.
+func txFromContext(ctx context.Context) *folderBranchTx {
+	tx, _ := ctx.Value(CtxTxKey).(*folderBranchTx)
+	return tx
+}
+
+// folderBranchTx implements the KBFSTx interface.  Its changes are
+// batched up by its folderBranchOps in a single revision, which isn't
+// put until the transaction is committed.
+type folderBranchTx struct {
+	fbo *folderBranchOps
+	// base is the head from before the transaction's pending
+	// changes, which becomes the head again if the transaction is
+	// aborted.  Protected by fbo.mdWriterLock.
+	base *RootMetadata
+	// staged is true once the transaction's changes have been
+	// moved onto a branch, to let updates from other devices in.
+	// Protected by fbo.mdWriterLock.
+	staged bool
+	// done is closed once the transaction is over.
+	done chan struct{}
+	// deadline is when the transaction is aborted, unless it
+	// changes something before then; timer fires at or before it.
+	// Protected by fbo.mdWriterLock.
+	deadline time.Time
+	timer    *time.Timer
+	// files holds the files written as part of the transaction,
+	// whose unsynced writes are dropped if it's aborted.  Protected
+	// by fbo.mdWriterLock.
+	files map[NodeID]Node
+}
+
+var _ KBFSTx = (*folderBranchTx)(nil)
+
+// ctx returns a context that marks operations as part of this
+// transaction, or a TxDoneError if the transaction is over.
+func (tx *folderBranchTx) ctx(ctx context.Context) (context.Context, error) {
+	select {
+	case <-tx.done:
+		return nil, TxDoneError{}
+	default:
+	}
+	return context.WithValue(ctx, CtxTxKey, tx), nil
+}
+
+// CreateDir implements the KBFSTx interface for folderBranchTx.
+func (tx *folderBranchTx) CreateDir(ctx context.Context, dir Node,
+	name string) (Node, EntryInfo, error) {
+	ctx, err := tx.ctx(ctx)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return tx.fbo.CreateDir(ctx, dir, name)
+}
+
+// CreateFile implements the KBFSTx interface for folderBranchTx.
+func (tx *folderBranchTx) CreateFile(ctx context.Context, dir Node,
+	name string, isExec bool) (Node, EntryInfo, error) {
+	ctx, err := tx.ctx(ctx)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return tx.fbo.CreateFile(ctx, dir, name, isExec)
+}
+
+// Write implements the KBFSTx interface for folderBranchTx.  The
+// write is synced right away, since syncs are what add file changes
+// to a revision.
+func (tx *folderBranchTx) Write(ctx context.Context, file Node,
+	data []byte, off int64) error {
+	ctx, err := tx.ctx(ctx)
+	if err != nil {
+		return err
+	}
+	if err := tx.fbo.writeInTx(ctx, tx, file, data, off); err != nil {
+		return err
+	}
+	return tx.fbo.Sync(ctx, file)
+}
+
+// RemoveDir implements the KBFSTx interface for folderBranchTx.
+func (tx *folderBranchTx) RemoveDir(ctx context.Context, dir Node,
+	dirName string) error {
+	ctx, err := tx.ctx(ctx)
+	if err != nil {
+		return err
+	}
+	return tx.fbo.RemoveDir(ctx, dir, dirName)
+}
+
+// RemoveEntry implements the KBFSTx interface for folderBranchTx.
+func (tx *folderBranchTx) RemoveEntry(ctx context.Context, dir Node,
+	name string) error {
+	ctx, err := tx.ctx(ctx)
+	if err != nil {
+		return err
+	}
+	return tx.fbo.RemoveEntry(ctx, dir, name)
+}
+
+// Rename implements the KBFSTx interface for folderBranchTx.
+func (tx *folderBranchTx) Rename(ctx context.Context, oldParent Node,
+	oldName string, newParent Node, newName string) error {
+	ctx, err := tx.ctx(ctx)
+	if err != nil {
+		return err
+	}
+	return tx.fbo.Rename(ctx, oldParent, oldName, newParent, newName)
+}
+
+// Commit implements the KBFSTx interface for folderBranchTx.
+func (tx *folderBranchTx) Commit(ctx context.Context) error {
+	return tx.fbo.commitTx(ctx, tx)
+}
+
+// Abort implements the KBFSTx interface for folderBranchTx.
+func (tx *folderBranchTx) Abort(ctx context.Context) error {
+	return tx.fbo.abortTx(ctx, tx)
+}
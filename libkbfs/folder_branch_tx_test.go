@@ -0,0 +1,487 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"golang.org/x/net/context"
+)
+
+func checkTxChildren(t *testing.T, ctx context.Context, config Config,
+	dir Node, expected ...string) {
+	children, err := config.KBFSOps().GetDirChildren(ctx, dir)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	var names []string
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sort.Strings(expected)
+	if len(names) != len(expected) {
+		t.Errorf("Got children %v, expected %v", names, expected)
+		return
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("Got children %v, expected %v", names, expected)
+			return
+		}
+	}
+}
+
+func TestKBFSTxCommit(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config1, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CheckConfigAndShutdown(t, config1)
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName)
+	defer CheckConfigAndShutdown(t, config2)
+
+	rootNode1 := GetRootNodeOrBust(t, config1, userName.String(), false)
+	kbfsOps1 := config1.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, userName.String(), false)
+	kbfsOps2 := config2.KBFSOps()
+	ops1 := getOps(config1, rootNode1.GetFolderBranch().Tlf)
+	startRev := ops1.getCurrMDRevision(makeFBOLockState())
+
+	tx, err := kbfsOps1.BeginTx(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't begin transaction: %v", err)
+	}
+	dirNode, _, err := tx.CreateDir(ctx, rootNode1, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	fileNode, _, err := tx.CreateFile(ctx, dirNode, "data", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := []byte("hello")
+	if err := tx.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if _, _, err := tx.CreateFile(ctx, rootNode1, "tmp", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = tx.Rename(ctx, rootNode1, "tmp", rootNode1, "manifest")
+	if err != nil {
+		t.Fatalf("Couldn't rename file: %v", err)
+	}
+
+	// The changes are visible locally, but not to other devices.
+	checkTxChildren(t, ctx, config1, rootNode1, "d", "manifest")
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	checkTxChildren(t, ctx, config2, rootNode2)
+
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Couldn't commit transaction: %v", err)
+	}
+	if rev := ops1.getCurrMDRevision(makeFBOLockState()); rev != startRev+1 {
+		t.Errorf("Transaction made revision %d, expected %d",
+			rev, startRev+1)
+	}
+	if _, _, err := tx.CreateFile(ctx, rootNode1, "x", false); err == nil {
+		t.Errorf("Transaction still usable after commit")
+	} else if _, ok := err.(TxDoneError); !ok {
+		t.Errorf("Unexpected error after commit: %v", err)
+	}
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	checkTxChildren(t, ctx, config2, rootNode2, "d", "manifest")
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	if err != nil {
+		t.Fatalf("Couldn't look up dir: %v", err)
+	}
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, dirNode2, "data")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := kbfsOps2.Read(ctx, fileNode2, buf, 0); err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("Read %q, expected %q", buf, data)
+	}
+}
+
+func TestKBFSTxAbort(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := []byte("hello")
+	if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	startRev := ops.getCurrMDRevision(makeFBOLockState())
+
+	tx, err := kbfsOps.BeginTx(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't begin transaction: %v", err)
+	}
+	if _, _, err := tx.CreateFile(ctx, rootNode, "b", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if err := tx.Write(ctx, fileNode, []byte("bye"), 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := tx.Rename(ctx, rootNode, "a", rootNode, "c"); err != nil {
+		t.Fatalf("Couldn't rename file: %v", err)
+	}
+	if err := tx.RemoveEntry(ctx, rootNode, "b"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+	checkTxChildren(t, ctx, config, rootNode, "c")
+
+	if err := tx.Abort(ctx); err != nil {
+		t.Fatalf("Couldn't abort transaction: %v", err)
+	}
+	if err := tx.Commit(ctx); err == nil {
+		t.Errorf("Committed an aborted transaction")
+	} else if _, ok := err.(TxDoneError); !ok {
+		t.Errorf("Unexpected error after abort: %v", err)
+	}
+	if rev := ops.getCurrMDRevision(makeFBOLockState()); rev != startRev {
+		t.Errorf("Revision is %d after abort, expected %d", rev, startRev)
+	}
+
+	// Everything is back to how it was, including the nodes.
+	checkTxChildren(t, ctx, config, rootNode, "a")
+	buf := make([]byte, len(data))
+	if _, err := kbfsOps.Read(ctx, fileNode, buf, 0); err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("Read %q, expected %q", buf, data)
+	}
+
+	// And the folder can still be written to.
+	if _, _, err := kbfsOps.CreateFile(ctx, rootNode, "d", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if rev := ops.getCurrMDRevision(makeFBOLockState()); rev != startRev+1 {
+		t.Errorf("Revision is %d after a new write, expected %d",
+			rev, startRev+1)
+	}
+}
+
+func TestKBFSTxOtherWritesWait(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	tx, err := kbfsOps.BeginTx(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't begin transaction: %v", err)
+	}
+	if _, _, err := tx.CreateFile(ctx, rootNode, "a", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false)
+		errChan <- err
+	}()
+	select {
+	case err := <-errChan:
+		t.Fatalf("Write wasn't blocked by the transaction: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if _, _, err := tx.CreateFile(ctx, rootNode, "c", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Couldn't commit transaction: %v", err)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	checkTxChildren(t, ctx, config, rootNode, "a", "b", "c")
+}
+
+func TestKBFSTxConflict(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+
+	tx, err := kbfsOps1.BeginTx(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't begin transaction: %v", err)
+	}
+	if _, _, err := tx.CreateFile(ctx, rootNode1, "a", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if _, _, err := kbfsOps2.CreateFile(ctx, rootNode2, "b", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// The commit conflicts with user 2's change, and gets resolved.
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Couldn't commit transaction: %v", err)
+	}
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	checkTxChildren(t, ctx, config1, rootNode1, "a", "b")
+	checkTxChildren(t, ctx, config2, rootNode2, "a", "b")
+}
+
+func TestKBFSTxLeaseExpires(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	ops.txLease = 10 * time.Millisecond
+
+	tx, err := kbfsOps.BeginTx(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't begin transaction: %v", err)
+	}
+	if _, _, err := tx.CreateFile(ctx, rootNode, "a", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// The abandoned transaction gets aborted, so other writes can
+	// go ahead.
+	select {
+	case <-tx.(*folderBranchTx).done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Transaction wasn't aborted")
+	}
+	if err := tx.Commit(ctx); err == nil {
+		t.Errorf("Committed an expired transaction")
+	} else if _, ok := err.(TxDoneError); !ok {
+		t.Errorf("Unexpected error committing: %v", err)
+	}
+	if _, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	checkTxChildren(t, ctx, config, rootNode, "b")
+}
+
+func TestKBFSTxStagedByUpdate(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	ops1 := getOps(config1, rootNode1.GetFolderBranch().Tlf)
+
+	for _, commit := range []bool{true, false} {
+		prefix := "abort-"
+		if commit {
+			prefix = "commit-"
+		}
+		tx, err := kbfsOps1.BeginTx(ctx, rootNode1.GetFolderBranch())
+		if err != nil {
+			t.Fatalf("Couldn't begin transaction: %v", err)
+		}
+		_, _, err = tx.CreateFile(ctx, rootNode1, prefix+"a", false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+		_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, prefix+"b", false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+
+		// The update moves the transaction onto a branch rather
+		// than waiting for it.
+		lState := makeFBOLockState()
+		err = ops1.getAndApplyMDUpdates(ctx, lState, ops1.applyMDUpdates)
+		if err == nil {
+			t.Errorf("Applied an update on top of the transaction")
+		}
+		if !ops1.getStaged(lState) {
+			t.Fatalf("Transaction wasn't moved onto a branch")
+		}
+		_, _, err = tx.CreateFile(ctx, rootNode1, prefix+"c", false)
+		if err != nil {
+			t.Fatalf("Couldn't create file on the branch: %v", err)
+		}
+
+		if commit {
+			err = tx.Commit(ctx)
+		} else {
+			err = tx.Abort(ctx)
+		}
+		if err != nil {
+			t.Fatalf("Couldn't end transaction: %v", err)
+		}
+		err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+		if err != nil {
+			t.Fatalf("Couldn't sync from server: %v", err)
+		}
+		err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+		if err != nil {
+			t.Fatalf("Couldn't sync from server: %v", err)
+		}
+	}
+	expected := []string{"commit-a", "commit-b", "commit-c", "abort-b"}
+	checkTxChildren(t, ctx, config1, rootNode1, expected...)
+	checkTxChildren(t, ctx, config2, rootNode2, expected...)
+}
+
+func TestKBFSTxAbortDropsUnsyncedWrites(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := []byte("hello")
+	if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	startRev := ops.getCurrMDRevision(makeFBOLockState())
+
+	tx, err := kbfsOps.BeginTx(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't begin transaction: %v", err)
+	}
+	// Write without syncing, as if the sync of a tx.Write failed.
+	fbtx := tx.(*folderBranchTx)
+	txCtx, err := fbtx.ctx(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get transaction context: %v", err)
+	}
+	err = ops.writeInTx(txCtx, fbtx, fileNode, []byte("bye"), 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := tx.Abort(ctx); err != nil {
+		t.Fatalf("Couldn't abort transaction: %v", err)
+	}
+
+	// Nothing is left for the background flusher to put.
+	lState := makeFBOLockState()
+	if ops.blocks.IsDirty(lState, ops.nodeCache.PathFromNode(fileNode)) {
+		t.Errorf("File still dirty after abort")
+	}
+	if refs := ops.blocks.GetDirtyRefs(lState); len(refs) != 0 {
+		t.Errorf("Dirty refs %v after abort", refs)
+	}
+	if rev := ops.getCurrMDRevision(lState); rev != startRev {
+		t.Errorf("Revision is %d after abort, expected %d", rev, startRev)
+	}
+	buf := make([]byte, len(data))
+	if _, err := kbfsOps.Read(ctx, fileNode, buf, 0); err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("Read %q, expected %q", buf, data)
+	}
+}
+
+func TestKBFSTxWriteOverDirtyBudget(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	// Only forced syncs, like those of writes over the budget.
+	go ops.backgroundFlusher(time.Hour)
+	const maxDirtyBytes = 64 << 10
+	config.SetDirtyBudget(NewDirtyBudgetStandard(
+		config, maxDirtyBytes, maxDirtyBytes, dirtyBudgetSyncTimeDefault))
+
+	tx, err := kbfsOps.BeginTx(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't begin transaction: %v", err)
+	}
+	fileNode, _, err := tx.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	// Fill up the budget with the transaction's own unsynced data.
+	fbtx := tx.(*folderBranchTx)
+	txCtx, err := fbtx.ctx(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get transaction context: %v", err)
+	}
+	data := make([]byte, maxDirtyBytes+1)
+	if err := ops.writeInTx(txCtx, fbtx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	// The next write has to wait for a sync, which happens within
+	// the transaction rather than after it.
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- tx.Write(ctx, fileNode, []byte{1}, int64(len(data)))
+	}()
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatalf("Couldn't write file: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Write stalled behind the transaction")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Couldn't commit transaction: %v", err)
+	}
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't stat file: %v", err)
+	}
+	if ei.Size != uint64(len(data)+1) {
+		t.Errorf("File size is %d, expected %d", ei.Size, len(data)+1)
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// fileLockLease is how long the MD server keeps a device's advisory
+// file lock before dropping it, unless the lock is renewed first.
+const fileLockLease = 1 * time.Minute
+
+// FileLock describes an advisory lock on a byte range of a file, held
+// by a single owner (for example, a process) on this device.
+type FileLock struct {
+	Owner uint64
+	// Start and End are the offsets of the first and last bytes in
+	// the locked range.
+	Start     uint64
+	End       uint64
+	Exclusive bool
+}
+
+func (l FileLock) overlaps(other FileLock) bool {
+	return l.Start <= other.End && other.Start <= l.End
+}
+
+func (l FileLock) conflictsWith(other FileLock) bool {
+	return l.Owner != other.Owner && l.overlaps(other) &&
+		(l.Exclusive || other.Exclusive)
+}
+
+// removeFileLockRange returns the given locks, minus the given range
+// for the given owner.  Locks that only partly overlap the range are
+// split.
+func removeFileLockRange(locks []FileLock, owner uint64,
+	start uint64, end uint64) []FileLock {
+	removed := FileLock{Owner: owner, Start: start, End: end}
+	var newLocks []FileLock
+	for _, l := range locks {
+		if l.Owner != owner || !l.overlaps(removed) {
+			newLocks = append(newLocks, l)
+			continue
+		}
+		if l.Start < start {
+			left := l
+			left.End = start - 1
+			newLocks = append(newLocks, left)
+		}
+		if l.End > end {
+			right := l
+			right.Start = end + 1
+			newLocks = append(newLocks, right)
+		}
+	}
+	return newLocks
+}
+
+type fileLockState struct {
+	// node keeps the locked file's node alive while it has locks.
+	node Node
+	// name is the file's name when it was first locked, for errors.
+	name string
+	// lockIDs are the IDs of this device's locks on the MD server
+	// for the file.  A file's lock ID changes whenever it's renamed,
+	// so it can pick up new ones while it's locked here; the old
+	// ones are kept until all the locks are released, for the sake
+	// of devices that haven't seen the rename yet.
+	lockIDs []string
+	locks   []FileLock
+	// exclusive is whether this device holds the lock on the MD
+	// server exclusively.
+	exclusive bool
+}
+
+func anyExclusiveFileLock(locks []FileLock) bool {
+	for _, l := range locks {
+		if l.Exclusive {
+			return true
+		}
+	}
+	return false
+}
+
+// addFileLockID returns lockIDs with lockID appended, if it isn't
+// there already, without modifying lockIDs itself.  It also returns
+// whether lockID was added.
+func addFileLockID(lockIDs []string, lockID string) ([]string, bool) {
+	for _, id := range lockIDs {
+		if id == lockID {
+			return lockIDs, false
+		}
+	}
+	newIDs := make([]string, len(lockIDs), len(lockIDs)+1)
+	copy(newIDs, lockIDs)
+	return append(newIDs, lockID), true
+}
+
+// folderFileLocks keeps track of the advisory file locks held by
+// owners on this device within a single folder.  Conflicts between
+// local owners are detected here at byte-range granularity; between
+// devices, the MD server only knows whether a device holds any shared
+// or exclusive lock on each file, and drops a device's lock when its
+// lease expires.  Locks held here are renewed in the background
+// until they're released.
+type folderFileLocks struct {
+	config       Config
+	log          logger.Logger
+	id           TlfID
+	shutdownChan <-chan struct{}
+	// getLockID returns the current ID of the given file's lock on
+	// the MD server.
+	getLockID func(ctx context.Context, node Node) (string, error)
+
+	// serverLock serializes all changes to this device's locks on
+	// the MD server.  It's held across MD server calls, and must be
+	// taken before lock.
+	serverLock sync.Mutex
+
+	// lock protects everything below, and is never held across MD
+	// server calls.
+	lock  sync.Mutex
+	files map[NodeID]*fileLockState
+	// renewing is whether the background renewal loop is running.
+	renewing bool
+	// unsupported is set once the MD server has said it doesn't
+	// support file locks, after which locks are only enforced
+	// between local owners.
+	unsupported bool
+}
+
+func newFolderFileLocks(config Config, log logger.Logger, id TlfID,
+	shutdownChan <-chan struct{},
+	getLockID func(context.Context, Node) (string, error)) *folderFileLocks {
+	return &folderFileLocks{
+		config:       config,
+		log:          log,
+		id:           id,
+		shutdownChan: shutdownChan,
+		getLockID:    getLockID,
+		files:        make(map[NodeID]*fileLockState),
+	}
+}
+
+// lockOnServer takes, renews or releases this device's lock on the
+// MD server under each of the given lock IDs of a file.
+// ffl.serverLock must be held by the caller.
+func (ffl *folderFileLocks) lockOnServer(ctx context.Context,
+	name string, lockIDs []string, exclusive bool, unlock bool) error {
+	ffl.lock.Lock()
+	unsupported := ffl.unsupported
+	ffl.lock.Unlock()
+	if unsupported {
+		return nil
+	}
+
+	for _, lockID := range lockIDs {
+		var err error
+		if unlock {
+			_, err = ffl.config.MDServer().FileUnlock(ctx, ffl.id, lockID)
+		} else {
+			_, err = ffl.config.MDServer().FileLock(
+				ctx, ffl.id, lockID, exclusive, fileLockLease)
+		}
+		switch err.(type) {
+		case nil:
+		case MDServerErrorLocked:
+			return FileLockedError{name}
+		case FileLocksUnsupportedError:
+			ffl.log.CDebugf(ctx, "File locks are only enforced locally: %v",
+				err)
+			ffl.lock.Lock()
+			ffl.unsupported = true
+			ffl.lock.Unlock()
+			return nil
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Lock takes the given lock on the given file, with the given name,
+// for the lock's owner, replacing any lock that owner already has on
+// the same range.
+func (ffl *folderFileLocks) Lock(ctx context.Context, node Node,
+	name string, lock FileLock) error {
+	lockID, err := ffl.getLockID(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	ffl.serverLock.Lock()
+	defer ffl.serverLock.Unlock()
+
+	ffl.lock.Lock()
+	state, ok := ffl.files[node.GetID()]
+	if !ok {
+		state = &fileLockState{node: node, name: name}
+	}
+	for _, l := range state.locks {
+		if lock.conflictsWith(l) {
+			ffl.lock.Unlock()
+			return FileLockedError{name}
+		}
+	}
+	ffl.lock.Unlock()
+
+	newLocks := append(removeFileLockRange(
+		state.locks, lock.Owner, lock.Start, lock.End), lock)
+	exclusive := anyExclusiveFileLock(newLocks)
+	lockIDs, added := addFileLockID(state.lockIDs, lockID)
+	if exclusive != state.exclusive {
+		err = ffl.lockOnServer(ctx, name, lockIDs, exclusive, false)
+	} else if added {
+		err = ffl.lockOnServer(ctx, name, []string{lockID}, exclusive, false)
+	}
+	if err != nil {
+		// Put back whatever was changed before the failure.
+		if added {
+			_ = ffl.lockOnServer(ctx, name, []string{lockID}, false, true)
+		}
+		if exclusive != state.exclusive && len(state.lockIDs) > 0 {
+			_ = ffl.lockOnServer(
+				ctx, name, state.lockIDs, state.exclusive, false)
+		}
+		return err
+	}
+
+	ffl.lock.Lock()
+	defer ffl.lock.Unlock()
+	state.locks = newLocks
+	state.lockIDs = lockIDs
+	state.exclusive = exclusive
+	ffl.files[node.GetID()] = state
+	if !ffl.renewing {
+		ffl.renewing = true
+		go ffl.renewLoop()
+	}
+	return nil
+}
+
+// Unlock releases the given owner's locks on the given range of the
+// given file.
+func (ffl *folderFileLocks) Unlock(ctx context.Context, node Node,
+	owner uint64, start uint64, end uint64) error {
+	ffl.serverLock.Lock()
+	defer ffl.serverLock.Unlock()
+
+	ffl.lock.Lock()
+	state, ok := ffl.files[node.GetID()]
+	ffl.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	newLocks := removeFileLockRange(state.locks, owner, start, end)
+	exclusive := anyExclusiveFileLock(newLocks)
+	if len(newLocks) == 0 {
+		err := ffl.lockOnServer(ctx, state.name, state.lockIDs, false, true)
+		if err != nil {
+			return err
+		}
+		ffl.lock.Lock()
+		defer ffl.lock.Unlock()
+		delete(ffl.files, node.GetID())
+		return nil
+	} else if exclusive != state.exclusive {
+		err := ffl.lockOnServer(
+			ctx, state.name, state.lockIDs, exclusive, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	ffl.lock.Lock()
+	defer ffl.lock.Unlock()
+	state.locks = newLocks
+	state.exclusive = exclusive
+	return nil
+}
+
+// GetConflict returns a lock held on this device that conflicts with
+// the given one, if there is one.
+func (ffl *folderFileLocks) GetConflict(node Node, lock FileLock) (
+	FileLock, bool) {
+	ffl.lock.Lock()
+	defer ffl.lock.Unlock()
+
+	state, ok := ffl.files[node.GetID()]
+	if !ok {
+		return FileLock{}, false
+	}
+	for _, l := range state.locks {
+		if lock.conflictsWith(l) {
+			return l, true
+		}
+	}
+	return FileLock{}, false
+}
+
+// Renew renews the server leases of this device's locks on the given
+// file, if it has any, and also takes the lock under the file's
+// current lock ID, in case the file has been renamed.
+func (ffl *folderFileLocks) Renew(ctx context.Context, node Node) error {
+	ffl.lock.Lock()
+	_, ok := ffl.files[node.GetID()]
+	ffl.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	lockID, err := ffl.getLockID(ctx, node)
+	if err != nil {
+		// The file may have been unlinked, so just renew the
+		// existing IDs.
+		ffl.log.CDebugf(ctx, "Couldn't get the current lock ID: %v", err)
+		lockID = ""
+	}
+
+	ffl.serverLock.Lock()
+	defer ffl.serverLock.Unlock()
+
+	ffl.lock.Lock()
+	state, ok := ffl.files[node.GetID()]
+	ffl.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	lockIDs := state.lockIDs
+	if lockID != "" {
+		lockIDs, _ = addFileLockID(lockIDs, lockID)
+	}
+	err = ffl.lockOnServer(ctx, state.name, lockIDs, state.exclusive, false)
+	if err != nil {
+		return err
+	}
+
+	ffl.lock.Lock()
+	defer ffl.lock.Unlock()
+	state.lockIDs = lockIDs
+	return nil
+}
+
+// renewLocks renews the server leases of all the locks held on this
+// device.  It returns false if there aren't any left to renew.
+func (ffl *folderFileLocks) renewLocks(ctx context.Context) bool {
+	ffl.lock.Lock()
+	if len(ffl.files) == 0 {
+		ffl.renewing = false
+		ffl.lock.Unlock()
+		return false
+	}
+	nodes := make([]Node, 0, len(ffl.files))
+	for _, state := range ffl.files {
+		nodes = append(nodes, state.node)
+	}
+	ffl.lock.Unlock()
+
+	for _, node := range nodes {
+		if err := ffl.Renew(ctx, node); err != nil {
+			ffl.log.CWarningf(ctx, "Couldn't renew the lock on %p: %v",
+				node.GetID(), err)
+		}
+	}
+	return true
+}
+
+func (ffl *folderFileLocks) renewLoop() {
+	ctx := ctxWithRandomID(context.Background(), CtxFBOIDKey, CtxFBOOpID,
+		ffl.log)
+	ticker := time.NewTicker(fileLockLease / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !ffl.renewLocks(ctx) {
+				return
+			}
+		case <-ffl.shutdownChan:
+			return
+		}
+	}
+}
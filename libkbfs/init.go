@@ -57,6 +57,60 @@ type InitParams struct {
 	// EnableSharingBeforeSignup if true, lets this client handle
 	// sharing before signup.
 	EnableSharingBeforeSignup bool
+
+	// ContentDefinedChunking if true, splits files into blocks at
+	// content-defined boundaries instead of at fixed offsets.
+	ContentDefinedChunking bool
+
+	// DiskBlockCacheMaxBytes is the maximum size of the on-disk
+	// cache of encrypted blocks. If zero, blocks are only cached
+	// in memory.
+	DiskBlockCacheMaxBytes int64
+
+	// ReadAheadBlocks is how many of the following blocks of a
+	// file to prefetch once the file is being read sequentially.
+	ReadAheadBlocks int
+
+	// DirPrefetch if true, prefetches the blocks of the
+	// subdirectories of a directory when it is listed.
+	DirPrefetch bool
+
+	// MaxParallelBlockPuts is the most block puts to run at once,
+	// across all folders.
+	MaxParallelBlockPuts int
+	// UploadBytesPerSecond limits the bandwidth of block puts. If
+	// zero, there is no limit.
+	UploadBytesPerSecond int64
+	// DownloadBytesPerSecond limits the bandwidth of block gets.
+	// If zero, there is no limit.
+	DownloadBytesPerSecond int64
+
+	// DirtyBudgetMinBytes and DirtyBudgetMaxBytes bound how much
+	// written data may be waiting to be synced before writers are
+	// slowed down.  Within those bounds, the budget is how much
+	// data the measured upload throughput can sync in
+	// DirtyBudgetSyncTime.  Writes block once DirtyBudgetMaxBytes
+	// of dirty data is held in memory.
+	DirtyBudgetMinBytes int64
+	DirtyBudgetMaxBytes int64
+	DirtyBudgetSyncTime time.Duration
+
+	// MDBatchWindow is how long local changes to a folder may be
+	// gathered into a single MD revision before it's put to the MD
+	// server.  If zero, each change gets its own revision.
+	MDBatchWindow time.Duration
+	// MDBatchBytes is how many bytes of new blocks a batch of
+	// changes may reference before it's put early.  If zero, only
+	// the window applies.
+	MDBatchBytes int64
+
+	// MergeTlfs are the canonical paths of the top-level folders
+	// in which conflicting changes to text files are merged,
+	// instead of being kept under different names.
+	MergeTlfs []string
+	// MergeMaxBytes is the size of the biggest file that gets
+	// merged in MergeTlfs.
+	MergeMaxBytes int64
 }
 
 var libkbOnce sync.Once
@@ -120,6 +174,24 @@ func AddFlags(flags *flag.FlagSet) *InitParams {
 	flags.StringVar(&params.ServerRootDir, "server-root", "", "directory to put local server files (and ignore -bserver and -mdserver)")
 	flags.StringVar(&params.LocalUser, "localuser", "", "fake local user (used only with -server-in-memory or -server-root)")
 	flags.DurationVar(&params.TLFValidDuration, "tlf-valid", tlfValidDurationDefault, "time tlfs are valid before redoing identification")
+	flags.BoolVar(&params.ContentDefinedChunking, "content-defined-chunking", false, "split files into blocks at content-defined boundaries")
+	params.DiskBlockCacheMaxBytes = 1024 * 1024 * 1024
+	flags.Var(SizeFlag{&params.DiskBlockCacheMaxBytes}, "disk-block-cache-max-size", "Maximum size of the on-disk block cache, or 0 to disable it")
+	flags.IntVar(&params.ReadAheadBlocks, "read-ahead-blocks", readAheadBlocksDefault, "number of blocks to prefetch ahead of sequential file reads, or 0 to disable read-ahead")
+	flags.BoolVar(&params.DirPrefetch, "dir-prefetch", false, "prefetch the subdirectories of listed directories")
+	flags.IntVar(&params.MaxParallelBlockPuts, "max-parallel-block-puts", maxParallelBlockPuts, "maximum number of block uploads to run at once")
+	flags.Var(SizeFlag{&params.UploadBytesPerSecond}, "upload-limit", "Maximum upload bandwidth per second, or 0 for no limit")
+	flags.Var(SizeFlag{&params.DownloadBytesPerSecond}, "download-limit", "Maximum download bandwidth per second, or 0 for no limit")
+	params.DirtyBudgetMinBytes = dirtyBudgetMinBytesDefault
+	flags.Var(SizeFlag{&params.DirtyBudgetMinBytes}, "dirty-budget-min", "Minimum amount of written data that may wait to be synced before writes are slowed down")
+	params.DirtyBudgetMaxBytes = dirtyBudgetMaxBytesDefault
+	flags.Var(SizeFlag{&params.DirtyBudgetMaxBytes}, "dirty-budget-max", "Maximum amount of written data that may wait to be synced before writes block")
+	flags.DurationVar(&params.DirtyBudgetSyncTime, "dirty-budget-sync-time", dirtyBudgetSyncTimeDefault, "how long syncing the written data that's waiting to be synced may take at the measured upload speed, before writes are slowed down")
+	flags.DurationVar(&params.MDBatchWindow, "md-batch-window", 0, "how long to gather local changes to a folder into a single revision, or 0 to put each change right away")
+	flags.Var(SizeFlag{&params.MDBatchBytes}, "md-batch-max-size", "Maximum size of the new blocks referenced by a batch of changes before it's put early, or 0 for no limit")
+	flags.Var(StringListFlag{&params.MergeTlfs}, "merge-tlf", "canonical path of a folder (like /keybase/private/alice,bob) in which to merge conflicting changes to text files; may be given more than once")
+	params.MergeMaxBytes = mergeMaxBytesDefault
+	flags.Var(SizeFlag{&params.MergeMaxBytes}, "merge-max-size", "Maximum size of a text file whose conflicting changes are merged in the -merge-tlf folders")
 	flags.BoolVar(&params.LogToFile, "log-to-file", false, fmt.Sprintf("Log to default file: %s", defaultLogPath()))
 	flags.StringVar(&params.LogFileConfig.Path, "log-file", "", "Path to log file")
 	flags.DurationVar(&params.LogFileConfig.MaxAge, "log-file-max-age", 30*24*time.Hour, "Maximum age of a log file before rotation")
@@ -206,6 +278,55 @@ func makeBlockServer(config Config, serverInMemory bool, serverRootDir, bserverA
 	return NewBlockServerRemote(config, bserverAddr), nil
 }
 
+func makeDiskBlockCache(config Config, serverInMemory bool, serverRootDir string, maxBytes int64) (
+	DiskBlockCache, error) {
+	if serverInMemory {
+		// Blocks from an in-memory server don't outlive the process.
+		return nil, nil
+	}
+
+	// Keep blocks from local servers apart from the ones from the
+	// real block server.
+	cacheDir := libkb.G.Env.GetCacheDir()
+	if len(serverRootDir) > 0 {
+		cacheDir = serverRootDir
+	}
+	return NewDiskBlockCacheStandard(
+		config, filepath.Join(cacheDir, "kbfs_block_cache"), maxBytes)
+}
+
+func makeDiskMDCache(config Config, serverInMemory bool, serverRootDir string) (
+	DiskMDCache, error) {
+	if serverInMemory {
+		// Folders on an in-memory server don't outlive the process.
+		return nil, nil
+	}
+
+	cacheDir := libkb.G.Env.GetCacheDir()
+	if len(serverRootDir) > 0 {
+		cacheDir = serverRootDir
+	}
+	return NewDiskMDCacheStandard(
+		config, filepath.Join(cacheDir, "kbfs_md_cache"))
+}
+
+func makeJournalServer(config Config, serverInMemory bool, serverRootDir string) (
+	*JournalServer, error) {
+	if serverInMemory {
+		// There's nothing to journal for an in-memory server.
+		return nil, nil
+	}
+
+	// Unlike the caches, the journal holds data that exists nowhere
+	// else, so keep it out of the cache directory.
+	dataDir := libkb.G.Env.GetDataDir()
+	if len(serverRootDir) > 0 {
+		dataDir = serverRootDir
+	}
+	return NewJournalServer(config, filepath.Join(dataDir, "kbfs_journal"),
+		config.BlockServer(), config.MDServer())
+}
+
 func makeKeybaseDaemon(config Config, serverInMemory bool, serverRootDir string, localUser libkb.NormalizedUsername, codec Codec, log logger.Logger, debug bool) (KeybaseDaemon, error) {
 	if len(localUser) == 0 {
 		libkb.G.ConfigureSocketInfo()
@@ -334,7 +455,34 @@ func Init(params InitParams, onInterruptFn func(), log logger.Logger) (Config, e
 	if err != nil {
 		return nil, err
 	}
-	config.SetBlockSplitter(bsplitter)
+	err = bsplitter.SetMaxDirEntriesByBlockSize(
+		config.Codec(), config.MaxNameBytes())
+	if err != nil {
+		return nil, err
+	}
+	if params.ContentDefinedChunking {
+		config.SetBlockSplitter(
+			newBlockSplitterCDC(bsplitter))
+	} else {
+		config.SetBlockSplitter(bsplitter)
+	}
+
+	config.SetReadAheadBlocks(params.ReadAheadBlocks)
+	config.SetDoDirPrefetch(params.DirPrefetch)
+	config.SetTransferScheduler(NewTransferSchedulerStandard(
+		config, params.MaxParallelBlockPuts, params.UploadBytesPerSecond,
+		params.DownloadBytesPerSecond))
+	config.SetDirtyBudget(NewDirtyBudgetStandard(
+		config, params.DirtyBudgetMinBytes, params.DirtyBudgetMaxBytes,
+		params.DirtyBudgetSyncTime))
+	config.SetMDBatching(params.MDBatchWindow, uint64(params.MDBatchBytes))
+	if len(params.MergeTlfs) > 0 {
+		merger := NewContentMergerStandard()
+		for _, tlfPath := range params.MergeTlfs {
+			merger.EnableForTlf(tlfPath, uint64(params.MergeMaxBytes))
+		}
+		config.SetContentMerger(merger)
+	}
 
 	if registry := config.MetricsRegistry(); registry != nil {
 		keyCache := config.KeyCache()
@@ -423,6 +571,36 @@ func Init(params InitParams, onInterruptFn func(), log logger.Logger) (Config, e
 
 	config.SetBlockServer(bserv)
 
+	if params.DiskBlockCacheMaxBytes > 0 {
+		dbcache, err := makeDiskBlockCache(config, params.ServerInMemory, params.ServerRootDir, params.DiskBlockCacheMaxBytes)
+		if err != nil {
+			// Another instance may have the cache open; just
+			// run without it.
+			log.Warning("Couldn't open the disk block cache: %v", err)
+		} else if dbcache != nil {
+			config.SetDiskBlockCache(dbcache)
+		}
+	}
+
+	dmcache, err := makeDiskMDCache(config, params.ServerInMemory, params.ServerRootDir)
+	if err != nil {
+		// Folders just won't be readable while disconnected.
+		log.Warning("Couldn't open the disk MD cache: %v", err)
+	} else if dmcache != nil {
+		config.SetDiskMDCache(dmcache)
+	}
+
+	// The key server has to be set up before the MD server gets
+	// wrapped, since they're currently the same object.
+	jServer, err := makeJournalServer(config, params.ServerInMemory, params.ServerRootDir)
+	if err != nil {
+		// Folders will just be read-only while disconnected.
+		log.Warning("Couldn't open the write journal: %v", err)
+	} else if jServer != nil {
+		config.SetBlockServer(jServer.blockServer())
+		config.SetMDServer(jServer.mdServer())
+	}
+
 	return config, nil
 }
 
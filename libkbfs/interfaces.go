@@ -128,6 +128,31 @@ type KBFSOps interface {
 	GetOrCreateRootNode(
 		ctx context.Context, h *TlfHandle, branch BranchName) (
 		node Node, ei EntryInfo, err error)
+	// GetRootNodeAtRevision returns the root node and root entry
+	// info of the given TLF as of the given merged revision, if the
+	// logged-in user has read permissions to the top-level folder.
+	// All nodes under the returned root are read-only, and stay
+	// pinned to that revision.  Until the caller calls
+	// ReleaseRevision, quota reclamation on this device won't
+	// delete any blocks the revision still needs.  This is a
+	// remote-access operation.
+	GetRootNodeAtRevision(
+		ctx context.Context, h *TlfHandle, rev MetadataRevision) (
+		node Node, ei EntryInfo, err error)
+	// ReleaseRevision undoes one successful call to
+	// GetRootNodeAtRevision, given the folder branch of the root
+	// node it returned.  Once every such call is undone, quota
+	// reclamation may delete the revision's blocks again, and the
+	// nodes under that root can no longer be used.
+	ReleaseRevision(ctx context.Context, folderBranch FolderBranch) error
+	// GetRevisionAtTime returns the latest merged revision of the
+	// given TLF that the MD server received at or before the given
+	// server time, if the logged-in user has read permissions to the
+	// top-level folder.  The revision can then be viewed with
+	// GetRootNodeAtRevision.  This is a remote-access operation.
+	GetRevisionAtTime(
+		ctx context.Context, h *TlfHandle, serverTime time.Time) (
+		MetadataRevision, error)
 	// GetDirChildren returns a map of children in the directory,
 	// mapped to their EntryInfo, if the logged-in user has read
 	// permission for the top-level folder.  This is a remote-access
@@ -160,6 +185,60 @@ type KBFSOps interface {
 	// is a remote-sync operation.
 	CreateLink(ctx context.Context, dir Node, fromName string, toPath string) (
 		EntryInfo, error)
+	// CreateHardLink gives the file represented by the given node
+	// an additional name under dir, if the logged-in user has write
+	// permission to the top-level folder.  Both must be in the same
+	// top-level folder.  The file's data is kept until its last name
+	// is removed.  Returns the file's updated entry info.  This is a
+	// remote-sync operation.
+	CreateHardLink(ctx context.Context, dir Node, name string, file Node) (
+		EntryInfo, error)
+	// CopyFile makes a copy of the file represented by the given
+	// node under dir, if the logged-in user has write permission to
+	// the top-level folder.  Both must be in the same top-level
+	// folder.  Instead of uploading the data again, the copy gets new
+	// references to the original file's blocks.  If dir already has
+	// an empty file with the given name, that file gets the copied
+	// contents instead.  Returns the copy's node and entry info.
+	// This is a remote-sync operation.
+	CopyFile(ctx context.Context, file Node, dir Node, name string) (
+		Node, EntryInfo, error)
+	// GetDeletedEntries returns the entries recently removed from
+	// the given top-level folder that can still be restored, with
+	// the most recently removed ones first.  Entries removed from a
+	// directory just before the directory itself (like with `rm
+	// -rf`) are only listed as part of that directory.  Entries
+	// removed before the folder's latest quota reclamation are gone
+	// for good, and aren't listed.  This is a remote-access
+	// operation.
+	GetDeletedEntries(ctx context.Context, folderBranch FolderBranch) (
+		[]DeletedEntry, error)
+	// RestoreDeletedEntry restores the given removed entry, along
+	// with everything under it, as name under dir, if the logged-in
+	// user has write permission to the top-level folder.  Like with
+	// CopyFile, the restored entry gets new references to the
+	// original blocks, and so it must be restored within the same
+	// top-level folder.  Hard links under a restored directory come
+	// back as separate copies of their files.  Returns the restored
+	// entry's node and entry info.  This is a remote-sync operation.
+	RestoreDeletedEntry(ctx context.Context, entry DeletedEntry, dir Node,
+		name string) (Node, EntryInfo, error)
+	// GetFileHistory returns the merged revisions in which the given
+	// file was written to, had its attributes changed or was
+	// renamed, most recent first.  The history goes back to the
+	// file's creation or to the folder's latest quota reclamation,
+	// whichever came last.  Like GetUpdateHistory, this is an
+	// expensive operation, and doesn't include any unmerged
+	// changes.  This is a remote-access operation.
+	GetFileHistory(ctx context.Context, file Node) ([]FileVersion, error)
+	// RestoreFileVersion makes the contents of the given file what
+	// they were as of the given merged revision, by writing them to
+	// the file and syncing it, if the logged-in user has write
+	// permission to the top-level folder.  Returns
+	// NoSuchFileVersionError if the file's history doesn't go back
+	// that far.  This is a remote-sync operation.
+	RestoreFileVersion(ctx context.Context, file Node,
+		rev MetadataRevision) error
 	// RemoveDir removes the subdirectory represented by the given
 	// node, if the logged-in user has write permission to the
 	// top-level folder.  Will return an error if the subdirectory is
@@ -171,8 +250,12 @@ type KBFSOps interface {
 	RemoveEntry(ctx context.Context, dir Node, name string) error
 	// Rename performs an atomic rename operation with a given
 	// top-level folder if the logged-in user has write permission to
-	// that folder, and will return an error if nodes from different
-	// folders are passed in.  Also returns an error if the new name
+	// that folder.  If nodes from different top-level folders are
+	// passed in, the entry is moved by re-encrypting its blocks for
+	// the new folder, and is only removed from the old folder once
+	// the new one has been updated; this returns a
+	// RenameAcrossDirsError if the new name already exists or the
+	// entry can't be moved.  Also returns an error if the new name
 	// already has an entry corresponding to an existing directory
 	// (only non-dir types may be renamed over).  This is a
 	// remote-sync operation.
@@ -201,6 +284,15 @@ type KBFSOps interface {
 	// the necessary blocks have been locally cached.  This is a
 	// remote-access operation.
 	Write(ctx context.Context, file Node, data []byte, off int64) error
+	// Append modifies the file at the given node, by writing the
+	// given buffer at the end of the file, as of when the write
+	// happens, if the logged-in user has write permission to the
+	// top-level folder.  Unlike writes at an offset, appends to the
+	// same file from different devices are merged rather than
+	// treated as a conflict, as long as neither device also
+	// overwrote or truncated the file.  This is a remote-access
+	// operation.
+	Append(ctx context.Context, file Node, data []byte) error
 	// Truncate modifies the file at the given node, by either
 	// shrinking or extending its size to match the given size, if the
 	// logged-in user has write permission to the top-level folder.
@@ -209,6 +301,18 @@ type KBFSOps interface {
 	// on whether or not the necessary blocks have been locally
 	// cached.  This is a remote-access operation.
 	Truncate(ctx context.Context, file Node, size uint64) error
+	// SeekData returns the offset of the first byte at or after off
+	// in the given file that isn't part of a hole.  It returns
+	// NoDataAfterOffsetError if off is at or past the end of the
+	// file, or if only a hole remains after it, like SEEK_DATA.
+	// This is a remote-access operation.
+	SeekData(ctx context.Context, file Node, off int64) (int64, error)
+	// SeekHole returns the offset of the start of the first hole at
+	// or after off in the given file, where the end of the file
+	// counts as a hole.  It returns NoDataAfterOffsetError if off is
+	// at or past the end of the file, like SEEK_HOLE.  This is a
+	// remote-access operation.
+	SeekHole(ctx context.Context, file Node, off int64) (int64, error)
 	// SetEx turns on or off the executable bit on the file
 	// represented by a given node, if the logged-in user has write
 	// permissions to the top-level folder.  This is a remote-sync
@@ -219,6 +323,38 @@ type KBFSOps interface {
 	// the top-level folder.  If mtime is nil, it is a noop.  This is
 	// a remote-sync operation.
 	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	// GetXattrs returns the extended attributes of the given node,
+	// by name.  The returned map is a copy that the caller may
+	// modify.
+	GetXattrs(ctx context.Context, node Node) (map[string][]byte, error)
+	// SetXattr sets the named extended attribute of the given
+	// node, replacing any existing value.  The attributes of an
+	// entry are limited in total size, and setting one that would
+	// exceed the limit returns an XattrTooBigError.
+	SetXattr(ctx context.Context, node Node, name string, value []byte) error
+	// RemoveXattr removes the named extended attribute of the given
+	// node, or returns a NoSuchXattrError if the node doesn't have
+	// it.
+	RemoveXattr(ctx context.Context, node Node, name string) error
+	// LockFile takes an advisory lock on a byte range of the given
+	// file for lock.Owner, replacing any lock the owner already has
+	// on that range.  Locks held by different owners conflict if
+	// their ranges overlap and either is exclusive.  Other devices
+	// only see whether this device has any shared or exclusive lock
+	// on the file at all, and only if the MD server supports file
+	// locks; otherwise locks are only enforced on this device.  If a
+	// conflicting lock is held, returns a FileLockedError.  This is
+	// a remote-access operation.
+	LockFile(ctx context.Context, file Node, lock FileLock) error
+	// UnlockFile releases the given owner's advisory locks on the
+	// byte range from start to end, inclusive, of the given file.
+	// This is a remote-access operation.
+	UnlockFile(ctx context.Context, file Node, owner uint64,
+		start uint64, end uint64) error
+	// GetConflictingFileLock returns an advisory lock held on this
+	// device that conflicts with the given one, if any.
+	GetConflictingFileLock(ctx context.Context, file Node, lock FileLock) (
+		conflict FileLock, ok bool, err error)
 	// Sync flushes all outstanding writes and truncates for the given
 	// file to the KBFS servers, if the logged-in user has write
 	// permissions to the top-level folder.  If done through a file
@@ -258,6 +394,25 @@ type KBFSOps interface {
 	// outstanding writes from the local device.
 	GetUpdateHistory(ctx context.Context, folderBranch FolderBranch) (
 		history TLFUpdateHistory, err error)
+	// GetRevisionDiff returns the paths of the given folder that
+	// were added, removed, renamed or modified between the merged
+	// revisions from and to, sorted by path.  Changes that were
+	// undone within the range, like a file that was created and
+	// then removed, aren't included.  This is a remote-access
+	// operation.
+	GetRevisionDiff(ctx context.Context, folderBranch FolderBranch,
+		from, to MetadataRevision) (RevisionDiff, error)
+	// BeginTx starts a transaction on the given folder-branch.  The
+	// changes made through the returned KBFSTx are only put to the
+	// KBFS servers, all together in one new revision, when it's
+	// committed.  Other changes to the folder-branch wait until the
+	// transaction is over, so it should be kept short; it's
+	// aborted automatically if it goes a minute without any
+	// changes.  Updates from other devices that arrive during the
+	// transaction move its changes onto a branch, which is
+	// resolved once it's committed.  This is a remote-access
+	// operation.
+	BeginTx(ctx context.Context, folderBranch FolderBranch) (KBFSTx, error)
 	// Shutdown is called to clean up any resources associated with
 	// this KBFSOps instance.
 	Shutdown() error
@@ -266,6 +421,41 @@ type KBFSOps interface {
 	PushConnectionStatusChange(service string, newStatus error)
 }
 
+// KBFSTx is a transaction on a single folder-branch, started by
+// KBFSOps.BeginTx.  Its methods behave like the KBFSOps ones of the
+// same name, except that their changes are only seen by other
+// devices once the transaction is committed.  Once it's committed
+// or aborted, all of its methods return a TxDoneError.
+type KBFSTx interface {
+	// CreateDir creates a new subdirectory under the given node.
+	CreateDir(ctx context.Context, dir Node, name string) (
+		Node, EntryInfo, error)
+	// CreateFile creates a new file under the given node.
+	CreateFile(ctx context.Context, dir Node, name string, isExec bool) (
+		Node, EntryInfo, error)
+	// Write modifies the file at the given node, by writing the
+	// given buffer at the given offset within the file.
+	Write(ctx context.Context, file Node, data []byte, off int64) error
+	// RemoveDir removes the subdirectory with the given name from
+	// the given directory node.
+	RemoveDir(ctx context.Context, dir Node, dirName string) error
+	// RemoveEntry removes the entry with the given name from the
+	// given directory node.
+	RemoveEntry(ctx context.Context, dir Node, name string) error
+	// Rename moves an entry within the folder-branch.
+	Rename(ctx context.Context, oldParent Node, oldName string,
+		newParent Node, newName string) error
+	// Commit puts all the changes of the transaction to the KBFS
+	// servers in one new revision.  If another device changed the
+	// folder in the meantime, they go through conflict resolution
+	// like any other unmerged changes, and are merged in one
+	// revision by it.  If the put fails, the
+	// transaction is still in progress and Commit may be retried.
+	Commit(ctx context.Context) error
+	// Abort drops all the changes of the transaction.
+	Abort(ctx context.Context) error
+}
+
 // KeybaseDaemon is an interface for communicating with the local
 // Keybase daemon.
 type KeybaseDaemon interface {
@@ -465,6 +655,9 @@ type MDCache interface {
 	Get(tlf TlfID, rev MetadataRevision, bid BranchID) (*RootMetadata, error)
 	// Put stores the metadata object.
 	Put(md *RootMetadata) error
+	// Delete removes the metadata object associated with the given
+	// TlfID, revision number, and branch ID, if there is one.
+	Delete(tlf TlfID, rev MetadataRevision, bid BranchID)
 }
 
 // KeyCache handles caching for both TLFCryptKeys and BlockCryptKeys.
@@ -539,6 +732,52 @@ type BlockCache interface {
 	// modifying the size of the dirty blocks outside of the cache
 	// while this is being called.
 	DirtyBytesEstimate() uint64
+	// TransientCapacity returns the number of transient entries
+	// the cache can hold, or 0 if it doesn't hold transient
+	// entries at all.
+	TransientCapacity() int
+}
+
+// DiskBlockCache caches encrypted blocks on local disk, so they
+// survive restarts.  It sits below BlockCache: blocks that aren't in
+// the BlockCache are looked for here before being fetched from the
+// block server.
+type DiskBlockCache interface {
+	// Get returns the encrypted data and key server half of the
+	// block with the given ID, or NoSuchBlockError if it isn't
+	// cached.
+	Get(ctx context.Context, id BlockID) (
+		[]byte, BlockCryptKeyServerHalf, error)
+	// Put stores the encrypted data and key server half of the
+	// block with the given ID, possibly evicting other blocks.
+	Put(ctx context.Context, id BlockID, buf []byte,
+		serverHalf BlockCryptKeyServerHalf) error
+	// Delete removes the blocks with the given IDs from the cache.
+	// No error is returned for IDs that aren't cached.
+	Delete(ctx context.Context, ids []BlockID) error
+	// Shutdown closes the cache.
+	Shutdown()
+}
+
+// DiskMDCache persists the latest merged head of each TLF, along
+// with what's needed to read it, so that TLFs can still be read
+// while the MD server can't be reached.
+type DiskMDCache interface {
+	// Get returns the persisted head for the given TLF, ready to be
+	// read, or nil if there isn't one.  The keys persisted with the
+	// head are put into the KeyCache.
+	Get(ctx context.Context, id TlfID) (*RootMetadata, error)
+	// GetForHandle is like Get, but looks the TLF up by its
+	// handle.
+	GetForHandle(ctx context.Context, handle *TlfHandle) (
+		*RootMetadata, error)
+	// Put persists the given merged MD as the head of its TLF,
+	// along with those of its TLF crypt keys that are in the
+	// KeyCache.  It does nothing if a newer head is already
+	// persisted.
+	Put(ctx context.Context, md *RootMetadata) error
+	// Shutdown closes the cache.
+	Shutdown()
 }
 
 // Crypto signs, verifies, encrypts, and decrypts stuff.
@@ -641,16 +880,21 @@ type Crypto interface {
 	// DecryptPrivateMetadata decrypts a PrivateMetadata object.
 	DecryptPrivateMetadata(encryptedPMD EncryptedPrivateMetadata, key TLFCryptKey) (*PrivateMetadata, error)
 
-	// EncryptBlocks encrypts a block. plainSize is the size of the encoded
-	// block; EncryptBlock() must guarantee that plainSize <=
-	// len(encryptedBlock).
-	EncryptBlock(block Block, key BlockCryptKey) (
+	// EncryptBlocks encrypts a block, compressing it first if that
+	// makes it smaller and its encoding is no bigger than maxSize.
+	// plainSize is the size of the encoded block before compression;
+	// unless the block was compressed, EncryptBlock() must guarantee
+	// that plainSize <= len(encryptedBlock).
+	EncryptBlock(block Block, key BlockCryptKey, maxSize int) (
 		plainSize int, encryptedBlock EncryptedBlock, err error)
 
 	// DecryptBlock decrypts a block. Similar to EncryptBlock(),
 	// DecryptBlock() must guarantee that (size of the decrypted
-	// block) <= len(encryptedBlock).
-	DecryptBlock(encryptedBlock EncryptedBlock, key BlockCryptKey, block Block) error
+	// block) <= len(encryptedBlock), unless the block was
+	// compressed, in which case it must fail if the block
+	// decompresses to more than maxSize bytes.
+	DecryptBlock(encryptedBlock EncryptedBlock, key BlockCryptKey,
+		maxSize int, block Block) error
 
 	// EncryptMerkleLeaf encrypts a Merkle leaf node with the TLFPublicKey.
 	EncryptMerkleLeaf(leaf MerkleLeaf, pubKey TLFPublicKey, nonce *[24]byte,
@@ -726,6 +970,14 @@ type MDOps interface {
 	GetUnmergedRange(ctx context.Context, id TlfID, bid BranchID,
 		start, stop MetadataRevision) ([]*RootMetadata, error)
 
+	// GetForTLFByTime returns the latest merged metadata object for
+	// the given top-level folder that the MD server received at or
+	// before the given server time.  It returns a
+	// NoRevisionAtTimeError if the folder had no revisions yet at
+	// that time.
+	GetForTLFByTime(ctx context.Context, id TlfID, serverTime time.Time) (
+		*RootMetadata, error)
+
 	// Put stores the metadata object for the given
 	// top-level folder.
 	Put(ctx context.Context, rmd *RootMetadata) error
@@ -775,8 +1027,9 @@ type BlockOps interface {
 	// Ready turns the given block (which belongs to the TLF with
 	// the given metadata) into encoded (and encrypted) data, and
 	// calculates its ID and size, so that we can do a bunch of
-	// block puts in parallel for every write. Ready() must
-	// guarantee that plainSize <= readyBlockData.QuotaSize().
+	// block puts in parallel for every write. Unless the block
+	// was compressed, Ready() must guarantee that plainSize <=
+	// readyBlockData.QuotaSize().
 	Ready(ctx context.Context, md *RootMetadata, block Block) (
 		id BlockID, plainSize int, readyBlockData ReadyBlockData, err error)
 
@@ -808,7 +1061,6 @@ type BlockOps interface {
 // it supports strict consistency).  On a get, it verifies the logged-in user
 // has read permissions.
 //
-// TODO: Add interface for searching by time
 type MDServer interface {
 	AuthTokenRefreshHandler
 
@@ -831,6 +1083,14 @@ type MDServer interface {
 	GetRange(ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus,
 		start, stop MetadataRevision) ([]*RootMetadataSigned, error)
 
+	// GetForTLFByTime returns the latest merged (signed/encrypted)
+	// metadata object for the given top-level folder that the server
+	// received at or before the given server time, if the logged-in
+	// user has read permission on the folder.  It returns nil if the
+	// folder had no revisions yet at that time.
+	GetForTLFByTime(ctx context.Context, id TlfID, serverTime time.Time) (
+		*RootMetadataSigned, error)
+
 	// Put stores the (signed/encrypted) metadata object for the given
 	// top-level folder. Note: If the unmerged bit is set in the metadata
 	// block's flags bitmask it will be appended to the unmerged per-device
@@ -868,6 +1128,19 @@ type MDServer interface {
 	// for this folder.  Returns true if the lock was successfully
 	// released.
 	TruncateUnlock(ctx context.Context, id TlfID) (bool, error)
+	// FileLock attempts to take, or renew, the advisory lock
+	// identified by lockID in this folder for the current device.  A
+	// shared lock may be held by several devices at once, but an
+	// exclusive one only by a single device.  The server drops the
+	// lock once the given lease has passed, unless FileLock is called
+	// again before then.  Returns true if the lock was successfully
+	// taken, or an MDServerErrorLocked if another device holds it.
+	FileLock(ctx context.Context, id TlfID, lockID string, exclusive bool,
+		lease time.Duration) (bool, error)
+	// FileUnlock releases the current device's hold on the advisory
+	// lock identified by lockID in this folder.  Returns true if the
+	// lock was successfully released.
+	FileUnlock(ctx context.Context, id TlfID, lockID string) (bool, error)
 
 	// DisableRekeyUpdatesForTesting disables processing rekey updates
 	// received from the mdserver while testing.
@@ -959,6 +1232,30 @@ type BlockSplitter interface {
 	// bytes from the next block should be appended.
 	CheckSplit(block *FileBlock) int64
 
+	// MaxPtrsPerBlock returns the maximum number of indirect
+	// pointers that fit into a single indirect file block.  Files
+	// that need more child blocks than that get more levels of
+	// indirection.
+	MaxPtrsPerBlock() int
+
+	// SplitDirIfNeeded, given a direct directory block, returns the
+	// names at which its entries should be split into separate
+	// blocks, in increasing order, or nil if the block doesn't need
+	// to be split.  Each returned name becomes the first entry of a
+	// new block.
+	SplitDirIfNeeded(block *DirBlock) []string
+
+	// ShouldMergeDirBlocks decides whether two adjacent direct
+	// directory blocks have few enough entries between them that
+	// they should be combined into a single block.
+	ShouldMergeDirBlocks(left, right *DirBlock) bool
+
+	// MaxSize returns the largest encoded size of the file blocks
+	// it makes.  Blocks are only compressed if they are no bigger
+	// than this, so that readers can refuse to decompress anything
+	// bigger.
+	MaxSize() int64
+
 	// ShouldEmbedBlockChanges decides whether we should keep the
 	// block changes embedded in the MD or not.
 	ShouldEmbedBlockChanges(bc *BlockChanges) bool
@@ -1043,6 +1340,20 @@ type ConflictRenamer interface {
 	ConflictRename(op op, original string) string
 }
 
+// ContentMerger merges the contents of a file that was changed on
+// both branches of a conflict, so that conflict resolution doesn't
+// have to keep the two versions under different names.
+type ContentMerger interface {
+	// MaxMergeBytes returns the size of the biggest file whose
+	// versions should be merged in the top-level folder with the
+	// given handle, or 0 if no files should be merged there.
+	MaxMergeBytes(h *TlfHandle) uint64
+	// Merge returns the contents that have both the changes from
+	// base to merged and the changes from base to unmerged, and
+	// true, if those changes can be combined without conflicting.
+	Merge(base, merged, unmerged []byte) ([]byte, bool)
+}
+
 // Config collects all the singleton instance instantiations needed to
 // run KBFS in one place.  The methods below are self-explanatory and
 // do not require comments.
@@ -1061,6 +1372,15 @@ type Config interface {
 	SetKeyCache(KeyCache)
 	BlockCache() BlockCache
 	SetBlockCache(BlockCache)
+	// DiskBlockCache may be nil, in which case blocks are only
+	// cached in memory.
+	DiskBlockCache() DiskBlockCache
+	SetDiskBlockCache(DiskBlockCache)
+	// DiskMDCache may be nil, in which case TLFs can't be read
+	// while disconnected from the MD server, unless they were
+	// already loaded.
+	DiskMDCache() DiskMDCache
+	SetDiskMDCache(DiskMDCache)
 	Crypto() Crypto
 	SetCrypto(Crypto)
 	Codec() Codec
@@ -1087,10 +1407,16 @@ type Config interface {
 	SetClock(Clock)
 	ConflictRenamer() ConflictRenamer
 	SetConflictRenamer(ConflictRenamer)
+	ContentMerger() ContentMerger
+	SetContentMerger(ContentMerger)
 	MetadataVersion() MetadataVer
 	DataVersion() DataVer
 	RekeyQueue() RekeyQueue
 	SetRekeyQueue(RekeyQueue)
+	TransferScheduler() TransferScheduler
+	SetTransferScheduler(TransferScheduler)
+	DirtyBudget() DirtyBudget
+	SetDirtyBudget(DirtyBudget)
 	// ReqsBufSize indicates the number of read or write operations
 	// that can be buffered per folder
 	ReqsBufSize() int
@@ -1107,6 +1433,21 @@ type Config interface {
 	// flush dirty files, even without a sync from the user.  Should
 	// be true except for during some testing.
 	DoBackgroundFlushes() bool
+	// ReadAheadBlocks indicates how many of the following blocks of
+	// a file to prefetch once the file is being read sequentially.
+	// If it is 0, files aren't read ahead.
+	ReadAheadBlocks() int
+	// DoDirPrefetch says whether to prefetch the blocks of the
+	// subdirectories of a directory when it is listed.
+	DoDirPrefetch() bool
+	// MDBatchWindow indicates how long local changes to a folder
+	// may be gathered into a single MD revision before it is put to
+	// the MD server.  If it is 0, every change is put right away.
+	MDBatchWindow() time.Duration
+	// MDBatchBytes indicates how many bytes of new blocks a batch of
+	// changes may reference before it is put, regardless of the
+	// batch window.  If it is 0, there is no limit.
+	MDBatchBytes() uint64
 	// RekeyWithPromptWaitTime indicates how long to wait, after
 	// setting the rekey bit, before prompting for a paper key.
 	RekeyWithPromptWaitTime() time.Duration
@@ -1186,6 +1527,26 @@ type NodeCache interface {
 type fileBlockDeepCopier func(context.Context, string, BlockPointer) (
 	BlockPointer, error)
 
+// fileBlockAppender makes a copy of a merged file (given by its name
+// and entry), with the data of an unmerged file, from the given
+// offset on, added to its end.  The copy replaces the merged file's
+// blocks once the resolution is synced.  It returns the pointers of
+// the merged file's child blocks that the copy replaces.
+type fileBlockAppender func(ctx context.Context, fromName string,
+	unmergedEntry DirEntry, off uint64, toName string,
+	mergedEntry DirEntry) ([]BlockPointer, error)
+
+// fileContentMerger makes a copy of a merged file (given by its name
+// and entry) with its contents merged with those of an unmerged file,
+// using the file at the given base pointer as their common ancestor.
+// The copy replaces the merged file's blocks once the resolution is
+// synced.  It returns the pointers of the merged file's child blocks
+// that the copy replaces and the size of the copy, or false if the
+// contents couldn't be merged.
+type fileContentMerger func(ctx context.Context, fromName string,
+	unmergedEntry DirEntry, base BlockPointer, toName string,
+	mergedEntry DirEntry) ([]BlockPointer, uint64, bool, error)
+
 // crAction represents a specific action to take as part of the
 // conflict resolution process.
 type crAction interface {
@@ -1199,9 +1560,11 @@ type crAction interface {
 	// do modifies the given merged block in place to resolve the
 	// conflict, and potential uses the provided blockCopyFetchers to
 	// obtain copies of other blocks (along with new BlockPointers)
-	// when requiring a block copy.
+	// when requiring a block copy, or the provided appender or
+	// merger to combine the contents of two files.
 	do(ctx context.Context, unmergedCopier fileBlockDeepCopier,
-		mergedCopier fileBlockDeepCopier, unmergedBlock *DirBlock,
+		mergedCopier fileBlockDeepCopier, appender fileBlockAppender,
+		merger fileContentMerger, unmergedBlock *DirBlock,
 		mergedBlock *DirBlock) error
 	// updateOps potentially modifies, in place, the slices of
 	// unmerged and merged operations stored in the corresponding
@@ -1228,6 +1591,66 @@ type crAction interface {
 	String() string
 }
 
+// TransferPriority orders the block transfers that have to wait for
+// their turn.
+type TransferPriority int
+
+const (
+	// InteractiveTransfer is for transfers that a user is likely
+	// waiting on, like the block puts of a small sync.
+	InteractiveTransfer TransferPriority = iota
+	// BulkTransfer is for large transfers, which go after any
+	// waiting interactive ones.
+	BulkTransfer
+	numTransferPriorities
+)
+
+// TransferScheduler schedules the block transfers of all the folders
+// of a client, keeping them under limits on concurrency and
+// bandwidth.
+type TransferScheduler interface {
+	// BeginPut waits until a block put of the given number of
+	// bytes may start, and returns a function to call once the
+	// put is done.
+	BeginPut(ctx context.Context, size int, prio TransferPriority) (
+		done func(), err error)
+	// RecordGet accounts for a block get of the given number of
+	// bytes that has just finished, and waits as long as needed
+	// to keep block gets under the download bandwidth limit.
+	RecordGet(ctx context.Context, size int) error
+	// MaxPuts returns the most block puts that may run at once.
+	MaxPuts() int
+}
+
+// DirtyBudget limits how much data written to files may be waiting
+// to be synced, across all the folders of a client, by pacing and
+// blocking writers.  Files are identified by the IDs of their nodes.
+type DirtyBudget interface {
+	// BeginWrite is called before n bytes are written to the given
+	// file.  It delays the write as needed to pace the file's
+	// writer, and returns true if the write must wait for a sync
+	// instead, because there's too much dirty data.
+	BeginWrite(ctx context.Context, tlf TlfID, file NodeID, n int64) (
+		mustWait bool, err error)
+	// Dirtied records that n more bytes were written to the given
+	// file.
+	Dirtied(tlf TlfID, file NodeID, n int64)
+	// ShouldForceSync returns true if the given folder has used
+	// up its share of the budget, and should be synced right away.
+	ShouldForceSync(tlf TlfID) bool
+	// SyncStarted records that a sync of the given file has
+	// started, which takes all the data dirtied so far.
+	SyncStarted(tlf TlfID, file NodeID)
+	// SyncFinished records that a sync of the given file has
+	// finished.  stillDirty says whether writes made during the
+	// sync have yet to be synced; if err is non-nil, none of the
+	// data was synced.
+	SyncFinished(tlf TlfID, file NodeID, stillDirty bool, err error)
+	// Discarded records that the given file's unsynced data was
+	// dropped without being synced.
+	Discarded(tlf TlfID, file NodeID)
+}
+
 // RekeyQueue is a managed queue of folders needing some rekey action taken upon them
 // by the current client.
 type RekeyQueue interface {
@@ -0,0 +1,98 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "golang.org/x/net/context"
+
+// journalBlockServer is a BlockServer that journals its writes through
+// a JournalServer when needed, and otherwise passes everything on to
+// the wrapped BlockServer.
+type journalBlockServer struct {
+	jServer *JournalServer
+	BlockServer
+}
+
+var _ BlockServer = journalBlockServer{}
+
+// Get implements the BlockServer interface for journalBlockServer.
+func (j journalBlockServer) Get(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	buf, serverHalf, ok, err := j.jServer.getBlock(id)
+	if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+	if ok {
+		return buf, serverHalf, nil
+	}
+	return j.BlockServer.Get(ctx, id, tlfID, context)
+}
+
+// Put implements the BlockServer interface for journalBlockServer.
+func (j journalBlockServer) Put(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	journaled, err := j.jServer.journal(ctx, tlfID, journalEntry{
+		Type:       journalBlockPut,
+		Ptrs:       []BlockPointer{journalPtr(id, context)},
+		Buf:        buf,
+		ServerHalf: serverHalf,
+	})
+	if journaled || err != nil {
+		return err
+	}
+	return j.BlockServer.Put(ctx, id, tlfID, context, buf, serverHalf)
+}
+
+// AddBlockReference implements the BlockServer interface for
+// journalBlockServer.
+func (j journalBlockServer) AddBlockReference(ctx context.Context,
+	id BlockID, tlfID TlfID, context BlockContext) error {
+	journaled, err := j.jServer.journal(ctx, tlfID, journalEntry{
+		Type: journalBlockAddRef,
+		Ptrs: []BlockPointer{journalPtr(id, context)},
+	})
+	if journaled || err != nil {
+		return err
+	}
+	return j.BlockServer.AddBlockReference(ctx, id, tlfID, context)
+}
+
+// RemoveBlockReference implements the BlockServer interface for
+// journalBlockServer.  The live counts of journaled removals aren't
+// known yet, so none are returned for them.
+func (j journalBlockServer) RemoveBlockReference(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) (
+	liveCounts map[BlockID]int, err error) {
+	journaled, err := j.jServer.journal(ctx, tlfID, journalEntry{
+		Type: journalBlockRemoveRefs,
+		Ptrs: journalPtrs(contexts),
+	})
+	if journaled || err != nil {
+		return nil, err
+	}
+	return j.BlockServer.RemoveBlockReference(ctx, tlfID, contexts)
+}
+
+// ArchiveBlockReferences implements the BlockServer interface for
+// journalBlockServer.
+func (j journalBlockServer) ArchiveBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) error {
+	journaled, err := j.jServer.journal(ctx, tlfID, journalEntry{
+		Type: journalBlockArchiveRefs,
+		Ptrs: journalPtrs(contexts),
+	})
+	if journaled || err != nil {
+		return err
+	}
+	return j.BlockServer.ArchiveBlockReferences(ctx, tlfID, contexts)
+}
+
+// Shutdown implements the BlockServer interface for
+// journalBlockServer.
+func (j journalBlockServer) Shutdown() {
+	j.jServer.shutdown()
+	j.BlockServer.Shutdown()
+}
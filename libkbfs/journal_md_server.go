@@ -0,0 +1,110 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "golang.org/x/net/context"
+
+// journalMDServer is an MDServer that journals its puts through a
+// JournalServer when needed.  While a TLF has journaled MD updates,
+// its merged history is read from the journal on top of the wrapped
+// MDServer.
+type journalMDServer struct {
+	jServer *JournalServer
+	MDServer
+}
+
+var _ MDServer = journalMDServer{}
+
+// GetForHandle implements the MDServer interface for journalMDServer.
+func (j journalMDServer) GetForHandle(ctx context.Context,
+	handle BareTlfHandle, mStatus MergeStatus) (
+	TlfID, *RootMetadataSigned, error) {
+	id, rmds, err := j.MDServer.GetForHandle(ctx, handle, mStatus)
+	if err != nil || mStatus != Merged {
+		return id, rmds, err
+	}
+	head, err := j.jServer.getMDHead(id)
+	if err != nil {
+		return NullTlfID, nil, err
+	}
+	if head != nil {
+		return id, head, nil
+	}
+	return id, rmds, nil
+}
+
+// GetForTLF implements the MDServer interface for journalMDServer.
+func (j journalMDServer) GetForTLF(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus) (*RootMetadataSigned, error) {
+	if mStatus == Merged && bid == NullBranchID {
+		head, err := j.jServer.getMDHead(id)
+		if err != nil {
+			return nil, err
+		}
+		if head != nil {
+			return head, nil
+		}
+	}
+	return j.MDServer.GetForTLF(ctx, id, bid, mStatus)
+}
+
+// GetRange implements the MDServer interface for journalMDServer.
+func (j journalMDServer) GetRange(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
+	if mStatus != Merged || bid != NullBranchID {
+		return j.MDServer.GetRange(ctx, id, bid, mStatus, start, stop)
+	}
+	journaled, first, err := j.jServer.getMDRange(id, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	if first == MetadataRevisionUninitialized {
+		return j.MDServer.GetRange(ctx, id, bid, mStatus, start, stop)
+	}
+	if start >= first {
+		return journaled, nil
+	}
+	// The older revisions are only on the server.
+	end := stop
+	if end >= first {
+		end = first - 1
+	}
+	rmdses, err := j.MDServer.GetRange(ctx, id, bid, mStatus, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return append(rmdses, journaled...), nil
+}
+
+// Put implements the MDServer interface for journalMDServer.
+func (j journalMDServer) Put(ctx context.Context,
+	rmds *RootMetadataSigned) error {
+	journaled, err := j.jServer.journal(ctx, rmds.MD.ID, journalEntry{
+		Type: journalMDPut,
+		MD:   rmds,
+	})
+	if journaled || err != nil {
+		return err
+	}
+	return j.MDServer.Put(ctx, rmds)
+}
+
+// RegisterForUpdate implements the MDServer interface for
+// journalMDServer.  While the TLF has journaled updates, the returned
+// channel only fires once they've all been flushed.
+func (j journalMDServer) RegisterForUpdate(ctx context.Context, id TlfID,
+	currHead MetadataRevision) (<-chan error, error) {
+	if ch := j.jServer.waitForFlush(id); ch != nil {
+		return ch, nil
+	}
+	return j.MDServer.RegisterForUpdate(ctx, id, currHead)
+}
+
+// Shutdown implements the MDServer interface for journalMDServer.
+func (j journalMDServer) Shutdown() {
+	j.jServer.shutdown()
+	j.MDServer.Shutdown()
+}
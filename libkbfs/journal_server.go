@@ -0,0 +1,943 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/keybase/backoff"
+	"github.com/keybase/client/go/logger"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	// journalEntryPrefix prefixes the keys of the journal entries,
+	// which are followed by the TLF ID and a sequence number, so
+	// that the entries of each TLF are iterated in the order they
+	// were made.
+	journalEntryPrefix = 'e'
+	// journalBlockPrefix prefixes the keys of the index from block
+	// IDs to the keys of the entries that put them.
+	journalBlockPrefix = 'b'
+	// journalMDPrefix prefixes the keys of the index from TLF IDs
+	// and revisions to the keys of the entries that put merged
+	// MDs.
+	journalMDPrefix = 'm'
+	// journalStatePrefix prefixes the keys of the branch states of
+	// the TLFs.
+	journalStatePrefix = 's'
+)
+
+type journalEntryType int
+
+const (
+	journalBlockPut journalEntryType = iota + 1
+	journalBlockAddRef
+	journalBlockRemoveRefs
+	journalBlockArchiveRefs
+	journalMDPut
+)
+
+// journalEntry is a single operation waiting to be sent to the block
+// or MD server.
+type journalEntry struct {
+	// These fields are only exported for serialization purposes.
+	Type journalEntryType
+	// Ptrs holds the ID and context of each block reference that
+	// a block operation is about.
+	Ptrs       []BlockPointer `codec:",omitempty"`
+	Buf        []byte         `codec:",omitempty"`
+	ServerHalf BlockCryptKeyServerHalf
+	// MD is already signed, so it can be sent as is, unless it has
+	// to be moved onto a branch.
+	MD *RootMetadataSigned `codec:",omitempty"`
+}
+
+// journalTLFState records the branch that the journaled MD updates of
+// a TLF are being moved onto, after they conflicted with the MD
+// server.
+type journalTLFState struct {
+	// These fields are only exported for serialization purposes.
+	BID BranchID
+	// PrevRoot is the ID of the last MD flushed onto the branch.
+	PrevRoot MdID
+}
+
+// TLFJournalStatus represents the status of the write journal of a
+// TLF. It is suitable for encoding directly as JSON.
+type TLFJournalStatus struct {
+	// RevisionStart and RevisionEnd are the first and last queued
+	// MD revisions, or MetadataRevisionUninitialized if there are
+	// none.
+	RevisionStart MetadataRevision
+	RevisionEnd   MetadataRevision
+	// BranchID is set if the queued MD updates conflicted with the
+	// server, and are being moved onto a branch.
+	BranchID       string `json:",omitempty"`
+	BlockOpCount   int
+	UnflushedBytes int64
+}
+
+// branchChangeListener is told when the journaled MD updates of a TLF
+// have been moved onto a branch. It returns errJournalNotFlushed if
+// more updates were journaled for the TLF before it could switch to
+// the branch.
+type branchChangeListener interface {
+	onTLFBranchChange(ctx context.Context, tlfID TlfID,
+		newBID BranchID) error
+}
+
+// CtxJournalTagKey is the type used for unique context tags within
+// the write journal.
+type CtxJournalTagKey int
+
+const (
+	// CtxJournalIDKey is the type of the tag for unique operation
+	// IDs within the write journal.
+	CtxJournalIDKey CtxJournalTagKey = iota
+)
+
+// CtxJournalOpID is the display name for the unique operation
+// journal ID tag.
+const CtxJournalOpID = "JID"
+
+// JournalServer wraps a BlockServer and an MDServer, and queues their
+// writes in a local leveldb journal while the MD server can't be
+// reached.  Once a TLF has queued writes, later writes to it are
+// queued too, to keep them in order, until the journal is flushed
+// after the connection comes back.  Failed flushes are retried with
+// an exponential backoff, and a TLF that can't be flushed doesn't
+// hold up the others.
+//
+// The journaled MD updates are signed as usual, and just sent as
+// they are, unless someone else changed the TLF in the meantime.  In
+// that case they're moved onto a new branch and re-signed, and the
+// TLF is told to resolve the conflict like it would for any unmerged
+// updates.
+type JournalServer struct {
+	config              Config
+	log                 logger.Logger
+	delegateBlockServer BlockServer
+	delegateMDServer    MDServer
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	flushCh chan struct{}
+	// flushLock makes sure only one flush runs at a time.
+	flushLock sync.Mutex
+
+	lock    sync.Mutex
+	storage storage.Storage
+	// db is nil after shutdown.
+	db      *leveldb.DB
+	nextSeq uint64
+	// queued counts the entries of each TLF that haven't been
+	// flushed yet.
+	queued map[TlfID]int
+	states map[TlfID]journalTLFState
+	// waiters are sent nil once the journal of their TLF is empty.
+	waiters map[TlfID][]chan error
+	// retrying is true while the background flusher is waiting to
+	// retry a failed flush.
+	retrying bool
+}
+
+func newJournalServerWithStorage(config Config, storage storage.Storage,
+	bserver BlockServer, mdserver MDServer) (*JournalServer, error) {
+	db, err := leveldb.Open(storage, leveldbOptions)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &JournalServer{
+		config:              config,
+		log:                 config.MakeLogger(""),
+		delegateBlockServer: bserver,
+		delegateMDServer:    mdserver,
+		ctx:                 ctx,
+		cancel:              cancel,
+		flushCh:             make(chan struct{}, 1),
+		storage:             storage,
+		db:                  db,
+		queued:              make(map[TlfID]int),
+		states:              make(map[TlfID]journalTLFState),
+		waiters:             make(map[TlfID][]chan error),
+	}
+	err = j.load()
+	if err != nil {
+		j.shutdown()
+		return nil, err
+	}
+
+	go j.flushLoop()
+	if len(j.queued) > 0 {
+		// Writes left over from an earlier run.
+		j.signalFlush()
+	}
+	return j, nil
+}
+
+// NewJournalServer returns a JournalServer wrapping the given servers,
+// with a leveldb journal in the given directory.  The directory is
+// created if needed with permissions that keep out other users.
+func NewJournalServer(config Config, dirPath string, bserver BlockServer,
+	mdserver MDServer) (*JournalServer, error) {
+	err := os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := storage.OpenFile(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	return newJournalServerWithStorage(config, storage, bserver, mdserver)
+}
+
+// NewJournalServerMemory returns a JournalServer wrapping the given
+// servers, with an in-memory leveldb journal.
+func NewJournalServerMemory(config Config, bserver BlockServer,
+	mdserver MDServer) (*JournalServer, error) {
+	return newJournalServerWithStorage(
+		config, storage.NewMemStorage(), bserver, mdserver)
+}
+
+// GetJournalServer returns the JournalServer tied to the given config,
+// or an error if writes aren't journaled.
+func GetJournalServer(config Config) (*JournalServer, error) {
+	jmdserver, ok := config.MDServer().(journalMDServer)
+	if !ok {
+		return nil, errors.New("Write journal not enabled")
+	}
+	return jmdserver.jServer, nil
+}
+
+// blockServer returns a BlockServer that journals its writes through
+// this JournalServer.
+func (j *JournalServer) blockServer() BlockServer {
+	return journalBlockServer{j, j.delegateBlockServer}
+}
+
+// mdServer returns an MDServer that journals its writes through this
+// JournalServer.
+func (j *JournalServer) mdServer() MDServer {
+	return journalMDServer{j, j.delegateMDServer}
+}
+
+func journalTlfKey(prefix byte, id TlfID) []byte {
+	return append([]byte{prefix}, id.Bytes()...)
+}
+
+func journalEntryKey(id TlfID, seq uint64) []byte {
+	var seqBuf [8]byte
+	binary.BigEndian.PutUint64(seqBuf[:], seq)
+	return append(journalTlfKey(journalEntryPrefix, id), seqBuf[:]...)
+}
+
+func journalBlockKey(id BlockID) []byte {
+	return append([]byte{journalBlockPrefix}, id.Bytes()...)
+}
+
+func journalMDKey(id TlfID, rev MetadataRevision) []byte {
+	var revBuf [8]byte
+	binary.BigEndian.PutUint64(revBuf[:], uint64(rev))
+	return append(journalTlfKey(journalMDPrefix, id), revBuf[:]...)
+}
+
+// parseJournalEntryKey returns the TLF ID and sequence number in the
+// given entry key.
+func parseJournalEntryKey(key []byte) (TlfID, uint64, error) {
+	if len(key) != 1+TlfIDByteLen+8 {
+		return NullTlfID, 0, fmt.Errorf("Bad journal entry key %v", key)
+	}
+	var id TlfID
+	err := id.UnmarshalBinary(key[1 : 1+TlfIDByteLen])
+	if err != nil {
+		return NullTlfID, 0, err
+	}
+	return id, binary.BigEndian.Uint64(key[1+TlfIDByteLen:]), nil
+}
+
+// journalPtr returns a BlockPointer holding the given block ID and
+// context, so that the context can be serialized.
+func journalPtr(id BlockID, context BlockContext) BlockPointer {
+	return BlockPointer{
+		ID:       id,
+		Creator:  context.GetCreator(),
+		Writer:   context.GetWriter(),
+		RefNonce: context.GetRefNonce(),
+	}
+}
+
+func journalPtrs(contexts map[BlockID][]BlockContext) []BlockPointer {
+	var ptrs []BlockPointer
+	for id, idContexts := range contexts {
+		for _, context := range idContexts {
+			ptrs = append(ptrs, journalPtr(id, context))
+		}
+	}
+	return ptrs
+}
+
+func journalContexts(ptrs []BlockPointer) map[BlockID][]BlockContext {
+	contexts := make(map[BlockID][]BlockContext)
+	for _, ptr := range ptrs {
+		contexts[ptr.ID] = append(contexts[ptr.ID], ptr)
+	}
+	return contexts
+}
+
+// load counts the queued entries of each TLF, and reads their branch
+// states.
+func (j *JournalServer) load() error {
+	iter := j.db.NewIterator(util.BytesPrefix([]byte{journalEntryPrefix}), nil)
+	for iter.Next() {
+		id, seq, err := parseJournalEntryKey(iter.Key())
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		j.queued[id]++
+		if seq >= j.nextSeq {
+			j.nextSeq = seq + 1
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	iter = j.db.NewIterator(util.BytesPrefix([]byte{journalStatePrefix}), nil)
+	for iter.Next() {
+		var id TlfID
+		err := id.UnmarshalBinary(iter.Key()[1:])
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		if j.queued[id] == 0 {
+			// The TLF finds its branch on the server by itself
+			// when it's loaded.
+			batch.Delete(append([]byte(nil), iter.Key()...))
+			continue
+		}
+		var state journalTLFState
+		err = j.config.Codec().Decode(iter.Value(), &state)
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		j.states[id] = state
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	return j.db.Write(batch, nil)
+}
+
+var errJournalShutdown = errors.New("Write journal already shut down")
+
+// errJournalNotFlushed is returned by branchChangeListeners when
+// there are still journaled updates for the TLF.
+var errJournalNotFlushed = errors.New("Write journal not flushed yet")
+
+// shouldJournalLocked returns whether writes to the given TLF must be
+// journaled.  It must be called with j.lock held.
+func (j *JournalServer) shouldJournalLocked(id TlfID) bool {
+	if j.queued[id] > 0 {
+		return true
+	}
+	if _, ok := j.states[id]; ok {
+		return true
+	}
+	return !j.delegateMDServer.IsConnected()
+}
+
+// journal appends the given entry to the journal of the given TLF,
+// if writes to it must be journaled.  It returns whether it did.
+func (j *JournalServer) journal(ctx context.Context, id TlfID,
+	entry journalEntry) (journaled bool, err error) {
+	buf, err := j.config.Codec().Encode(entry)
+	if err != nil {
+		return false, err
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.db == nil {
+		return false, errJournalShutdown
+	}
+	if !j.shouldJournalLocked(id) {
+		return false, nil
+	}
+
+	key := journalEntryKey(id, j.nextSeq)
+	batch := new(leveldb.Batch)
+	batch.Put(key, buf)
+	switch entry.Type {
+	case journalBlockPut:
+		batch.Put(journalBlockKey(entry.Ptrs[0].ID), key)
+	case journalMDPut:
+		if entry.MD.MD.MergedStatus() == Merged {
+			batch.Put(journalMDKey(id, entry.MD.MD.Revision), key)
+		}
+	}
+	err = j.db.Write(batch, nil)
+	if err != nil {
+		return false, err
+	}
+	j.log.CDebugf(ctx, "Journaled entry %d of type %d for %s",
+		j.nextSeq, entry.Type, id)
+	j.nextSeq++
+	j.queued[id]++
+	if !j.retrying && j.delegateMDServer.IsConnected() {
+		// The TLF still had queued writes even though the MD
+		// server can be reached, so make sure this one doesn't
+		// wait for the next reconnection.
+		j.signalFlush()
+	}
+	return true, nil
+}
+
+// getEntryLocked returns the entry stored under the given key.  It
+// must be called with j.lock held.
+func (j *JournalServer) getEntryLocked(key []byte) (journalEntry, error) {
+	buf, err := j.db.Get(key, nil)
+	if err != nil {
+		return journalEntry{}, err
+	}
+	var entry journalEntry
+	err = j.config.Codec().Decode(buf, &entry)
+	if err != nil {
+		return journalEntry{}, err
+	}
+	return entry, nil
+}
+
+// getBlock returns the data of the given block, if it's in the
+// journal.
+func (j *JournalServer) getBlock(id BlockID) (
+	buf []byte, serverHalf BlockCryptKeyServerHalf, ok bool, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.db == nil {
+		return nil, BlockCryptKeyServerHalf{}, false, errJournalShutdown
+	}
+	key, err := j.db.Get(journalBlockKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, BlockCryptKeyServerHalf{}, false, nil
+	} else if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, false, err
+	}
+	entry, err := j.getEntryLocked(key)
+	if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, false, err
+	}
+	return entry.Buf, entry.ServerHalf, true, nil
+}
+
+// getMDRange returns the journaled merged MDs of the given TLF with
+// revisions between start and stop (inclusive), along with the first
+// revision in its journal.  The first revision is
+// MetadataRevisionUninitialized if the journal doesn't have a merged
+// view of the TLF, because it has no merged MDs, or they're being
+// moved onto a branch.
+func (j *JournalServer) getMDRange(id TlfID, start, stop MetadataRevision) (
+	rmdses []*RootMetadataSigned, first MetadataRevision, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.db == nil {
+		return nil, MetadataRevisionUninitialized, errJournalShutdown
+	}
+	if _, ok := j.states[id]; ok {
+		return nil, MetadataRevisionUninitialized, nil
+	}
+
+	first = MetadataRevisionUninitialized
+	prefix := journalTlfKey(journalMDPrefix, id)
+	iter := j.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		rev := MetadataRevision(
+			binary.BigEndian.Uint64(iter.Key()[len(prefix):]))
+		if first == MetadataRevisionUninitialized {
+			first = rev
+		}
+		if rev < start || rev > stop {
+			continue
+		}
+		entry, err := j.getEntryLocked(iter.Value())
+		if err != nil {
+			return nil, MetadataRevisionUninitialized, err
+		}
+		rmdses = append(rmdses, entry.MD)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, MetadataRevisionUninitialized, err
+	}
+	return rmdses, first, nil
+}
+
+// getMDHead returns the latest journaled merged MD of the given TLF,
+// or nil if the journal doesn't have a merged view of the TLF.
+func (j *JournalServer) getMDHead(id TlfID) (*RootMetadataSigned, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.db == nil {
+		return nil, errJournalShutdown
+	}
+	if _, ok := j.states[id]; ok {
+		return nil, nil
+	}
+
+	iter := j.db.NewIterator(
+		util.BytesPrefix(journalTlfKey(journalMDPrefix, id)), nil)
+	defer iter.Release()
+	if !iter.Last() {
+		return nil, iter.Error()
+	}
+	entry, err := j.getEntryLocked(iter.Value())
+	if err != nil {
+		return nil, err
+	}
+	return entry.MD, nil
+}
+
+// waitForFlush returns a channel that's sent nil once the given TLF
+// has nothing left in the journal, or nil if it already doesn't.
+func (j *JournalServer) waitForFlush(id TlfID) <-chan error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.queued[id] == 0 {
+		if _, ok := j.states[id]; !ok {
+			return nil
+		}
+	}
+	ch := make(chan error, 1)
+	j.waiters[id] = append(j.waiters[id], ch)
+	return ch
+}
+
+// queuedCount returns the number of entries of the given TLF that
+// haven't been flushed yet.
+func (j *JournalServer) queuedCount(id TlfID) int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.queued[id]
+}
+
+// signalFlush makes the background flusher flush the journal soon.
+func (j *JournalServer) signalFlush() {
+	select {
+	case j.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+func (j *JournalServer) setRetrying(retrying bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.retrying = retrying
+}
+
+func (j *JournalServer) flushLoop() {
+	// Retry failed flushes with an exponential backoff, so that a
+	// TLF that keeps failing (e.g., because it's over quota)
+	// doesn't overwhelm the servers, but is still flushed
+	// eventually without waiting for a reconnection.
+	expBackoff := backoff.NewExponentialBackOff()
+	// Never give up until we shut down.
+	expBackoff.MaxElapsedTime = 0
+	var retryCh <-chan time.Time
+	for {
+		select {
+		case <-j.flushCh:
+		case <-retryCh:
+		case <-j.ctx.Done():
+			return
+		}
+		retryCh = nil
+		ctx := ctxWithRandomID(j.ctx, CtxJournalIDKey, CtxJournalOpID, j.log)
+		err := j.flush(ctx)
+		if err == nil {
+			expBackoff.Reset()
+			j.setRetrying(false)
+			continue
+		}
+		nextTime := expBackoff.NextBackOff()
+		j.log.CDebugf(ctx, "Retrying the journal flush in %s due to err: %v",
+			nextTime, err)
+		j.setRetrying(true)
+		retryCh = time.After(nextTime)
+	}
+}
+
+// flush sends all the journaled writes to the servers, unless the MD
+// server can't be reached.  A TLF that fails to flush is left for the
+// next try, after the other TLFs are flushed.
+func (j *JournalServer) flush(ctx context.Context) error {
+	j.flushLock.Lock()
+	defer j.flushLock.Unlock()
+	if !j.delegateMDServer.IsConnected() {
+		return nil
+	}
+
+	ids := func() []TlfID {
+		j.lock.Lock()
+		defer j.lock.Unlock()
+		var ids []TlfID
+		for id := range j.queued {
+			ids = append(ids, id)
+		}
+		for id := range j.states {
+			if j.queued[id] == 0 {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}()
+	var errors []error
+	for _, id := range ids {
+		if err := j.flushTLF(ctx, id); err != nil {
+			j.log.CDebugf(ctx, "Couldn't flush the journal of %s: %v",
+				id, err)
+			errors = append(errors, err)
+			// Continue on and try to flush the other TLFs.
+		}
+	}
+	if len(errors) == 1 {
+		return errors[0]
+	} else if len(errors) > 1 {
+		return fmt.Errorf("Multiple errors flushing the journal: %v", errors)
+	}
+	return nil
+}
+
+func (j *JournalServer) flushTLF(ctx context.Context, id TlfID) error {
+	j.log.CDebugf(ctx, "Flushing the journal of %s", id)
+	for {
+		key, entry, state, err := j.nextEntry(id)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			state, err = j.flushEntry(ctx, id, *entry, state)
+			if err != nil {
+				return err
+			}
+			err = j.removeEntry(id, key, *entry, state)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if state.BID != NullBranchID {
+			// All the journaled updates are on the branch now, so
+			// the TLF can switch to it.
+			err := j.notifyBranchChange(ctx, id, state.BID)
+			if err == errJournalNotFlushed {
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+		done, err := j.finishFlush(id)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// nextEntry returns the oldest entry in the journal of the given TLF
+// along with its key, or nil if there isn't one, and the TLF's branch
+// state.
+func (j *JournalServer) nextEntry(id TlfID) (
+	[]byte, *journalEntry, journalTLFState, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.db == nil {
+		return nil, nil, journalTLFState{}, errJournalShutdown
+	}
+	state := j.states[id]
+	iter := j.db.NewIterator(
+		util.BytesPrefix(journalTlfKey(journalEntryPrefix, id)), nil)
+	defer iter.Release()
+	if !iter.First() {
+		return nil, nil, state, iter.Error()
+	}
+	key := append([]byte(nil), iter.Key()...)
+	var entry journalEntry
+	err := j.config.Codec().Decode(iter.Value(), &entry)
+	if err != nil {
+		return nil, nil, journalTLFState{}, err
+	}
+	return key, &entry, state, nil
+}
+
+// flushEntry sends the given entry to the right server, and returns
+// the new branch state of the TLF.
+func (j *JournalServer) flushEntry(ctx context.Context, id TlfID,
+	entry journalEntry, state journalTLFState) (journalTLFState, error) {
+	switch entry.Type {
+	case journalBlockPut:
+		ptr := entry.Ptrs[0]
+		return state, j.delegateBlockServer.Put(
+			ctx, ptr.ID, id, ptr, entry.Buf, entry.ServerHalf)
+	case journalBlockAddRef:
+		ptr := entry.Ptrs[0]
+		return state, j.delegateBlockServer.AddBlockReference(
+			ctx, ptr.ID, id, ptr)
+	case journalBlockRemoveRefs:
+		_, err := j.delegateBlockServer.RemoveBlockReference(
+			ctx, id, journalContexts(entry.Ptrs))
+		return state, err
+	case journalBlockArchiveRefs:
+		return state, j.delegateBlockServer.ArchiveBlockReferences(
+			ctx, id, journalContexts(entry.Ptrs))
+	case journalMDPut:
+		return j.flushMD(ctx, entry.MD, state)
+	default:
+		return state, fmt.Errorf("Unknown journal entry type %d", entry.Type)
+	}
+}
+
+func (j *JournalServer) flushMD(ctx context.Context,
+	rmds *RootMetadataSigned, state journalTLFState) (
+	journalTLFState, error) {
+	if state.BID != NullBranchID {
+		err := j.convertMD(ctx, rmds, state)
+		if err != nil {
+			return state, err
+		}
+	}
+	err := j.delegateMDServer.Put(ctx, rmds)
+	if isRevisionConflict(err) && state.BID == NullBranchID &&
+		rmds.MD.MergedStatus() == Merged {
+		// Someone else changed the TLF while this was journaled,
+		// so move it and everything after it onto a branch.
+		j.log.CDebugf(ctx, "Conflict flushing revision %d: %v",
+			rmds.MD.Revision, err)
+		bid, err := j.config.Crypto().MakeRandomBranchID()
+		if err != nil {
+			return state, err
+		}
+		state = journalTLFState{BID: bid}
+		err = j.convertMD(ctx, rmds, state)
+		if err != nil {
+			return state, err
+		}
+		err = j.delegateMDServer.Put(ctx, rmds)
+		if err != nil {
+			return state, err
+		}
+	} else if err != nil {
+		return state, err
+	}
+
+	if state.BID != NullBranchID {
+		state.PrevRoot, err = j.config.Crypto().MakeMdID(&rmds.MD)
+		if err != nil {
+			return state, err
+		}
+	}
+	return state, nil
+}
+
+// convertMD moves the given MD onto the branch in state, and signs it
+// again.
+func (j *JournalServer) convertMD(ctx context.Context,
+	rmds *RootMetadataSigned, state journalTLFState) error {
+	md := &rmds.MD
+	if md.MergedStatus() == Merged {
+		// The local copy of this revision never made it to the
+		// merged branch, so it mustn't be mistaken for the
+		// server's version of it.
+		j.config.MDCache().Delete(md.ID, md.Revision, NullBranchID)
+	}
+	md.WFlags |= MetadataFlagUnmerged
+	md.BID = state.BID
+	if state.PrevRoot != (MdID{}) {
+		md.PrevRoot = state.PrevRoot
+	}
+
+	codec := j.config.Codec()
+	crypto := j.config.Crypto()
+	if !md.IsWriterMetadataCopiedSet() {
+		buf, err := codec.Encode(md.WriterMetadata)
+		if err != nil {
+			return err
+		}
+		md.WriterMetadataSigInfo, err = crypto.Sign(ctx, buf)
+		if err != nil {
+			return err
+		}
+	}
+	buf, err := codec.Encode(md)
+	if err != nil {
+		return err
+	}
+	rmds.SigInfo, err = crypto.Sign(ctx, buf)
+	return err
+}
+
+// removeEntry removes a flushed entry from the journal of the given
+// TLF, and records its new branch state.
+func (j *JournalServer) removeEntry(id TlfID, key []byte,
+	entry journalEntry, state journalTLFState) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.db == nil {
+		return errJournalShutdown
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Delete(key)
+	var indexKey []byte
+	switch entry.Type {
+	case journalBlockPut:
+		indexKey = journalBlockKey(entry.Ptrs[0].ID)
+	case journalMDPut:
+		indexKey = journalMDKey(id, entry.MD.MD.Revision)
+	}
+	if indexKey != nil {
+		// Only remove the index if it still points to this entry.
+		indexed, err := j.db.Get(indexKey, nil)
+		if err == nil && string(indexed) == string(key) {
+			batch.Delete(indexKey)
+		} else if err != nil && err != leveldb.ErrNotFound {
+			return err
+		}
+	}
+	if state.BID != NullBranchID {
+		buf, err := j.config.Codec().Encode(state)
+		if err != nil {
+			return err
+		}
+		batch.Put(journalTlfKey(journalStatePrefix, id), buf)
+	}
+	err := j.db.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+
+	j.queued[id]--
+	if j.queued[id] == 0 {
+		delete(j.queued, id)
+	}
+	if state.BID != NullBranchID {
+		j.states[id] = state
+	}
+	return nil
+}
+
+// finishFlush clears the branch state of the given TLF and tells
+// anyone waiting for its journal to be flushed, unless more entries
+// were journaled in the meantime.
+func (j *JournalServer) finishFlush(id TlfID) (done bool, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.db == nil {
+		return false, errJournalShutdown
+	}
+	if j.queued[id] > 0 {
+		return false, nil
+	}
+	if _, ok := j.states[id]; ok {
+		err := j.db.Delete(journalTlfKey(journalStatePrefix, id), nil)
+		if err != nil {
+			return false, err
+		}
+		delete(j.states, id)
+	}
+	for _, ch := range j.waiters[id] {
+		ch <- nil
+		close(ch)
+	}
+	delete(j.waiters, id)
+	return true, nil
+}
+
+func (j *JournalServer) notifyBranchChange(ctx context.Context, id TlfID,
+	bid BranchID) error {
+	listener, ok := j.config.KBFSOps().(branchChangeListener)
+	if !ok {
+		return nil
+	}
+	j.log.CDebugf(ctx, "Moved the journaled updates of %s onto branch %s",
+		id, bid)
+	return listener.onTLFBranchChange(ctx, id, bid)
+}
+
+// tlfStatus returns the status of the journal of the given TLF.
+func (j *JournalServer) tlfStatus(id TlfID) (TLFJournalStatus, error) {
+	status := TLFJournalStatus{
+		RevisionStart: MetadataRevisionUninitialized,
+		RevisionEnd:   MetadataRevisionUninitialized,
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.db == nil {
+		return TLFJournalStatus{}, errJournalShutdown
+	}
+	if state, ok := j.states[id]; ok {
+		status.BranchID = state.BID.String()
+	}
+	iter := j.db.NewIterator(
+		util.BytesPrefix(journalTlfKey(journalEntryPrefix, id)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var entry journalEntry
+		err := j.config.Codec().Decode(iter.Value(), &entry)
+		if err != nil {
+			return TLFJournalStatus{}, err
+		}
+		if entry.Type != journalMDPut {
+			status.BlockOpCount++
+			status.UnflushedBytes += int64(len(entry.Buf))
+			continue
+		}
+		if status.RevisionStart == MetadataRevisionUninitialized {
+			status.RevisionStart = entry.MD.MD.Revision
+		}
+		status.RevisionEnd = entry.MD.MD.Revision
+	}
+	if err := iter.Error(); err != nil {
+		return TLFJournalStatus{}, err
+	}
+	return status, nil
+}
+
+// shutdown stops the background flusher and closes the journal.  It
+// doesn't shut down the wrapped servers.
+func (j *JournalServer) shutdown() {
+	j.cancel()
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.db == nil {
+		return
+	}
+	j.db.Close()
+	j.db = nil
+	j.storage.Close()
+}
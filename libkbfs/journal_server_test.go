@@ -0,0 +1,255 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// disconnectableMDServer can be made to act like an MD server that
+// can't be reached, or that fails some puts.
+type disconnectableMDServer struct {
+	MDServer
+	disconnected int32
+	failPuts     int32
+}
+
+func (md *disconnectableMDServer) setConnected(connected bool) {
+	var disconnected int32
+	if !connected {
+		disconnected = 1
+	}
+	atomic.StoreInt32(&md.disconnected, disconnected)
+}
+
+func (md *disconnectableMDServer) IsConnected() bool {
+	return atomic.LoadInt32(&md.disconnected) == 0
+}
+
+func (md *disconnectableMDServer) GetForTLF(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus) (*RootMetadataSigned, error) {
+	if !md.IsConnected() {
+		return nil, errDisconnected{}
+	}
+	return md.MDServer.GetForTLF(ctx, id, bid, mStatus)
+}
+
+func (md *disconnectableMDServer) GetRange(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
+	if !md.IsConnected() {
+		return nil, errDisconnected{}
+	}
+	return md.MDServer.GetRange(ctx, id, bid, mStatus, start, stop)
+}
+
+func (md *disconnectableMDServer) Put(ctx context.Context,
+	rmds *RootMetadataSigned) error {
+	if !md.IsConnected() {
+		return errDisconnected{}
+	}
+	if atomic.AddInt32(&md.failPuts, -1) >= 0 {
+		return errors.New("Put failed for testing")
+	}
+	return md.MDServer.Put(ctx, rmds)
+}
+
+// setupJournalServerForTest makes the given config journal its writes
+// to an in-memory journal, with an MD server that can be
+// disconnected.
+func setupJournalServerForTest(t *testing.T, config *ConfigLocal) (
+	*JournalServer, *disconnectableMDServer) {
+	mdserver := &disconnectableMDServer{MDServer: config.MDServer()}
+	jServer, err := NewJournalServerMemory(
+		config, config.BlockServer(), mdserver)
+	if err != nil {
+		t.Fatalf("Couldn't make journal server: %v", err)
+	}
+	config.SetBlockServer(jServer.blockServer())
+	config.SetMDServer(jServer.mdServer())
+	return jServer, mdserver
+}
+
+func TestJournalServerFlushOnReconnect(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	// Another device, which only sees what reaches the servers.
+	config2 := ConfigAsUser(config.(*ConfigLocal), "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	jServer, mdserver := setupJournalServerForTest(t, config.(*ConfigLocal))
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	mdserver.setConnected(false)
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file while disconnected: %v", err)
+	}
+	err = kbfsOps.Sync(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't sync file while disconnected: %v", err)
+	}
+
+	fb := rootNode.GetFolderBranch()
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't get folder status: %v", err)
+	}
+	if !status.Disconnected || status.Journal == nil {
+		t.Fatalf("Unexpected status while disconnected: %+v", status)
+	}
+	if status.Journal.RevisionStart == MetadataRevisionUninitialized ||
+		status.Journal.RevisionStart != status.Journal.RevisionEnd {
+		t.Errorf("Unexpected journaled revisions %d-%d",
+			status.Journal.RevisionStart, status.Journal.RevisionEnd)
+	}
+	if status.Journal.UnflushedBytes == 0 {
+		t.Errorf("No unflushed bytes in the journal")
+	}
+
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	checkRead := func(expected string) {
+		fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+		if err != nil {
+			t.Fatalf("Couldn't look up file: %v", err)
+		}
+		buf := make([]byte, 10)
+		nr, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read file: %v", err)
+		}
+		if g := string(buf[:nr]); g != expected {
+			t.Errorf("The other device read %q, expected %q", g, expected)
+		}
+	}
+	checkRead("")
+
+	mdserver.setConnected(true)
+	flushed := jServer.waitForFlush(fb.Tlf)
+	if flushed == nil {
+		t.Fatalf("Nothing to wait for in the journal")
+	}
+	kbfsOps.PushConnectionStatusChange(MDServiceName, nil)
+	if err := <-flushed; err != nil {
+		t.Fatalf("Couldn't flush the journal: %v", err)
+	}
+
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't get folder status: %v", err)
+	}
+	if status.Disconnected || status.Journal == nil ||
+		status.Journal.RevisionStart != MetadataRevisionUninitialized ||
+		status.Journal.UnflushedBytes != 0 {
+		t.Errorf("Unexpected status after flushing: %+v %+v",
+			status, status.Journal)
+	}
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	checkRead("hello")
+}
+
+func TestJournalServerConflictOnReconnect(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	config2 := ConfigAsUser(config.(*ConfigLocal), "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	jServer, mdserver := setupJournalServerForTest(t, config.(*ConfigLocal))
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	kbfsOps2 := config2.KBFSOps()
+
+	mdserver.setConnected(false)
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file while disconnected: %v", err)
+	}
+	// Meanwhile, the other device changes the folder.
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	mdserver.setConnected(true)
+	err = jServer.flush(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't flush the journal: %v", err)
+	}
+
+	// The journaled update ended up on a branch, so conflict
+	// resolution merges it with the other device's update.
+	fb := rootNode.GetFolderBranch()
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't get folder status: %v", err)
+	}
+	if status.Staged {
+		t.Errorf("Still staged after conflict resolution")
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	for _, ops := range []KBFSOps{kbfsOps, kbfsOps2} {
+		root := rootNode
+		if ops == kbfsOps2 {
+			root = rootNode2
+		}
+		children, err := ops.GetDirChildren(ctx, root)
+		if err != nil {
+			t.Fatalf("Couldn't get children: %v", err)
+		}
+		if _, ok := children["a"]; !ok || len(children) != 2 {
+			t.Errorf("Unexpected children after resolution: %v", children)
+		}
+	}
+}
+
+func TestJournalServerRetryFailedFlush(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	jServer, mdserver := setupJournalServerForTest(t, config.(*ConfigLocal))
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+
+	mdserver.setConnected(false)
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file while disconnected: %v", err)
+	}
+
+	// The first try fails even though the MD server is back, and
+	// the flusher retries by itself.
+	atomic.StoreInt32(&mdserver.failPuts, 1)
+	mdserver.setConnected(true)
+	fb := rootNode.GetFolderBranch()
+	flushed := jServer.waitForFlush(fb.Tlf)
+	if flushed == nil {
+		t.Fatalf("Nothing to wait for in the journal")
+	}
+	kbfsOps.PushConnectionStatusChange(MDServiceName, nil)
+	if err := <-flushed; err != nil {
+		t.Fatalf("Couldn't flush the journal: %v", err)
+	}
+	if n := jServer.queuedCount(fb.Tlf); n != 0 {
+		t.Errorf("%d entries still queued after the retry", n)
+	}
+}
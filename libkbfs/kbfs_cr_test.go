@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"bytes"
 	"reflect"
 	"sync"
 	"testing"
@@ -1446,3 +1447,643 @@ func TestCRSyncParallelBlocksErrorCleanup(t *testing.T) {
 		t.Fatalf("Couldn't sync from server: %v", err)
 	}
 }
+
+// Tests that conflict resolution merges the link counts of a
+// hard-linked file that was linked and unlinked on different
+// branches.
+func TestCRHardLinkCounts(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file with two names in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := []byte{1, 2, 3}
+	err = kbfsOps1.Write(ctx, fileNode1, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	_, err = kbfsOps1.CreateHardLink(ctx, rootNode1, "b", fileNode1)
+	if err != nil {
+		t.Fatalf("Couldn't create hard link: %v", err)
+	}
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// User 1 removes one name
+	err = kbfsOps1.RemoveEntry(ctx, rootNode1, "a")
+	if err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+
+	// User 2 adds another name
+	_, err = kbfsOps2.CreateHardLink(ctx, rootNode2, "c", fileNode2)
+	if err != nil {
+		t.Fatalf("Couldn't create hard link: %v", err)
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// Make sure they both see the same set of children
+	expectedChildren := []string{"b", "c"}
+	children1, err := kbfsOps1.GetDirChildren(ctx, rootNode1)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+
+	children2, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+
+	if g, e := len(children1), len(expectedChildren); g != e {
+		t.Errorf("Wrong number of children: %d vs %d", g, e)
+	}
+
+	for _, child := range expectedChildren {
+		ei, ok := children1[child]
+		if !ok {
+			t.Errorf("Couldn't find child %s", child)
+		} else if ei.Nlink != 2 {
+			t.Errorf("Wrong link count for %s: %d", child, ei.Nlink)
+		}
+	}
+
+	if !reflect.DeepEqual(children1, children2) {
+		t.Fatalf("Users 1 and 2 see different children: %v vs %v",
+			children1, children2)
+	}
+
+	// The new name works for user 1 too
+	cNode1, _, err := kbfsOps1.Lookup(ctx, rootNode1, "c")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+	buf := make([]byte, len(data))
+	nr, err := kbfsOps1.Read(ctx, cNode1, buf, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	if nr != int64(len(data)) || !bytes.Equal(data, buf) {
+		t.Fatalf("Got wrong data %v; expected %v", buf[:nr], data)
+	}
+}
+
+// Tests that changes to different extended attributes of the same
+// file by two users are all kept after conflict resolution.
+func TestCRMergedXattrs(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps1.SetXattr(ctx, fileNode1, "user.both", []byte("0"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// User 1 sets one xattr
+	err = kbfsOps1.SetXattr(ctx, fileNode1, "user.1", []byte("1"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+
+	// User 2 sets a different xattr and removes the shared one
+	err = kbfsOps2.SetXattr(ctx, fileNode2, "user.2", []byte("2"))
+	if err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+	err = kbfsOps2.RemoveXattr(ctx, fileNode2, "user.both")
+	if err != nil {
+		t.Fatalf("Couldn't remove xattr: %v", err)
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// Both users see both new xattrs, and not the removed one.
+	expected := map[string][]byte{
+		"user.1": []byte("1"),
+		"user.2": []byte("2"),
+	}
+	checkXattrs := func(kbfsOps KBFSOps, n Node) {
+		xattrs, err := kbfsOps.GetXattrs(ctx, n)
+		if err != nil {
+			t.Fatalf("Couldn't get xattrs: %v", err)
+		}
+		if len(xattrs) != len(expected) {
+			t.Fatalf("Got xattrs %v, expected %v", xattrs, expected)
+		}
+		for k, v := range expected {
+			if !bytes.Equal(xattrs[k], v) {
+				t.Fatalf("Got xattrs %v, expected %v", xattrs, expected)
+			}
+		}
+	}
+	checkXattrs(kbfsOps1, fileNode1)
+	checkXattrs(kbfsOps2, fileNode2)
+}
+
+func TestCRCopyFileConflict(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps1.Write(ctx, fileNode1, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// User 1 creates a new file with the name user 2 copies to.
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "b", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// User 2 copies the file.
+	_, _, err = kbfsOps2.CopyFile(ctx, fileNode2, rootNode2, "b")
+	if err != nil {
+		t.Fatalf("Couldn't copy file: %v", err)
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// Both users see the new file and the renamed copy, with the
+	// original's data.
+	checkCopy := func(kbfsOps KBFSOps, rootNode Node) {
+		children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+		if err != nil {
+			t.Fatalf("Couldn't get children: %v", err)
+		}
+		if len(children) != 3 {
+			t.Fatalf("Got %d children, expected 3: %v",
+				len(children), children)
+		}
+		for childName, ei := range children {
+			if childName == "a" || childName == "b" {
+				continue
+			}
+			if ei.Size != uint64(len(data)) {
+				t.Fatalf("Copy %s has size %d", childName, ei.Size)
+			}
+			n, _, err := kbfsOps.Lookup(ctx, rootNode, childName)
+			if err != nil {
+				t.Fatalf("Couldn't lookup copy: %v", err)
+			}
+			buf := make([]byte, len(data))
+			nr, err := kbfsOps.Read(ctx, n, buf, 0)
+			if err != nil {
+				t.Fatalf("Couldn't read copy: %v", err)
+			}
+			if !bytes.Equal(data, buf[:nr]) {
+				t.Fatalf("Copy has the wrong data: %v", buf[:nr])
+			}
+		}
+	}
+	checkCopy(kbfsOps1, rootNode1)
+	checkCopy(kbfsOps2, rootNode2)
+}
+
+// Tests that when two users append to the same file at the same
+// time, CR merges the appends into the file, with the merged data
+// first, instead of making a conflicted copy.
+func testCRAppendConflict(t *testing.T, blockSize int64) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	if blockSize > 0 {
+		for _, config := range []Config{config1, config2} {
+			bsplitter, err := NewBlockSplitterSimple(
+				blockSize, 8*1024, config.Codec())
+			if err != nil {
+				t.Fatalf("Couldn't create block splitter: %v", err)
+			}
+			config.SetBlockSplitter(bsplitter)
+		}
+	}
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps1.Write(ctx, fileNode1, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// Both users append to the file.
+	data1 := bytes.Repeat([]byte{6}, 10)
+	err = kbfsOps1.Append(ctx, fileNode1, data1)
+	if err != nil {
+		t.Fatalf("Couldn't append to file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	data2 := bytes.Repeat([]byte{7}, 30)
+	err = kbfsOps2.Append(ctx, fileNode2, data2[:15])
+	if err != nil {
+		t.Fatalf("Couldn't append to file: %v", err)
+	}
+	err = kbfsOps2.Append(ctx, fileNode2, data2[15:])
+	if err != nil {
+		t.Fatalf("Couldn't append to file: %v", err)
+	}
+	err = kbfsOps2.Sync(ctx, fileNode2)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// Both users see just the one file, with all of the data.
+	expectedData := append(append(append([]byte{}, data...), data1...),
+		data2...)
+	checkAppended := func(kbfsOps KBFSOps, rootNode Node, fileNode Node) {
+		children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+		if err != nil {
+			t.Fatalf("Couldn't get children: %v", err)
+		}
+		if len(children) != 1 {
+			t.Fatalf("Got %d children, expected 1: %v",
+				len(children), children)
+		}
+		if ei := children["a"]; ei.Size != uint64(len(expectedData)) {
+			t.Fatalf("File has size %d, expected %d",
+				ei.Size, len(expectedData))
+		}
+		buf := make([]byte, len(expectedData))
+		nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read file: %v", err)
+		}
+		if !bytes.Equal(expectedData, buf[:nr]) {
+			t.Fatalf("File has the wrong data: %v", buf[:nr])
+		}
+	}
+	checkAppended(kbfsOps1, rootNode1, fileNode1)
+	checkAppended(kbfsOps2, rootNode2, fileNode2)
+}
+
+func TestCRAppendConflict(t *testing.T) {
+	testCRAppendConflict(t, 0)
+}
+
+// Tests appends that make the merged file indirect.
+func TestCRAppendConflictIndirect(t *testing.T) {
+	testCRAppendConflict(t, 20)
+}
+
+// Tests that when two users edit different lines of the same text
+// file at the same time, in a folder with merging enabled, CR merges
+// their changes into the file.  If the edits conflict, CR makes a
+// conflicted copy of the unmerged file as usual.
+func testCRMergeFileConflict(t *testing.T, blockSize int64,
+	unmergedData []byte, expectedData []byte) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	if blockSize > 0 {
+		for _, config := range []Config{config1, config2} {
+			bsplitter, err := NewBlockSplitterSimple(
+				blockSize, 8*1024, config.Codec())
+			if err != nil {
+				t.Fatalf("Couldn't create block splitter: %v", err)
+			}
+			config.SetBlockSplitter(bsplitter)
+		}
+	}
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := []byte("one\ntwo\nthree\nfour\nfive\n")
+	err = kbfsOps1.Write(ctx, fileNode1, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// look it up on user2, who resolves the conflict and so is the
+	// one that needs merging enabled.
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	config2.ContentMerger().(*ContentMergerStandard).EnableForTlf(
+		buildCanonicalPath(false, CanonicalTlfName(name)), 1<<20)
+
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// User 1 changes the first line.
+	mergedData := []byte("ONE\ntwo\nthree\nfour\nfive\n")
+	err = kbfsOps1.Write(ctx, fileNode1, mergedData, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// User 2 writes the new contents.
+	err = kbfsOps2.Truncate(ctx, fileNode2, 0)
+	if err != nil {
+		t.Fatalf("Couldn't truncate file: %v", err)
+	}
+	err = kbfsOps2.Write(ctx, fileNode2, unmergedData, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps2.Sync(ctx, fileNode2)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// Both users see the merged contents, and a conflicted copy if
+	// the changes couldn't be merged.
+	expectedChildren := 1
+	if expectedData == nil {
+		expectedChildren = 2
+		expectedData = mergedData
+	}
+	checkMerged := func(kbfsOps KBFSOps, rootNode Node, fileNode Node) {
+		children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+		if err != nil {
+			t.Fatalf("Couldn't get children: %v", err)
+		}
+		if len(children) != expectedChildren {
+			t.Fatalf("Got %d children, expected %d: %v",
+				len(children), expectedChildren, children)
+		}
+		if ei := children["a"]; ei.Size != uint64(len(expectedData)) {
+			t.Fatalf("File has size %d, expected %d",
+				ei.Size, len(expectedData))
+		}
+		buf := make([]byte, len(expectedData)+1)
+		nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read file: %v", err)
+		}
+		if !bytes.Equal(expectedData, buf[:nr]) {
+			t.Fatalf("File has the wrong data: %q", buf[:nr])
+		}
+	}
+	checkMerged(kbfsOps1, rootNode1, fileNode1)
+	checkMerged(kbfsOps2, rootNode2, fileNode2)
+}
+
+func TestCRMergeFileConflict(t *testing.T) {
+	testCRMergeFileConflict(t, 0,
+		[]byte("one\ntwo\nthree\nfour\nfive\nsix\n"),
+		[]byte("ONE\ntwo\nthree\nfour\nfive\nsix\n"))
+}
+
+// Tests merges into and out of files with indirect blocks.
+func TestCRMergeFileConflictIndirect(t *testing.T) {
+	testCRMergeFileConflict(t, 20,
+		[]byte("one\ntwo\nthree\nfive\n"),
+		[]byte("ONE\ntwo\nthree\nfive\n"))
+}
+
+func TestCRMergeFileConflictFallback(t *testing.T) {
+	testCRMergeFileConflict(t, 0,
+		[]byte("1\ntwo\nthree\nfour\nfive\n"), nil)
+}
@@ -24,6 +24,9 @@ type KBFSOpsStandard struct {
 	ops      map[FolderBranch]*folderBranchOps
 	opsByFav map[Favorite]*folderBranchOps
 	opsLock  sync.RWMutex
+	// archivedLock makes pinning a revision and making its ops
+	// atomic with respect to unpinning it and removing its ops.
+	archivedLock sync.Mutex
 	// reIdentifyControlChan controls reidentification.
 	// Sending a value to this channel forces all fbos
 	// to be marked for revalidation.
@@ -113,6 +116,28 @@ func (fs *KBFSOpsStandard) Shutdown() error {
 // PushConnectionStatusChange pushes human readable connection status changes.
 func (fs *KBFSOpsStandard) PushConnectionStatusChange(service string, newStatus error) {
 	fs.currentStatus.PushConnectionStatusChange(service, newStatus)
+	if service == MDServiceName && newStatus == nil {
+		// Send anything journaled while disconnected.
+		if jServer, err := GetJournalServer(fs.config); err == nil {
+			jServer.signalFlush()
+		}
+	}
+}
+
+var _ branchChangeListener = (*KBFSOpsStandard)(nil)
+
+// onTLFBranchChange implements the branchChangeListener interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) onTLFBranchChange(ctx context.Context,
+	tlfID TlfID, newBID BranchID) error {
+	fs.opsLock.RLock()
+	ops, ok := fs.ops[FolderBranch{Tlf: tlfID, Branch: MasterBranch}]
+	fs.opsLock.RUnlock()
+	if !ok {
+		// It finds its branch on the server when it's loaded.
+		return nil
+	}
+	return ops.onTLFBranchChange(ctx, newBID)
 }
 
 // GetFavorites implements the KBFSOps interface for
@@ -174,8 +199,13 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(fb FolderBranch) *folderBranchOps {
 	ops, ok := fs.ops[fb]
 	if !ok {
 		// TODO: add some interface for specifying the type of the
-		// branch; for now assume online and read-write.
-		ops = newFolderBranchOps(fs.config, fb, standard)
+		// branch; for now assume online, and read-write unless it
+		// views an older revision.
+		bType := standard
+		if fb.Branch.IsArchived() {
+			bType = archive
+		}
+		ops = newFolderBranchOps(fs.config, fb, bType)
 		fs.ops[fb] = ops
 	}
 	return ops
@@ -209,6 +239,37 @@ func (fs *KBFSOpsStandard) getOpsByHandle(ctx context.Context,
 	return ops
 }
 
+// getHeadWhileDisconnected returns the head of the folder with the
+// given handle, if the MD server can't be reached but the folder is
+// either already loaded or has a head persisted in the DiskMDCache.
+func (fs *KBFSOpsStandard) getHeadWhileDisconnected(
+	ctx context.Context, h *TlfHandle) *RootMetadata {
+	if fs.config.MDServer().IsConnected() {
+		return nil
+	}
+
+	fs.opsLock.RLock()
+	ops, ok := fs.opsByFav[h.ToFavorite()]
+	fs.opsLock.RUnlock()
+	if ok {
+		if md := ops.getHead(makeFBOLockState()); md != nil {
+			return md
+		}
+	}
+
+	dmcache := fs.config.DiskMDCache()
+	if dmcache == nil {
+		return nil
+	}
+	md, err := dmcache.GetForHandle(ctx, h)
+	if err != nil {
+		fs.log.CDebugf(ctx, "Couldn't get the persisted head for %s: %v",
+			h.GetCanonicalPath(), err)
+		return nil
+	}
+	return md
+}
+
 // GetOrCreateRootNode implements the KBFSOps interface for
 // KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetOrCreateRootNode(
@@ -222,12 +283,11 @@ func (fs *KBFSOpsStandard) GetOrCreateRootNode(
 	mdops := fs.config.MDOps()
 	// TODO: only do this the first time, cache the folder ID after that
 	md, err := mdops.GetUnmergedForHandle(ctx, h)
-	if err != nil {
-		return nil, EntryInfo{}, err
-	}
-	if md == nil {
+	if err == nil && md == nil {
 		md, err = mdops.GetForHandle(ctx, h)
-		if err != nil {
+	}
+	if err != nil {
+		if md = fs.getHeadWhileDisconnected(ctx, h); md == nil {
 			return nil, EntryInfo{}, err
 		}
 	}
@@ -272,6 +332,103 @@ func (fs *KBFSOpsStandard) GetOrCreateRootNode(
 	return node, ei, nil
 }
 
+// GetRootNodeAtRevision implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetRootNodeAtRevision(
+	ctx context.Context, h *TlfHandle, rev MetadataRevision) (
+	node Node, ei EntryInfo, err error) {
+	fs.log.CDebugf(ctx, "GetRootNodeAtRevision(%s, %d)",
+		h.GetCanonicalPath(), rev)
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %#v", err) }()
+
+	md, err := fs.config.MDOps().GetForHandle(ctx, h)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if err := md.isReadableOrError(ctx, fs.config); err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if rev < MetadataRevisionInitial || rev > md.Revision {
+		return nil, EntryInfo{}, NoSuchRevisionError{rev}
+	}
+
+	// Pin the revision before reading anything from it, so that the
+	// master branch doesn't reclaim its blocks in the meantime.
+	fb := FolderBranch{Tlf: md.ID, Branch: MakeRevBranchName(rev)}
+	ops := func() *folderBranchOps {
+		fs.archivedLock.Lock()
+		defer fs.archivedLock.Unlock()
+		fs.getOpsNoAdd(FolderBranch{Tlf: md.ID, Branch: MasterBranch}).
+			fbm.pinRevision(rev)
+		return fs.getOpsNoAdd(fb)
+	}()
+	node, ei, _, err = ops.getRootNode(ctx)
+	if err != nil {
+		if releaseErr := fs.ReleaseRevision(ctx, fb); releaseErr != nil {
+			fs.log.CDebugf(ctx, "Couldn't release revision %d: %v",
+				rev, releaseErr)
+		}
+		return nil, EntryInfo{}, err
+	}
+	return node, ei, nil
+}
+
+// ReleaseRevision implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) ReleaseRevision(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fs.log.CDebugf(ctx, "ReleaseRevision(%s)", folderBranch)
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %#v", err) }()
+
+	rev, ok := folderBranch.Branch.RevisionIfSpecified()
+	if !ok {
+		return fmt.Errorf("%s doesn't view an older revision", folderBranch)
+	}
+
+	fs.archivedLock.Lock()
+	defer fs.archivedLock.Unlock()
+	master := fs.getOpsNoAdd(
+		FolderBranch{Tlf: folderBranch.Tlf, Branch: MasterBranch})
+	if master.fbm.unpinRevision(rev) > 0 {
+		return nil
+	}
+
+	// Nothing views this revision anymore, so stop its background
+	// goroutines and forget its ops.
+	fs.opsLock.Lock()
+	ops, ok := fs.ops[folderBranch]
+	delete(fs.ops, folderBranch)
+	fs.opsLock.Unlock()
+	if !ok {
+		return nil
+	}
+	return ops.Shutdown()
+}
+
+// GetRevisionAtTime implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetRevisionAtTime(
+	ctx context.Context, h *TlfHandle, serverTime time.Time) (
+	rev MetadataRevision, err error) {
+	fs.log.CDebugf(ctx, "GetRevisionAtTime(%s, %s)",
+		h.GetCanonicalPath(), serverTime)
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %d %#v", rev, err) }()
+
+	md, err := fs.config.MDOps().GetForHandle(ctx, h)
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+	if err := md.isReadableOrError(ctx, fs.config); err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+
+	md, err = fs.config.MDOps().GetForTLFByTime(ctx, md.ID, serverTime)
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+	return md.Revision, nil
+}
+
 // GetDirChildren implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetDirChildren(ctx context.Context, dir Node) (
 	map[string]EntryInfo, error) {
@@ -316,6 +473,69 @@ func (fs *KBFSOpsStandard) CreateLink(
 	return ops.CreateLink(ctx, dir, fromName, toPath)
 }
 
+// CreateHardLink implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CreateHardLink(
+	ctx context.Context, dir Node, name string, file Node) (
+	EntryInfo, error) {
+	// only works for nodes within the same topdir
+	if dir.GetFolderBranch() != file.GetFolderBranch() {
+		return EntryInfo{}, LinkAcrossFoldersError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CreateHardLink(ctx, dir, name, file)
+}
+
+// CopyFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CopyFile(
+	ctx context.Context, file Node, dir Node, name string) (
+	Node, EntryInfo, error) {
+	// only works for nodes within the same topdir
+	if dir.GetFolderBranch() != file.GetFolderBranch() {
+		return nil, EntryInfo{}, CopyAcrossFoldersError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CopyFile(ctx, file, dir, name)
+}
+
+// GetDeletedEntries implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetDeletedEntries(
+	ctx context.Context, folderBranch FolderBranch) ([]DeletedEntry, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.GetDeletedEntries(ctx, folderBranch)
+}
+
+// RestoreDeletedEntry implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) RestoreDeletedEntry(
+	ctx context.Context, entry DeletedEntry, dir Node, name string) (
+	Node, EntryInfo, error) {
+	// only works for entries within the same topdir
+	if dir.GetFolderBranch().Tlf != entry.tlf {
+		return nil, EntryInfo{}, CopyAcrossFoldersError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.RestoreDeletedEntry(ctx, entry, dir, name)
+}
+
+// GetFileHistory implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetFileHistory(
+	ctx context.Context, file Node) ([]FileVersion, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.GetFileHistory(ctx, file)
+}
+
+// RestoreFileVersion implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) RestoreFileVersion(
+	ctx context.Context, file Node, rev MetadataRevision) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.RestoreFileVersion(ctx, file, rev)
+}
+
 // RemoveDir implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RemoveDir(
 	ctx context.Context, dir Node, name string) error {
@@ -337,15 +557,61 @@ func (fs *KBFSOpsStandard) Rename(
 	oldFB := oldParent.GetFolderBranch()
 	newFB := newParent.GetFolderBranch()
 
-	// only works for nodes within the same topdir
 	if oldFB != newFB {
-		return RenameAcrossDirsError{}
+		// Only master branches of different top-level folders
+		// can be moved between.
+		if oldFB.Tlf == newFB.Tlf || oldFB.Branch != MasterBranch ||
+			newFB.Branch != MasterBranch {
+			return RenameAcrossDirsError{}
+		}
+		return fs.renameAcrossFolders(
+			ctx, oldParent, oldName, newParent, newName)
 	}
 
 	ops := fs.getOpsByNode(ctx, oldParent)
 	return ops.Rename(ctx, oldParent, oldName, newParent, newName)
 }
 
+// renameAcrossFolders moves an entry into another top-level folder,
+// by copying its blocks, re-encrypted under the keys of the new
+// folder.  The old entry is only removed once the new folder's MD
+// with the copy has been put, so at worst a crash leaves the entry in
+// both folders.  If the old entry changes in the meantime, the copy is
+// removed again, and the entry stays only in the old folder.
+func (fs *KBFSOpsStandard) renameAcrossFolders(
+	ctx context.Context, oldParent Node, oldName string, newParent Node,
+	newName string) error {
+	oldOps := fs.getOpsByNode(ctx, oldParent)
+	newOps := fs.getOpsByNode(ctx, newParent)
+
+	srcMD, de, err := oldOps.getEntryForMove(ctx, oldParent, oldName)
+	if err != nil {
+		return err
+	}
+	mb, err := newOps.importEntry(ctx, newParent, newName, srcMD, de)
+	if err != nil {
+		return err
+	}
+	err = oldOps.removeMovedEntry(
+		ctx, oldParent, oldName, de.BlockPointer, mb)
+	if _, ok := err.(EntryChangedDuringMoveError); !ok {
+		return err
+	}
+
+	// The root block of the copy is the last one made.
+	copyPtr := zeroPtr
+	if len(mb.new) > 0 {
+		copyPtr = mb.new[len(mb.new)-1].BlockPointer
+	}
+	removeErr := newOps.removeMovedEntry(ctx, newParent, newName, copyPtr,
+		&movedBlocks{old: mb.new})
+	if removeErr != nil {
+		fs.log.CDebugf(ctx, "Couldn't remove the copy of %s: %v",
+			oldName, removeErr)
+	}
+	return err
+}
+
 // Read implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Read(
 	ctx context.Context, file Node, dest []byte, off int64) (
@@ -354,6 +620,20 @@ func (fs *KBFSOpsStandard) Read(
 	return ops.Read(ctx, file, dest, off)
 }
 
+// SeekData implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SeekData(
+	ctx context.Context, file Node, off int64) (int64, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.SeekData(ctx, file, off)
+}
+
+// SeekHole implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SeekHole(
+	ctx context.Context, file Node, off int64) (int64, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.SeekHole(ctx, file, off)
+}
+
 // Write implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Write(
 	ctx context.Context, file Node, data []byte, off int64) error {
@@ -361,6 +641,13 @@ func (fs *KBFSOpsStandard) Write(
 	return ops.Write(ctx, file, data, off)
 }
 
+// Append implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) Append(
+	ctx context.Context, file Node, data []byte) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.Append(ctx, file, data)
+}
+
 // Truncate implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Truncate(
 	ctx context.Context, file Node, size uint64) error {
@@ -382,6 +669,49 @@ func (fs *KBFSOpsStandard) SetMtime(
 	return ops.SetMtime(ctx, file, mtime)
 }
 
+// GetXattrs implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetXattrs(
+	ctx context.Context, node Node) (map[string][]byte, error) {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.GetXattrs(ctx, node)
+}
+
+// SetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetXattr(
+	ctx context.Context, node Node, name string, value []byte) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.SetXattr(ctx, node, name, value)
+}
+
+// RemoveXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) RemoveXattr(
+	ctx context.Context, node Node, name string) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.RemoveXattr(ctx, node, name)
+}
+
+// LockFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) LockFile(
+	ctx context.Context, file Node, lock FileLock) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.LockFile(ctx, file, lock)
+}
+
+// UnlockFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) UnlockFile(ctx context.Context, file Node,
+	owner uint64, start uint64, end uint64) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.UnlockFile(ctx, file, owner, start, end)
+}
+
+// GetConflictingFileLock implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetConflictingFileLock(
+	ctx context.Context, file Node, lock FileLock) (FileLock, bool, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.GetConflictingFileLock(ctx, file, lock)
+}
+
 // Sync implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Sync(ctx context.Context, file Node) error {
 	ops := fs.getOpsByNode(ctx, file)
@@ -449,6 +779,13 @@ func (fs *KBFSOpsStandard) SyncFromServerForTesting(
 	return ops.SyncFromServerForTesting(ctx, folderBranch)
 }
 
+// BeginTx implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) BeginTx(
+	ctx context.Context, folderBranch FolderBranch) (KBFSTx, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.BeginTx(ctx, folderBranch)
+}
+
 // GetUpdateHistory implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetUpdateHistory(ctx context.Context,
 	folderBranch FolderBranch) (history TLFUpdateHistory, err error) {
@@ -456,6 +793,14 @@ func (fs *KBFSOpsStandard) GetUpdateHistory(ctx context.Context,
 	return ops.GetUpdateHistory(ctx, folderBranch)
 }
 
+// GetRevisionDiff implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetRevisionDiff(ctx context.Context,
+	folderBranch FolderBranch, from, to MetadataRevision) (
+	RevisionDiff, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.GetRevisionDiff(ctx, folderBranch, from, to)
+}
+
 // Notifier:
 var _ Notifier = (*KBFSOpsStandard)(nil)
 
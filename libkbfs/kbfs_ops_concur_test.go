@@ -10,6 +10,7 @@ import (
 	"runtime"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/keybase/client/go/libkb"
@@ -269,13 +270,15 @@ func testKBFSOpsConcurWritesDuringSync(t *testing.T,
 
 	// there should be 4+n clean blocks at this point: the original
 	// root block + 2 modifications (create + write), the empty file
-	// block, the n initial modification blocks plus top block (if
-	// applicable).
+	// block, the n initial modification blocks plus all the indirect
+	// blocks above them (if applicable).
 	bcs := config.BlockCache().(*BlockCacheStandard)
 	numCleanBlocks := bcs.cleanTransient.Len()
 	nFileBlocks := 1 + len(data)/int(bsplitter.maxSize)
-	if nFileBlocks > 1 {
-		nFileBlocks++ // top indirect block
+	for nLevel := nFileBlocks; nLevel > 1; {
+		nLevel = (nLevel + bsplitter.maxPtrsPerBlock - 1) /
+			bsplitter.maxPtrsPerBlock
+		nFileBlocks += nLevel // indirect blocks
 	}
 	if g, e := numCleanBlocks, 4+nFileBlocks; g != e {
 		t.Errorf("Unexpected number of cached clean blocks: %d vs %d (%d vs %d)\n", g, e, totalSize, bsplitter.maxSize)
@@ -1108,6 +1111,82 @@ func TestKBFSOpsConcurWriteParallelBlocksCanceled(t *testing.T) {
 	config.MDServer().Shutdown()
 }
 
+// Test that a folder runs as many block puts at once as the transfer
+// scheduler allows, even past the default limit.
+func TestKBFSOpsConcurWriteParallelBlocksSchedulerLimit(t *testing.T) {
+	config, _, ctx := kbfsOpsConcurInit(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	maxPuts := 2 * maxParallelBlockPuts
+	config.SetTransferScheduler(
+		NewTransferSchedulerStandard(config, maxPuts, 0, 0))
+
+	// give it a remote block server with a fake client
+	fc := NewFakeBServerClient(nil, nil, nil)
+	b := newBlockServerRemoteWithClient(config, fc)
+	config.SetBlockServer(b)
+
+	// make blocks small
+	blockSize := int64(5)
+	config.BlockSplitter().(*BlockSplitterSimple).maxSize = blockSize
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	var data []byte
+	for i := int64(0); i < blockSize*int64(maxPuts+3); i++ {
+		data = append(data, byte(i))
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	if err != nil {
+		t.Errorf("Couldn't write file: %v", err)
+	}
+
+	readyChan := make(chan struct{})
+	goChan := make(chan struct{})
+	fc.readyChan = readyChan
+	fc.goChan = goChan
+
+	syncDone := make(chan struct{})
+	go func() {
+		defer close(goChan)
+		// Every worker should be waiting on the server at once.
+		for i := 0; i < maxPuts; i++ {
+			select {
+			case <-readyChan:
+			case <-time.After(10 * time.Second):
+				t.Errorf("Only %d of %d puts started at once", i, maxPuts)
+				return
+			}
+		}
+	}()
+	go func() {
+		// Let the rest of the puts through once the workers are
+		// released.
+		<-goChan
+		for {
+			select {
+			case <-readyChan:
+			case <-syncDone:
+				return
+			}
+		}
+	}()
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	close(syncDone)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// Avoid checking state when using a fake block server.
+	config.MDServer().Shutdown()
+}
+
 // Test that, when writing multiple blocks in parallel, one error will
 // cancel the remaining puts.
 func TestKBFSOpsConcurWriteParallelBlocksError(t *testing.T) {
@@ -1567,14 +1646,22 @@ func TestKBFSOpsErrorOnBlockedWriteDuringSync(t *testing.T) {
 		t.Fatalf("Couldn't create file: %v", err)
 	}
 
-	// Write over the dirty amount of data.  TODO: make this
-	// configurable for a speedier test.
-	data := make([]byte, dirtyBytesThreshold+1)
+	// Write over the dirty amount of data.
+	const maxDirtyBytes = 64 << 10
+	config.SetDirtyBudget(NewDirtyBudgetStandard(
+		config, maxDirtyBytes, maxDirtyBytes, dirtyBudgetSyncTimeDefault))
+	data := make([]byte, maxDirtyBytes+1)
 	err = kbfsOps.Write(ctx, fileNode, data, 0)
 	if err != nil {
 		t.Errorf("Couldn't write file: %v", err)
 	}
 
+	// Let the archiving of the old blocks finish with the real
+	// block ops before swapping them out.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	if err := ops.fbm.waitForArchives(ctx); err != nil {
+		t.Fatalf("Couldn't wait for archives: %v", err)
+	}
 	booq := &blockOpsOverQuota{BlockOps: staller.delegate}
 	staller.delegate = booq
 
@@ -1595,7 +1682,6 @@ func TestKBFSOpsErrorOnBlockedWriteDuringSync(t *testing.T) {
 	}()
 
 	// Wait until the write is blocked
-	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
 	func() {
 		lState := makeFBOLockState()
 		ops.blocks.blockLock.Lock(lState)
@@ -8,7 +8,11 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -96,6 +100,9 @@ func kbfsOpsInit(t *testing.T, changeMd bool) (mockCtrl *gomock.Controller,
 	config.mockMdserv.EXPECT().RegisterForUpdate(gomock.Any(),
 		gomock.Any(), gomock.Any()).AnyTimes().Return(c, nil)
 
+	// None of these tests run while disconnected.
+	config.mockMdserv.EXPECT().IsConnected().AnyTimes().Return(true)
+
 	// None of these tests depend on time
 	config.mockClock.EXPECT().Now().AnyTimes().Return(time.Now())
 
@@ -112,6 +119,9 @@ func kbfsOpsInit(t *testing.T, changeMd bool) (mockCtrl *gomock.Controller,
 	config.mockKbpki.EXPECT().FavoriteAdd(gomock.Any(), gomock.Any()).
 		AnyTimes().Return(nil)
 
+	// Don't limit the fan-out of indirect file blocks
+	config.mockBsplit.EXPECT().MaxPtrsPerBlock().AnyTimes().Return(0)
+
 	interposeDaemonKBPKI(config, "alice", "bob", "charlie")
 
 	// make the context identifiable, to verify that it is passed
@@ -573,7 +583,7 @@ func makeBP(id BlockID, rmd *RootMetadata, config Config,
 	return BlockPointer{
 		ID:      id,
 		KeyGen:  rmd.LatestKeyGeneration(),
-		DataVer: config.DataVersion(),
+		DataVer: defaultNewBlockDataVersion(false, false, false, false, false),
 		Creator: u,
 		// refnonces not needed for tests until dedup is implemented
 	}
@@ -595,6 +605,7 @@ func makeIFP(id BlockID, rmd *RootMetadata, config Config,
 			EncodedSize:  encodedSize,
 		},
 		off,
+		false,
 		codec.UnknownFieldSetHandler{},
 	}
 }
@@ -994,6 +1005,9 @@ func expectSyncBlockHelper(
 	// all MD is embedded for now
 	config.mockBsplit.EXPECT().ShouldEmbedBlockChanges(gomock.Any()).
 		AnyTimes().Return(true)
+	// no directories are big enough to be split
+	config.mockBsplit.EXPECT().SplitDirIfNeeded(gomock.Any()).
+		AnyTimes().Return(nil)
 
 	// By convention for these tests, the old blocks along the path
 	// all have EncodedSize == 1.
@@ -2397,43 +2411,34 @@ func TestRenameAcrossOtherPrefixSuccess(t *testing.T) {
 }
 
 func TestRenameFailAcrossTopLevelFolders(t *testing.T) {
-	mockCtrl, config, ctx := kbfsOpsInit(t, false)
-	defer kbfsTestShutdown(mockCtrl, config)
-
-	id1 := FakeTlfID(1, false)
-	h1 := parseTlfHandleOrBust(t, config, "alice,bob", false)
-	rmd1 := newRootMetadataOrBust(t, id1, h1)
-
-	id2 := FakeTlfID(2, false)
-	h2 := parseTlfHandleOrBust(t, config, "alice,bob,charlie", false)
-	rmd2 := newRootMetadataOrBust(t, id1, h2)
-
-	uid1 := h2.Writers[0]
-	uid2 := h2.Writers[2]
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config, _, ctx := kbfsOpsInitNoMocks(t, u1, u2)
+	defer CheckConfigAndShutdown(t, config)
 
-	rootID1 := fakeBlockID(41)
-	aID1 := fakeBlockID(42)
-	node1 := pathNode{makeBP(rootID1, rmd1, config, uid1), "p"}
-	aNode1 := pathNode{makeBP(aID1, rmd1, config, uid1), "a"}
-	p1 := path{FolderBranch{Tlf: id1}, []pathNode{node1, aNode1}}
-	ops1 := getOps(config, id1)
-	n1 := nodeFromPath(t, ops1, p1)
+	kbfsOps := config.KBFSOps()
+	rootNode1 := GetRootNodeOrBust(t, config, u1.String(), false)
+	rootNode2 := GetRootNodeOrBust(
+		t, config, u1.String()+","+u2.String(), false)
 
-	rootID2 := fakeBlockID(38)
-	aID2 := fakeBlockID(39)
-	node2 := pathNode{makeBP(rootID2, rmd2, config, uid2), "p"}
-	aNode2 := pathNode{makeBP(aID2, rmd2, config, uid2), "a"}
-	p2 := path{FolderBranch{Tlf: id2}, []pathNode{node2, aNode2}}
-	ops2 := getOps(config, id2)
-	n2 := nodeFromPath(t, ops2, p2)
+	// A file with several names can't be moved to another folder.
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if _, err := kbfsOps.CreateHardLink(
+		ctx, rootNode1, "b", fileNode); err != nil {
+		t.Fatalf("Couldn't create hard link: %v", err)
+	}
 
 	expectedErr := RenameAcrossDirsError{}
 
-	if err := config.KBFSOps().Rename(ctx, n1, "b", n2, "c"); err == nil {
+	if err := kbfsOps.Rename(ctx, rootNode1, "b", rootNode2, "c"); err == nil {
 		t.Errorf("Got no expected error on rename")
 	} else if err.Error() != expectedErr.Error() {
 		t.Errorf("Got unexpected error on rename: %v", err)
 	}
+	checkTxChildren(t, ctx, config, rootNode1, "a", "b")
+	checkTxChildren(t, ctx, config, rootNode2)
 }
 
 func TestRenameFailAcrossBranches(t *testing.T) {
@@ -3548,11 +3553,13 @@ func TestKBFSOpsTruncateBiggerSuccess(t *testing.T) {
 
 	testPutBlockInCache(config, node.BlockPointer, id, rootBlock)
 	testPutBlockInCache(config, fileNode.BlockPointer, id, fileBlock)
+	// the block is padded out with zeroes up to the new size
 	config.mockBsplit.EXPECT().CopyUntilSplit(
-		gomock.Any(), gomock.Any(), []byte{0, 0, 0, 0, 0}, int64(5)).
+		gomock.Any(), gomock.Any(), []byte(nil), int64(10)).
 		Do(func(block *FileBlock, lb bool, data []byte, off int64) {
-			block.Contents = append(block.Contents, data...)
-		}).Return(int64(5))
+			block.Contents = append(block.Contents,
+				make([]byte, off-int64(len(block.Contents)))...)
+		}).Return(int64(0))
 
 	data := []byte{1, 2, 3, 4, 5, 0, 0, 0, 0, 0}
 	if err := config.KBFSOps().Truncate(ctx, n, 10); err != nil {
@@ -5059,3 +5066,1894 @@ func TestKBFSOpsFailToReadUnverifiableBlock(t *testing.T) {
 		t.Fatalf("Could unexpectedly lookup the file: %v", err)
 	}
 }
+
+func TestKBFSOpsIndirectDirBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	// make dir blocks small
+	bsplit := config.BlockSplitter().(*BlockSplitterSimple)
+	bsplit.maxDirEntriesPerBlock = 4
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+
+	const numFiles = 20
+	createFiles := func(n Node) {
+		for i := 0; i < numFiles; i++ {
+			_, _, err := kbfsOps.CreateFile(
+				ctx, n, fmt.Sprintf("f%02d", i), false)
+			if err != nil {
+				t.Fatalf("Couldn't create file %d: %v", i, err)
+			}
+		}
+	}
+	dirSize := func(n Node) uint64 {
+		ei, err := kbfsOps.Stat(ctx, n)
+		if err != nil {
+			t.Fatalf("Couldn't stat dir: %v", err)
+		}
+		return ei.Size
+	}
+	createFiles(dirNode)
+
+	// Make the same directory without splitting it, to compare sizes.
+	bsplit.maxDirEntriesPerBlock = 2 * numFiles
+	directNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "e")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	createFiles(directNode)
+	bsplit.maxDirEntriesPerBlock = 4
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	checkInd := func(expectedInd bool) {
+		md, err := ops.getMDLocked(ctx, lState, mdReadNoIdentify)
+		if err != nil {
+			t.Fatalf("Couldn't get MD: %v", err)
+		}
+		p := ops.nodeCache.PathFromNode(dirNode)
+		dblock, err := ops.blocks.GetDirBlockForReading(
+			ctx, lState, md, p.tailPointer(), p.Branch, p)
+		if err != nil {
+			t.Fatalf("Couldn't get dir block: %v", err)
+		}
+		if dblock.IsInd != expectedInd {
+			t.Fatalf("Dir block IsInd=%t, expected %t",
+				dblock.IsInd, expectedInd)
+		}
+		// Older clients would see a split directory as empty.
+		v := p.tailPointer().DataVer
+		if expectedInd && v != IndirectDirsDataVer {
+			t.Fatalf("Split dir has data version %d, expected %d",
+				v, IndirectDirsDataVer)
+		} else if !expectedInd && v >= IndirectDirsDataVer {
+			t.Fatalf("Unsplit dir has data version %d", v)
+		}
+	}
+	checkInd(true)
+
+	// The size of the directory covers all of its child blocks.
+	size := dirSize(dirNode)
+	if directSize := dirSize(directNode); size < directSize {
+		t.Fatalf("Split dir size %d is less than unsplit size %d",
+			size, directSize)
+	}
+	config.(*ConfigLocal).maxDirBytes = size
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "toobig", false)
+	if _, ok := err.(DirTooBigError); !ok {
+		t.Fatalf("Unexpected error creating file in full dir: %v", err)
+	}
+	config.(*ConfigLocal).maxDirBytes = maxDirBytesDefault
+
+	children, err := kbfsOps.GetDirChildren(ctx, dirNode)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	if len(children) != numFiles {
+		t.Fatalf("Got %d children, expected %d", len(children), numFiles)
+	}
+	for i := 0; i < numFiles; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		if _, _, err := kbfsOps.Lookup(ctx, dirNode, name); err != nil {
+			t.Fatalf("Couldn't lookup %s: %v", name, err)
+		}
+	}
+
+	// Rename across child blocks, and out of the directory.
+	err = kbfsOps.Rename(ctx, dirNode, "f00", dirNode, "g00")
+	if err != nil {
+		t.Fatalf("Couldn't rename: %v", err)
+	}
+	err = kbfsOps.Rename(ctx, dirNode, "f01", rootNode, "f01")
+	if err != nil {
+		t.Fatalf("Couldn't rename: %v", err)
+	}
+	if _, _, err := kbfsOps.Lookup(ctx, dirNode, "g00"); err != nil {
+		t.Fatalf("Couldn't lookup renamed file: %v", err)
+	}
+
+	// Removing the directory should fail while it's non-empty.
+	err = kbfsOps.RemoveDir(ctx, rootNode, "d")
+	if _, ok := err.(DirNotEmptyError); !ok {
+		t.Fatalf("Unexpected error removing non-empty dir: %v", err)
+	}
+
+	children, err = kbfsOps.GetDirChildren(ctx, dirNode)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	for name := range children {
+		if err := kbfsOps.RemoveEntry(ctx, dirNode, name); err != nil {
+			t.Fatalf("Couldn't remove %s: %v", name, err)
+		}
+	}
+	// The directory should have shrunk back into a direct block.
+	checkInd(false)
+
+	err = kbfsOps.RemoveDir(ctx, rootNode, "d")
+	if err != nil {
+		t.Fatalf("Couldn't remove dir: %v", err)
+	}
+}
+
+func TestKBFSOpsMultiLevelIndirectFileBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	// make file blocks tiny, with only two pointers per indirect
+	// block, so that even small files are several levels deep.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't create block splitter: %v", err)
+	}
+	bsplitter.maxPtrsPerBlock = 2
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	checkDepth := func(expectedDepth int) {
+		md, err := ops.getMDLocked(ctx, lState, mdReadNoIdentify)
+		if err != nil {
+			t.Fatalf("Couldn't get MD: %v", err)
+		}
+		p := ops.nodeCache.PathFromNode(fileNode)
+		fblock, err := ops.blocks.GetFileBlockForReading(
+			ctx, lState, md, p.tailPointer(), p.Branch, p)
+		if err != nil {
+			t.Fatalf("Couldn't get file block: %v", err)
+		}
+		depth := 0
+		for fblock.IsInd {
+			depth++
+			if len(fblock.IPtrs) > bsplitter.maxPtrsPerBlock {
+				t.Fatalf("Too many pointers at depth %d: %d",
+					depth, len(fblock.IPtrs))
+			}
+			fblock, err = ops.blocks.GetFileBlockForReading(ctx, lState,
+				md, fblock.IPtrs[0].BlockPointer, p.Branch, p)
+			if err != nil {
+				t.Fatalf("Couldn't get file block: %v", err)
+			}
+		}
+		if depth != expectedDepth {
+			t.Fatalf("File depth=%d, expected %d", depth, expectedDepth)
+		}
+	}
+
+	checkData := func(expected []byte) {
+		buf := make([]byte, len(expected)+1)
+		nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read data: %v", err)
+		}
+		if nr != int64(len(expected)) || !bytes.Equal(expected, buf[:nr]) {
+			t.Fatalf("Got wrong data %v; expected %v", buf[:nr], expected)
+		}
+	}
+
+	// 100 bytes is 9 leaf blocks, which needs 4 levels of
+	// indirection.
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	checkData(data)
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	checkData(data)
+	checkDepth(4)
+
+	// Listing the file's blocks finds all of them, at every level.
+	md, err := ops.getMDLocked(ctx, lState, mdReadNoIdentify)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %v", err)
+	}
+	p := ops.nodeCache.PathFromNode(fileNode)
+	var countBlocks func(ptr BlockPointer) int
+	countBlocks = func(ptr BlockPointer) int {
+		fblock, err := ops.blocks.GetFileBlockForReading(
+			ctx, lState, md, ptr, p.Branch, p)
+		if err != nil {
+			t.Fatalf("Couldn't get file block: %v", err)
+		}
+		n := 1
+		for _, iptr := range fblock.IPtrs {
+			n += countBlocks(iptr.BlockPointer)
+		}
+		return n
+	}
+	infos, err := ops.blocks.GetIndirectFileBlockInfos(ctx, lState, md, p)
+	if err != nil {
+		t.Fatalf("Couldn't get block infos: %v", err)
+	}
+	if expected := countBlocks(p.tailPointer()) - 1; len(infos) != expected {
+		t.Errorf("Got %d block infos, expected %d", len(infos), expected)
+	}
+
+	// Older clients can't read a file this deep.
+	if v := p.tailPointer().DataVer; v != MultiLevelFilesDataVer {
+		t.Errorf("File has data version %d, expected %d",
+			v, MultiLevelFilesDataVer)
+	}
+
+	// Overwrite a range in the middle, spanning several blocks.
+	newData := []byte{200, 201, 202, 203, 204, 205, 206, 207, 208, 209}
+	if err := kbfsOps.Write(ctx, fileNode, newData, 45); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	copy(data[45:], newData)
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	checkData(data)
+
+	// Truncating drops all the blocks past the new end.
+	if err := kbfsOps.Truncate(ctx, fileNode, 30); err != nil {
+		t.Fatalf("Couldn't truncate file: %v", err)
+	}
+	data = data[:30]
+	checkData(data)
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	checkData(data)
+
+	// And the file can grow again afterwards.
+	if err := kbfsOps.Write(ctx, fileNode, newData, 30); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	data = append(data, newData...)
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	checkData(data)
+	p = ops.nodeCache.PathFromNode(fileNode)
+	if v := p.tailPointer().DataVer; v != MultiLevelFilesDataVer {
+		t.Errorf("File has data version %d after changes, expected %d",
+			v, MultiLevelFilesDataVer)
+	}
+}
+
+func TestKBFSOpsSparseFile(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	// make file blocks tiny, with only two pointers per indirect
+	// block, so holes end up in the middle of the tree.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't create block splitter: %v", err)
+	}
+	bsplitter.maxPtrsPerBlock = 2
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	// countLeaves returns the number of leaf blocks in the file, and
+	// the total number of bytes they hold.
+	countLeaves := func() (leaves int, nBytes int) {
+		md, err := ops.getMDLocked(ctx, lState, mdReadNoIdentify)
+		if err != nil {
+			t.Fatalf("Couldn't get MD: %v", err)
+		}
+		p := ops.nodeCache.PathFromNode(fileNode)
+		var count func(ptr BlockPointer)
+		count = func(ptr BlockPointer) {
+			fblock, err := ops.blocks.GetFileBlockForReading(
+				ctx, lState, md, ptr, p.Branch, p)
+			if err != nil {
+				t.Fatalf("Couldn't get file block: %v", err)
+			}
+			if !fblock.IsInd {
+				leaves++
+				nBytes += len(fblock.Contents)
+				return
+			}
+			for _, iptr := range fblock.IPtrs {
+				count(iptr.BlockPointer)
+			}
+		}
+		count(p.tailPointer())
+		return leaves, nBytes
+	}
+
+	data := []byte{1, 2, 3, 4, 5}
+	checkData := func() {
+		ei, err := kbfsOps.Stat(ctx, fileNode)
+		if err != nil {
+			t.Fatalf("Couldn't stat file: %v", err)
+		}
+		if ei.Size != uint64(len(data)) {
+			t.Fatalf("Size=%d, expected %d", ei.Size, len(data))
+		}
+		buf := make([]byte, len(data)+1)
+		nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read data: %v", err)
+		}
+		if nr != int64(len(data)) || !bytes.Equal(data, buf[:nr]) {
+			t.Fatalf("Got wrong data %v; expected %v", buf[:nr], data)
+		}
+	}
+	checkSeek := func(off int64, hole bool, expectedOff int64) {
+		var newOff int64
+		var err error
+		if hole {
+			newOff, err = kbfsOps.SeekHole(ctx, fileNode, off)
+		} else {
+			newOff, err = kbfsOps.SeekData(ctx, fileNode, off)
+		}
+		if expectedOff < 0 {
+			if _, ok := err.(NoDataAfterOffsetError); !ok {
+				t.Fatalf("Seek(%d, hole=%t) got unexpected result %d, %v",
+					off, hole, newOff, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Seek(%d, hole=%t) failed: %v", off, hole, err)
+		}
+		if newOff != expectedOff {
+			t.Fatalf("Seek(%d, hole=%t)=%d, expected %d",
+				off, hole, newOff, expectedOff)
+		}
+	}
+	sync := func() {
+		if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+			t.Fatalf("Couldn't sync file: %v", err)
+		}
+		checkData()
+		p := ops.nodeCache.PathFromNode(fileNode)
+		// The file is several levels deep, which needs an even
+		// newer data version.
+		if v := p.tailPointer().DataVer; v < FilesWithHolesDataVer {
+			t.Fatalf("File has data version %d, expected at least %d",
+				v, FilesWithHolesDataVer)
+		}
+	}
+
+	if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	// Writing far past the end leaves a hole, without filling in
+	// any blocks with zeroes.
+	if err := kbfsOps.Write(ctx, fileNode, data, 1000); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	data = append(data, make([]byte, 995)...)
+	data = append(data, 1, 2, 3, 4, 5)
+	checkData()
+	sync()
+	if leaves, nBytes := countLeaves(); leaves != 2 || nBytes != 10 {
+		t.Fatalf("Got %d leaves with %d bytes after the write",
+			leaves, nBytes)
+	}
+	checkSeek(0, false, 0)
+	checkSeek(0, true, 5)
+	checkSeek(5, false, 1000)
+	checkSeek(700, true, 700)
+	checkSeek(1000, true, 1005)
+	checkSeek(1005, false, -1)
+
+	// Extending with truncate just adds an empty block at the end.
+	if err := kbfsOps.Truncate(ctx, fileNode, 5000); err != nil {
+		t.Fatalf("Couldn't truncate file: %v", err)
+	}
+	data = append(data, make([]byte, 3995)...)
+	checkData()
+	sync()
+	if leaves, nBytes := countLeaves(); leaves != 3 || nBytes != 10 {
+		t.Fatalf("Got %d leaves with %d bytes after the truncate",
+			leaves, nBytes)
+	}
+	checkSeek(1003, true, 1005)
+	checkSeek(1005, false, -1)
+	checkSeek(5000, true, -1)
+
+	// Writing into the middle of a hole splits it in two.
+	if err := kbfsOps.Write(ctx, fileNode, data[:3], 500); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	copy(data[500:], data[:3])
+	checkData()
+	sync()
+	checkSeek(5, false, 500)
+	checkSeek(500, true, 503)
+	checkSeek(503, false, 1000)
+
+	// Truncating into a hole drops the blocks after it.
+	if err := kbfsOps.Truncate(ctx, fileNode, 700); err != nil {
+		t.Fatalf("Couldn't truncate file: %v", err)
+	}
+	data = data[:700]
+	checkData()
+	sync()
+	checkSeek(503, false, -1)
+	checkSeek(503, true, 503)
+	if leaves, nBytes := countLeaves(); leaves != 3 || nBytes != 8 {
+		t.Fatalf("Got %d leaves with %d bytes after the truncate",
+			leaves, nBytes)
+	}
+
+	// Filling in a hole can leave short blocks in the middle of the
+	// file, which later writes across them mustn't overflow.
+	fill := make([]byte, 495)
+	for i := range fill {
+		fill[i] = 0xff
+	}
+	if err := kbfsOps.Write(ctx, fileNode, fill, 5); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	copy(data[5:], fill)
+	checkData()
+	sync()
+	overwrite := make([]byte, 503)
+	for i := range overwrite {
+		overwrite[i] = byte(i)
+	}
+	if err := kbfsOps.Write(ctx, fileNode, overwrite, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	copy(data, overwrite)
+	checkData()
+	sync()
+}
+
+func TestKBFSOpsHardLink(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := []byte{1, 2, 3, 4, 5}
+	if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	checkNlink := func(n Node, expected uint32) {
+		ei, err := kbfsOps.Stat(ctx, n)
+		if err != nil {
+			t.Fatalf("Couldn't stat file: %v", err)
+		}
+		if ei.Nlink != expected {
+			t.Fatalf("Nlink=%d, expected %d", ei.Nlink, expected)
+		}
+	}
+	checkData := func(dir Node, name string) Node {
+		n, ei, err := kbfsOps.Lookup(ctx, dir, name)
+		if err != nil {
+			t.Fatalf("Couldn't look up %s: %v", name, err)
+		}
+		if ei.Type != File || ei.Size != uint64(len(data)) {
+			t.Fatalf("Unexpected entry info for %s: %v", name, ei)
+		}
+		if n.GetID() != fileNode.GetID() {
+			t.Fatalf("%s has a different node than the original file", name)
+		}
+		buf := make([]byte, len(data)+1)
+		nr, err := kbfsOps.Read(ctx, n, buf, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read %s: %v", name, err)
+		}
+		if nr != int64(len(data)) || !bytes.Equal(data, buf[:nr]) {
+			t.Fatalf("Got wrong data %v; expected %v", buf[:nr], data)
+		}
+		return n
+	}
+
+	// The first link moves the file into the links directory.
+	ei, err := kbfsOps.CreateHardLink(ctx, dirNode, "b", fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't create hard link: %v", err)
+	}
+	if ei.Nlink != 2 {
+		t.Fatalf("Nlink=%d after first link, expected 2", ei.Nlink)
+	}
+	// Older clients can't read directories with hard links.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	p := ops.nodeCache.PathFromNode(dirNode)
+	if v := p.tailPointer().DataVer; v != HardLinksDataVer {
+		t.Fatalf("Dir has data version %d, expected %d", v, HardLinksDataVer)
+	}
+	_, err = kbfsOps.CreateHardLink(ctx, rootNode, "c", fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't create second hard link: %v", err)
+	}
+	checkNlink(fileNode, 3)
+	_, err = kbfsOps.CreateHardLink(ctx, rootNode, "c", fileNode)
+	if _, ok := err.(NameExistsError); !ok {
+		t.Fatalf("Unexpected error linking over an existing name: %v", err)
+	}
+	_, err = kbfsOps.CreateHardLink(ctx, rootNode, "e", dirNode)
+	if _, ok := err.(NotFileError); !ok {
+		t.Fatalf("Unexpected error linking a directory: %v", err)
+	}
+
+	checkData(rootNode, "a")
+	checkData(dirNode, "b")
+	checkData(rootNode, "c")
+
+	// A write through one name shows up through the others.
+	bNode := checkData(dirNode, "b")
+	data = []byte{6, 7, 8, 9, 10, 11}
+	if err := kbfsOps.Write(ctx, bNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, bNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	checkData(rootNode, "c")
+	checkNlink(fileNode, 3)
+
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	if len(children) != 3 {
+		t.Fatalf("Unexpected root children: %v", children)
+	}
+	if children["a"].Nlink != 3 || children["a"].Size != uint64(len(data)) {
+		t.Fatalf("Unexpected entry info for a: %v", children["a"])
+	}
+	if _, _, err := kbfsOps.Lookup(ctx, rootNode, linksDirName); err == nil {
+		t.Fatalf("Unexpectedly found the links directory")
+	}
+
+	// The file survives until the last name is gone.
+	if err := kbfsOps.RemoveEntry(ctx, rootNode, "a"); err != nil {
+		t.Fatalf("Couldn't remove a: %v", err)
+	}
+	checkNlink(fileNode, 2)
+	if err := kbfsOps.Rename(ctx, rootNode, "c", dirNode, "b"); err != nil {
+		t.Fatalf("Couldn't rename c over b: %v", err)
+	}
+	checkNlink(fileNode, 1)
+	checkData(dirNode, "b")
+	if err := kbfsOps.RemoveEntry(ctx, dirNode, "b"); err != nil {
+		t.Fatalf("Couldn't remove b: %v", err)
+	}
+	children, err = kbfsOps.GetDirChildren(ctx, dirNode)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	if len(children) != 0 {
+		t.Fatalf("Unexpected children after removing the last name: %v",
+			children)
+	}
+}
+
+func TestKBFSOpsXattrs(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	checkXattrs := func(n Node, expected map[string][]byte) {
+		xattrs, err := kbfsOps.GetXattrs(ctx, n)
+		if err != nil {
+			t.Fatalf("Couldn't get xattrs: %v", err)
+		}
+		if len(xattrs) != len(expected) {
+			t.Fatalf("Got xattrs %v, expected %v", xattrs, expected)
+		}
+		for k, v := range expected {
+			if !bytes.Equal(xattrs[k], v) {
+				t.Fatalf("Got xattrs %v, expected %v", xattrs, expected)
+			}
+		}
+	}
+
+	checkXattrs(fileNode, nil)
+	if err := kbfsOps.SetXattr(
+		ctx, fileNode, "user.a", []byte("1")); err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+	if err := kbfsOps.SetXattr(
+		ctx, fileNode, "user.b", []byte("2")); err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+	if err := kbfsOps.SetXattr(
+		ctx, fileNode, "user.a", []byte("3")); err != nil {
+		t.Fatalf("Couldn't set xattr: %v", err)
+	}
+	checkXattrs(fileNode, map[string][]byte{
+		"user.a": []byte("3"),
+		"user.b": []byte("2"),
+	})
+
+	// The xattrs are synced along with the entry.
+	config2 := ConfigAsUser(config.(*ConfigLocal), "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+	xattrs, err := config2.KBFSOps().GetXattrs(ctx, fileNode2)
+	if err != nil {
+		t.Fatalf("Couldn't get xattrs: %v", err)
+	}
+	if !bytes.Equal(xattrs["user.b"], []byte("2")) {
+		t.Fatalf("Unexpected xattrs for the other user: %v", xattrs)
+	}
+
+	if err := kbfsOps.RemoveXattr(ctx, fileNode, "user.a"); err != nil {
+		t.Fatalf("Couldn't remove xattr: %v", err)
+	}
+	checkXattrs(fileNode, map[string][]byte{"user.b": []byte("2")})
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.a")
+	if _, ok := err.(NoSuchXattrError); !ok {
+		t.Fatalf("Unexpected error removing a missing xattr: %v", err)
+	}
+
+	err = kbfsOps.SetXattr(
+		ctx, fileNode, "user.big", make([]byte, maxXattrBytes))
+	if _, ok := err.(XattrTooBigError); !ok {
+		t.Fatalf("Unexpected error setting a big xattr: %v", err)
+	}
+	checkXattrs(fileNode, map[string][]byte{"user.b": []byte("2")})
+
+	// A write to the file doesn't lose its xattrs.
+	if err := kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	checkXattrs(fileNode, map[string][]byte{"user.b": []byte("2")})
+}
+
+func TestKBFSOpsFileLocks(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsInitNoMocks(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+
+	checkLocked := func(err error) {
+		if _, ok := err.(FileLockedError); !ok {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Owners on the same device conflict only on overlapping ranges.
+	err = kbfsOps1.LockFile(ctx, fileNode1, FileLock{1, 0, 9, true})
+	if err != nil {
+		t.Fatalf("Couldn't lock file: %v", err)
+	}
+	err = kbfsOps1.LockFile(ctx, fileNode1, FileLock{2, 10, 19, false})
+	if err != nil {
+		t.Fatalf("Couldn't lock file: %v", err)
+	}
+	err = kbfsOps1.LockFile(ctx, fileNode1, FileLock{2, 5, 10, false})
+	checkLocked(err)
+	conflict, ok, err := kbfsOps1.GetConflictingFileLock(
+		ctx, fileNode1, FileLock{2, 5, 10, false})
+	if err != nil {
+		t.Fatalf("Couldn't get conflicting lock: %v", err)
+	}
+	if !ok || conflict != (FileLock{1, 0, 9, true}) {
+		t.Fatalf("Unexpected conflict: %v (%t)", conflict, ok)
+	}
+
+	// Another device can't lock the file at all.
+	err = kbfsOps2.LockFile(ctx, fileNode2, FileLock{1, 100, 109, false})
+	checkLocked(err)
+
+	// Once only shared locks remain, the other device can share too.
+	err = kbfsOps1.UnlockFile(ctx, fileNode1, 1, 0, 4)
+	if err != nil {
+		t.Fatalf("Couldn't unlock file: %v", err)
+	}
+	err = kbfsOps2.LockFile(ctx, fileNode2, FileLock{1, 100, 109, false})
+	checkLocked(err)
+	err = kbfsOps1.UnlockFile(ctx, fileNode1, 1, 0, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("Couldn't unlock file: %v", err)
+	}
+	err = kbfsOps2.LockFile(ctx, fileNode2, FileLock{1, 100, 109, false})
+	if err != nil {
+		t.Fatalf("Couldn't lock file: %v", err)
+	}
+	err = kbfsOps1.LockFile(ctx, fileNode1, FileLock{1, 0, 9, true})
+	checkLocked(err)
+
+	// Releasing every lock on the file frees it for everyone.
+	err = kbfsOps1.UnlockFile(ctx, fileNode1, 2, 0, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("Couldn't unlock file: %v", err)
+	}
+	err = kbfsOps2.UnlockFile(ctx, fileNode2, 1, 0, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("Couldn't unlock file: %v", err)
+	}
+	err = kbfsOps1.LockFile(ctx, fileNode1, FileLock{1, 0, 9, true})
+	if err != nil {
+		t.Fatalf("Couldn't lock file: %v", err)
+	}
+
+	// The lock still holds for a device that hasn't seen the latest
+	// version of the file.
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps1.UnlockFile(ctx, fileNode1, 1, 0, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("Couldn't unlock file: %v", err)
+	}
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{1, 2, 3}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps1.Sync(ctx, fileNode1); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	err = kbfsOps1.LockFile(ctx, fileNode1, FileLock{1, 0, 9, true})
+	if err != nil {
+		t.Fatalf("Couldn't lock file: %v", err)
+	}
+	err = kbfsOps2.LockFile(ctx, fileNode2, FileLock{1, 100, 109, false})
+	checkLocked(err)
+	c <- struct{}{}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	err = kbfsOps2.LockFile(ctx, fileNode2, FileLock{1, 100, 109, false})
+	checkLocked(err)
+
+	// A renamed file stays locked under its new name too.
+	err = kbfsOps1.Rename(ctx, rootNode1, "a", rootNode1, "b")
+	if err != nil {
+		t.Fatalf("Couldn't rename file: %v", err)
+	}
+	ops1 := getOps(config1, rootNode1.GetFolderBranch().Tlf)
+	if err := ops1.fileLocks.Renew(ctx, fileNode1); err != nil {
+		t.Fatalf("Couldn't renew lock: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	err = kbfsOps2.LockFile(ctx, fileNode2, FileLock{1, 100, 109, false})
+	checkLocked(err)
+}
+
+func TestKBFSOpsContentDefinedChunking(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	bsplitter, err := NewBlockSplitterCDC(4096, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't create block splitter: %v", err)
+	}
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	getLeafPtrs := func() []BlockPointer {
+		md, err := ops.getMDLocked(ctx, lState, mdReadNoIdentify)
+		if err != nil {
+			t.Fatalf("Couldn't get MD: %v", err)
+		}
+		p := ops.nodeCache.PathFromNode(fileNode)
+		var ptrs []BlockPointer
+		var walk func(ptr BlockPointer)
+		walk = func(ptr BlockPointer) {
+			fblock, err := ops.blocks.GetFileBlockForReading(
+				ctx, lState, md, ptr, p.Branch, p)
+			if err != nil {
+				t.Fatalf("Couldn't get file block: %v", err)
+			}
+			if !fblock.IsInd {
+				ptrs = append(ptrs, ptr)
+				return
+			}
+			for _, iptr := range fblock.IPtrs {
+				walk(iptr.BlockPointer)
+			}
+		}
+		walk(p.tailPointer())
+		return ptrs
+	}
+
+	writeAndSync := func(data []byte) {
+		if err := kbfsOps.Truncate(ctx, fileNode, 0); err != nil {
+			t.Fatalf("Couldn't truncate file: %v", err)
+		}
+		if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+			t.Fatalf("Couldn't write file: %v", err)
+		}
+		if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+			t.Fatalf("Couldn't sync file: %v", err)
+		}
+		buf := make([]byte, len(data)+1)
+		nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read data: %v", err)
+		}
+		if !bytes.Equal(data, buf[:nr]) {
+			t.Fatalf("Read back the wrong data")
+		}
+	}
+
+	data := make([]byte, 64*1024)
+	r := rand.New(rand.NewSource(1))
+	for i := range data {
+		data[i] = byte(r.Intn(256))
+	}
+	writeAndSync(data)
+	oldPtrs := getLeafPtrs()
+	oldIDs := make(map[BlockID]bool)
+	for _, ptr := range oldPtrs {
+		oldIDs[ptr.ID] = true
+	}
+
+	// Inserting a byte at the front only changes the first block;
+	// the rest are new references to the existing blocks.
+	writeAndSync(append([]byte{0xff}, data...))
+	newPtrs := getLeafPtrs()
+	if len(newPtrs) != len(oldPtrs) {
+		t.Fatalf("Got %d blocks after the insert, expected %d",
+			len(newPtrs), len(oldPtrs))
+	}
+	for i, ptr := range newPtrs {
+		if i == 0 {
+			if oldIDs[ptr.ID] {
+				t.Fatalf("First block wasn't changed by the insert")
+			}
+			continue
+		}
+		if !oldIDs[ptr.ID] {
+			t.Fatalf("Block %d wasn't reused after the insert", i)
+		}
+		if ptr.IsFirstRef() {
+			t.Fatalf("Block %d isn't a new reference", i)
+		}
+	}
+
+	// Overwriting in the middle also just changes the blocks
+	// around the write.
+	if err := kbfsOps.Write(
+		ctx, fileNode, []byte{^data[32*1024]}, 32*1024+1); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	changed := 0
+	for _, ptr := range getLeafPtrs() {
+		if !oldIDs[ptr.ID] {
+			changed++
+		}
+	}
+	if changed > 3 {
+		t.Fatalf("%d blocks changed after a one-byte overwrite", changed)
+	}
+}
+
+func TestKBFSOpsCompressedBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("a line of a very repetitive log\n"), 4096)
+	if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	md, err := ops.getMDLocked(ctx, lState, mdReadNoIdentify)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %v", err)
+	}
+	// Older clients can tell from the file's own pointer that they
+	// can't read it.
+	p := ops.nodeCache.PathFromNode(fileNode)
+	if v := p.tailPointer().DataVer; v != CompressedBlocksDataVer {
+		t.Fatalf("File has data version %d, expected %d",
+			v, CompressedBlocksDataVer)
+	}
+	// Quota is charged for the compressed, encrypted size.
+	if md.DiskUsage >= uint64(len(data)) {
+		t.Fatalf("Disk usage %d isn't less than the file size %d",
+			md.DiskUsage, len(data))
+	}
+
+	// Make sure the contents come back uncompressed, even after
+	// the cached copy is gone.
+	config.ResetCaches()
+	rootNode = GetRootNodeOrBust(t, config, "test_user", false)
+	fileNode, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+	buf := make([]byte, len(data)+1)
+	nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read data: %v", err)
+	}
+	if !bytes.Equal(data, buf[:nr]) {
+		t.Fatalf("Read back the wrong data")
+	}
+}
+
+func TestKBFSOpsCopyFile(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	bsplitter, err := NewBlockSplitterSimple(4096, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't create block splitter: %v", err)
+	}
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	// Leave the data unsynced; the copy should sync it first.
+	data := makeTestCDCData(64 * 1024)
+	if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	copyNode, ei, err := kbfsOps.CopyFile(ctx, fileNode, rootNode, "b")
+	if err != nil {
+		t.Fatalf("Couldn't copy file: %v", err)
+	}
+	if ei.Size != uint64(len(data)) {
+		t.Fatalf("Copy has size %d, expected %d", ei.Size, len(data))
+	}
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	getLeafPtrs := func(node Node) []BlockPointer {
+		md, err := ops.getMDLocked(ctx, lState, mdReadNoIdentify)
+		if err != nil {
+			t.Fatalf("Couldn't get MD: %v", err)
+		}
+		p := ops.nodeCache.PathFromNode(node)
+		fblock, err := ops.blocks.GetFileBlockForReading(
+			ctx, lState, md, p.tailPointer(), p.Branch, p)
+		if err != nil {
+			t.Fatalf("Couldn't get file block: %v", err)
+		}
+		if !fblock.IsInd {
+			t.Fatalf("File isn't indirect")
+		}
+		var ptrs []BlockPointer
+		for _, iptr := range fblock.IPtrs {
+			ptrs = append(ptrs, iptr.BlockPointer)
+		}
+		return ptrs
+	}
+	oldPtrs := getLeafPtrs(fileNode)
+	newPtrs := getLeafPtrs(copyNode)
+	if len(oldPtrs) != len(newPtrs) {
+		t.Fatalf("Copy has %d blocks, original has %d",
+			len(newPtrs), len(oldPtrs))
+	}
+	for i, ptr := range newPtrs {
+		if ptr.ID != oldPtrs[i].ID {
+			t.Errorf("Block %d of the copy has a new ID", i)
+		}
+		if ptr.IsFirstRef() || ptr.RefNonce == oldPtrs[i].RefNonce {
+			t.Errorf("Block %d of the copy isn't a new reference", i)
+		}
+	}
+
+	checkData := func(node Node, expected []byte) {
+		buf := make([]byte, len(expected)+1)
+		nr, err := kbfsOps.Read(ctx, node, buf, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read data: %v", err)
+		}
+		if !bytes.Equal(expected, buf[:nr]) {
+			t.Fatalf("Read back the wrong data")
+		}
+	}
+
+	// Changing the copy leaves the original alone.
+	if err := kbfsOps.Write(ctx, copyNode, []byte{^data[0]}, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, copyNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	checkData(fileNode, data)
+
+	// Copying into a new empty file fills it in.
+	emptyNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "c", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	n, _, err := kbfsOps.CopyFile(ctx, fileNode, rootNode, "c")
+	if err != nil {
+		t.Fatalf("Couldn't copy into empty file: %v", err)
+	}
+	if n.GetID() != emptyNode.GetID() {
+		t.Fatalf("Copying into an empty file made a new node")
+	}
+	checkData(emptyNode, data)
+
+	// But not into a non-empty one.
+	_, _, err = kbfsOps.CopyFile(ctx, fileNode, rootNode, "b")
+	if _, ok := err.(NameExistsError); !ok {
+		t.Fatalf("Unexpected error copying over a file: %v", err)
+	}
+
+	config.ResetCaches()
+	rootNode = GetRootNodeOrBust(t, config, "test_user", false)
+	for _, name := range []string{"a", "c"} {
+		node, _, err := kbfsOps.Lookup(ctx, rootNode, name)
+		if err != nil {
+			t.Fatalf("Couldn't look up file: %v", err)
+		}
+		checkData(node, data)
+	}
+}
+
+func TestKBFSOpsGetRootNodeAtRevision(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if err := kbfsOps.Write(ctx, fileNode, []byte("hello"), 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	rev := ops.getCurrMDRevision(lState)
+
+	if err := kbfsOps.Write(ctx, fileNode, []byte("world"), 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	if err := kbfsOps.RemoveEntry(ctx, rootNode, "a"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+
+	h := parseTlfHandleOrBust(t, config, "test_user", false)
+	archivedRoot, _, err := kbfsOps.GetRootNodeAtRevision(ctx, h, rev)
+	if err != nil {
+		t.Fatalf("Couldn't get root node at revision %d: %v", rev, err)
+	}
+	if fb := archivedRoot.GetFolderBranch(); fb.Branch != MakeRevBranchName(rev) {
+		t.Fatalf("Unexpected archived branch: %s", fb)
+	}
+	archivedFile, _, err := kbfsOps.Lookup(ctx, archivedRoot, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up archived file: %v", err)
+	}
+	buf := make([]byte, 10)
+	nr, err := kbfsOps.Read(ctx, archivedFile, buf, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read archived file: %v", err)
+	}
+	if string(buf[:nr]) != "hello" {
+		t.Fatalf("Read %q from the archived file", buf[:nr])
+	}
+
+	// The archived revision is read-only.
+	expectedErr := WriteToArchivedRevisionError{rev}
+	if err := kbfsOps.Write(ctx, archivedFile, []byte("x"), 0); err != expectedErr {
+		t.Fatalf("Got unexpected error on write: %v", err)
+	}
+	if _, _, err := kbfsOps.CreateDir(ctx, archivedRoot, "b"); err != expectedErr {
+		t.Fatalf("Got unexpected error on mkdir: %v", err)
+	}
+	if err := kbfsOps.RemoveEntry(ctx, archivedRoot, "a"); err != expectedErr {
+		t.Fatalf("Got unexpected error on remove: %v", err)
+	}
+
+	// The master branch is unaffected.
+	if _, _, err := kbfsOps.Lookup(ctx, rootNode, "a"); err == nil {
+		t.Fatalf("Removed file still exists in the master branch")
+	}
+
+	badRev := ops.getCurrMDRevision(lState) + 1
+	_, _, err = kbfsOps.GetRootNodeAtRevision(ctx, h, badRev)
+	if _, ok := err.(NoSuchRevisionError); !ok {
+		t.Fatalf("Got unexpected error for a future revision: %v", err)
+	}
+
+	// The revision stays pinned, and its ops stay around, until
+	// every reference to it is released.
+	_, _, err = kbfsOps.GetRootNodeAtRevision(ctx, h, rev)
+	if err != nil {
+		t.Fatalf("Couldn't get root node at revision %d: %v", rev, err)
+	}
+	archivedFB := archivedRoot.GetFolderBranch()
+	if err := kbfsOps.ReleaseRevision(ctx, archivedFB); err != nil {
+		t.Fatalf("Couldn't release revision: %v", err)
+	}
+	if pinned := ops.fbm.getEarliestPinnedRevision(); pinned != rev {
+		t.Fatalf("Earliest pinned revision %d, expected %d", pinned, rev)
+	}
+	if err := kbfsOps.ReleaseRevision(ctx, archivedFB); err != nil {
+		t.Fatalf("Couldn't release revision: %v", err)
+	}
+	if pinned := ops.fbm.getEarliestPinnedRevision(); pinned !=
+		MetadataRevisionUninitialized {
+		t.Fatalf("Revision %d still pinned", pinned)
+	}
+	kbfsOpsStd := kbfsOps.(*KBFSOpsStandard)
+	kbfsOpsStd.opsLock.RLock()
+	_, ok := kbfsOpsStd.ops[archivedFB]
+	kbfsOpsStd.opsLock.RUnlock()
+	if ok {
+		t.Fatalf("Ops for %s weren't removed", archivedFB)
+	}
+}
+
+func TestKBFSOpsGetRevisionAtTime(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	clock, t0 := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	h := parseTlfHandleOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+
+	// Make one revision per minute.
+	var revs []MetadataRevision
+	for _, name := range []string{"a", "b", "c"} {
+		clock.Add(time.Minute)
+		if _, _, err := kbfsOps.CreateDir(ctx, rootNode, name); err != nil {
+			t.Fatalf("Couldn't create dir: %v", err)
+		}
+		revs = append(revs, ops.getCurrMDRevision(lState))
+	}
+
+	for i, rev := range revs {
+		serverTime := t0.Add(time.Duration(i+1)*time.Minute + time.Second)
+		timeRev, err := kbfsOps.GetRevisionAtTime(ctx, h, serverTime)
+		if err != nil {
+			t.Fatalf("Couldn't get revision at %s: %v", serverTime, err)
+		}
+		if timeRev != rev {
+			t.Fatalf("Got revision %d at %s, expected %d",
+				timeRev, serverTime, rev)
+		}
+	}
+
+	_, err := kbfsOps.GetRevisionAtTime(ctx, h, t0.Add(-time.Hour))
+	if _, ok := err.(NoRevisionAtTimeError); !ok {
+		t.Fatalf("Got unexpected error for a time before the folder: %v",
+			err)
+	}
+}
+
+func TestKBFSOpsRestoreDeletedEntry(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	bsplitter, err := NewBlockSplitterSimple(4096, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't create block splitter: %v", err)
+	}
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	writeFile := func(dir Node, name string, data []byte) {
+		fileNode, _, err := kbfsOps.CreateFile(ctx, dir, name, false)
+		if err != nil {
+			t.Fatalf("Couldn't create file %s: %v", name, err)
+		}
+		if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+			t.Fatalf("Couldn't write file %s: %v", name, err)
+		}
+		if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+			t.Fatalf("Couldn't sync file %s: %v", name, err)
+		}
+	}
+	checkFile := func(dir Node, name string, data []byte) {
+		fileNode, _, err := kbfsOps.Lookup(ctx, dir, name)
+		if err != nil {
+			t.Fatalf("Couldn't look up %s: %v", name, err)
+		}
+		buf := make([]byte, len(data)+1)
+		nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read %s: %v", name, err)
+		}
+		if !bytes.Equal(buf[:nr], data) {
+			t.Fatalf("Read %d wrong bytes from %s", nr, name)
+		}
+	}
+
+	bigData := makeTestCDCData(64 * 1024)
+	writeFile(rootNode, "f", []byte("file"))
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	writeFile(dirNode, "a", []byte("hello"))
+	writeFile(dirNode, "b", bigData)
+	subdirNode, _, err := kbfsOps.CreateDir(ctx, dirNode, "s")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	writeFile(subdirNode, "c", []byte("world"))
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	fullRev := ops.getCurrMDRevision(lState)
+
+	// Remove f, and then all of d, like `rm -rf` would.
+	if err := kbfsOps.RemoveEntry(ctx, rootNode, "f"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+	fRev := ops.getCurrMDRevision(lState)
+	if err := kbfsOps.RemoveEntry(ctx, subdirNode, "c"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+	if err := kbfsOps.RemoveDir(ctx, dirNode, "s"); err != nil {
+		t.Fatalf("Couldn't remove dir: %v", err)
+	}
+	if err := kbfsOps.RemoveEntry(ctx, dirNode, "a"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+	if err := kbfsOps.RemoveEntry(ctx, dirNode, "b"); err != nil {
+		t.Fatalf("Couldn't remove file: %v", err)
+	}
+	if err := kbfsOps.RemoveDir(ctx, rootNode, "d"); err != nil {
+		t.Fatalf("Couldn't remove dir: %v", err)
+	}
+	dRev := ops.getCurrMDRevision(lState)
+
+	// The removals under d are only listed as part of d.
+	entries, err := kbfsOps.GetDeletedEntries(
+		ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get deleted entries: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Got %d deleted entries, expected 2: %v",
+			len(entries), entries)
+	}
+	d, f := entries[0], entries[1]
+	if d.Name != "d" || d.Type != Dir || d.Revision != dRev ||
+		d.SnapshotRevision != fullRev+1 || len(d.Dir) != 0 {
+		t.Fatalf("Unexpected deleted dir: %v", d)
+	}
+	if f.Name != "f" || f.Type != File || f.Revision != fRev ||
+		f.SnapshotRevision != fRev-1 || f.Size != 4 {
+		t.Fatalf("Unexpected deleted file: %v", f)
+	}
+
+	// The entries found in each revision are cached, and listing
+	// them again gives the same result.
+	ops.deletedEntriesLock.Lock()
+	_, fCached := ops.deletedEntries[fRev]
+	_, dCached := ops.deletedEntries[dRev]
+	ops.deletedEntriesLock.Unlock()
+	if !fCached || !dCached {
+		t.Fatalf("Deleted entries weren't cached")
+	}
+	entries2, err := kbfsOps.GetDeletedEntries(
+		ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get deleted entries: %v", err)
+	}
+	require.Equal(t, entries, entries2)
+
+	// Restore everything under new names.
+	if _, _, err := kbfsOps.RestoreDeletedEntry(
+		ctx, f, rootNode, "f2"); err != nil {
+		t.Fatalf("Couldn't restore file: %v", err)
+	}
+	checkFile(rootNode, "f2", []byte("file"))
+	restoredDir, _, err := kbfsOps.RestoreDeletedEntry(
+		ctx, d, rootNode, "d2")
+	if err != nil {
+		t.Fatalf("Couldn't restore dir: %v", err)
+	}
+	checkFile(restoredDir, "a", []byte("hello"))
+	checkFile(restoredDir, "b", bigData)
+	restoredSubdir, _, err := kbfsOps.Lookup(ctx, restoredDir, "s")
+	if err != nil {
+		t.Fatalf("Couldn't look up restored subdir: %v", err)
+	}
+	checkFile(restoredSubdir, "c", []byte("world"))
+
+	// The restored name can't already exist.
+	_, _, err = kbfsOps.RestoreDeletedEntry(ctx, f, rootNode, "d2")
+	if _, ok := err.(NameExistsError); !ok {
+		t.Fatalf("Got unexpected error restoring over an entry: %v", err)
+	}
+}
+
+func TestKBFSOpsFileHistory(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	createRev := ops.getCurrMDRevision(lState)
+	writeAndSync := func(data []byte) MetadataRevision {
+		if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+			t.Fatalf("Couldn't write file: %v", err)
+		}
+		if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+			t.Fatalf("Couldn't sync file: %v", err)
+		}
+		return ops.getCurrMDRevision(lState)
+	}
+	helloRev := writeAndSync([]byte("hello"))
+	writeAndSync([]byte("hello world"))
+	if err := kbfsOps.SetEx(ctx, fileNode, true); err != nil {
+		t.Fatalf("Couldn't set ex: %v", err)
+	}
+	// Unrelated changes aren't part of the history.
+	if _, _, err := kbfsOps.CreateDir(ctx, rootNode, "d"); err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	if err := kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b"); err != nil {
+		t.Fatalf("Couldn't rename file: %v", err)
+	}
+
+	versions, err := kbfsOps.GetFileHistory(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't get file history: %v", err)
+	}
+	expectedOps := []string{"rename", "setAttr", "sync", "sync", "create"}
+	expectedSizes := []uint64{11, 11, 11, 5, 0}
+	if len(versions) != len(expectedOps) {
+		t.Fatalf("Got %d versions, expected %d: %v",
+			len(versions), len(expectedOps), versions)
+	}
+	for i, v := range versions {
+		if len(v.Ops) != 1 || !strings.HasPrefix(v.Ops[0], expectedOps[i]) {
+			t.Errorf("Version %d has ops %v, expected %s",
+				i, v.Ops, expectedOps[i])
+		}
+		if v.Size != expectedSizes[i] {
+			t.Errorf("Version %d has size %d, expected %d",
+				i, v.Size, expectedSizes[i])
+		}
+		if v.Writer != "test_user" {
+			t.Errorf("Version %d has writer %s", i, v.Writer)
+		}
+	}
+	if versions[3].Revision != helloRev {
+		t.Errorf("Got revision %d, expected %d",
+			versions[3].Revision, helloRev)
+	}
+	if versions[4].Revision != createRev {
+		t.Errorf("Got revision %d, expected %d",
+			versions[4].Revision, createRev)
+	}
+
+	err = kbfsOps.RestoreFileVersion(ctx, fileNode, helloRev)
+	if err != nil {
+		t.Fatalf("Couldn't restore file version: %v", err)
+	}
+	buf := make([]byte, 20)
+	nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	if g, e := string(buf[:nr]), "hello"; g != e {
+		t.Errorf("Read %q after restore, expected %q", g, e)
+	}
+	versions, err = kbfsOps.GetFileHistory(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't get file history: %v", err)
+	}
+	if len(versions) != len(expectedOps)+1 || versions[0].Size != 5 {
+		t.Errorf("The restore didn't add a new version: %v", versions)
+	}
+
+	err = kbfsOps.RestoreFileVersion(ctx, fileNode, createRev-1)
+	if _, ok := err.(NoSuchFileVersionError); !ok {
+		t.Errorf("Got unexpected error restoring before creation: %v", err)
+	}
+}
+
+func TestKBFSOpsRestoreSparseFileVersion(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	// make file blocks tiny, so holes don't fit in a single block.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't create block splitter: %v", err)
+	}
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	write := func(data []byte, off int64) {
+		if err := kbfsOps.Write(ctx, fileNode, data, off); err != nil {
+			t.Fatalf("Couldn't write file: %v", err)
+		}
+	}
+	sync := func() {
+		if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+			t.Fatalf("Couldn't sync file: %v", err)
+		}
+	}
+
+	// The old version has a hole in the middle and one at the end.
+	write([]byte{1, 2, 3, 4, 5}, 0)
+	write([]byte{6, 7, 8, 9, 10}, 200)
+	if err := kbfsOps.Truncate(ctx, fileNode, 400); err != nil {
+		t.Fatalf("Couldn't truncate file: %v", err)
+	}
+	sync()
+	sparseRev := ops.getCurrMDRevision(makeFBOLockState())
+	data := make([]byte, 400)
+	copy(data, []byte{1, 2, 3, 4, 5})
+	copy(data[200:], []byte{6, 7, 8, 9, 10})
+
+	// Fill in the holes.
+	filled := make([]byte, 500)
+	for i := range filled {
+		filled[i] = 0xff
+	}
+	write(filled, 0)
+	sync()
+
+	err = kbfsOps.RestoreFileVersion(ctx, fileNode, sparseRev)
+	if err != nil {
+		t.Fatalf("Couldn't restore file version: %v", err)
+	}
+	buf := make([]byte, len(filled))
+	nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	if !bytes.Equal(buf[:nr], data) {
+		t.Fatalf("Read %d bytes that don't match the old version", nr)
+	}
+
+	// The holes are holes again.
+	for _, c := range []struct {
+		off, expectedOff int64
+		hole             bool
+	}{
+		{0, 5, true},
+		{5, 200, false},
+		{200, 205, true},
+	} {
+		var newOff int64
+		if c.hole {
+			newOff, err = kbfsOps.SeekHole(ctx, fileNode, c.off)
+		} else {
+			newOff, err = kbfsOps.SeekData(ctx, fileNode, c.off)
+		}
+		if err != nil {
+			t.Fatalf("Seek(%d, hole=%t) failed: %v", c.off, c.hole, err)
+		}
+		if newOff != c.expectedOff {
+			t.Errorf("Seek(%d, hole=%t)=%d, expected %d",
+				c.off, c.hole, newOff, c.expectedOff)
+		}
+	}
+	if _, err := kbfsOps.SeekData(ctx, fileNode, 205); err == nil {
+		t.Errorf("Found data in the hole at the end")
+	}
+}
+
+// disconnectedMDServer acts like an MD server that can't be reached.
+type disconnectedMDServer struct {
+	MDServer
+}
+
+func (md disconnectedMDServer) IsConnected() bool {
+	return false
+}
+
+func (md disconnectedMDServer) GetForHandle(ctx context.Context,
+	handle BareTlfHandle, mStatus MergeStatus) (
+	TlfID, *RootMetadataSigned, error) {
+	return NullTlfID, nil, errDisconnected{}
+}
+
+func (md disconnectedMDServer) GetForTLF(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus) (*RootMetadataSigned, error) {
+	return nil, errDisconnected{}
+}
+
+func (md disconnectedMDServer) RegisterForUpdate(ctx context.Context,
+	id TlfID, currHead MetadataRevision) (<-chan error, error) {
+	return nil, errDisconnected{}
+}
+
+// disconnectedBlockServer acts like a block server that can't be
+// reached.
+type disconnectedBlockServer struct {
+	BlockServer
+}
+
+func (b disconnectedBlockServer) Get(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	return nil, BlockCryptKeyServerHalf{}, errDisconnected{}
+}
+
+func TestKBFSOpsReadWhileDisconnected(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "kbfs_disk_md_cache")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	dbcache, err := NewDiskBlockCacheMemory(config, 1024*1024)
+	if err != nil {
+		t.Fatalf("Couldn't make disk block cache: %v", err)
+	}
+	config.SetDiskBlockCache(dbcache)
+	dmcache, err := NewDiskMDCacheStandard(config, tempdir)
+	if err != nil {
+		t.Fatalf("Couldn't make disk MD cache: %v", err)
+	}
+	config.SetDiskMDCache(dmcache)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps.Sync(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	// Hand the persisted heads over to the restarted "process".
+	dmcache.Shutdown()
+
+	// Start again from scratch, without a connection.
+	config2 := ConfigAsUser(config.(*ConfigLocal), "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetDiskBlockCache(dbcache)
+	dmcache2, err := NewDiskMDCacheStandard(config2, tempdir)
+	if err != nil {
+		t.Fatalf("Couldn't reopen disk MD cache: %v", err)
+	}
+	config2.SetDiskMDCache(dmcache2)
+	config2.SetMDServer(disconnectedMDServer{config2.MDServer()})
+	config2.SetBlockServer(disconnectedBlockServer{config2.BlockServer()})
+
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file while disconnected: %v", err)
+	}
+	buf := make([]byte, 10)
+	nr, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read file while disconnected: %v", err)
+	}
+	if g, e := string(buf[:nr]), "hello"; g != e {
+		t.Errorf("Read %q while disconnected, expected %q", g, e)
+	}
+
+	err = kbfsOps2.Write(ctx, fileNode2, []byte("bye"), 0)
+	if _, ok := err.(OfflineReadOnlyError); !ok {
+		t.Errorf("Got unexpected error writing while disconnected: %v", err)
+	}
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b", false)
+	if _, ok := err.(OfflineReadOnlyError); !ok {
+		t.Errorf("Got unexpected error creating while disconnected: %v", err)
+	}
+
+	status, _, err := kbfsOps2.FolderStatus(
+		ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get folder status: %v", err)
+	}
+	if !status.Disconnected {
+		t.Errorf("Folder status doesn't show the disconnection")
+	}
+}
+
+func TestKBFSOpsBatchedMDCommits(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	config.(*ConfigLocal).SetMDBatching(time.Hour, 0)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	id := rootNode.GetFolderBranch().Tlf
+	getServerRev := func() MetadataRevision {
+		rmds, err := config.MDServer().GetForTLF(ctx, id, NullBranchID, Merged)
+		if err != nil {
+			t.Fatalf("Couldn't get MD: %v", err)
+		}
+		return rmds.MD.Revision
+	}
+	startRev := getServerRev()
+
+	// Creating several files only makes one new local revision,
+	// which doesn't get put yet.
+	var fileNodes []Node
+	for _, name := range []string{"a", "b", "c"} {
+		fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false)
+		if err != nil {
+			t.Fatalf("Couldn't create file %s: %v", name, err)
+		}
+		fileNodes = append(fileNodes, fileNode)
+	}
+	if rev := getServerRev(); rev != startRev {
+		t.Errorf("Server revision is %d before the batch window is over, "+
+			"expected %d", rev, startRev)
+	}
+	ops := getOps(config, id)
+	lState := makeFBOLockState()
+	if rev := ops.getCurrMDRevision(lState); rev != startRev+1 {
+		t.Errorf("Local revision is %d, expected %d", rev, startRev+1)
+	}
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	if len(children) != 3 {
+		t.Errorf("Got %d children, expected 3", len(children))
+	}
+
+	// An explicit sync puts the whole batch right away.
+	if err := kbfsOps.Sync(ctx, fileNodes[0]); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	if rev := getServerRev(); rev != startRev+1 {
+		t.Errorf("Server revision is %d after sync, expected %d",
+			rev, startRev+1)
+	}
+	md := ops.getHead(lState)
+	if len(md.data.Changes.Ops) != 3 {
+		t.Errorf("Batched revision has %d ops, expected 3",
+			len(md.data.Changes.Ops))
+	}
+
+	// Changes over the byte threshold are put right away.
+	config.(*ConfigLocal).SetMDBatching(time.Hour, 1)
+	if _, _, err := kbfsOps.CreateFile(ctx, rootNode, "d", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if rev := getServerRev(); rev != startRev+2 {
+		t.Errorf("Server revision is %d after a big change, expected %d",
+			rev, startRev+2)
+	}
+
+	// A pending batch is put once the window is over.
+	config.(*ConfigLocal).SetMDBatching(10*time.Millisecond, 0)
+	if _, _, err := kbfsOps.CreateFile(ctx, rootNode, "e", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	for i := 0; getServerRev() != startRev+3; i++ {
+		if i > 1000 {
+			t.Fatalf("The batch was never put")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKBFSOpsRenameAcrossFolders(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config, _, ctx := kbfsOpsInitNoMocks(t, u1, u2)
+	defer CheckConfigAndShutdown(t, config)
+
+	kbfsOps := config.KBFSOps()
+	rootNode1 := GetRootNodeOrBust(t, config, u1.String(), false)
+	rootNode2 := GetRootNodeOrBust(
+		t, config, u1.String()+","+u2.String(), false)
+
+	// Make a tree with a subdirectory, an executable and a symlink.
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode1, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "f", true)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := []byte("hello")
+	if err := kbfsOps.Write(ctx, fileNode, data, 0); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	subdirNode, _, err := kbfsOps.CreateDir(ctx, dirNode, "s")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	if _, _, err := kbfsOps.CreateFile(ctx, subdirNode, "g", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	if _, err := kbfsOps.CreateLink(ctx, dirNode, "l", "f"); err != nil {
+		t.Fatalf("Couldn't create symlink: %v", err)
+	}
+	mtime := time.Unix(1000, 0)
+	if err := kbfsOps.SetMtime(ctx, fileNode, &mtime); err != nil {
+		t.Fatalf("Couldn't set mtime: %v", err)
+	}
+	oldEi, err := kbfsOps.Stat(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't stat file: %v", err)
+	}
+
+	// A name that's taken in the new folder can't be moved onto.
+	if _, _, err := kbfsOps.CreateFile(ctx, rootNode2, "x", false); err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps.Rename(ctx, rootNode1, "d", rootNode2, "x")
+	if _, ok := err.(RenameAcrossDirsError); !ok {
+		t.Fatalf("Unexpected error for an existing name: %v", err)
+	}
+	checkTxChildren(t, ctx, config, rootNode1, "d")
+
+	if err := kbfsOps.Rename(ctx, rootNode1, "d", rootNode2, "e"); err != nil {
+		t.Fatalf("Couldn't rename across folders: %v", err)
+	}
+	checkTxChildren(t, ctx, config, rootNode1)
+	checkTxChildren(t, ctx, config, rootNode2, "e", "x")
+
+	newDirNode, _, err := kbfsOps.Lookup(ctx, rootNode2, "e")
+	if err != nil {
+		t.Fatalf("Couldn't look up dir: %v", err)
+	}
+	checkTxChildren(t, ctx, config, newDirNode, "f", "l", "s")
+	newFileNode, newEi, err := kbfsOps.Lookup(ctx, newDirNode, "f")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+	if newEi.Type != Exec {
+		t.Errorf("Moved file has type %s, expected %s", newEi.Type, Exec)
+	}
+	if newEi.Mtime != oldEi.Mtime || newEi.Ctime != oldEi.Ctime {
+		t.Errorf("Moved file has times %d/%d, expected %d/%d",
+			newEi.Mtime, newEi.Ctime, oldEi.Mtime, oldEi.Ctime)
+	}
+	buf := make([]byte, len(data))
+	if _, err := kbfsOps.Read(ctx, newFileNode, buf, 0); err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("Read %q, expected %q", buf, data)
+	}
+	_, linkEi, err := kbfsOps.Lookup(ctx, newDirNode, "l")
+	if err != nil {
+		t.Fatalf("Couldn't look up symlink: %v", err)
+	}
+	if linkEi.Type != Sym || linkEi.SymPath != "f" {
+		t.Errorf("Bad symlink after the move: %v", linkEi)
+	}
+	newSubdirNode, _, err := kbfsOps.Lookup(ctx, newDirNode, "s")
+	if err != nil {
+		t.Fatalf("Couldn't look up dir: %v", err)
+	}
+	checkTxChildren(t, ctx, config, newSubdirNode, "g")
+}
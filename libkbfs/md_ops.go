@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
@@ -440,6 +441,31 @@ func (md *MDOpsStandard) GetUnmergedRange(ctx context.Context, id TlfID,
 	return md.getRange(ctx, id, bid, Unmerged, start, stop)
 }
 
+// GetForTLFByTime implements the MDOps interface for MDOpsStandard.
+func (md *MDOpsStandard) GetForTLFByTime(ctx context.Context, id TlfID,
+	serverTime time.Time) (*RootMetadata, error) {
+	rmds, err := md.config.MDServer().GetForTLFByTime(ctx, id, serverTime)
+	if err != nil {
+		return nil, err
+	}
+	if rmds == nil {
+		return nil, NoRevisionAtTimeError{serverTime}
+	}
+	bareHandle, err := rmds.MD.MakeBareTlfHandle()
+	if err != nil {
+		return nil, err
+	}
+	handle, err := MakeTlfHandle(ctx, bareHandle, md.config.KBPKI())
+	if err != nil {
+		return nil, err
+	}
+	err = md.processMetadataWithID(ctx, id, NullBranchID, handle, rmds)
+	if err != nil {
+		return nil, err
+	}
+	return &rmds.MD, nil
+}
+
 func (md *MDOpsStandard) readyMD(ctx context.Context, rmd *RootMetadata) (
 	rms *RootMetadataSigned, err error) {
 	_, me, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
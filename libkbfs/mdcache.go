@@ -49,3 +49,9 @@ func (md *MDCacheStandard) Put(rmd *RootMetadata) error {
 	md.lru.Add(key, rmd)
 	return nil
 }
+
+// Delete implements the MDCache interface for MDCacheStandard.
+func (md *MDCacheStandard) Delete(tlf TlfID, rev MetadataRevision,
+	bid BranchID) {
+	md.lru.Remove(mdCacheKey{tlf, rev, bid})
+}
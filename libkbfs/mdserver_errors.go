@@ -149,7 +149,7 @@ func (e MDServerErrorConflictDiskUsage) Error() string {
 	return e.Desc
 }
 
-// MDServerErrorLocked is returned when the folder truncation lock is acquired by someone else.
+// MDServerErrorLocked is returned when the folder truncation lock, or an advisory file lock, is acquired by someone else.
 type MDServerErrorLocked struct {
 }
 
@@ -35,7 +35,7 @@ type MDServerLocal struct {
 	log      logger.Logger
 
 	locksMutex *sync.Mutex
-	locksDb    *leveldb.DB // folderId -> deviceKID
+	locksDb    *leveldb.DB // folderId -> deviceKID, folderId+lockId -> mdServerLocalFileLock
 
 	// mutex protects observers and sessionHeads
 	mutex *sync.Mutex
@@ -400,6 +400,67 @@ func (md *MDServerLocal) GetRange(ctx context.Context, id TlfID,
 	return rmdses, nil
 }
 
+// GetForTLFByTime implements the MDServer interface for MDServerLocal.
+func (md *MDServerLocal) GetForTLFByTime(ctx context.Context, id TlfID,
+	serverTime time.Time) (*RootMetadataSigned, error) {
+	md.log.CDebugf(ctx, "GetForTLFByTime %s", serverTime)
+	md.shutdownLock.RLock()
+	defer md.shutdownLock.RUnlock()
+	if *md.shutdown {
+		return nil, errors.New("MD server already shut down")
+	}
+
+	// Check permissions
+	ok, err := md.isReader(ctx, id)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	if !ok {
+		return nil, MDServerErrorUnauthorized{}
+	}
+
+	head, err := md.getHeadForTLF(ctx, id, NullBranchID, Merged)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	if head == nil {
+		return nil, nil
+	}
+
+	startKey, err := md.getMDKey(
+		id, MetadataRevisionInitial, NullBranchID, Merged)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	stopKey, err := md.getMDKey(id, head.MD.Revision+1, NullBranchID, Merged)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+
+	// Revisions are stored in order, and the server time of each one
+	// is after that of the one before it, so stop at the first one
+	// received after the given time.
+	var rmds *RootMetadataSigned
+	iter := md.mdDb.NewIterator(&util.Range{Start: startKey, Limit: stopKey}, nil)
+	defer iter.Release()
+	for iter.Next() {
+		block := new(mdBlockLocal)
+		err := md.config.Codec().Decode(iter.Value(), block)
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		if block.Timestamp.After(serverTime) {
+			break
+		}
+		block.MD.untrustedServerTimestamp = block.Timestamp
+		rmds = block.MD
+	}
+	if err := iter.Error(); err != nil {
+		return nil, MDServerError{err}
+	}
+	return rmds, nil
+}
+
 // Put implements the MDServer interface for MDServerLocal.
 func (md *MDServerLocal) Put(ctx context.Context, rmds *RootMetadataSigned) error {
 	md.shutdownLock.RLock()
@@ -749,6 +810,159 @@ func (md *MDServerLocal) TruncateUnlock(ctx context.Context, id TlfID) (
 	return false, MDServerErrorLocked{}
 }
 
+// mdServerLocalFileLock is the state of a single advisory file lock
+// in the locks database.
+type mdServerLocalFileLock struct {
+	Exclusive bool
+	// Holders maps the KID of each device holding the lock to the
+	// time its lease expires, in Unix nanoseconds.
+	Holders map[string]int64
+}
+
+// getFileLockKey returns the locks database key for the given file
+// lock in the given folder.  Unlike the history truncation lock key,
+// it's followed by the lock ID.
+func getFileLockKey(id TlfID, lockID string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	// add folder id
+	_, err := buf.Write(id.Bytes())
+	if err != nil {
+		return []byte{}, err
+	}
+	_, err = buf.WriteString(lockID)
+	if err != nil {
+		return []byte{}, err
+	}
+	return buf.Bytes(), nil
+}
+
+// getFileLockLocked returns the current state of the given file lock,
+// without any expired leases.  md.locksMutex must be held by the
+// caller.
+func (md *MDServerLocal) getFileLockLocked(key []byte) (
+	mdServerLocalFileLock, error) {
+	lockBytes, err := md.locksDb.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return mdServerLocalFileLock{Holders: make(map[string]int64)}, nil
+	} else if err != nil {
+		return mdServerLocalFileLock{}, err
+	}
+
+	var lock mdServerLocalFileLock
+	err = md.config.Codec().Decode(lockBytes, &lock)
+	if err != nil {
+		return mdServerLocalFileLock{}, err
+	}
+	if lock.Holders == nil {
+		lock.Holders = make(map[string]int64)
+	}
+	now := md.config.Clock().Now().UnixNano()
+	for kid, expiry := range lock.Holders {
+		if expiry <= now {
+			delete(lock.Holders, kid)
+		}
+	}
+	return lock, nil
+}
+
+// putFileLockLocked stores the given file lock state, or deletes it
+// if there are no holders left.  md.locksMutex must be held by the
+// caller.
+func (md *MDServerLocal) putFileLockLocked(
+	key []byte, lock mdServerLocalFileLock) error {
+	if len(lock.Holders) == 0 {
+		return md.locksDb.Delete(key, nil)
+	}
+	lockBytes, err := md.config.Codec().Encode(lock)
+	if err != nil {
+		return err
+	}
+	return md.locksDb.Put(key, lockBytes, nil)
+}
+
+// FileLock implements the MDServer interface for MDServerLocal.
+func (md *MDServerLocal) FileLock(ctx context.Context, id TlfID,
+	lockID string, exclusive bool, lease time.Duration) (bool, error) {
+	if lockID == "" {
+		return false, errors.New("Empty file lock ID")
+	}
+
+	md.locksMutex.Lock()
+	defer md.locksMutex.Unlock()
+
+	key, err := getFileLockKey(id, lockID)
+	if err != nil {
+		return false, err
+	}
+
+	deviceKID, err := md.getCurrentDeviceKID(ctx)
+	if err != nil {
+		return false, err
+	}
+	myKID := deviceKID.String()
+
+	lock, err := md.getFileLockLocked(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, isHolder := lock.Holders[myKID]
+	othersHold := len(lock.Holders) > 1 ||
+		(len(lock.Holders) == 1 && !isHolder)
+	if othersHold && (exclusive || lock.Exclusive) {
+		// Locked by someone else.
+		return false, MDServerErrorLocked{}
+	}
+
+	lock.Exclusive = exclusive
+	lock.Holders[myKID] = md.config.Clock().Now().Add(lease).UnixNano()
+	if err := md.putFileLockLocked(key, lock); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// FileUnlock implements the MDServer interface for MDServerLocal.
+func (md *MDServerLocal) FileUnlock(ctx context.Context, id TlfID,
+	lockID string) (bool, error) {
+	if lockID == "" {
+		return false, errors.New("Empty file lock ID")
+	}
+
+	md.locksMutex.Lock()
+	defer md.locksMutex.Unlock()
+
+	key, err := getFileLockKey(id, lockID)
+	if err != nil {
+		return false, err
+	}
+
+	deviceKID, err := md.getCurrentDeviceKID(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	lock, err := md.getFileLockLocked(key)
+	if err != nil {
+		return false, err
+	}
+
+	myKID := deviceKID.String()
+	if _, isHolder := lock.Holders[myKID]; isHolder {
+		delete(lock.Holders, myKID)
+		if err := md.putFileLockLocked(key, lock); err != nil {
+			return false, err
+		}
+		return true, nil
+	} else if len(lock.Holders) == 0 {
+		// Already unlocked
+		return true, nil
+	}
+
+	// Locked by someone else.
+	return false, MDServerErrorLocked{}
+}
+
 // Shutdown implements the MDServer interface for MDServerLocal.
 func (md *MDServerLocal) Shutdown() {
 	md.shutdownLock.Lock()
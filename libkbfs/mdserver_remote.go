@@ -415,6 +415,63 @@ func (md *MDServerRemote) GetRange(ctx context.Context, id TlfID,
 	return rmds, err
 }
 
+// GetForTLFByTime implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) GetForTLFByTime(ctx context.Context, id TlfID,
+	serverTime time.Time) (*RootMetadataSigned, error) {
+	// The metadata protocol can't search by time, but the server
+	// time of each revision is after that of the one before it, so
+	// binary search over the merged revisions instead.
+	head, err := md.GetForTLF(ctx, id, NullBranchID, Merged)
+	if err != nil {
+		return nil, err
+	}
+	if head == nil {
+		return nil, nil
+	}
+	if !head.untrustedServerTimestamp.After(serverTime) {
+		return head, nil
+	}
+
+	var found *RootMetadataSigned
+	low, high := MetadataRevisionInitial, head.MD.Revision-1
+	for low <= high {
+		mid := low + (high-low)/2
+		// Fetch a few revisions at a time, so that the search can
+		// stop as soon as it finds two neighboring revisions on
+		// either side of serverTime.
+		stop := mid + maxMDsAtATime - 1
+		if stop > high {
+			stop = high
+		}
+		rmdses, err := md.GetRange(ctx, id, NullBranchID, Merged, mid, stop)
+		if err != nil {
+			return nil, err
+		}
+		if len(rmdses) == 0 && stop < high {
+			// The server doesn't have any of these revisions, so
+			// fall back to the nearest later ones it does have.
+			rmdses, err = md.GetRange(
+				ctx, id, NullBranchID, Merged, stop+1, high)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(rmdses) == 0 ||
+			rmdses[0].untrustedServerTimestamp.After(serverTime) {
+			high = mid - 1
+			continue
+		}
+		for _, rmds := range rmdses {
+			if rmds.untrustedServerTimestamp.After(serverTime) {
+				return found, nil
+			}
+			found = rmds
+		}
+		low = found.MD.Revision + 1
+	}
+	return found, nil
+}
+
 // Put implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) Put(ctx context.Context, rmds *RootMetadataSigned) error {
 	// encode MD block
@@ -562,6 +619,19 @@ func (md *MDServerRemote) TruncateUnlock(ctx context.Context, id TlfID) (
 	return md.client.TruncateUnlock(ctx, id.String())
 }
 
+// FileLock implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) FileLock(ctx context.Context, id TlfID,
+	lockID string, exclusive bool, lease time.Duration) (bool, error) {
+	// The metadata protocol doesn't have file locks yet.
+	return false, FileLocksUnsupportedError{}
+}
+
+// FileUnlock implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) FileUnlock(ctx context.Context, id TlfID,
+	lockID string) (bool, error) {
+	return false, FileLocksUnsupportedError{}
+}
+
 // GetLatestHandleForTLF implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) GetLatestHandleForTLF(ctx context.Context, id TlfID) (
 	*BareTlfHandle, error) {
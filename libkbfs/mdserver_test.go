@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/protocol"
 
@@ -250,3 +251,161 @@ func TestMDServerRegisterForUpdate(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMDServerFileLocks(t *testing.T) {
+	// setup
+	config1 := MakeTestConfigOrBust(t, "test_user1", "test_user2")
+	defer config1.Shutdown()
+	clock, _ := newTestClockAndTimeNow()
+	config1.SetClock(clock)
+	config2 := ConfigAsUser(config1, "test_user2")
+	defer config2.Shutdown()
+	config2.SetClock(clock)
+	mdServer1 := config1.MDServer()
+	mdServer2 := config2.MDServer()
+	ctx := context.Background()
+	id := FakeTlfID(1, false)
+	lease := time.Minute
+
+	checkLocked := func(err error) {
+		if _, ok := err.(MDServerErrorLocked); !ok {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Shared locks can be held by both devices.
+	if _, err := mdServer1.FileLock(ctx, id, "a", false, lease); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mdServer2.FileLock(ctx, id, "a", false, lease); err != nil {
+		t.Fatal(err)
+	}
+	_, err := mdServer1.FileLock(ctx, id, "a", true, lease)
+	checkLocked(err)
+
+	// Other files, and the truncation lock, are independent.
+	if _, err := mdServer2.FileLock(ctx, id, "b", true, lease); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mdServer1.TruncateLock(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the other device lets go, the lock can be upgraded.
+	if _, err := mdServer2.FileUnlock(ctx, id, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mdServer1.FileLock(ctx, id, "a", true, lease); err != nil {
+		t.Fatal(err)
+	}
+	_, err = mdServer2.FileLock(ctx, id, "a", false, lease)
+	checkLocked(err)
+	_, err = mdServer2.FileUnlock(ctx, id, "a")
+	checkLocked(err)
+
+	// Renewing extends the lease, but it eventually expires.
+	clock.Add(lease / 2)
+	if _, err := mdServer1.FileLock(ctx, id, "a", true, lease); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(lease / 2)
+	_, err = mdServer2.FileLock(ctx, id, "a", true, lease)
+	checkLocked(err)
+	clock.Add(lease / 2)
+	if _, err := mdServer2.FileLock(ctx, id, "a", true, lease); err != nil {
+		t.Fatal(err)
+	}
+
+	// The truncation lock never expires.
+	_, err = mdServer2.TruncateLock(ctx, id)
+	checkLocked(err)
+}
+
+func TestMDServerGetForTLFByTime(t *testing.T) {
+	// setup
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	clock, t0 := newTestClockAndTimeNow()
+	config.SetClock(clock)
+	mdServer := config.MDServer()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing exists yet.
+	rmds, err := mdServer.GetForTLFByTime(ctx, id, t0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rmds != nil {
+		t.Fatalf("Unexpected revision %d", rmds.MD.Revision)
+	}
+
+	// Put a revision every minute.
+	var prevRoot MdID
+	for i := MetadataRevision(1); i <= 5; i++ {
+		clock.Add(time.Minute)
+		rmds, err := NewRootMetadataSignedForTest(id, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rmds.MD.SerializedPrivateMetadata = make([]byte, 1)
+		rmds.MD.SerializedPrivateMetadata[0] = 0x1
+		rmds.MD.Revision = i
+		FakeInitialRekey(&rmds.MD, h)
+		rmds.MD.clearCachedMetadataIDForTest()
+		if i > 1 {
+			rmds.MD.PrevRoot = prevRoot
+		}
+		err = mdServer.Put(ctx, rmds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prevRoot, err = rmds.MD.MetadataID(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkRev := func(serverTime time.Time, expectedRev MetadataRevision) {
+		rmds, err := mdServer.GetForTLFByTime(ctx, id, serverTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expectedRev == MetadataRevisionUninitialized {
+			if rmds != nil {
+				t.Fatalf("Unexpected revision %d at %s",
+					rmds.MD.Revision, serverTime)
+			}
+			return
+		}
+		if rmds == nil {
+			t.Fatalf("No revision at %s", serverTime)
+		}
+		if rmds.MD.Revision != expectedRev {
+			t.Fatalf("Got revision %d at %s, expected %d",
+				rmds.MD.Revision, serverTime, expectedRev)
+		}
+		if rmds.untrustedServerTimestamp.After(serverTime) {
+			t.Fatalf("Revision %d is from %s, after %s", rmds.MD.Revision,
+				rmds.untrustedServerTimestamp, serverTime)
+		}
+	}
+
+	checkRev(t0.Add(30*time.Second), MetadataRevisionUninitialized)
+	checkRev(t0.Add(time.Minute), 1)
+	checkRev(t0.Add(150*time.Second), 2)
+	checkRev(t0.Add(5*time.Minute), 5)
+	checkRev(t0.Add(time.Hour), 5)
+}
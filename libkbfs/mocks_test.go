@@ -281,6 +281,39 @@ func (_mr *_MockKBFSOpsRecorder) GetOrCreateRootNode(arg0, arg1, arg2 interface{
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetOrCreateRootNode", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) GetRootNodeAtRevision(ctx context.Context, h *TlfHandle, rev MetadataRevision) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "GetRootNodeAtRevision", ctx, h, rev)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetRootNodeAtRevision(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRootNodeAtRevision", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) ReleaseRevision(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "ReleaseRevision", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) ReleaseRevision(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ReleaseRevision", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) GetRevisionAtTime(ctx context.Context, h *TlfHandle, serverTime time.Time) (MetadataRevision, error) {
+	ret := _m.ctrl.Call(_m, "GetRevisionAtTime", ctx, h, serverTime)
+	ret0, _ := ret[0].(MetadataRevision)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetRevisionAtTime(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRevisionAtTime", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) GetDirChildren(ctx context.Context, dir Node) (map[string]EntryInfo, error) {
 	ret := _m.ctrl.Call(_m, "GetDirChildren", ctx, dir)
 	ret0, _ := ret[0].(map[string]EntryInfo)
@@ -350,6 +383,73 @@ func (_mr *_MockKBFSOpsRecorder) CreateLink(arg0, arg1, arg2, arg3 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateLink", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) CreateHardLink(ctx context.Context, dir Node, name string, file Node) (EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CreateHardLink", ctx, dir, name, file)
+	ret0, _ := ret[0].(EntryInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) CreateHardLink(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateHardLink", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) CopyFile(ctx context.Context, file Node, dir Node, name string) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CopyFile", ctx, file, dir, name)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) CopyFile(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CopyFile", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) GetDeletedEntries(ctx context.Context, folderBranch FolderBranch) ([]DeletedEntry, error) {
+	ret := _m.ctrl.Call(_m, "GetDeletedEntries", ctx, folderBranch)
+	ret0, _ := ret[0].([]DeletedEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetDeletedEntries(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetDeletedEntries", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) RestoreDeletedEntry(ctx context.Context, entry DeletedEntry, dir Node, name string) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "RestoreDeletedEntry", ctx, entry, dir, name)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) RestoreDeletedEntry(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RestoreDeletedEntry", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) GetFileHistory(ctx context.Context, file Node) ([]FileVersion, error) {
+	ret := _m.ctrl.Call(_m, "GetFileHistory", ctx, file)
+	ret0, _ := ret[0].([]FileVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetFileHistory(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetFileHistory", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) RestoreFileVersion(ctx context.Context, file Node, rev MetadataRevision) error {
+	ret := _m.ctrl.Call(_m, "RestoreFileVersion", ctx, file, rev)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RestoreFileVersion(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RestoreFileVersion", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) RemoveDir(ctx context.Context, dir Node, dirName string) error {
 	ret := _m.ctrl.Call(_m, "RemoveDir", ctx, dir, dirName)
 	ret0, _ := ret[0].(error)
@@ -401,6 +501,16 @@ func (_mr *_MockKBFSOpsRecorder) Write(arg0, arg1, arg2, arg3 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Write", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) Append(ctx context.Context, file Node, data []byte) error {
+	ret := _m.ctrl.Call(_m, "Append", ctx, file, data)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) Append(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Append", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Truncate(ctx context.Context, file Node, size uint64) error {
 	ret := _m.ctrl.Call(_m, "Truncate", ctx, file, size)
 	ret0, _ := ret[0].(error)
@@ -411,6 +521,28 @@ func (_mr *_MockKBFSOpsRecorder) Truncate(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Truncate", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) SeekData(ctx context.Context, file Node, off int64) (int64, error) {
+	ret := _m.ctrl.Call(_m, "SeekData", ctx, file, off)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) SeekData(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SeekData", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SeekHole(ctx context.Context, file Node, off int64) (int64, error) {
+	ret := _m.ctrl.Call(_m, "SeekHole", ctx, file, off)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) SeekHole(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SeekHole", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) SetEx(ctx context.Context, file Node, ex bool) error {
 	ret := _m.ctrl.Call(_m, "SetEx", ctx, file, ex)
 	ret0, _ := ret[0].(error)
@@ -431,6 +563,69 @@ func (_mr *_MockKBFSOpsRecorder) SetMtime(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMtime", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) GetXattrs(ctx context.Context, node Node) (map[string][]byte, error) {
+	ret := _m.ctrl.Call(_m, "GetXattrs", ctx, node)
+	ret0, _ := ret[0].(map[string][]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetXattrs(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetXattrs", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) SetXattr(ctx context.Context, node Node, name string, value []byte) error {
+	ret := _m.ctrl.Call(_m, "SetXattr", ctx, node, name, value)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetXattr(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetXattr", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) RemoveXattr(ctx context.Context, node Node, name string) error {
+	ret := _m.ctrl.Call(_m, "RemoveXattr", ctx, node, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RemoveXattr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveXattr", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) LockFile(ctx context.Context, file Node, lock FileLock) error {
+	ret := _m.ctrl.Call(_m, "LockFile", ctx, file, lock)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) LockFile(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LockFile", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) UnlockFile(ctx context.Context, file Node, owner uint64, start uint64, end uint64) error {
+	ret := _m.ctrl.Call(_m, "UnlockFile", ctx, file, owner, start, end)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) UnlockFile(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnlockFile", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockKBFSOps) GetConflictingFileLock(ctx context.Context, file Node, lock FileLock) (FileLock, bool, error) {
+	ret := _m.ctrl.Call(_m, "GetConflictingFileLock", ctx, file, lock)
+	ret0, _ := ret[0].(FileLock)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetConflictingFileLock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetConflictingFileLock", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Sync(ctx context.Context, file Node) error {
 	ret := _m.ctrl.Call(_m, "Sync", ctx, file)
 	ret0, _ := ret[0].(error)
@@ -506,6 +701,28 @@ func (_mr *_MockKBFSOpsRecorder) GetUpdateHistory(arg0, arg1 interface{}) *gomoc
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUpdateHistory", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetRevisionDiff(ctx context.Context, folderBranch FolderBranch, from MetadataRevision, to MetadataRevision) (RevisionDiff, error) {
+	ret := _m.ctrl.Call(_m, "GetRevisionDiff", ctx, folderBranch, from, to)
+	ret0, _ := ret[0].(RevisionDiff)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetRevisionDiff(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRevisionDiff", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) BeginTx(ctx context.Context, folderBranch FolderBranch) (KBFSTx, error) {
+	ret := _m.ctrl.Call(_m, "BeginTx", ctx, folderBranch)
+	ret0, _ := ret[0].(KBFSTx)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) BeginTx(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BeginTx", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) Shutdown() error {
 	ret := _m.ctrl.Call(_m, "Shutdown")
 	ret0, _ := ret[0].(error)
@@ -524,6 +741,111 @@ func (_mr *_MockKBFSOpsRecorder) PushConnectionStatusChange(arg0, arg1 interface
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "PushConnectionStatusChange", arg0, arg1)
 }
 
+// Mock of KBFSTx interface
+type MockKBFSTx struct {
+	ctrl     *gomock.Controller
+	recorder *_MockKBFSTxRecorder
+}
+
+// Recorder for MockKBFSTx (not exported)
+type _MockKBFSTxRecorder struct {
+	mock *MockKBFSTx
+}
+
+func NewMockKBFSTx(ctrl *gomock.Controller) *MockKBFSTx {
+	mock := &MockKBFSTx{ctrl: ctrl}
+	mock.recorder = &_MockKBFSTxRecorder{mock}
+	return mock
+}
+
+func (_m *MockKBFSTx) EXPECT() *_MockKBFSTxRecorder {
+	return _m.recorder
+}
+
+func (_m *MockKBFSTx) CreateDir(ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CreateDir", ctx, dir, name)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSTxRecorder) CreateDir(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateDir", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSTx) CreateFile(ctx context.Context, dir Node, name string, isExec bool) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CreateFile", ctx, dir, name, isExec)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSTxRecorder) CreateFile(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateFile", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSTx) Write(ctx context.Context, file Node, data []byte, off int64) error {
+	ret := _m.ctrl.Call(_m, "Write", ctx, file, data, off)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSTxRecorder) Write(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Write", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSTx) RemoveDir(ctx context.Context, dir Node, dirName string) error {
+	ret := _m.ctrl.Call(_m, "RemoveDir", ctx, dir, dirName)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSTxRecorder) RemoveDir(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveDir", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSTx) RemoveEntry(ctx context.Context, dir Node, name string) error {
+	ret := _m.ctrl.Call(_m, "RemoveEntry", ctx, dir, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSTxRecorder) RemoveEntry(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveEntry", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSTx) Rename(ctx context.Context, oldParent Node, oldName string, newParent Node, newName string) error {
+	ret := _m.ctrl.Call(_m, "Rename", ctx, oldParent, oldName, newParent, newName)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSTxRecorder) Rename(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Rename", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockKBFSTx) Commit(ctx context.Context) error {
+	ret := _m.ctrl.Call(_m, "Commit", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSTxRecorder) Commit(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Commit", arg0)
+}
+
+func (_m *MockKBFSTx) Abort(ctx context.Context) error {
+	ret := _m.ctrl.Call(_m, "Abort", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSTxRecorder) Abort(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Abort", arg0)
+}
+
 // Mock of KeybaseDaemon interface
 type MockKeybaseDaemon struct {
 	ctrl     *gomock.Controller
@@ -1069,6 +1391,14 @@ func (_mr *_MockMDCacheRecorder) Put(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0)
 }
 
+func (_m *MockMDCache) Delete(tlf TlfID, rev MetadataRevision, bid BranchID) {
+	_m.ctrl.Call(_m, "Delete", tlf, rev, bid)
+}
+
+func (_mr *_MockMDCacheRecorder) Delete(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Delete", arg0, arg1, arg2)
+}
+
 // Mock of KeyCache interface
 type MockKeyCache struct {
 	ctrl     *gomock.Controller
@@ -1234,6 +1564,138 @@ func (_mr *_MockBlockCacheRecorder) DirtyBytesEstimate() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DirtyBytesEstimate")
 }
 
+func (_m *MockBlockCache) TransientCapacity() int {
+	ret := _m.ctrl.Call(_m, "TransientCapacity")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockBlockCacheRecorder) TransientCapacity() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "TransientCapacity")
+}
+
+// Mock of DiskBlockCache interface
+type MockDiskBlockCache struct {
+	ctrl     *gomock.Controller
+	recorder *_MockDiskBlockCacheRecorder
+}
+
+// Recorder for MockDiskBlockCache (not exported)
+type _MockDiskBlockCacheRecorder struct {
+	mock *MockDiskBlockCache
+}
+
+func NewMockDiskBlockCache(ctrl *gomock.Controller) *MockDiskBlockCache {
+	mock := &MockDiskBlockCache{ctrl: ctrl}
+	mock.recorder = &_MockDiskBlockCacheRecorder{mock}
+	return mock
+}
+
+func (_m *MockDiskBlockCache) EXPECT() *_MockDiskBlockCacheRecorder {
+	return _m.recorder
+}
+
+func (_m *MockDiskBlockCache) Get(ctx context.Context, id BlockID) ([]byte, BlockCryptKeyServerHalf, error) {
+	ret := _m.ctrl.Call(_m, "Get", ctx, id)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(BlockCryptKeyServerHalf)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Get(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Get", arg0, arg1)
+}
+
+func (_m *MockDiskBlockCache) Put(ctx context.Context, id BlockID, buf []byte, serverHalf BlockCryptKeyServerHalf) error {
+	ret := _m.ctrl.Call(_m, "Put", ctx, id, buf, serverHalf)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Put(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockDiskBlockCache) Delete(ctx context.Context, ids []BlockID) error {
+	ret := _m.ctrl.Call(_m, "Delete", ctx, ids)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Delete(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Delete", arg0, arg1)
+}
+
+func (_m *MockDiskBlockCache) Shutdown() {
+	_m.ctrl.Call(_m, "Shutdown")
+}
+
+func (_mr *_MockDiskBlockCacheRecorder) Shutdown() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown")
+}
+
+// Mock of DiskMDCache interface
+type MockDiskMDCache struct {
+	ctrl     *gomock.Controller
+	recorder *_MockDiskMDCacheRecorder
+}
+
+// Recorder for MockDiskMDCache (not exported)
+type _MockDiskMDCacheRecorder struct {
+	mock *MockDiskMDCache
+}
+
+func NewMockDiskMDCache(ctrl *gomock.Controller) *MockDiskMDCache {
+	mock := &MockDiskMDCache{ctrl: ctrl}
+	mock.recorder = &_MockDiskMDCacheRecorder{mock}
+	return mock
+}
+
+func (_m *MockDiskMDCache) EXPECT() *_MockDiskMDCacheRecorder {
+	return _m.recorder
+}
+
+func (_m *MockDiskMDCache) Get(ctx context.Context, id TlfID) (*RootMetadata, error) {
+	ret := _m.ctrl.Call(_m, "Get", ctx, id)
+	ret0, _ := ret[0].(*RootMetadata)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDiskMDCacheRecorder) Get(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Get", arg0, arg1)
+}
+
+func (_m *MockDiskMDCache) GetForHandle(ctx context.Context, handle *TlfHandle) (*RootMetadata, error) {
+	ret := _m.ctrl.Call(_m, "GetForHandle", ctx, handle)
+	ret0, _ := ret[0].(*RootMetadata)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDiskMDCacheRecorder) GetForHandle(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetForHandle", arg0, arg1)
+}
+
+func (_m *MockDiskMDCache) Put(ctx context.Context, md *RootMetadata) error {
+	ret := _m.ctrl.Call(_m, "Put", ctx, md)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskMDCacheRecorder) Put(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0, arg1)
+}
+
+func (_m *MockDiskMDCache) Shutdown() {
+	_m.ctrl.Call(_m, "Shutdown")
+}
+
+func (_mr *_MockDiskMDCacheRecorder) Shutdown() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown")
+}
+
 // Mock of Crypto interface
 type MockCrypto struct {
 	ctrl     *gomock.Controller
@@ -1521,26 +1983,26 @@ func (_mr *_MockCryptoRecorder) DecryptPrivateMetadata(arg0, arg1 interface{}) *
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptPrivateMetadata", arg0, arg1)
 }
 
-func (_m *MockCrypto) EncryptBlock(block Block, key BlockCryptKey) (int, EncryptedBlock, error) {
-	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key)
+func (_m *MockCrypto) EncryptBlock(block Block, key BlockCryptKey, maxSize int) (int, EncryptedBlock, error) {
+	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key, maxSize)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(EncryptedBlock)
 	ret2, _ := ret[2].(error)
 	return ret0, ret1, ret2
 }
 
-func (_mr *_MockCryptoRecorder) EncryptBlock(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1)
+func (_mr *_MockCryptoRecorder) EncryptBlock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1, arg2)
 }
 
-func (_m *MockCrypto) DecryptBlock(encryptedBlock EncryptedBlock, key BlockCryptKey, block Block) error {
-	ret := _m.ctrl.Call(_m, "DecryptBlock", encryptedBlock, key, block)
+func (_m *MockCrypto) DecryptBlock(encryptedBlock EncryptedBlock, key BlockCryptKey, maxSize int, block Block) error {
+	ret := _m.ctrl.Call(_m, "DecryptBlock", encryptedBlock, key, maxSize, block)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockCryptoRecorder) DecryptBlock(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptBlock", arg0, arg1, arg2)
+func (_mr *_MockCryptoRecorder) DecryptBlock(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptBlock", arg0, arg1, arg2, arg3)
 }
 
 func (_m *MockCrypto) EncryptMerkleLeaf(leaf MerkleLeaf, pubKey TLFPublicKey, nonce *[24]byte, ePrivKey TLFEphemeralPrivateKey) (EncryptedMerkleLeaf, error) {
@@ -1718,6 +2180,17 @@ func (_mr *_MockMDOpsRecorder) GetUnmergedRange(arg0, arg1, arg2, arg3, arg4 int
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUnmergedRange", arg0, arg1, arg2, arg3, arg4)
 }
 
+func (_m *MockMDOps) GetForTLFByTime(ctx context.Context, id TlfID, serverTime time.Time) (*RootMetadata, error) {
+	ret := _m.ctrl.Call(_m, "GetForTLFByTime", ctx, id, serverTime)
+	ret0, _ := ret[0].(*RootMetadata)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDOpsRecorder) GetForTLFByTime(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetForTLFByTime", arg0, arg1, arg2)
+}
+
 func (_m *MockMDOps) Put(ctx context.Context, rmd *RootMetadata) error {
 	ret := _m.ctrl.Call(_m, "Put", ctx, rmd)
 	ret0, _ := ret[0].(error)
@@ -1939,6 +2412,17 @@ func (_mr *_MockMDServerRecorder) GetRange(arg0, arg1, arg2, arg3, arg4, arg5 in
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRange", arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
+func (_m *MockMDServer) GetForTLFByTime(ctx context.Context, id TlfID, serverTime time.Time) (*RootMetadataSigned, error) {
+	ret := _m.ctrl.Call(_m, "GetForTLFByTime", ctx, id, serverTime)
+	ret0, _ := ret[0].(*RootMetadataSigned)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) GetForTLFByTime(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetForTLFByTime", arg0, arg1, arg2)
+}
+
 func (_m *MockMDServer) Put(ctx context.Context, rmds *RootMetadataSigned) error {
 	ret := _m.ctrl.Call(_m, "Put", ctx, rmds)
 	ret0, _ := ret[0].(error)
@@ -2002,6 +2486,28 @@ func (_mr *_MockMDServerRecorder) TruncateUnlock(arg0, arg1 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "TruncateUnlock", arg0, arg1)
 }
 
+func (_m *MockMDServer) FileLock(ctx context.Context, id TlfID, lockID string, exclusive bool, lease time.Duration) (bool, error) {
+	ret := _m.ctrl.Call(_m, "FileLock", ctx, id, lockID, exclusive, lease)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) FileLock(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FileLock", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockMDServer) FileUnlock(ctx context.Context, id TlfID, lockID string) (bool, error) {
+	ret := _m.ctrl.Call(_m, "FileUnlock", ctx, id, lockID)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) FileUnlock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FileUnlock", arg0, arg1, arg2)
+}
+
 func (_m *MockMDServer) DisableRekeyUpdatesForTesting() {
 	_m.ctrl.Call(_m, "DisableRekeyUpdatesForTesting")
 }
@@ -2181,6 +2687,46 @@ func (_mr *_MockBlockSplitterRecorder) CheckSplit(arg0 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CheckSplit", arg0)
 }
 
+func (_m *MockBlockSplitter) MaxPtrsPerBlock() int {
+	ret := _m.ctrl.Call(_m, "MaxPtrsPerBlock")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockBlockSplitterRecorder) MaxPtrsPerBlock() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxPtrsPerBlock")
+}
+
+func (_m *MockBlockSplitter) SplitDirIfNeeded(block *DirBlock) []string {
+	ret := _m.ctrl.Call(_m, "SplitDirIfNeeded", block)
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+func (_mr *_MockBlockSplitterRecorder) SplitDirIfNeeded(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SplitDirIfNeeded", arg0)
+}
+
+func (_m *MockBlockSplitter) ShouldMergeDirBlocks(left *DirBlock, right *DirBlock) bool {
+	ret := _m.ctrl.Call(_m, "ShouldMergeDirBlocks", left, right)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockBlockSplitterRecorder) ShouldMergeDirBlocks(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ShouldMergeDirBlocks", arg0, arg1)
+}
+
+func (_m *MockBlockSplitter) MaxSize() int64 {
+	ret := _m.ctrl.Call(_m, "MaxSize")
+	ret0, _ := ret[0].(int64)
+	return ret0
+}
+
+func (_mr *_MockBlockSplitterRecorder) MaxSize() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxSize")
+}
+
 func (_m *MockBlockSplitter) ShouldEmbedBlockChanges(bc *BlockChanges) bool {
 	ret := _m.ctrl.Call(_m, "ShouldEmbedBlockChanges", bc)
 	ret0, _ := ret[0].(bool)
@@ -2399,6 +2945,48 @@ func (_mr *_MockConflictRenamerRecorder) ConflictRename(arg0, arg1 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictRename", arg0, arg1)
 }
 
+// Mock of ContentMerger interface
+type MockContentMerger struct {
+	ctrl     *gomock.Controller
+	recorder *_MockContentMergerRecorder
+}
+
+// Recorder for MockContentMerger (not exported)
+type _MockContentMergerRecorder struct {
+	mock *MockContentMerger
+}
+
+func NewMockContentMerger(ctrl *gomock.Controller) *MockContentMerger {
+	mock := &MockContentMerger{ctrl: ctrl}
+	mock.recorder = &_MockContentMergerRecorder{mock}
+	return mock
+}
+
+func (_m *MockContentMerger) EXPECT() *_MockContentMergerRecorder {
+	return _m.recorder
+}
+
+func (_m *MockContentMerger) MaxMergeBytes(h *TlfHandle) uint64 {
+	ret := _m.ctrl.Call(_m, "MaxMergeBytes", h)
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+func (_mr *_MockContentMergerRecorder) MaxMergeBytes(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxMergeBytes", arg0)
+}
+
+func (_m *MockContentMerger) Merge(base []byte, merged []byte, unmerged []byte) ([]byte, bool) {
+	ret := _m.ctrl.Call(_m, "Merge", base, merged, unmerged)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+func (_mr *_MockContentMergerRecorder) Merge(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Merge", arg0, arg1, arg2)
+}
+
 // Mock of Config interface
 type MockConfig struct {
 	ctrl     *gomock.Controller
@@ -2546,6 +3134,42 @@ func (_mr *_MockConfigRecorder) SetBlockCache(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockCache", arg0)
 }
 
+func (_m *MockConfig) DiskBlockCache() DiskBlockCache {
+	ret := _m.ctrl.Call(_m, "DiskBlockCache")
+	ret0, _ := ret[0].(DiskBlockCache)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DiskBlockCache() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DiskBlockCache")
+}
+
+func (_m *MockConfig) SetDiskBlockCache(_param0 DiskBlockCache) {
+	_m.ctrl.Call(_m, "SetDiskBlockCache", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDiskBlockCache(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDiskBlockCache", arg0)
+}
+
+func (_m *MockConfig) DiskMDCache() DiskMDCache {
+	ret := _m.ctrl.Call(_m, "DiskMDCache")
+	ret0, _ := ret[0].(DiskMDCache)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DiskMDCache() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DiskMDCache")
+}
+
+func (_m *MockConfig) SetDiskMDCache(_param0 DiskMDCache) {
+	_m.ctrl.Call(_m, "SetDiskMDCache", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDiskMDCache(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDiskMDCache", arg0)
+}
+
 func (_m *MockConfig) Crypto() Crypto {
 	ret := _m.ctrl.Call(_m, "Crypto")
 	ret0, _ := ret[0].(Crypto)
@@ -2780,6 +3404,24 @@ func (_mr *_MockConfigRecorder) SetConflictRenamer(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConflictRenamer", arg0)
 }
 
+func (_m *MockConfig) ContentMerger() ContentMerger {
+	ret := _m.ctrl.Call(_m, "ContentMerger")
+	ret0, _ := ret[0].(ContentMerger)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ContentMerger() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ContentMerger")
+}
+
+func (_m *MockConfig) SetContentMerger(_param0 ContentMerger) {
+	_m.ctrl.Call(_m, "SetContentMerger", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetContentMerger(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetContentMerger", arg0)
+}
+
 func (_m *MockConfig) MetadataVersion() MetadataVer {
 	ret := _m.ctrl.Call(_m, "MetadataVersion")
 	ret0, _ := ret[0].(MetadataVer)
@@ -2818,6 +3460,42 @@ func (_mr *_MockConfigRecorder) SetRekeyQueue(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetRekeyQueue", arg0)
 }
 
+func (_m *MockConfig) TransferScheduler() TransferScheduler {
+	ret := _m.ctrl.Call(_m, "TransferScheduler")
+	ret0, _ := ret[0].(TransferScheduler)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) TransferScheduler() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "TransferScheduler")
+}
+
+func (_m *MockConfig) SetTransferScheduler(_param0 TransferScheduler) {
+	_m.ctrl.Call(_m, "SetTransferScheduler", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetTransferScheduler(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTransferScheduler", arg0)
+}
+
+func (_m *MockConfig) DirtyBudget() DirtyBudget {
+	ret := _m.ctrl.Call(_m, "DirtyBudget")
+	ret0, _ := ret[0].(DirtyBudget)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DirtyBudget() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DirtyBudget")
+}
+
+func (_m *MockConfig) SetDirtyBudget(_param0 DirtyBudget) {
+	_m.ctrl.Call(_m, "SetDirtyBudget", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDirtyBudget(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDirtyBudget", arg0)
+}
+
 func (_m *MockConfig) ReqsBufSize() int {
 	ret := _m.ctrl.Call(_m, "ReqsBufSize")
 	ret0, _ := ret[0].(int)
@@ -2868,6 +3546,46 @@ func (_mr *_MockConfigRecorder) DoBackgroundFlushes() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DoBackgroundFlushes")
 }
 
+func (_m *MockConfig) ReadAheadBlocks() int {
+	ret := _m.ctrl.Call(_m, "ReadAheadBlocks")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ReadAheadBlocks() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ReadAheadBlocks")
+}
+
+func (_m *MockConfig) DoDirPrefetch() bool {
+	ret := _m.ctrl.Call(_m, "DoDirPrefetch")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DoDirPrefetch() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DoDirPrefetch")
+}
+
+func (_m *MockConfig) MDBatchWindow() time.Duration {
+	ret := _m.ctrl.Call(_m, "MDBatchWindow")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MDBatchWindow() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MDBatchWindow")
+}
+
+func (_m *MockConfig) MDBatchBytes() uint64 {
+	ret := _m.ctrl.Call(_m, "MDBatchBytes")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MDBatchBytes() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MDBatchBytes")
+}
+
 func (_m *MockConfig) RekeyWithPromptWaitTime() time.Duration {
 	ret := _m.ctrl.Call(_m, "RekeyWithPromptWaitTime")
 	ret0, _ := ret[0].(time.Duration)
@@ -3101,14 +3819,14 @@ func (_mr *_MockcrActionRecorder) swapUnmergedBlock(arg0, arg1, arg2 interface{}
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "swapUnmergedBlock", arg0, arg1, arg2)
 }
 
-func (_m *MockcrAction) do(ctx context.Context, unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier, unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
-	ret := _m.ctrl.Call(_m, "do", ctx, unmergedCopier, mergedCopier, unmergedBlock, mergedBlock)
+func (_m *MockcrAction) do(ctx context.Context, unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier, appender fileBlockAppender, merger fileContentMerger, unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	ret := _m.ctrl.Call(_m, "do", ctx, unmergedCopier, mergedCopier, appender, merger, unmergedBlock, mergedBlock)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockcrActionRecorder) do(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "do", arg0, arg1, arg2, arg3, arg4)
+func (_mr *_MockcrActionRecorder) do(arg0, arg1, arg2, arg3, arg4, arg5, arg6 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "do", arg0, arg1, arg2, arg3, arg4, arg5, arg6)
 }
 
 func (_m *MockcrAction) updateOps(unmergedMostRecent BlockPointer, mergedMostRecent BlockPointer, unmergedBlock *DirBlock, mergedBlock *DirBlock, unmergedChains *crChains, mergedChains *crChains) error {
@@ -3131,6 +3849,132 @@ func (_mr *_MockcrActionRecorder) String() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "String")
 }
 
+// Mock of TransferScheduler interface
+type MockTransferScheduler struct {
+	ctrl     *gomock.Controller
+	recorder *_MockTransferSchedulerRecorder
+}
+
+// Recorder for MockTransferScheduler (not exported)
+type _MockTransferSchedulerRecorder struct {
+	mock *MockTransferScheduler
+}
+
+func NewMockTransferScheduler(ctrl *gomock.Controller) *MockTransferScheduler {
+	mock := &MockTransferScheduler{ctrl: ctrl}
+	mock.recorder = &_MockTransferSchedulerRecorder{mock}
+	return mock
+}
+
+func (_m *MockTransferScheduler) EXPECT() *_MockTransferSchedulerRecorder {
+	return _m.recorder
+}
+
+func (_m *MockTransferScheduler) BeginPut(ctx context.Context, size int, prio TransferPriority) (func(), error) {
+	ret := _m.ctrl.Call(_m, "BeginPut", ctx, size, prio)
+	ret0, _ := ret[0].(func())
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockTransferSchedulerRecorder) BeginPut(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BeginPut", arg0, arg1, arg2)
+}
+
+func (_m *MockTransferScheduler) RecordGet(ctx context.Context, size int) error {
+	ret := _m.ctrl.Call(_m, "RecordGet", ctx, size)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockTransferSchedulerRecorder) RecordGet(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RecordGet", arg0, arg1)
+}
+
+func (_m *MockTransferScheduler) MaxPuts() int {
+	ret := _m.ctrl.Call(_m, "MaxPuts")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockTransferSchedulerRecorder) MaxPuts() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxPuts")
+}
+
+// Mock of DirtyBudget interface
+type MockDirtyBudget struct {
+	ctrl     *gomock.Controller
+	recorder *_MockDirtyBudgetRecorder
+}
+
+// Recorder for MockDirtyBudget (not exported)
+type _MockDirtyBudgetRecorder struct {
+	mock *MockDirtyBudget
+}
+
+func NewMockDirtyBudget(ctrl *gomock.Controller) *MockDirtyBudget {
+	mock := &MockDirtyBudget{ctrl: ctrl}
+	mock.recorder = &_MockDirtyBudgetRecorder{mock}
+	return mock
+}
+
+func (_m *MockDirtyBudget) EXPECT() *_MockDirtyBudgetRecorder {
+	return _m.recorder
+}
+
+func (_m *MockDirtyBudget) BeginWrite(ctx context.Context, tlf TlfID, file NodeID, n int64) (bool, error) {
+	ret := _m.ctrl.Call(_m, "BeginWrite", ctx, tlf, file, n)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDirtyBudgetRecorder) BeginWrite(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BeginWrite", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockDirtyBudget) Dirtied(tlf TlfID, file NodeID, n int64) {
+	_m.ctrl.Call(_m, "Dirtied", tlf, file, n)
+}
+
+func (_mr *_MockDirtyBudgetRecorder) Dirtied(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Dirtied", arg0, arg1, arg2)
+}
+
+func (_m *MockDirtyBudget) ShouldForceSync(tlf TlfID) bool {
+	ret := _m.ctrl.Call(_m, "ShouldForceSync", tlf)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockDirtyBudgetRecorder) ShouldForceSync(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ShouldForceSync", arg0)
+}
+
+func (_m *MockDirtyBudget) SyncStarted(tlf TlfID, file NodeID) {
+	_m.ctrl.Call(_m, "SyncStarted", tlf, file)
+}
+
+func (_mr *_MockDirtyBudgetRecorder) SyncStarted(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SyncStarted", arg0, arg1)
+}
+
+func (_m *MockDirtyBudget) SyncFinished(tlf TlfID, file NodeID, stillDirty bool, err error) {
+	_m.ctrl.Call(_m, "SyncFinished", tlf, file, stillDirty, err)
+}
+
+func (_mr *_MockDirtyBudgetRecorder) SyncFinished(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SyncFinished", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockDirtyBudget) Discarded(tlf TlfID, file NodeID) {
+	_m.ctrl.Call(_m, "Discarded", tlf, file)
+}
+
+func (_mr *_MockDirtyBudgetRecorder) Discarded(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Discarded", arg0, arg1)
+}
+
 // Mock of RekeyQueue interface
 type MockRekeyQueue struct {
 	ctrl     *gomock.Controller
@@ -49,6 +49,9 @@ const (
 	resolutionOpCode
 	rekeyOpCode
 	gcOpCode // for deleting old blocks during an MD history truncation
+	linkOpCode
+	unlinkOpCode
+	copyOpCode
 )
 
 // blockUpdate represents a block that was updated to have a new
@@ -153,6 +156,11 @@ type createOp struct {
 	// conflict resolution, and the following field represents the
 	// text of the symlink. This op should never be persisted.
 	crSymPath string
+
+	// If true, this create op stands in for a copyOp, so the new
+	// file already has contents even without any syncs.  This op
+	// should never be persisted.
+	copied bool
 }
 
 func newCreateOp(name string, oldDir BlockPointer, t EntryType) *createOp {
@@ -233,6 +241,15 @@ func (co *createOp) CheckConflict(renamer ConflictRenamer, mergedOp op) (
 				unique:   true,
 			}, nil
 		}
+	case *linkOp:
+		if realMergedOp.NewName == co.NewName {
+			// A new hard link name conflicts just like any other
+			// non-directory entry would.
+			stub := newCreateOp(realMergedOp.NewName,
+				realMergedOp.Dir.Unref, HardLink)
+			stub.setWriterInfo(realMergedOp.getWriterInfo())
+			return co.CheckConflict(renamer, stub)
+		}
 	}
 	// Doesn't conflict with any rmOps, because the default action
 	// will just re-create it in the merged branch as necessary.
@@ -311,6 +328,17 @@ func (ro *rmOp) CheckConflict(renamer ConflictRenamer, mergedOp op) (
 			// Both removed the same file.
 			return &dropUnmergedAction{op: ro}, nil
 		}
+	case *linkOp:
+		if realMergedOp.adjustsCount() && realMergedOp.LinkID == ro.OldName {
+			// This rm dropped the last name we knew of for a
+			// hard-linked file, but the merged branch gave it a new
+			// one, so keep the file and its blocks around.
+			return &adjustLinkCountAction{
+				name:  ro.OldName,
+				delta: -1,
+				drop:  ro,
+			}, nil
+		}
 	}
 	return nil, nil
 }
@@ -439,11 +467,14 @@ func (w WriteRange) Affects(other WriteRange) bool {
 		(other.Off <= w.End() && w.End() <= other.End())
 }
 
-// syncOp is an op that represents a series of writes to a file.
+// syncOp is an op that represents a series of writes to a file.  If
+// Append is set, all the writes added to the end of the file, so
+// concurrent appends to the same file can be merged.
 type syncOp struct {
 	OpCommon
 	File   blockUpdate  `codec:"f"`
 	Writes []WriteRange `codec:"w"`
+	Append bool         `codec:"a,omitempty"`
 }
 
 func newSyncOp(oldFile BlockPointer) *syncOp {
@@ -468,12 +499,23 @@ func (so *syncOp) AddUpdate(oldPtr BlockPointer, newPtr BlockPointer) {
 func (so *syncOp) addWrite(off uint64, length uint64) WriteRange {
 	latestWrite := WriteRange{Off: off, Len: length}
 	so.Writes = append(so.Writes, latestWrite)
+	so.Append = false
+	return latestWrite
+}
+
+// addAppend adds a write to the end of the file.  The sync stays an
+// append only as long as all of its writes are.
+func (so *syncOp) addAppend(off uint64, length uint64) WriteRange {
+	isAppend := len(so.Writes) == 0 || so.Append
+	latestWrite := so.addWrite(off, length)
+	so.Append = isAppend
 	return latestWrite
 }
 
 func (so *syncOp) addTruncate(off uint64) WriteRange {
 	latestWrite := WriteRange{Off: off, Len: 0}
 	so.Writes = append(so.Writes, latestWrite)
+	so.Append = false
 	return latestWrite
 }
 
@@ -492,16 +534,28 @@ func (so *syncOp) String() string {
 	for _, r := range so.Writes {
 		writes = append(writes, fmt.Sprintf("{off=%d, len=%d}", r.Off, r.Len))
 	}
+	if so.Append {
+		return fmt.Sprintf("append [%s]", strings.Join(writes, ", "))
+	}
 	return fmt.Sprintf("sync [%s]", strings.Join(writes, ", "))
 }
 
 func (so *syncOp) CheckConflict(renamer ConflictRenamer, mergedOp op) (
 	crAction, error) {
-	switch mergedOp.(type) {
+	switch realMergedOp := mergedOp.(type) {
 	case *syncOp:
-		// Any sync on the same file is a conflict.  (TODO: add
-		// type-specific intelligent conflict resolvers for file
-		// contents?)
+		if so.Append && realMergedOp.Append && len(so.Writes) > 0 {
+			// Concurrent appends are merged by adding the unmerged
+			// data after the merged data.
+			return &appendUnmergedAction{
+				fromName: so.getFinalPath().tailName(),
+				toName:   mergedOp.getFinalPath().tailName(),
+				off:      so.Writes[0].Off,
+			}, nil
+		}
+		// Any other sync on the same file is a conflict.  (TODO:
+		// add type-specific intelligent conflict resolvers for
+		// file contents?)
 		return &renameUnmergedAction{
 			fromName: so.getFinalPath().tailName(),
 			toName: renamer.ConflictRename(so, mergedOp.getFinalPath().
@@ -649,6 +703,7 @@ const (
 	exAttr attrChange = iota
 	mtimeAttr
 	sizeAttr // only used during conflict resolution
+	xattrAttr
 )
 
 func (ac attrChange) String() string {
@@ -659,18 +714,22 @@ func (ac attrChange) String() string {
 		return "mtime"
 	case sizeAttr:
 		return "size"
+	case xattrAttr:
+		return "xattr"
 	}
 	return "<invalid attrChange>"
 }
 
 // setAttrOp is an op that represents changing the attributes of a
-// file/subdirectory with in a directory.
+// file/subdirectory with in a directory.  For xattrAttr, XattrName
+// says which extended attribute was set or removed.
 type setAttrOp struct {
 	OpCommon
-	Name string       `codec:"n"`
-	Dir  blockUpdate  `codec:"d"`
-	Attr attrChange   `codec:"a"`
-	File BlockPointer `codec:"f"`
+	Name      string       `codec:"n"`
+	Dir       blockUpdate  `codec:"d"`
+	Attr      attrChange   `codec:"a"`
+	File      BlockPointer `codec:"f"`
+	XattrName string       `codec:"x,omitempty"`
 }
 
 func newSetAttrOp(name string, oldDir BlockPointer,
@@ -693,7 +752,7 @@ func (sao *setAttrOp) AddUpdate(oldPtr BlockPointer, newPtr BlockPointer) {
 }
 
 func (sao *setAttrOp) SizeExceptUpdates() uint64 {
-	return uint64(len(sao.Name))
+	return uint64(len(sao.Name) + len(sao.XattrName))
 }
 
 func (sao *setAttrOp) AllUpdates() []blockUpdate {
@@ -703,6 +762,10 @@ func (sao *setAttrOp) AllUpdates() []blockUpdate {
 }
 
 func (sao *setAttrOp) String() string {
+	if sao.Attr == xattrAttr {
+		return fmt.Sprintf("setAttr %s (%s %s)", sao.Name, sao.Attr,
+			sao.XattrName)
+	}
 	return fmt.Sprintf("setAttr %s (%s)", sao.Name, sao.Attr)
 }
 
@@ -710,9 +773,11 @@ func (sao *setAttrOp) CheckConflict(renamer ConflictRenamer, mergedOp op) (
 	crAction, error) {
 	switch realMergedOp := mergedOp.(type) {
 	case *setAttrOp:
-		if realMergedOp.Attr == sao.Attr {
+		if realMergedOp.Attr == sao.Attr &&
+			realMergedOp.XattrName == sao.XattrName {
 			// A set attr for the same attribute on the same file is a
-			// conflict.
+			// conflict.  Different extended attributes don't
+			// conflict with each other.
 			return &renameUnmergedAction{
 				fromName: sao.getFinalPath().tailName(),
 				toName: renamer.ConflictRename(
@@ -728,11 +793,15 @@ func (sao *setAttrOp) CheckConflict(renamer ConflictRenamer, mergedOp op) (
 }
 
 func (sao *setAttrOp) GetDefaultAction(mergedPath path) crAction {
-	return &copyUnmergedAttrAction{
+	cuaa := &copyUnmergedAttrAction{
 		fromName: sao.getFinalPath().tailName(),
 		toName:   mergedPath.tailName(),
 		attr:     []attrChange{sao.Attr},
 	}
+	if sao.Attr == xattrAttr {
+		cuaa.xattrs = []string{sao.XattrName}
+	}
+	return cuaa
 }
 
 // resolutionOp is an op that represents the block changes that took
@@ -840,6 +909,332 @@ func (gco *gcOp) GetDefaultAction(mergedPath path) crAction {
 	return nil
 }
 
+// linkOp is an op representing a new hard link to a file.  The
+// linked file itself lives in the hidden links directory (Links)
+// under LinkID, and NewName becomes a HardLink entry in Dir that
+// refers to it.
+//
+// If OldName is set, this op also turns a regular file into a
+// hard-linked one: the file entry named OldName moves from OldDir
+// into the links directory, and OldName is replaced with a HardLink
+// entry.  If OldDir is the same as Dir, OldDir will be equivalent to
+// blockUpdate{}.  Linked records the moved pointer, like
+// renameOp.Renamed.
+//
+// During conflict resolution, a linkOp is split into separate ops
+// that each either add a name (Links is empty) or only bump the
+// link count (NewName is empty).
+type linkOp struct {
+	OpCommon
+	NewName string       `codec:"n,omitempty"`
+	Dir     blockUpdate  `codec:"d"`
+	LinkID  string       `codec:"l"`
+	Links   blockUpdate  `codec:"ld"`
+	OldName string       `codec:"on,omitempty"`
+	OldDir  blockUpdate  `codec:"od"`
+	Linked  BlockPointer `codec:"lp"`
+}
+
+func newLinkOp(newName string, oldDir BlockPointer, linkID string,
+	oldLinks BlockPointer) *linkOp {
+	lo := &linkOp{
+		NewName: newName,
+		LinkID:  linkID,
+	}
+	lo.Dir.Unref = oldDir
+	lo.Links.Unref = oldLinks
+	return lo
+}
+
+// convertFrom marks this op as the one that first moved the given
+// file into the links directory.
+func (lo *linkOp) convertFrom(oldName string, oldOldDir BlockPointer,
+	linked BlockPointer) {
+	lo.OldName = oldName
+	if oldOldDir != lo.Dir.Unref {
+		lo.OldDir.Unref = oldOldDir
+	}
+	lo.Linked = linked
+}
+
+// adjustsCount returns true if this op increments the link count of
+// an existing hard-linked file.  (A conversion sets the initial count
+// when it creates the file's entry in the links directory.)
+func (lo *linkOp) adjustsCount() bool {
+	return lo.Links != (blockUpdate{}) && lo.OldName == ""
+}
+
+func (lo *linkOp) AddUpdate(oldPtr BlockPointer, newPtr BlockPointer) {
+	if lo.Dir != (blockUpdate{}) && oldPtr == lo.Dir.Unref {
+		lo.Dir.Ref = newPtr
+		return
+	}
+	if lo.Links != (blockUpdate{}) && oldPtr == lo.Links.Unref {
+		lo.Links.Ref = newPtr
+		return
+	}
+	if lo.OldDir != (blockUpdate{}) && oldPtr == lo.OldDir.Unref {
+		lo.OldDir.Ref = newPtr
+		return
+	}
+	lo.OpCommon.AddUpdate(oldPtr, newPtr)
+}
+
+func (lo *linkOp) SizeExceptUpdates() uint64 {
+	return uint64(len(lo.NewName) + len(lo.LinkID) + len(lo.OldName))
+}
+
+func (lo *linkOp) AllUpdates() []blockUpdate {
+	updates := make([]blockUpdate, len(lo.Updates))
+	copy(updates, lo.Updates)
+	for _, update := range []blockUpdate{lo.Dir, lo.Links, lo.OldDir} {
+		if update != (blockUpdate{}) {
+			updates = append(updates, update)
+		}
+	}
+	return updates
+}
+
+func (lo *linkOp) String() string {
+	switch {
+	case lo.OldName != "":
+		return fmt.Sprintf("link %s -> %s (%s)", lo.OldName, lo.NewName,
+			lo.LinkID)
+	case lo.NewName == "":
+		return fmt.Sprintf("link count %s +1", lo.LinkID)
+	}
+	return fmt.Sprintf("link %s (%s)", lo.NewName, lo.LinkID)
+}
+
+func (lo *linkOp) CheckConflict(renamer ConflictRenamer, mergedOp op) (
+	crAction, error) {
+	switch realMergedOp := mergedOp.(type) {
+	case *createOp:
+		if lo.NewName != "" && realMergedOp.NewName == lo.NewName {
+			// The new name is taken; keep the link under a
+			// different name.
+			return &copyUnmergedEntryAction{
+				fromName: lo.NewName,
+				toName:   renamer.ConflictRename(lo, lo.NewName),
+				unique:   true,
+			}, nil
+		}
+	case *linkOp:
+		if lo.NewName != "" && realMergedOp.NewName == lo.NewName {
+			return &copyUnmergedEntryAction{
+				fromName: lo.NewName,
+				toName:   renamer.ConflictRename(lo, lo.NewName),
+				unique:   true,
+			}, nil
+		}
+	case *rmOp:
+		if lo.adjustsCount() && realMergedOp.OldName == lo.LinkID {
+			// The merged branch removed the last name it knew of,
+			// but this branch added a new one, so bring the file
+			// back.
+			return &adjustLinkCountAction{
+				name:    lo.LinkID,
+				delta:   1,
+				restore: true,
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (lo *linkOp) GetDefaultAction(mergedPath path) crAction {
+	if lo.adjustsCount() {
+		return &adjustLinkCountAction{
+			name:  lo.LinkID,
+			delta: 1,
+		}
+	}
+	return &copyUnmergedEntryAction{
+		fromName: lo.NewName,
+		toName:   lo.NewName,
+	}
+}
+
+// unlinkOp is an op representing the removal of one name of a
+// hard-linked file, and the matching decrement of its link count.
+// If that was the file's last name, its entry is removed from the
+// links directory too, and the op unrefs all of its blocks.
+//
+// Like linkOp, an unlinkOp is split during conflict resolution into
+// an op that removes a name (Links is empty) and one that only
+// adjusts the count (Dir is empty, but OldName is kept so that two
+// removals of the same name aren't counted twice); the removal of the
+// file itself becomes an rmOp.
+type unlinkOp struct {
+	OpCommon
+	OldName string      `codec:"n,omitempty"`
+	Dir     blockUpdate `codec:"d"`
+	LinkID  string      `codec:"l"`
+	Links   blockUpdate `codec:"ld"`
+}
+
+func newUnlinkOp(oldName string, oldDir BlockPointer, linkID string,
+	oldLinks BlockPointer) *unlinkOp {
+	uo := &unlinkOp{
+		OldName: oldName,
+		LinkID:  linkID,
+	}
+	uo.Dir.Unref = oldDir
+	uo.Links.Unref = oldLinks
+	return uo
+}
+
+// removesFile returns true if this op removed the last name of the
+// file, and with it the file itself.
+func (uo *unlinkOp) removesFile() bool {
+	return uo.Links != (blockUpdate{}) && len(uo.Unrefs()) > 0
+}
+
+// adjustsCount returns true if this op decrements the link count of a
+// file that still has other names.
+func (uo *unlinkOp) adjustsCount() bool {
+	return uo.Links != (blockUpdate{}) && len(uo.Unrefs()) == 0
+}
+
+func (uo *unlinkOp) AddUpdate(oldPtr BlockPointer, newPtr BlockPointer) {
+	if uo.Dir != (blockUpdate{}) && oldPtr == uo.Dir.Unref {
+		uo.Dir.Ref = newPtr
+		return
+	}
+	if uo.Links != (blockUpdate{}) && oldPtr == uo.Links.Unref {
+		uo.Links.Ref = newPtr
+		return
+	}
+	uo.OpCommon.AddUpdate(oldPtr, newPtr)
+}
+
+func (uo *unlinkOp) SizeExceptUpdates() uint64 {
+	return uint64(len(uo.OldName) + len(uo.LinkID))
+}
+
+func (uo *unlinkOp) AllUpdates() []blockUpdate {
+	updates := make([]blockUpdate, len(uo.Updates))
+	copy(updates, uo.Updates)
+	for _, update := range []blockUpdate{uo.Dir, uo.Links} {
+		if update != (blockUpdate{}) {
+			updates = append(updates, update)
+		}
+	}
+	return updates
+}
+
+func (uo *unlinkOp) String() string {
+	if uo.Dir == (blockUpdate{}) {
+		return fmt.Sprintf("link count %s -1", uo.LinkID)
+	}
+	return fmt.Sprintf("unlink %s (%s)", uo.OldName, uo.LinkID)
+}
+
+func (uo *unlinkOp) CheckConflict(renamer ConflictRenamer, mergedOp op) (
+	crAction, error) {
+	switch realMergedOp := mergedOp.(type) {
+	case *rmOp:
+		if uo.Links == (blockUpdate{}) &&
+			realMergedOp.OldName == uo.OldName {
+			// The name is already gone.
+			return &dropUnmergedAction{op: uo}, nil
+		}
+		if uo.adjustsCount() && realMergedOp.OldName == uo.LinkID {
+			// The file is already gone.
+			return &dropUnmergedAction{op: uo}, nil
+		}
+	case *unlinkOp:
+		if realMergedOp.OldName == uo.OldName &&
+			realMergedOp.LinkID == uo.LinkID {
+			// Both removed the same name, and the merged branch
+			// already adjusted the count for it.
+			return &dropUnmergedAction{op: uo}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (uo *unlinkOp) GetDefaultAction(mergedPath path) crAction {
+	if uo.adjustsCount() {
+		return &adjustLinkCountAction{
+			name:  uo.LinkID,
+			delta: -1,
+		}
+	}
+	return &rmMergedEntryAction{name: uo.OldName}
+}
+
+// copyOp is an op representing the creation of a file as a copy of
+// another one.  Instead of new blocks, the copy gets new references
+// to the leaf blocks of the original file (plus copies of any
+// indirect blocks pointing to them), which are listed in the op's
+// Refs, with the copy's top block first.  Restoring a removed entry
+// is also done with a copyOp; for a directory, the new references
+// cover everything under it, plus new copies of the directory
+// blocks.
+//
+// During conflict resolution, a copyOp is treated as a createOp for
+// an entry that happens to already have all its blocks.
+type copyOp struct {
+	OpCommon
+	NewName string      `codec:"n"`
+	Dir     blockUpdate `codec:"d"`
+	Type    EntryType   `codec:"t"`
+}
+
+func newCopyOp(name string, oldDir BlockPointer, t EntryType) *copyOp {
+	co := &copyOp{
+		NewName: name,
+		Type:    t,
+	}
+	co.Dir.Unref = oldDir
+	return co
+}
+
+// toCreateOp returns a createOp that creates the same file, with
+// the same refs, as this op.
+func (co *copyOp) toCreateOp() *createOp {
+	cro := newCreateOp(co.NewName, co.Dir.Unref, co.Type)
+	cro.Dir.Ref = co.Dir.Ref
+	cro.copied = true
+	cro.setWriterInfo(co.getWriterInfo())
+	for _, ptr := range co.Refs() {
+		cro.AddRefBlock(ptr)
+	}
+	return cro
+}
+
+func (co *copyOp) AddUpdate(oldPtr BlockPointer, newPtr BlockPointer) {
+	if oldPtr == co.Dir.Unref {
+		co.Dir.Ref = newPtr
+		return
+	}
+	co.OpCommon.AddUpdate(oldPtr, newPtr)
+}
+
+func (co *copyOp) SizeExceptUpdates() uint64 {
+	return uint64(len(co.NewName))
+}
+
+func (co *copyOp) AllUpdates() []blockUpdate {
+	updates := make([]blockUpdate, len(co.Updates))
+	copy(updates, co.Updates)
+	return append(updates, co.Dir)
+}
+
+func (co *copyOp) String() string {
+	return fmt.Sprintf("copy %s (%s)", co.NewName, co.Type)
+}
+
+func (co *copyOp) CheckConflict(renamer ConflictRenamer, mergedOp op) (
+	crAction, error) {
+	return co.toCreateOp().CheckConflict(renamer, mergedOp)
+}
+
+func (co *copyOp) GetDefaultAction(mergedPath path) crAction {
+	return co.toCreateOp().GetDefaultAction(mergedPath)
+}
+
 // invertOpForLocalNotifications returns an operation that represents
 // an undoing of the effect of the given op.  These are intended to be
 // used for local notifications only, and would not be useful for
@@ -870,6 +1265,16 @@ func invertOpForLocalNotifications(oldOp op) op {
 		newOp = newSetAttrOp(op.Name, op.Dir.Ref, op.Attr, op.File)
 	case *gcOp:
 		newOp = op
+	case *linkOp:
+		newOp = newUnlinkOp(op.NewName, op.Dir.Ref, op.LinkID, op.Links.Ref)
+	case *unlinkOp:
+		newName := op.OldName
+		if op.Dir == (blockUpdate{}) {
+			newName = ""
+		}
+		newOp = newLinkOp(newName, op.Dir.Ref, op.LinkID, op.Links.Ref)
+	case *copyOp:
+		newOp = newRmOp(op.NewName, op.Dir.Ref)
 	}
 
 	// Now reverse all the block updates.  Don't bother with bare Refs
@@ -909,6 +1314,12 @@ func opPointerizer(iface interface{}) reflect.Value {
 		return reflect.ValueOf(&op)
 	case gcOp:
 		return reflect.ValueOf(&op)
+	case linkOp:
+		return reflect.ValueOf(&op)
+	case unlinkOp:
+		return reflect.ValueOf(&op)
+	case copyOp:
+		return reflect.ValueOf(&op)
 	}
 }
 
@@ -922,6 +1333,9 @@ func RegisterOps(codec Codec) {
 	codec.RegisterType(reflect.TypeOf(resolutionOp{}), resolutionOpCode)
 	codec.RegisterType(reflect.TypeOf(rekeyOp{}), rekeyOpCode)
 	codec.RegisterType(reflect.TypeOf(gcOp{}), gcOpCode)
+	codec.RegisterType(reflect.TypeOf(linkOp{}), linkOpCode)
+	codec.RegisterType(reflect.TypeOf(unlinkOp{}), unlinkOpCode)
+	codec.RegisterType(reflect.TypeOf(copyOp{}), copyOpCode)
 	codec.RegisterIfaceSliceType(reflect.TypeOf(opsList{}), opsListCode,
 		opPointerizer)
 }
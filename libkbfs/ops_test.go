@@ -170,6 +170,12 @@ func opPointerizerFuture(iface interface{}) reflect.Value {
 		return reflect.ValueOf(&op)
 	case gcOpFuture:
 		return reflect.ValueOf(&op)
+	case linkOpFuture:
+		return reflect.ValueOf(&op)
+	case unlinkOpFuture:
+		return reflect.ValueOf(&op)
+	case copyOpFuture:
+		return reflect.ValueOf(&op)
 	}
 }
 
@@ -182,6 +188,9 @@ func registerOpsFuture(codec Codec) {
 	codec.RegisterType(reflect.TypeOf(resolutionOpFuture{}), resolutionOpCode)
 	codec.RegisterType(reflect.TypeOf(rekeyOpFuture{}), rekeyOpCode)
 	codec.RegisterType(reflect.TypeOf(gcOpFuture{}), gcOpCode)
+	codec.RegisterType(reflect.TypeOf(linkOpFuture{}), linkOpCode)
+	codec.RegisterType(reflect.TypeOf(unlinkOpFuture{}), unlinkOpCode)
+	codec.RegisterType(reflect.TypeOf(copyOpFuture{}), copyOpCode)
 	codec.RegisterIfaceSliceType(reflect.TypeOf(opsList{}), opsListCode,
 		opPointerizerFuture)
 }
@@ -232,6 +241,7 @@ func makeFakeCreateOpFuture(t *testing.T) createOpFuture {
 			false,
 			false,
 			"",
+			false,
 		},
 		makeExtraOrBust("createOp", t),
 	}
@@ -331,6 +341,7 @@ func makeFakeSyncOpFuture(t *testing.T) syncOpFuture {
 			makeFakeOpCommon(t, true),
 			makeFakeBlockUpdate(t),
 			nil,
+			false,
 		},
 		[]writeRangeFuture{
 			makeFakeWriteRangeFuture(t),
@@ -366,6 +377,7 @@ func makeFakeSetAttrOpFuture(t *testing.T) setAttrOpFuture {
 			makeFakeBlockUpdate(t),
 			mtimeAttr,
 			makeFakeBlockPointer(t),
+			"",
 		},
 		makeExtraOrBust("setAttrOp", t),
 	}
@@ -458,6 +470,101 @@ func TestGcOpUnknownFields(t *testing.T) {
 	testStructUnknownFields(t, makeFakeGcOpFuture(t))
 }
 
+type linkOpFuture struct {
+	linkOp
+	extra
+}
+
+func (lof linkOpFuture) toCurrent() linkOp {
+	return lof.linkOp
+}
+
+func (lof linkOpFuture) toCurrentStruct() currentStruct {
+	return lof.toCurrent()
+}
+
+func makeFakeLinkOpFuture(t *testing.T) linkOpFuture {
+	lof := linkOpFuture{
+		linkOp{
+			makeFakeOpCommon(t, false),
+			"new name",
+			makeFakeBlockUpdate(t),
+			"link id",
+			makeFakeBlockUpdate(t),
+			"old name",
+			makeFakeBlockUpdate(t),
+			makeFakeBlockPointer(t),
+		},
+		makeExtraOrBust("linkOp", t),
+	}
+	return lof
+}
+
+func TestLinkOpUnknownFields(t *testing.T) {
+	testStructUnknownFields(t, makeFakeLinkOpFuture(t))
+}
+
+type unlinkOpFuture struct {
+	unlinkOp
+	extra
+}
+
+func (uof unlinkOpFuture) toCurrent() unlinkOp {
+	return uof.unlinkOp
+}
+
+func (uof unlinkOpFuture) toCurrentStruct() currentStruct {
+	return uof.toCurrent()
+}
+
+func makeFakeUnlinkOpFuture(t *testing.T) unlinkOpFuture {
+	uof := unlinkOpFuture{
+		unlinkOp{
+			makeFakeOpCommon(t, false),
+			"old name",
+			makeFakeBlockUpdate(t),
+			"link id",
+			makeFakeBlockUpdate(t),
+		},
+		makeExtraOrBust("unlinkOp", t),
+	}
+	return uof
+}
+
+func TestUnlinkOpUnknownFields(t *testing.T) {
+	testStructUnknownFields(t, makeFakeUnlinkOpFuture(t))
+}
+
+type copyOpFuture struct {
+	copyOp
+	extra
+}
+
+func (cof copyOpFuture) toCurrent() copyOp {
+	return cof.copyOp
+}
+
+func (cof copyOpFuture) toCurrentStruct() currentStruct {
+	return cof.toCurrent()
+}
+
+func makeFakeCopyOpFuture(t *testing.T) copyOpFuture {
+	cof := copyOpFuture{
+		copyOp{
+			makeFakeOpCommon(t, true),
+			"new name",
+			makeFakeBlockUpdate(t),
+			File,
+		},
+		makeExtraOrBust("copyOp", t),
+	}
+	return cof
+}
+
+func TestCopyOpUnknownFields(t *testing.T) {
+	testStructUnknownFields(t, makeFakeCopyOpFuture(t))
+}
+
 type testOps struct {
 	Ops []interface{}
 }
@@ -0,0 +1,164 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"strings"
+)
+
+// diffPath returns the path of the given child of dir, relative to
+// the root of the folder.
+func diffPath(dir path, name string) string {
+	names := make([]string, 0, len(dir.path))
+	for _, pn := range dir.path[1:] {
+		names = append(names, pn.Name)
+	}
+	return strings.Join(append(names, name), "/")
+}
+
+// diffEntriesByPath sorts diff entries by their paths.
+type diffEntriesByPath []DiffEntry
+
+func (d diffEntriesByPath) Len() int {
+	return len(d)
+}
+
+func (d diffEntriesByPath) Less(i, j int) bool {
+	if d[i].Path == d[j].Path {
+		// Something removed and then re-added at the same path
+		// should be listed in that order.
+		return d[i].Change == DiffRemoved && d[j].Change != DiffRemoved
+	}
+	return d[i].Path < d[j].Path
+}
+
+func (d diffEntriesByPath) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
+
+// diffEntries returns what the ops in these chains changed, sorted by
+// path.  oldPaths holds the paths of the chains' original pointers
+// as of the revision before the chains start, and newPaths those of
+// their most recent pointers as of the last revision in the chains.
+// Changes that can't be placed in those revisions, like those to
+// entries that were both created and removed within the chains, are
+// left out, as is anything within the hidden hard links directory.
+func (ccs *crChains) diffEntries(
+	oldPaths, newPaths map[BlockPointer]path) []DiffEntry {
+	// A rename is split into a removal from its old directory and
+	// a creation in its new one, which only need to be listed as
+	// a rename.
+	type dirName struct {
+		dir  BlockPointer
+		name string
+	}
+	renamedFrom := make(map[dirName]bool)
+	var entries []DiffEntry
+	for original, ri := range ccs.renamedOriginals {
+		renamedFrom[dirName{ri.originalOldParent, ri.oldName}] = true
+		oldDir, oldOk := oldPaths[ri.originalOldParent]
+		var newDir path
+		newOk := false
+		if chain, ok := ccs.byOriginal[ri.originalNewParent]; ok {
+			newDir, newOk = newPaths[chain.mostRecent]
+		}
+		switch {
+		case ccs.isCreated(original) && ccs.isDeleted(original):
+		case ccs.isCreated(original):
+			if newOk {
+				entries = append(entries, DiffEntry{
+					Change: DiffAdded,
+					Path:   diffPath(newDir, ri.newName),
+				})
+			}
+		case ccs.isDeleted(original):
+			if oldOk {
+				entries = append(entries, DiffEntry{
+					Change: DiffRemoved,
+					Path:   diffPath(oldDir, ri.oldName),
+				})
+			}
+		default:
+			if oldOk && newOk {
+				entries = append(entries, DiffEntry{
+					Change:  DiffRenamed,
+					Path:    diffPath(newDir, ri.newName),
+					OldPath: diffPath(oldDir, ri.oldName),
+				})
+			}
+		}
+	}
+
+	for original, chain := range ccs.byOriginal {
+		oldDir, oldOk := oldPaths[original]
+		newPath, newOk := newPaths[chain.mostRecent]
+		var attrs []string
+		for _, op := range chain.ops {
+			switch realOp := op.(type) {
+			case *createOp:
+				if !realOp.renamed && newOk {
+					entries = append(entries, DiffEntry{
+						Change: DiffAdded,
+						Path:   diffPath(newPath, realOp.NewName),
+					})
+				}
+			case *rmOp:
+				if !renamedFrom[dirName{original, realOp.OldName}] && oldOk {
+					entries = append(entries, DiffEntry{
+						Change: DiffRemoved,
+						Path:   diffPath(oldDir, realOp.OldName),
+					})
+				}
+			case *linkOp:
+				// A file that gets its first hard link is moved
+				// into the links directory and linked back under
+				// its old name, which isn't a change.
+				if realOp.NewName != "" && newOk &&
+					!renamedFrom[dirName{original, realOp.NewName}] {
+					entries = append(entries, DiffEntry{
+						Change: DiffAdded,
+						Path:   diffPath(newPath, realOp.NewName),
+					})
+				}
+			case *unlinkOp:
+				if realOp.Dir != (blockUpdate{}) && oldOk {
+					entries = append(entries, DiffEntry{
+						Change: DiffRemoved,
+						Path:   diffPath(oldDir, realOp.OldName),
+					})
+				}
+			case *setAttrOp:
+				attr := realOp.Attr.String()
+				if realOp.Attr == xattrAttr {
+					attr += " " + realOp.XattrName
+				}
+				attrs = append(attrs, attr)
+			}
+		}
+
+		writes := chain.getCollapsedWriteRange()
+		if (len(writes) == 0 && len(attrs) == 0) || ccs.isCreated(original) ||
+			!newOk || len(newPath.path) < 2 {
+			continue
+		}
+		entries = append(entries, DiffEntry{
+			Change: DiffModified,
+			Path:   diffPath(*newPath.parentPath(), newPath.tailName()),
+			Writes: writes,
+			Attrs:  attrs,
+		})
+	}
+
+	visible := entries[:0]
+	for _, e := range entries {
+		if e.Path != linksDirName &&
+			!strings.HasPrefix(e.Path, linksDirName+"/") {
+			visible = append(visible, e)
+		}
+	}
+	sort.Sort(diffEntriesByPath(visible))
+	return visible
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetRevisionDiff(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	writeFile := func(dir Node, name string, data []byte, off int64) Node {
+		fileNode, _, err := kbfsOps.Lookup(ctx, dir, name)
+		if _, ok := err.(NoSuchNameError); ok {
+			fileNode, _, err = kbfsOps.CreateFile(ctx, dir, name, false)
+		}
+		if err != nil {
+			t.Fatalf("Couldn't create file %s: %v", name, err)
+		}
+		if err := kbfsOps.Write(ctx, fileNode, data, off); err != nil {
+			t.Fatalf("Couldn't write file %s: %v", name, err)
+		}
+		if err := kbfsOps.Sync(ctx, fileNode); err != nil {
+			t.Fatalf("Couldn't sync file %s: %v", name, err)
+		}
+		return fileNode
+	}
+
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	writeFile(dirNode, "a", []byte("hello"), 0)
+	bNode := writeFile(dirNode, "b", []byte("world"), 0)
+	writeFile(rootNode, "c", []byte("moved"), 0)
+	writeFile(rootNode, "e", []byte("removed"), 0)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	from := ops.getCurrMDRevision(lState)
+
+	writeFile(dirNode, "a", []byte("EL"), 1)
+	writeFile(rootNode, "new", []byte("new"), 0)
+	if err := kbfsOps.Rename(ctx, rootNode, "c", dirNode, "c2"); err != nil {
+		t.Fatalf("Couldn't rename: %v", err)
+	}
+	if err := kbfsOps.RemoveEntry(ctx, rootNode, "e"); err != nil {
+		t.Fatalf("Couldn't remove: %v", err)
+	}
+	if err := kbfsOps.SetEx(ctx, bNode, true); err != nil {
+		t.Fatalf("Couldn't set ex: %v", err)
+	}
+	// Changes that are undone within the range don't show up.
+	writeFile(rootNode, "tmp", []byte("tmp"), 0)
+	if err := kbfsOps.RemoveEntry(ctx, rootNode, "tmp"); err != nil {
+		t.Fatalf("Couldn't remove: %v", err)
+	}
+	to := ops.getCurrMDRevision(lState)
+
+	diff, err := kbfsOps.GetRevisionDiff(
+		ctx, rootNode.GetFolderBranch(), from, to)
+	if err != nil {
+		t.Fatalf("Couldn't get diff: %v", err)
+	}
+	if diff.From != from || diff.To != to {
+		t.Errorf("Got diff for %d-%d, expected %d-%d",
+			diff.From, diff.To, from, to)
+	}
+	expected := []DiffEntry{
+		{Change: DiffModified, Path: "d/a",
+			Writes: []WriteRange{{Off: 1, Len: 2}}},
+		{Change: DiffModified, Path: "d/b", Attrs: []string{"ex"}},
+		{Change: DiffRenamed, Path: "d/c2", OldPath: "c"},
+		{Change: DiffRemoved, Path: "e"},
+		{Change: DiffAdded, Path: "new"},
+	}
+	if !reflect.DeepEqual(diff.Entries, expected) {
+		t.Errorf("Got diff entries %+v, expected %+v",
+			diff.Entries, expected)
+	}
+
+	diff, err = kbfsOps.GetRevisionDiff(
+		ctx, rootNode.GetFolderBranch(), to, to)
+	if err != nil {
+		t.Fatalf("Couldn't get empty diff: %v", err)
+	}
+	if len(diff.Entries) != 0 {
+		t.Errorf("Got entries in an empty diff: %+v", diff.Entries)
+	}
+
+	_, err = kbfsOps.GetRevisionDiff(
+		ctx, rootNode.GetFolderBranch(), to, from)
+	if _, ok := err.(InvalidRevisionRangeError); !ok {
+		t.Errorf("Got unexpected error for a backwards range: %v", err)
+	}
+	_, err = kbfsOps.GetRevisionDiff(
+		ctx, rootNode.GetFolderBranch(), from, to+1)
+	if _, ok := err.(NoSuchRevisionError); !ok {
+		t.Errorf("Got unexpected error for a future revision: %v", err)
+	}
+}
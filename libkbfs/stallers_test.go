@@ -4,7 +4,11 @@
 
 package libkbfs
 
-import "golang.org/x/net/context"
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
 
 // staller is a pair of channels. Whenever something is to be
 // stalled, a value is sent on stalled (if not blocked), and then
@@ -155,6 +159,12 @@ func (m *stallingMDOps) GetUnmergedRange(ctx context.Context, id TlfID,
 	return m.delegate.GetUnmergedRange(ctx, id, bid, start, stop)
 }
 
+func (m *stallingMDOps) GetForTLFByTime(ctx context.Context, id TlfID,
+	serverTime time.Time) (*RootMetadata, error) {
+	m.maybeStall(ctx, "GetForTLFByTime")
+	return m.delegate.GetForTLFByTime(ctx, id, serverTime)
+}
+
 func (m *stallingMDOps) Put(ctx context.Context, md *RootMetadata) error {
 	m.maybeStall(ctx, "Put")
 	err := m.delegate.Put(ctx, md)
@@ -67,8 +67,24 @@ func (sc *StateChecker) findAllBlocksInPath(ctx context.Context,
 		return err
 	}
 
-	for name, de := range dblock.Children {
-		if de.Type == Sym {
+	children := dblock.Children
+	if dblock.IsInd {
+		children = make(map[string]DirEntry)
+		for _, iptr := range dblock.IPtrs {
+			blockSizes[iptr.BlockPointer] = iptr.EncodedSize
+			leaf, err := ops.blocks.GetDirBlockForReading(ctx, lState, md,
+				iptr.BlockPointer, dir.Branch, dir)
+			if err != nil {
+				return err
+			}
+			for name, de := range leaf.Children {
+				children[name] = de
+			}
+		}
+	}
+
+	for name, de := range children {
+		if de.Type == Sym || de.Type == HardLink {
 			continue
 		}
 
@@ -150,11 +166,18 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlf TlfID) error {
 	}
 
 	lastGCRevisionTime := sc.getLastGCRevisionTime(ctx, tlf)
+	// QR doesn't go past any revision that's being viewed.
+	pinnedRevision := ops.fbm.getEarliestPinnedRevision()
 
 	// Build the expected block list.
 	expectedLiveBlocks := make(map[BlockPointer]bool)
 	expectedRef := uint64(0)
 	archivedBlocks := make(map[BlockPointer]bool)
+	// The blocks of entries removed in the revisions searched by
+	// GetDeletedEntries stay live, so they can be restored.
+	removedBlocks := make(map[BlockPointer]bool)
+	trashStartRevision :=
+		rmds[len(rmds)-1].Revision - maxDeletedEntriesRevisions + 1
 	actualLiveBlocks := make(map[BlockPointer]uint32)
 
 	// See what the last GC op revision is.  All unref'd pointers from
@@ -210,9 +233,16 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlf TlfID) error {
 						// indicates a failed and retried sync), the
 						// corresponding block should already be
 						// cleaned up.
-						if rmd.Revision <= gcRevision || opRefs[ptr] {
+						_, isRmOp := op.(*rmOp)
+						switch {
+						case rmd.Revision <= gcRevision || opRefs[ptr]:
 							delete(archivedBlocks, ptr)
-						} else {
+							delete(removedBlocks, ptr)
+						case isRmOp && rmd.Revision >= trashStartRevision:
+							delete(archivedBlocks, ptr)
+							removedBlocks[ptr] = true
+						default:
+							delete(removedBlocks, ptr)
 							archivedBlocks[ptr] = true
 						}
 					}
@@ -221,6 +251,7 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlf TlfID) error {
 			for _, update := range op.AllUpdates() {
 				delete(expectedLiveBlocks, update.Unref)
 				if update.Unref != zeroPtr && update.Ref != update.Unref {
+					delete(removedBlocks, update.Unref)
 					if rmd.Revision <= gcRevision {
 						delete(archivedBlocks, update.Unref)
 					} else {
@@ -245,7 +276,9 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlf TlfID) error {
 		// it will be run completely and not left partially done due
 		// to there being too many pointers to collect in one sweep.
 		mtime := time.Unix(0, rmd.data.Dir.Mtime)
-		if !lastGCRevisionTime.Before(mtime) {
+		pinned := pinnedRevision != MetadataRevisionUninitialized &&
+			rmd.Revision > pinnedRevision
+		if !lastGCRevisionTime.Before(mtime) && !pinned {
 			if rmd.Revision > gcRevision {
 				return fmt.Errorf("Revision %d happened before the last "+
 					"gc time %s, but was not included in the latest gc op "+
@@ -339,6 +372,12 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlf TlfID) error {
 		}
 		blockRefsByID[ptr.ID][ptr.RefNonce] = archivedBlockRef
 	}
+	for ptr := range removedBlocks {
+		if _, ok := blockRefsByID[ptr.ID]; !ok {
+			blockRefsByID[ptr.ID] = make(map[BlockRefNonce]blockRefLocalStatus)
+		}
+		blockRefsByID[ptr.ID][ptr.RefNonce] = liveBlockRef
+	}
 
 	if g, e := bserverKnownBlocks, blockRefsByID; !reflect.DeepEqual(g, e) {
 		for id, eRefs := range e {
@@ -67,7 +67,7 @@ func MakeTestConfigOrBust(t logger.TestLogBackend,
 	config.SetKBFSOps(kbfsOps)
 	config.SetNotifier(kbfsOps)
 
-	config.SetBlockSplitter(&BlockSplitterSimple{64 * 1024, 8 * 1024})
+	config.SetBlockSplitter(&BlockSplitterSimple{64 * 1024, 8 * 1024, 0, 0, 65 * 1024})
 	config.SetKeyManager(NewKeyManagerStandard(config))
 	config.SetMDOps(NewMDOpsStandard(config))
 
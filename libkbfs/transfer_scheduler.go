@@ -0,0 +1,230 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// tokenBucket limits the rate of a flow of bytes.  Takers reserve
+// their bytes up front, possibly driving the bucket into debt, and
+// then wait for the debt to be paid off; that way a single transfer
+// can be bigger than the bucket.
+type tokenBucket struct {
+	config Config
+	// rate is in bytes per second.  If it's 0, there's no limit.
+	rate float64
+	// burst is the most tokens the bucket can hold.
+	burst float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(config Config, bytesPerSecond int64) *tokenBucket {
+	rate := float64(bytesPerSecond)
+	return &tokenBucket{
+		config: config,
+		rate:   rate,
+		burst:  rate,
+		tokens: rate,
+	}
+}
+
+// take waits until n more bytes fit within the rate limit.
+func (b *tokenBucket) take(ctx context.Context, n int) error {
+	if b.rate <= 0 {
+		return nil
+	}
+
+	wait := func() time.Duration {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		now := b.config.Clock().Now()
+		if !b.last.IsZero() {
+			b.tokens += now.Sub(b.last).Seconds() * b.rate
+			if b.tokens > b.burst {
+				b.tokens = b.burst
+			}
+		}
+		b.last = now
+		b.tokens -= float64(n)
+		if b.tokens >= 0 {
+			return 0
+		}
+		return time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}()
+	if wait == 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		// Give back the reservation, so later transfers don't wait
+		// for bytes that were never sent.
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.tokens += float64(n)
+		return ctx.Err()
+	}
+}
+
+// TransferSchedulerStandard implements the TransferScheduler
+// interface.  Puts that can't start right away wait in one FIFO
+// queue per priority.
+type TransferSchedulerStandard struct {
+	maxPuts  int
+	upload   *tokenBucket
+	download *tokenBucket
+
+	putQueueDepth metrics.Gauge
+	uploadMeter   metrics.Meter
+	downloadMeter metrics.Meter
+
+	lock       sync.Mutex
+	activePuts int
+	// waitingPuts holds, for each priority, the channels to close
+	// to hand a put slot to each waiting put, in order.
+	waitingPuts [numTransferPriorities][]chan struct{}
+}
+
+var _ TransferScheduler = (*TransferSchedulerStandard)(nil)
+
+// NewTransferSchedulerStandard returns a TransferSchedulerStandard
+// that runs at most maxPuts block puts at once, and keeps uploads and
+// downloads under the given rates.  A rate of 0 means there's no
+// limit.
+func NewTransferSchedulerStandard(config Config, maxPuts int,
+	uploadBytesPerSecond, downloadBytesPerSecond int64) *TransferSchedulerStandard {
+	if maxPuts < 1 {
+		maxPuts = 1
+	}
+	s := &TransferSchedulerStandard{
+		maxPuts:  maxPuts,
+		upload:   newTokenBucket(config, uploadBytesPerSecond),
+		download: newTokenBucket(config, downloadBytesPerSecond),
+	}
+	if registry := config.MetricsRegistry(); registry != nil {
+		s.putQueueDepth = metrics.GetOrRegisterGauge(
+			"TransferScheduler.PutQueueDepth", registry)
+		s.uploadMeter = metrics.GetOrRegisterMeter(
+			"TransferScheduler.UploadBytes", registry)
+		s.downloadMeter = metrics.GetOrRegisterMeter(
+			"TransferScheduler.DownloadBytes", registry)
+	} else {
+		s.putQueueDepth = metrics.NilGauge{}
+		s.uploadMeter = metrics.NilMeter{}
+		s.downloadMeter = metrics.NilMeter{}
+	}
+	return s
+}
+
+func (s *TransferSchedulerStandard) numWaitingPutsLocked() int {
+	n := 0
+	for _, waiting := range s.waitingPuts {
+		n += len(waiting)
+	}
+	return n
+}
+
+func (s *TransferSchedulerStandard) acquirePutSlot(
+	ctx context.Context, prio TransferPriority) error {
+	ch := func() chan struct{} {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.activePuts < s.maxPuts && s.numWaitingPutsLocked() == 0 {
+			s.activePuts++
+			return nil
+		}
+		ch := make(chan struct{})
+		s.waitingPuts[prio] = append(s.waitingPuts[prio], ch)
+		s.putQueueDepth.Update(int64(s.numWaitingPutsLocked()))
+		return ch
+	}()
+	if ch == nil {
+		return nil
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	waiting := s.waitingPuts[prio]
+	for i, c := range waiting {
+		if c == ch {
+			s.waitingPuts[prio] = append(waiting[:i], waiting[i+1:]...)
+			s.putQueueDepth.Update(int64(s.numWaitingPutsLocked()))
+			return ctx.Err()
+		}
+	}
+	// The slot was handed over just as the context was canceled.
+	s.releasePutSlotLocked()
+	return ctx.Err()
+}
+
+// releasePutSlotLocked hands the caller's put slot to the first
+// waiting put with the highest priority, if there is one.
+func (s *TransferSchedulerStandard) releasePutSlotLocked() {
+	for prio, waiting := range s.waitingPuts {
+		if len(waiting) == 0 {
+			continue
+		}
+		close(waiting[0])
+		s.waitingPuts[prio] = waiting[1:]
+		s.putQueueDepth.Update(int64(s.numWaitingPutsLocked()))
+		return
+	}
+	s.activePuts--
+}
+
+func (s *TransferSchedulerStandard) releasePutSlot() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.releasePutSlotLocked()
+}
+
+// BeginPut implements the TransferScheduler interface for
+// TransferSchedulerStandard.
+func (s *TransferSchedulerStandard) BeginPut(ctx context.Context,
+	size int, prio TransferPriority) (done func(), err error) {
+	err = s.acquirePutSlot(ctx, prio)
+	if err != nil {
+		return nil, err
+	}
+	err = s.upload.take(ctx, size)
+	if err != nil {
+		s.releasePutSlot()
+		return nil, err
+	}
+	return func() {
+		s.uploadMeter.Mark(int64(size))
+		s.releasePutSlot()
+	}, nil
+}
+
+// RecordGet implements the TransferScheduler interface for
+// TransferSchedulerStandard.
+func (s *TransferSchedulerStandard) RecordGet(ctx context.Context,
+	size int) error {
+	s.downloadMeter.Mark(int64(size))
+	return s.download.take(ctx, size)
+}
+
+// MaxPuts implements the TransferScheduler interface for
+// TransferSchedulerStandard.
+func (s *TransferSchedulerStandard) MaxPuts() int {
+	return s.maxPuts
+}
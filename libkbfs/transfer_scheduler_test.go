@@ -0,0 +1,146 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+func checkPutQueueDepth(t *testing.T, config Config, expected int64) {
+	gauge, ok := config.MetricsRegistry().Get(
+		"TransferScheduler.PutQueueDepth").(metrics.Gauge)
+	if !ok {
+		t.Fatalf("No put queue depth gauge")
+	}
+	if depth := gauge.Value(); depth != expected {
+		t.Errorf("Put queue depth is %d, expected %d", depth, expected)
+	}
+}
+
+func TestTransferSchedulerPutPriority(t *testing.T) {
+	config := NewConfigLocal()
+	s := NewTransferSchedulerStandard(config, 1, 0, 0)
+	ctx := context.Background()
+
+	done, err := s.BeginPut(ctx, 10, BulkTransfer)
+	if err != nil {
+		t.Fatalf("Couldn't begin put: %v", err)
+	}
+
+	// Queue up a bulk put, and then an interactive one.
+	started := make(chan TransferPriority, 2)
+	errChan := make(chan error, 2)
+	beginPut := func(prio TransferPriority) {
+		done, err := s.BeginPut(ctx, 10, prio)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		started <- prio
+		done()
+		errChan <- nil
+	}
+	go beginPut(BulkTransfer)
+	for i := 0; ; i++ {
+		s.lock.Lock()
+		n := s.numWaitingPutsLocked()
+		s.lock.Unlock()
+		if n == 1 {
+			break
+		} else if i > 1000 {
+			t.Fatalf("The bulk put never got queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go beginPut(InteractiveTransfer)
+	for i := 0; ; i++ {
+		s.lock.Lock()
+		n := s.numWaitingPutsLocked()
+		s.lock.Unlock()
+		if n == 2 {
+			break
+		} else if i > 1000 {
+			t.Fatalf("The interactive put never got queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	checkPutQueueDepth(t, config, 2)
+
+	done()
+	if prio := <-started; prio != InteractiveTransfer {
+		t.Errorf("The bulk put went first")
+	}
+	if prio := <-started; prio != BulkTransfer {
+		t.Errorf("Unexpected second put with priority %d", prio)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errChan; err != nil {
+			t.Fatalf("Couldn't begin put: %v", err)
+		}
+	}
+	checkPutQueueDepth(t, config, 0)
+}
+
+func TestTransferSchedulerPutCanceled(t *testing.T) {
+	config := NewConfigLocal()
+	s := NewTransferSchedulerStandard(config, 1, 0, 0)
+
+	done, err := s.BeginPut(context.Background(), 10, InteractiveTransfer)
+	if err != nil {
+		t.Fatalf("Couldn't begin put: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.BeginPut(ctx, 10, InteractiveTransfer)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error for a canceled put: %v", err)
+	}
+	checkPutQueueDepth(t, config, 0)
+
+	// The canceled put didn't take the slot.
+	done()
+	done, err = s.BeginPut(context.Background(), 10, InteractiveTransfer)
+	if err != nil {
+		t.Fatalf("Couldn't begin put: %v", err)
+	}
+	done()
+}
+
+func TestTransferSchedulerBandwidthLimit(t *testing.T) {
+	config := NewConfigLocal()
+	s := NewTransferSchedulerStandard(config, 10, 10000, 20000)
+	ctx := context.Background()
+
+	// The first second's worth of bytes goes right through, but
+	// the next bytes have to wait for the bucket to refill.
+	start := time.Now()
+	done, err := s.BeginPut(ctx, 10000, BulkTransfer)
+	if err != nil {
+		t.Fatalf("Couldn't begin put: %v", err)
+	}
+	done()
+	done, err = s.BeginPut(ctx, 2000, BulkTransfer)
+	if err != nil {
+		t.Fatalf("Couldn't begin put: %v", err)
+	}
+	done()
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Puts weren't limited; took only %s", elapsed)
+	}
+
+	// Downloads have their own limit.
+	start = time.Now()
+	if err := s.RecordGet(ctx, 10000); err != nil {
+		t.Fatalf("Couldn't record get: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Get was limited by the upload limit; took %s", elapsed)
+	}
+}